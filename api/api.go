@@ -15,3 +15,37 @@ type API interface {
 	ReportIllegal(detectResultList *[]DetectResult) (err error)
 	Debug()
 }
+
+// IdempotentReporter is implemented by the clients able to tag a traffic
+// report with a key, so the panel can drop a retry of a report it has
+// already counted.
+type IdempotentReporter interface {
+	ReportUserTrafficWithKey(key string, userTraffic *[]UserTraffic) (err error)
+}
+
+// Commander is implemented by the clients of the panels queueing commands for
+// the node, like restarting it or kicking a user, so the admins can operate
+// it without a shell. A command is run again if its result fails to be
+// reported.
+type Commander interface {
+	GetCommands() (commands []Command, err error)
+	ReportCommandResults(results []CommandResult) (err error)
+}
+
+// AliveReporter is implemented by the clients able to post an alive report to
+// a path of the panel, with the auth of their other requests, for the panels
+// marking the nodes they don't hear from offline
+type AliveReporter interface {
+	ReportAlive(path string, alive map[string]any) (err error)
+}
+
+// IdempotencyKeyHeader carries the key of a traffic report
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyHeaders returns the headers tagging a request with key, none if key is empty
+func IdempotencyHeaders(key string) map[string]string {
+	if key == "" {
+		return nil
+	}
+	return map[string]string{IdempotencyKeyHeader: key}
+}
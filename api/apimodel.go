@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"regexp"
 
 	"github.com/xtls/xray-core/infra/conf"
@@ -15,17 +16,27 @@ const (
 
 // Config API config
 type Config struct {
-	APIHost             string  `mapstructure:"ApiHost"`
-	NodeID              int     `mapstructure:"NodeID"`
-	Key                 string  `mapstructure:"ApiKey"`
-	NodeType            string  `mapstructure:"NodeType"`
-	EnableVless         bool    `mapstructure:"EnableVless"`
-	VlessFlow           string  `mapstructure:"VlessFlow"`
-	Timeout             int     `mapstructure:"Timeout"`
-	SpeedLimit          float64 `mapstructure:"SpeedLimit"`
-	DeviceLimit         int     `mapstructure:"DeviceLimit"`
-	RuleListPath        string  `mapstructure:"RuleListPath"`
-	DisableCustomConfig bool    `mapstructure:"DisableCustomConfig"`
+	APIHost             string            `mapstructure:"ApiHost"`
+	NodeID              int               `mapstructure:"NodeID"`
+	Key                 string            `mapstructure:"ApiKey"`
+	NodeType            string            `mapstructure:"NodeType"`
+	EnableVless         bool              `mapstructure:"EnableVless"`
+	VlessFlow           string            `mapstructure:"VlessFlow"`
+	Timeout             int               `mapstructure:"Timeout"`
+	Timeouts            *TimeoutConfig    `mapstructure:"Timeouts"`
+	Retry               *RetryConfig      `mapstructure:"Retry"`
+	MaxResponseSize     int               `mapstructure:"MaxResponseSize"` // MB
+	Resolver            *ResolverConfig   `mapstructure:"Resolver"`
+	Connection          *ConnectionConfig `mapstructure:"Connection"`
+	CircuitBreaker      *BreakerConfig    `mapstructure:"CircuitBreaker"`
+	RecordDir           string            `mapstructure:"RecordDir"` // Where the responses are recorded, see RecordResponses
+	SpeedLimit          float64           `mapstructure:"SpeedLimit"`
+	DeviceLimit         int               `mapstructure:"DeviceLimit"`
+	RuleListPath        string            `mapstructure:"RuleListPath"`
+	DisableCustomConfig bool              `mapstructure:"DisableCustomConfig"`
+	EnableGzip          bool              `mapstructure:"EnableGzip"`
+	EnableUserDelta     bool              `mapstructure:"EnableUserDelta"`
+	DataDir             string            `mapstructure:"-"` // Set from the DataDir of the controller
 }
 
 // NodeStatus Node status
@@ -37,7 +48,7 @@ type NodeStatus struct {
 }
 
 type NodeInfo struct {
-	NodeType          string // Must be V2ray, Trojan, and Shadowsocks
+	NodeType          string // Must be V2ray, Trojan, Shadowsocks, AnyTLS, Naive, Juicity, WireGuard, Mixed, SSH and Forward
 	NodeID            int
 	Port              uint32
 	SpeedLimit        uint64 // Bps
@@ -50,12 +61,19 @@ type NodeInfo struct {
 	EnableVless       bool
 	VlessFlow         string
 	CypherMethod      string
-	ServerKey         string
+	ServerKey         string // Of Shadowsocks 2022, the private key of WireGuard or the Ed25519 host key seed of SSH
 	ServiceName       string
 	Header            json.RawMessage
 	NameServerConfig  []*conf.NameServerConfig
 	EnableREALITY     bool
 	REALITYConfig     *REALITYConfig
+	Plugin            string   // SIP003 plugin of Shadowsocks, like obfs-server or v2ray-plugin
+	PluginOpts        string   // Like obfs=http;obfs-host=www.bing.com
+	PaddingScheme     string   // Of AnyTLS, the default one if empty
+	CongestionControl string   // Of Juicity, the default one if empty
+	ForwardAddress    string   // Of Forward, the host:port the connections are forwarded to
+	ForwardNetwork    string   // Of Forward, tcp, udp or tcp,udp, both if empty
+	Mux               *MuxInfo // The defaults of Xray if nil
 }
 
 type UserInfo struct {
@@ -68,11 +86,27 @@ type UserInfo struct {
 	Method      string
 	SpeedLimit  uint64 // Bps
 	DeviceLimit int
+	Tag         string // Group of the user given by the panel, used by the user routes
+	ExpiredAt   int64  // Unix time the user expires at, 0 for never
+	Quota       int64  // Traffic left to the user when listed, Byte. 0 for unlimited, negative when used up
+	UDP         int8   // 1 for allowed, -1 for blocked, 0 for the default of the node
+	Disabled    bool   // Banned or disabled by the panel while still listed
+	PublicKey   string // Of the WireGuard peer of the user, derived from the UUID if empty
+}
+
+// CoreEmail returns the email the user is known by in the core for the inbound
+// with tag, InboundTag|uid@node|uid. It is built from the UID, as the email of
+// the panel may be personal or even the password of the user, and it ends up
+// in the access log.
+func (u *UserInfo) CoreEmail(tag string) string {
+	return fmt.Sprintf("%s|%d@node|%d", tag, u.UID, u.UID)
 }
 
 type OnlineUser struct {
-	UID int
-	IP  string
+	UID       int
+	IP        string
+	FirstSeen int64 // Unix time the IP was first seen online
+	LastSeen  int64 // Unix time of the last connection from the IP
 }
 
 type UserTraffic struct {
@@ -109,3 +143,34 @@ type REALITYConfig struct {
 	MaxTimeDiff      uint64
 	ShortIds         []string
 }
+
+// MuxInfo is the mux.cool setting of a node
+type MuxInfo struct {
+	RejectInbound   bool   // Refuse the clients multiplexing their connections, XUDP included
+	Outbound        bool   // Multiplex the connections of the relay outbound
+	Concurrency     int16  // Of the relay outbound, 8 if 0
+	XudpConcurrency int16  // Of the relay outbound, UDP through the connections if 0
+	XudpProxyUDP443 string // Of the relay outbound, reject, allow or skip
+}
+
+// The commands a panel can queue for a node
+const (
+	CommandRestart   = "restart"    // Close the node and start it again
+	CommandKickUser  = "kick_user"  // Close the connections of the user UID
+	CommandRenewCert = "renew_cert" // Renew the certificate if it is due
+	CommandSyncUsers = "sync_users" // Fetch the user list now
+)
+
+// Command is a command queued by the panel for the node
+type Command struct {
+	ID   string
+	Type string
+	UID  int // Of kick_user
+}
+
+// CommandResult is the outcome of a command, reported back to the panel
+type CommandResult struct {
+	ID      string
+	OK      bool
+	Message string
+}
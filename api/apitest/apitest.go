@@ -0,0 +1,268 @@
+// Package apitest checks that a panel client behaves the way the controller
+// expects of an api.API, against a mock of its panel. The tests of a client
+// call Run with the answers of its panel describing the node and users of
+// Fixture, see the ones of sspanel.
+package apitest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// FixtureUser is a user the user list answered to the client must hold
+type FixtureUser struct {
+	UID    int
+	UUID   string
+	Passwd string
+}
+
+// Fixture is the node and users the answers given to Run describe
+var Fixture = struct {
+	NodeID int
+	Port   uint32
+	Users  []FixtureUser
+}{
+	NodeID: 1,
+	Port:   10086,
+	Users: []FixtureUser{
+		{UID: 1, UUID: "7f2b7cbb-0e0b-4b56-9b1a-2b5a3f7c1a01", Passwd: "apitest-passwd-1"},
+		{UID: 2, UUID: "7f2b7cbb-0e0b-4b56-9b1a-2b5a3f7c1a02", Passwd: "apitest-passwd-2"},
+	},
+}
+
+// Key is the ApiKey of the client under test
+const Key = "apitest-key"
+
+// eTag is answered with the node info and user list, the client asking for
+// them again with it gets a 304
+const eTag = `"apitest"`
+
+// Endpoint is a request of the client and the answer of the panel to it
+type Endpoint struct {
+	Method string // GET if empty
+	Path   string // URL path, the query is not matched
+	Body   string // Answered with 200, as JSON
+}
+
+// Panel describes a client and its panel to Run
+type Panel struct {
+	New      func(config *api.Config) api.API
+	NodeType string   // Of the config of the client, V2ray if empty
+	NodeInfo Endpoint // Answers the node of Fixture
+	UserList Endpoint // Answers the users of Fixture
+	Traffic  Endpoint // Accepts a traffic report
+	Online   Endpoint // Accepts an online user report
+}
+
+// Run checks the client of p against a mock of its panel, each behaviour in
+// its own subtest
+func Run(t *testing.T, p Panel) {
+	if p.NodeType == "" {
+		p.NodeType = "V2ray"
+	}
+	t.Run("Describe", func(t *testing.T) {
+		m := newMock(t, &p)
+		info := m.client.Describe()
+		if info.APIHost != m.server.URL || info.NodeID != Fixture.NodeID || info.NodeType != p.NodeType || info.Key != Key {
+			t.Errorf("Describe returned %+v", info)
+		}
+	})
+	t.Run("NodeInfo", func(t *testing.T) {
+		m := newMock(t, &p)
+		node, err := m.client.GetNodeInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.NodeID != Fixture.NodeID || node.NodeType != p.NodeType || node.Port != Fixture.Port {
+			t.Errorf("got node %d of type %s on port %d, want node %d of type %s on port %d",
+				node.NodeID, node.NodeType, node.Port, Fixture.NodeID, p.NodeType, Fixture.Port)
+		}
+	})
+	t.Run("UserList", func(t *testing.T) {
+		m := newMock(t, &p)
+		users, err := m.client.GetUserList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkUsers(t, *users)
+	})
+	t.Run("NotModified", func(t *testing.T) {
+		m := newMock(t, &p)
+		for _, c := range []struct {
+			endpoint *Endpoint
+			get      func() error
+			want     string
+		}{
+			{&p.NodeInfo, func() error { _, err := m.client.GetNodeInfo(); return err }, api.NodeNotModified},
+			{&p.UserList, func() error { _, err := m.client.GetUserList(); return err }, api.UserNotModified},
+		} {
+			if err := c.get(); err != nil {
+				t.Fatal(err)
+			}
+			err := c.get()
+			if !m.revalidated(c.endpoint) {
+				t.Logf("%s is not asked for with If-None-Match, the panel sends it in full each time", c.endpoint.Path)
+				continue
+			}
+			if err == nil || err.Error() != c.want {
+				t.Errorf("got %v on a 304 of %s, want %q", err, c.endpoint.Path, c.want)
+			}
+		}
+	})
+	t.Run("Reports", func(t *testing.T) {
+		m := newMock(t, &p)
+		traffic := []api.UserTraffic{{UID: Fixture.Users[0].UID, Upload: 1024, Download: 2048}}
+		if err := m.client.ReportUserTraffic(&traffic); err != nil {
+			t.Error(err)
+		}
+		online := []api.OnlineUser{{UID: Fixture.Users[0].UID, IP: "192.0.2.1"}}
+		if err := m.client.ReportNodeOnlineUsers(&online); err != nil {
+			t.Error(err)
+		}
+		for _, e := range []*Endpoint{&p.Traffic, &p.Online} {
+			if n := m.requests(e); n != 1 {
+				t.Errorf("%s requested %d times, want 1", e.Path, n)
+			}
+		}
+	})
+	t.Run("ErrorStatus", func(t *testing.T) {
+		for _, c := range []struct {
+			status int
+			class  error
+			retry  bool
+		}{
+			{http.StatusForbidden, api.ErrUnauthorized, false},
+			{http.StatusNotFound, api.ErrNotFound, false},
+			{http.StatusServiceUnavailable, api.ErrServer, true},
+		} {
+			m := newMock(t, &p)
+			m.fail(&p.NodeInfo, c.status)
+			_, err := m.client.GetNodeInfo()
+			if !errors.Is(err, c.class) {
+				t.Errorf("got %v on a %d, want %v", err, c.status, c.class)
+			}
+			if n := m.requests(&p.NodeInfo); (n > 1) != c.retry {
+				t.Errorf("requested %d times on a %d, retried should be %t", n, c.status, c.retry)
+			}
+			m.fail(&p.Traffic, c.status)
+			traffic := []api.UserTraffic{{UID: Fixture.Users[0].UID, Upload: 1}}
+			if err := m.client.ReportUserTraffic(&traffic); !errors.Is(err, c.class) {
+				t.Errorf("got %v reporting traffic on a %d, want %v", err, c.status, c.class)
+			}
+		}
+	})
+}
+
+// checkUsers checks the users got are the ones of Fixture
+func checkUsers(t *testing.T, users []api.UserInfo) {
+	t.Helper()
+	if len(users) != len(Fixture.Users) {
+		t.Errorf("got %d users, want %d", len(users), len(Fixture.Users))
+	}
+	byUID := make(map[int]api.UserInfo, len(users))
+	for _, u := range users {
+		byUID[u.UID] = u
+	}
+	for _, want := range Fixture.Users {
+		u, ok := byUID[want.UID]
+		switch {
+		case !ok:
+			t.Errorf("user %d missing", want.UID)
+		case u.UUID == "" && u.Passwd == "":
+			t.Errorf("user %d has neither UUID nor Passwd", want.UID)
+		case u.UUID != "" && u.UUID != want.UUID:
+			t.Errorf("user %d has UUID %s, want %s", want.UID, u.UUID, want.UUID)
+		// Some panels give the UUID as the password
+		case u.Passwd != "" && u.Passwd != want.Passwd && u.Passwd != want.UUID:
+			t.Errorf("user %d has Passwd %s, want %s", want.UID, u.Passwd, want.Passwd)
+		}
+	}
+}
+
+// mock is the panel of a client, answering the endpoints of a Panel
+type mock struct {
+	server *httptest.Server
+	client api.API
+
+	access      sync.Mutex
+	failures    map[string]int // Status answered instead, by endpoint
+	counts      map[string]int // Requests, by endpoint
+	revalidates map[string]int // Requests with the ETag in If-None-Match, by endpoint
+}
+
+func newMock(t *testing.T, p *Panel) *mock {
+	m := &mock{
+		failures:    make(map[string]int),
+		counts:      make(map[string]int),
+		revalidates: make(map[string]int),
+	}
+	endpoints := make(map[string]*Endpoint)
+	for _, e := range []*Endpoint{&p.NodeInfo, &p.UserList, &p.Traffic, &p.Online} {
+		endpoints[endpointKey(e.Method, e.Path)] = e
+	}
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := endpointKey(r.Method, r.URL.Path)
+		e, ok := endpoints[key]
+		m.access.Lock()
+		m.counts[key]++
+		status := m.failures[key]
+		revalidate := e == &p.NodeInfo || e == &p.UserList
+		if revalidate && r.Header.Get("If-None-Match") == eTag {
+			m.revalidates[key]++
+		}
+		m.access.Unlock()
+		switch {
+		case !ok:
+			http.NotFound(w, r)
+		case status != 0:
+			w.WriteHeader(status)
+		case revalidate && r.Header.Get("If-None-Match") == eTag:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			if revalidate {
+				w.Header().Set("ETag", eTag)
+			}
+			w.Write([]byte(e.Body))
+		}
+	}))
+	t.Cleanup(m.server.Close)
+	m.client = p.New(&api.Config{
+		APIHost:  m.server.URL,
+		NodeID:   Fixture.NodeID,
+		Key:      Key,
+		NodeType: p.NodeType,
+	})
+	return m
+}
+
+func endpointKey(method, path string) string {
+	if method == "" {
+		method = http.MethodGet
+	}
+	return method + " " + path
+}
+
+// fail makes the mock answer e with status
+func (m *mock) fail(e *Endpoint, status int) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.failures[endpointKey(e.Method, e.Path)] = status
+}
+
+func (m *mock) requests(e *Endpoint) int {
+	m.access.Lock()
+	defer m.access.Unlock()
+	return m.counts[endpointKey(e.Method, e.Path)]
+}
+
+func (m *mock) revalidated(e *Endpoint) bool {
+	m.access.Lock()
+	defer m.access.Unlock()
+	return m.revalidates[endpointKey(e.Method, e.Path)] > 0
+}
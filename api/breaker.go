@@ -0,0 +1,114 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ErrCircuitOpen is returned without calling the panel while the circuit
+// breaker of the client is open
+var ErrCircuitOpen = errors.New("circuit breaker open, the panel is not called")
+
+const defaultBreakerCooldown = 60 * time.Second
+
+// States of a Breaker
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerConfig is the config of the circuit breaker of a client
+type BreakerConfig struct {
+	Failures int `mapstructure:"Failures"` // Consecutive failed calls opening the breaker, 0 to disable it
+	Cooldown int `mapstructure:"Cooldown"` // Second the panel is not called once the breaker is open
+}
+
+// Breaker stops calling the panel for a cooldown after consecutive failed
+// calls, so a panel down is not hammered by its nodes. The node keeps serving
+// the users it has meanwhile. Once the cooldown is over the breaker is half
+// open: the next call failing opens it again at once, the next one
+// succeeding closes it.
+type Breaker struct {
+	apiHost  string
+	failures int
+	cooldown time.Duration
+
+	access    sync.Mutex
+	failed    int // Consecutive failed calls
+	openUntil time.Time
+}
+
+// Breakable is implemented by the clients with a circuit breaker
+type Breakable interface {
+	Breaker() *Breaker
+}
+
+// NewBreaker adds the CircuitBreaker of config to the client, nil if it is
+// disabled. A call fails when the panel can't be reached or answers 429 or
+// 5xx, once its retries are done.
+func NewBreaker(client *resty.Client, config *Config) *Breaker {
+	c := config.CircuitBreaker
+	if c == nil || c.Failures <= 0 {
+		return nil
+	}
+	b := &Breaker{apiHost: config.APIHost, failures: c.Failures, cooldown: defaultBreakerCooldown}
+	if c.Cooldown > 0 {
+		b.cooldown = time.Duration(c.Cooldown) * time.Second
+	}
+	client.OnBeforeRequest(func(*resty.Client, *resty.Request) error {
+		if b.State() == BreakerOpen {
+			return ErrCircuitOpen
+		}
+		return nil
+	})
+	client.OnSuccess(func(_ *resty.Client, res *resty.Response) {
+		code := res.StatusCode()
+		b.record(code != http.StatusTooManyRequests && code < 500)
+	})
+	client.OnError(func(_ *resty.Request, err error) {
+		if !errors.Is(err, ErrCircuitOpen) {
+			b.record(false)
+		}
+	})
+	return b
+}
+
+// State returns the state of the breaker, closed if b is nil
+func (b *Breaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.access.Lock()
+	defer b.access.Unlock()
+	switch {
+	case b.failed < b.failures:
+		return BreakerClosed
+	case time.Now().Before(b.openUntil):
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
+
+func (b *Breaker) record(ok bool) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if ok {
+		if b.failed >= b.failures {
+			log.Printf("Circuit breaker of %s closed, the panel answers again", b.apiHost)
+		}
+		b.failed = 0
+		return
+	}
+	b.failed++
+	if b.failed >= b.failures {
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Printf("Circuit breaker of %s open for %s after %d failed calls", b.apiHost, b.cooldown, b.failed)
+	}
+}
@@ -0,0 +1,56 @@
+package api_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+func TestBreaker(t *testing.T) {
+	var status, calls atomic.Int32
+	status.Store(http.StatusBadGateway)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+	client := resty.New()
+	breaker := api.NewBreaker(client, &api.Config{
+		APIHost:        server.URL,
+		CircuitBreaker: &api.BreakerConfig{Failures: 2, Cooldown: 1},
+	})
+	for i := 0; i < 2; i++ {
+		client.R().Get(server.URL)
+	}
+	if state := breaker.State(); state != api.BreakerOpen {
+		t.Fatalf("state %s after 2 failed calls", state)
+	}
+	// The panel is not called while the breaker is open
+	if _, err := client.R().Get(server.URL); !errors.Is(err, api.ErrCircuitOpen) {
+		t.Errorf("got %v, want ErrCircuitOpen", err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("%d calls, want 2", n)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if state := breaker.State(); state != api.BreakerHalfOpen {
+		t.Fatalf("state %s after the cooldown", state)
+	}
+	status.Store(http.StatusOK)
+	if _, err := client.R().Get(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if state := breaker.State(); state != api.BreakerClosed {
+		t.Errorf("state %s after a call succeeded", state)
+	}
+	if b := api.NewBreaker(resty.New(), &api.Config{}); b != nil || b.State() != api.BreakerClosed {
+		t.Error("breaker without CircuitBreaker")
+	}
+}
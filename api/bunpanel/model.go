@@ -51,15 +51,10 @@ type User struct {
 }
 
 type OnlineUser struct {
-	UID int    `json:"userId"`
-	IP  string `json:"ip"`
-}
-
-// UserTraffic is the data structure of traffic
-type UserTraffic struct {
-	UID      int   `json:"userId"`
-	Upload   int64 `json:"u"`
-	Download int64 `json:"d"`
+	UID       int    `json:"userId"`
+	IP        string `json:"ip"`
+	FirstSeen int64  `json:"firstSeen,omitempty"`
+	LastSeen  int64  `json:"lastSeen,omitempty"`
 }
 
 type Response struct {
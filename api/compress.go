@@ -0,0 +1,43 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// EnableGzipRequest makes the client gzip every request body it sends.
+// Only turn it on for panels that accept Content-Encoding: gzip.
+func EnableGzipRequest(client *resty.Client) {
+	client.SetPreRequestHook(func(_ *resty.Client, req *http.Request) error {
+		if req.Body == nil || req.Body == http.NoBody {
+			return nil
+		}
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		compressed := buf.Bytes()
+
+		req.Body = io.NopCloser(bytes.NewReader(compressed))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(compressed)), nil
+		}
+		req.ContentLength = int64(len(compressed))
+		req.Header.Set("Content-Encoding", "gzip")
+		return nil
+	})
+}
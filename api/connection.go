@@ -0,0 +1,84 @@
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"golang.org/x/net/http2"
+)
+
+// ConnectionConfig tunes the reuse of the connections to the panel, for the
+// panels behind a CDN mishandling the long-lived ones
+type ConnectionConfig struct {
+	MaxIdleConns int    `mapstructure:"MaxIdleConns"` // Idle connections kept to the panel, -1 to close each one after its request
+	IdleTimeout  int    `mapstructure:"IdleTimeout"`  // Second an idle connection is kept
+	HTTPVersion  string `mapstructure:"HTTPVersion"`  // Auto, HTTP/1.1 or HTTP/2
+	PingInterval int    `mapstructure:"PingInterval"` // Second an HTTP/2 connection may stay silent before it is pinged, and closed without an answer
+}
+
+var httpVersions = []string{"", "Auto", "HTTP/1.1", "HTTP/2"}
+
+const pingTimeout = 15 * time.Second
+
+// Check returns an error if the config is invalid
+func (c *ConnectionConfig) Check() error {
+	if c == nil {
+		return nil
+	}
+	if !slices.Contains(httpVersions, c.HTTPVersion) {
+		return fmt.Errorf("unknown HTTPVersion %s, use one of %v", c.HTTPVersion, httpVersions[1:])
+	}
+	if c.PingInterval > 0 && c.HTTPVersion == "HTTP/1.1" {
+		return fmt.Errorf("PingInterval needs HTTP/2, HTTPVersion is %s", c.HTTPVersion)
+	}
+	return nil
+}
+
+// SetConnection applies the Connection of config to the transport of the
+// client. It must be called before the transport is wrapped, and the
+// Connection checked before.
+func SetConnection(client *resty.Client, config *Config) {
+	c := config.Connection
+	if c == nil {
+		return
+	}
+	transport, ok := client.GetClient().Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	switch {
+	case c.MaxIdleConns < 0:
+		transport.DisableKeepAlives = true
+	case c.MaxIdleConns > 0:
+		transport.MaxIdleConns = c.MaxIdleConns
+		transport.MaxIdleConnsPerHost = c.MaxIdleConns
+	}
+	if c.IdleTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(c.IdleTimeout) * time.Second
+	}
+	if c.HTTPVersion == "HTTP/1.1" {
+		// A non-nil empty map turns HTTP/2 off
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		return
+	}
+	if c.HTTPVersion != "HTTP/2" && c.PingInterval <= 0 {
+		return
+	}
+	h2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		return
+	}
+	if c.PingInterval > 0 {
+		h2.ReadIdleTimeout = time.Duration(c.PingInterval) * time.Second
+		h2.PingTimeout = pingTimeout
+	}
+	if c.HTTPVersion == "HTTP/2" {
+		// HTTP/1.1 is no more offered to the panel
+		transport.TLSClientConfig.NextProtos = []string{http2.NextProtoTLS}
+	}
+}
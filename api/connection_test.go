@@ -0,0 +1,48 @@
+package api_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+func TestConnectionHTTPVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	for _, test := range []struct {
+		connection *api.ConnectionConfig
+		proto      string
+	}{
+		{&api.ConnectionConfig{HTTPVersion: "Auto"}, "HTTP/2.0"},
+		{&api.ConnectionConfig{HTTPVersion: "HTTP/1.1", MaxIdleConns: -1}, "HTTP/1.1"},
+		{&api.ConnectionConfig{HTTPVersion: "HTTP/2", PingInterval: 30}, "HTTP/2.0"},
+	} {
+		if err := test.connection.Check(); err != nil {
+			t.Fatal(err)
+		}
+		client := resty.New().SetTLSClientConfig(&tls.Config{RootCAs: roots})
+		api.SetConnection(client, &api.Config{APIHost: server.URL, Connection: test.connection})
+		res, err := client.R().Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.String(); got != test.proto {
+			t.Errorf("HTTPVersion %s: got %s, want %s", test.connection.HTTPVersion, got, test.proto)
+		}
+	}
+	if err := (&api.ConnectionConfig{HTTPVersion: "HTTP/1.1", PingInterval: 30}).Check(); err == nil {
+		t.Error("PingInterval accepted with HTTP/1.1")
+	}
+}
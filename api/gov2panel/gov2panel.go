@@ -37,12 +37,20 @@ type APIClient struct {
 	LocalRuleList []api.DetectRule
 	resp          atomic.Value
 	eTags         map[string]string
+	breaker       *api.Breaker
+	health        *api.SyncHealth
 }
 
 // New create an api instance
 func New(apiConfig *api.Config) *APIClient {
 	client := resty.New()
-	client.SetRetryCount(3)
+	api.SetRetryPolicy(client, apiConfig)
+	api.SetConnection(client, apiConfig)
+	api.SetResolver(client, apiConfig)
+	api.LimitResponseSize(client, apiConfig)
+	api.RecordResponses(client, apiConfig)
+	breaker := api.NewBreaker(client, apiConfig)
+	health := api.NewSyncHealth(client)
 	if apiConfig.Timeout > 0 {
 		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
 	} else {
@@ -55,6 +63,9 @@ func New(apiConfig *api.Config) *APIClient {
 			log.Print(v.Err)
 		}
 	})
+	if apiConfig.EnableGzip {
+		api.EnableGzipRequest(client)
+	}
 	client.SetBaseURL(apiConfig.APIHost)
 	// Create Key for each requests
 	client.SetQueryParams(map[string]string{
@@ -76,6 +87,8 @@ func New(apiConfig *api.Config) *APIClient {
 		DeviceLimit:   apiConfig.DeviceLimit,
 		LocalRuleList: localRuleList,
 		eTags:         make(map[string]string),
+		breaker:       breaker,
+		health:        health,
 	}
 	return apiClient
 }
@@ -98,14 +111,19 @@ func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
 
 		// read line by line
 		for fileScanner.Scan() {
+			pattern, err := regexp.Compile(fileScanner.Text())
+			if err != nil {
+				log.Printf("Skip invalid rule %q: %s", fileScanner.Text(), err)
+				continue
+			}
 			LocalRuleList = append(LocalRuleList, api.DetectRule{
 				ID:      -1,
-				Pattern: regexp.MustCompile(fileScanner.Text()),
+				Pattern: pattern,
 			})
 		}
 		// handle first encountered error while reading
 		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
+			log.Printf("Error while reading file: %s", err)
 			return
 		}
 	}
@@ -118,6 +136,16 @@ func (c *APIClient) Describe() api.ClientInfo {
 	return api.ClientInfo{APIHost: c.APIHost, NodeID: c.NodeID, Key: c.Key, NodeType: c.NodeType}
 }
 
+// Breaker returns the circuit breaker of the client, nil if it has none
+func (c *APIClient) Breaker() *api.Breaker {
+	return c.breaker
+}
+
+// Health returns the health of the endpoints of the panel called so far
+func (c *APIClient) Health() []api.EndpointHealth {
+	return c.health.Endpoints()
+}
+
 // Debug set the client debug for client
 func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
@@ -132,8 +160,8 @@ func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (
 		return nil, fmt.Errorf("request %s failed: %v", c.assembleURL(path), err)
 	}
 
-	if res.StatusCode() > 399 {
-		return nil, fmt.Errorf("request %s failed: %s, %v", c.assembleURL(path), res.String(), err)
+	if err := api.CheckStatus(res, c.assembleURL(path)); err != nil {
+		return nil, err
 	}
 
 	rtn, err := simplejson.NewJson(res.Body())
@@ -144,6 +172,22 @@ func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (
 	return rtn, nil
 }
 
+// decodeResponse decodes the JSON body of a response requested with
+// SetDoNotParseResponse into v as it is read, so the body is neither held in
+// memory nor parsed twice
+func (c *APIClient) decodeResponse(res *resty.Response, path string, err error, v any) error {
+	if err != nil {
+		return fmt.Errorf("request %s failed: %v", c.assembleURL(path), err)
+	}
+	if err := api.CheckStatus(res, c.assembleURL(path)); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(res.RawBody()).Decode(v); err != nil {
+		return fmt.Errorf("ret of %s invalid: %s", c.assembleURL(path), err)
+	}
+	return nil
+}
+
 // GetNodeInfo will pull NodeInfo Config from panel
 func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 	server := new(serverConfig)
@@ -208,8 +252,11 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 
 	res, err := c.client.R().
 		SetHeader("If-None-Match", c.eTags["users"]).
-		ForceContentType("application/json").
+		SetDoNotParseResponse(true).
 		Get(path)
+	if res != nil && res.RawBody() != nil {
+		defer res.RawBody().Close()
+	}
 
 	// Etag identifier for a specific version of a resource. StatusCode = 304 means no changed
 	if res.StatusCode() == 304 {
@@ -220,12 +267,11 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 		c.eTags["users"] = res.Header().Get("Etag")
 	}
 
-	usersResp, err := c.parseResponse(res, path, err)
-	if err != nil {
+	list := new(userList)
+	if err := c.decodeResponse(res, path, err, list); err != nil {
 		return nil, err
 	}
-	b, _ := usersResp.Get("users").Encode()
-	json.Unmarshal(b, &users)
+	users = list.Users
 	if len(users) == 0 {
 		return nil, errors.New("users is null")
 	}
@@ -257,9 +303,15 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 
 // ReportUserTraffic reports the user traffic
 func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+	return c.ReportUserTrafficWithKey("", userTraffic)
+}
+
+// ReportUserTrafficWithKey reports the user traffic, tagged with the
+// idempotency key unless it is empty
+func (c *APIClient) ReportUserTrafficWithKey(key string, userTraffic *[]api.UserTraffic) error {
 	path := "/api/server/push"
 
-	res, err := c.client.R().SetBody(userTraffic).ForceContentType("application/json").Post(path)
+	res, err := c.client.R().SetHeaders(api.IdempotencyHeaders(key)).SetBody(userTraffic).ForceContentType("application/json").Post(path)
 	_, err = c.parseResponse(res, path, err)
 	if err != nil {
 		return err
@@ -297,6 +349,16 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 	return nil
 }
 
+// ReportAlive posts the alive report of the node to path
+func (c *APIClient) ReportAlive(path string, alive map[string]any) error {
+	res, err := c.client.R().
+		SetBody(alive).
+		ForceContentType("application/json").
+		Post(path)
+	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
 // ReportIllegal implements the API interface
 func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 	return nil
@@ -44,3 +44,9 @@ type user struct {
 	Uuid       string `json:"uuid"`
 	SpeedLimit int    `json:"speed_limit"`
 }
+
+// userList is the response of the user list, decoded as it is read instead
+// of through simplejson, as it may hold tens of thousands of users
+type userList struct {
+	Users []*user `json:"users"`
+}
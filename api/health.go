@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// EndpointHealth is how the calls of a client to an endpoint of the panel went
+type EndpointHealth struct {
+	Endpoint    string `json:"Endpoint"`              // Method and path, with the act param of the panels taking the call in it
+	LastSuccess int64  `json:"LastSuccess,omitempty"` // Unix time
+	LastFailure int64  `json:"LastFailure,omitempty"` // Unix time
+	Failures    int    `json:"Failures"`              // In a row, 0 once a call succeeds
+	LastError   string `json:"LastError,omitempty"`
+}
+
+// HealthReporter is implemented by the clients keeping the health of their
+// endpoints
+type HealthReporter interface {
+	Health() []EndpointHealth
+}
+
+// SyncHealth keeps the EndpointHealth of the endpoints called by a client. A
+// call fails when the panel can't be reached or answers an error status, once
+// its retries are done.
+type SyncHealth struct {
+	access    sync.Mutex
+	endpoints map[string]*EndpointHealth
+}
+
+// NewSyncHealth keeps the health of the endpoints called by client
+func NewSyncHealth(client *resty.Client) *SyncHealth {
+	h := &SyncHealth{endpoints: make(map[string]*EndpointHealth)}
+	client.OnSuccess(func(_ *resty.Client, res *resty.Response) {
+		var err error
+		// The body is left to the client, it may not be read yet
+		if res.StatusCode() >= 400 {
+			err = fmt.Errorf("status %s", res.Status())
+		}
+		h.record(res.Request, err)
+	})
+	client.OnError(func(req *resty.Request, err error) {
+		// Not a call to the panel
+		if !errors.Is(err, ErrCircuitOpen) {
+			h.record(req, err)
+		}
+	})
+	return h
+}
+
+// Endpoints returns the health of the endpoints called so far, by Endpoint
+func (h *SyncHealth) Endpoints() []EndpointHealth {
+	if h == nil {
+		return nil
+	}
+	h.access.Lock()
+	defer h.access.Unlock()
+	endpoints := make([]EndpointHealth, 0, len(h.endpoints))
+	for _, e := range h.endpoints {
+		endpoints = append(endpoints, *e)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Endpoint < endpoints[j].Endpoint })
+	return endpoints
+}
+
+func (h *SyncHealth) record(req *resty.Request, err error) {
+	if req == nil {
+		return
+	}
+	name := req.Method
+	if u, parseErr := url.Parse(req.URL); parseErr == nil {
+		name += " " + u.Path
+		if act := u.Query().Get("act"); act != "" {
+			name += "?act=" + act
+		}
+	}
+	h.access.Lock()
+	defer h.access.Unlock()
+	e, ok := h.endpoints[name]
+	if !ok {
+		e = &EndpointHealth{Endpoint: name}
+		h.endpoints[name] = e
+	}
+	now := time.Now().Unix()
+	if err == nil {
+		e.LastSuccess = now
+		e.Failures = 0
+		return
+	}
+	e.LastFailure = now
+	e.Failures++
+	e.LastError = err.Error()
+}
@@ -0,0 +1,45 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+func TestSyncHealth(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users" {
+			w.WriteHeader(int(status.Load()))
+		}
+	}))
+	defer server.Close()
+	client := resty.New().SetBaseURL(server.URL)
+	health := api.NewSyncHealth(client)
+	client.R().Get("/users")
+	client.R().SetQueryParam("act", "config").Get("/")
+	client.R().Get("/users")
+
+	endpoints := health.Endpoints()
+	if len(endpoints) != 2 {
+		t.Fatalf("got %+v", endpoints)
+	}
+	if e := endpoints[0]; e.Endpoint != "GET /?act=config" || e.Failures != 0 || e.LastSuccess == 0 {
+		t.Errorf("got %+v", e)
+	}
+	if e := endpoints[1]; e.Endpoint != "GET /users" || e.Failures != 2 || e.LastSuccess != 0 || e.LastError != "status 503 Service Unavailable" {
+		t.Errorf("got %+v", e)
+	}
+
+	status.Store(http.StatusOK)
+	client.R().Get("/users")
+	if e := health.Endpoints()[1]; e.Failures != 0 || e.LastSuccess == 0 || e.LastFailure == 0 {
+		t.Errorf("got %+v after a call succeeded", e)
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ErrResponseTooLarge is returned for a response over the MaxResponseSize of
+// the client, it is not retried
+var ErrResponseTooLarge = errors.New("response too large, see MaxResponseSize")
+
+const defaultMaxResponseSize = 64 // MB
+
+// LimitResponseSize makes the client fail the responses with a body over the
+// MaxResponseSize of config as they are read, so a panel answering with a
+// huge body can't run the node out of memory. The limit applies to the body
+// once decompressed.
+func LimitResponseSize(client *resty.Client, config *Config) {
+	limit := int64(config.MaxResponseSize)
+	if limit <= 0 {
+		limit = defaultMaxResponseSize
+	}
+	base := client.GetClient().Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.SetTransport(&limitTransport{base: base, limit: limit << 20})
+}
+
+type limitTransport struct {
+	base  http.RoundTripper
+	limit int64 // Byte
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.ContentLength > t.limit {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, res.ContentLength)
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, left: t.limit}
+	return res, nil
+}
+
+// limitedBody fails the read going over the limit, rather than cutting the
+// body short like io.LimitReader
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		var one [1]byte
+		n, err := b.ReadCloser.Read(one[:])
+		if n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,58 @@
+package api_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+func TestLimitResponseSize(t *testing.T) {
+	for _, test := range []struct {
+		size    int
+		chunked bool
+		err     error
+	}{
+		{1 << 10, false, nil},
+		{1 << 20, true, nil},
+		{1<<20 + 1, false, api.ErrResponseTooLarge},
+		{2 << 20, true, api.ErrResponseTooLarge},
+	} {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			body := bytes.Repeat([]byte("a"), test.size)
+			if !test.chunked {
+				w.Header().Set("Content-Length", strconv.Itoa(test.size))
+			}
+			for len(body) > 0 {
+				n := min(len(body), 64<<10)
+				w.Write(body[:n])
+				w.(http.Flusher).Flush()
+				body = body[n:]
+			}
+		}))
+		client := resty.New()
+		api.SetRetryPolicy(client, &api.Config{Retry: &api.RetryConfig{Count: 2}})
+		api.LimitResponseSize(client, &api.Config{MaxResponseSize: 1})
+		res, err := client.R().Get(server.URL)
+		server.Close()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%d bytes, chunked %t: got %v, want %v", test.size, test.chunked, err, test.err)
+			continue
+		}
+		if err == nil && len(res.Body()) != test.size {
+			t.Errorf("%d bytes: read %d", test.size, len(res.Body()))
+		}
+		if got := attempts.Load(); got != 1 {
+			t.Errorf("%d bytes: %d attempts, want 1", test.size, got)
+		}
+	}
+}
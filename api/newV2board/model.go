@@ -8,13 +8,17 @@ type serverConfig struct {
 	shadowsocks
 	v2ray
 	trojan
+	anytls
+	juicity
+	forward
 
 	ServerPort int `json:"server_port"`
 	BaseConfig struct {
 		PushInterval int `json:"push_interval"`
 		PullInterval int `json:"pull_interval"`
 	} `json:"base_config"`
-	Routes []route `json:"routes"`
+	Routes []route       `json:"routes"`
+	Mux    *muxSettings `json:"mux_settings"` // Optional
 }
 
 type shadowsocks struct {
@@ -24,7 +28,9 @@ type shadowsocks struct {
 		Path string `json:"path"`
 		Host string `json:"host"`
 	} `json:"obfs_settings"`
-	ServerKey string `json:"server_key"`
+	ServerKey  string `json:"server_key"`
+	Plugin     string `json:"plugin"`      // Optional, SIP003 plugin
+	PluginOpts string `json:"plugin_opts"` // Optional
 }
 
 type v2ray struct {
@@ -58,6 +64,28 @@ type trojan struct {
 	ServerName string `json:"server_name"`
 }
 
+type anytls struct {
+	PaddingScheme []string `json:"padding_scheme"` // Lines of the scheme
+}
+
+type juicity struct {
+	CongestionControl string `json:"congestion_control"`
+}
+
+type forward struct {
+	ForwardHost    string `json:"forward_host"`
+	ForwardPort    int    `json:"forward_port"`
+	ForwardNetwork string `json:"forward_network"` // Optional, tcp, udp or tcp,udp
+}
+
+type muxSettings struct {
+	Enabled         bool   `json:"enabled"` // Of the relay outbound
+	Concurrency     int16  `json:"concurrency"`
+	XudpConcurrency int16  `json:"xudp_concurrency"`
+	XudpProxyUDP443 string `json:"xudp_proxy_udp443"`
+	RejectInbound   bool   `json:"reject_inbound"`
+}
+
 type route struct {
 	Id          int      `json:"id"`
 	Match       []string `json:"match"`
@@ -65,8 +93,45 @@ type route struct {
 	ActionValue string   `json:"action_value"`
 }
 
+// userList is the response of the user list, decoded as it is read instead
+// of through simplejson, as it may hold tens of thousands of users
+type userList struct {
+	Users   []*user    `json:"users"`
+	Version string     `json:"version"`
+	Delta   *userDelta `json:"delta"` // Instead of Users, if the version sent is known to the panel
+}
+
+// userDelta is the change of the user list since the version sent by the node
+type userDelta struct {
+	Added   []*user `json:"added"`
+	Changed []*user `json:"changed"`
+	Removed []int   `json:"removed"` // IDs
+}
+
 type user struct {
-	Id         int    `json:"id"`
-	Uuid       string `json:"uuid"`
-	SpeedLimit int    `json:"speed_limit"`
-}
\ No newline at end of file
+	Id          int    `json:"id"`
+	Uuid        string `json:"uuid"`
+	SpeedLimit  int    `json:"speed_limit"`
+	DeviceLimit int    `json:"limit_device"` // Optional, the DeviceLimit of the node is used when absent or zero
+	Tag         string `json:"tag"`          // Optional, set by panels that group their users
+	ExpiredAt   int64  `json:"expired_at"`   // Optional, set by panels that let the nodes expire their users
+	UDP         *bool  `json:"udp"`          // Optional, set by panels selling TCP only plans
+	Enabled     *bool  `json:"enabled"`      // Optional, set by panels that keep listing the disabled users
+	Banned      bool   `json:"banned"`       // Optional, set by panels that keep listing the banned users
+	PublicKey   string `json:"public_key"`   // Optional, WireGuard public key of the user
+	// Optional, set by panels that let the nodes enforce the traffic quota
+	U              int64 `json:"u"`
+	D              int64 `json:"d"`
+	TransferEnable int64 `json:"transfer_enable"`
+}
+type command struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	UID  int    `json:"uid"`
+}
+
+type commandResult struct {
+	ID      string `json:"id"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
@@ -7,10 +7,10 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -24,30 +24,40 @@ import (
 
 // APIClient create an api client to the panel.
 type APIClient struct {
-	client        *resty.Client
-	APIHost       string
-	NodeID        int
-	Key           string
-	NodeType      string
-	EnableVless   bool
-	VlessFlow     string
-	SpeedLimit    float64
-	DeviceLimit   int
-	LocalRuleList []api.DetectRule
+	client           *resty.Client
+	APIHost          string
+	NodeID           int
+	Key              string
+	NodeType         string
+	EnableVless      bool
+	VlessFlow        string
+	SpeedLimit       float64
+	DeviceLimit      int
+	LocalRuleList    []api.DetectRule
 	LastReportOnline map[int]int
-	resp          atomic.Value
-	eTags         map[string]string
+	onlineState      *api.OnlineState
+	resp             atomic.Value
+	eTags            map[string]string
+	enableUserDelta  bool
+	userVersion      string        // Version of users, sent to get the changes since
+	users            map[int]*user // Last user list, the deltas of the panel apply to it
+	timeouts         *api.Timeouts
+	breaker          *api.Breaker
+	health           *api.SyncHealth
 }
 
 // New create an api instance
 func New(apiConfig *api.Config) *APIClient {
 	client := resty.New()
-	client.SetRetryCount(3)
-	if apiConfig.Timeout > 0 {
-		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
-	} else {
-		client.SetTimeout(5 * time.Second)
-	}
+	api.SetRetryPolicy(client, apiConfig)
+	api.SetConnection(client, apiConfig)
+	api.SetResolver(client, apiConfig)
+	api.LimitResponseSize(client, apiConfig)
+	api.RecordResponses(client, apiConfig)
+	breaker := api.NewBreaker(client, apiConfig)
+	health := api.NewSyncHealth(client)
+	timeouts := api.NewTimeouts(apiConfig)
+	client.SetTimeout(timeouts.Client)
 	client.OnError(func(req *resty.Request, err error) {
 		if v, ok := err.(*resty.ResponseError); ok {
 			// v.Response contains the last response from the server
@@ -55,6 +65,9 @@ func New(apiConfig *api.Config) *APIClient {
 			log.Print(v.Err)
 		}
 	})
+	if apiConfig.EnableGzip {
+		api.EnableGzipRequest(client)
+	}
 	client.SetBaseURL(apiConfig.APIHost)
 
 	var nodeType string
@@ -72,18 +85,25 @@ func New(apiConfig *api.Config) *APIClient {
 	})
 	// Read local rule list
 	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
+	onlineState := api.NewOnlineState(apiConfig)
 	apiClient := &APIClient{
-		client:        client,
-		NodeID:        apiConfig.NodeID,
-		Key:           apiConfig.Key,
-		APIHost:       apiConfig.APIHost,
-		NodeType:      apiConfig.NodeType,
-		EnableVless:   apiConfig.EnableVless,
-		VlessFlow:     apiConfig.VlessFlow,
-		SpeedLimit:    apiConfig.SpeedLimit,
-		DeviceLimit:   apiConfig.DeviceLimit,
-		LocalRuleList: localRuleList,
-		eTags:         make(map[string]string),
+		client:           client,
+		NodeID:           apiConfig.NodeID,
+		Key:              apiConfig.Key,
+		APIHost:          apiConfig.APIHost,
+		NodeType:         apiConfig.NodeType,
+		EnableVless:      apiConfig.EnableVless,
+		VlessFlow:        apiConfig.VlessFlow,
+		SpeedLimit:       apiConfig.SpeedLimit,
+		DeviceLimit:      apiConfig.DeviceLimit,
+		LocalRuleList:    localRuleList,
+		LastReportOnline: onlineState.Load(),
+		onlineState:      onlineState,
+		eTags:            make(map[string]string),
+		enableUserDelta:  apiConfig.EnableUserDelta,
+		timeouts:         timeouts,
+		breaker:          breaker,
+		health:           health,
 	}
 	return apiClient
 }
@@ -106,14 +126,19 @@ func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
 
 		// read line by line
 		for fileScanner.Scan() {
+			pattern, err := regexp.Compile(fileScanner.Text())
+			if err != nil {
+				log.Printf("Skip invalid rule %q: %s", fileScanner.Text(), err)
+				continue
+			}
 			LocalRuleList = append(LocalRuleList, api.DetectRule{
 				ID:      -1,
-				Pattern: regexp.MustCompile(fileScanner.Text()),
+				Pattern: pattern,
 			})
 		}
 		// handle first encountered error while reading
 		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
+			log.Printf("Error while reading file: %s", err)
 			return
 		}
 	}
@@ -126,6 +151,16 @@ func (c *APIClient) Describe() api.ClientInfo {
 	return api.ClientInfo{APIHost: c.APIHost, NodeID: c.NodeID, Key: c.Key, NodeType: c.NodeType}
 }
 
+// Breaker returns the circuit breaker of the client, nil if it has none
+func (c *APIClient) Breaker() *api.Breaker {
+	return c.breaker
+}
+
+// Health returns the health of the endpoints of the panel called so far
+func (c *APIClient) Health() []api.EndpointHealth {
+	return c.health.Endpoints()
+}
+
 // Debug set the client debug for client
 func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
@@ -140,8 +175,8 @@ func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (
 		return nil, fmt.Errorf("request %s failed: %v", c.assembleURL(path), err)
 	}
 
-	if res.StatusCode() > 399 {
-		return nil, fmt.Errorf("request %s failed: %s, %v", c.assembleURL(path), res.String(), err)
+	if err := api.CheckStatus(res, c.assembleURL(path)); err != nil {
+		return nil, err
 	}
 
 	rtn, err := simplejson.NewJson(res.Body())
@@ -152,12 +187,31 @@ func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (
 	return rtn, nil
 }
 
+// decodeResponse decodes the JSON body of a response requested with
+// SetDoNotParseResponse into v as it is read, so the body is neither held in
+// memory nor parsed twice
+func (c *APIClient) decodeResponse(res *resty.Response, path string, err error, v any) error {
+	if err != nil {
+		return fmt.Errorf("request %s failed: %v", c.assembleURL(path), err)
+	}
+	if err := api.CheckStatus(res, c.assembleURL(path)); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(res.RawBody()).Decode(v); err != nil {
+		return fmt.Errorf("ret of %s invalid: %s", c.assembleURL(path), err)
+	}
+	return nil
+}
+
 // GetNodeInfo will pull NodeInfo Config from panel
 func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 	server := new(serverConfig)
 	path := "/api/v1/server/UniProxy/config"
+	ctx, cancel := c.timeouts.Context(c.timeouts.NodeInfo)
+	defer cancel()
 
 	res, err := c.client.R().
+		SetContext(ctx).
 		SetHeader("If-None-Match", c.eTags["node"]).
 		ForceContentType("application/json").
 		Get(path)
@@ -187,10 +241,22 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 	switch c.NodeType {
 	case "V2ray":
 		nodeInfo, err = c.parseV2rayNodeResponse(server)
-	case "Trojan":
+	case "Trojan", "Naive":
 		nodeInfo, err = c.parseTrojanNodeResponse(server)
 	case "Shadowsocks":
 		nodeInfo, err = c.parseSSNodeResponse(server)
+	case "AnyTLS":
+		nodeInfo, err = c.parseAnyTLSNodeResponse(server)
+	case "Juicity":
+		nodeInfo, err = c.parseJuicityNodeResponse(server)
+	case "WireGuard":
+		nodeInfo, err = c.parseWireGuardNodeResponse(server)
+	case "Mixed":
+		nodeInfo, err = c.parseMixedNodeResponse(server)
+	case "SSH":
+		nodeInfo, err = c.parseSSHNodeResponse(server)
+	case "Forward":
+		nodeInfo, err = c.parseForwardNodeResponse(server)
 	default:
 		return nil, fmt.Errorf("unsupported node type: %s", c.NodeType)
 	}
@@ -198,6 +264,15 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("parse node info failed: %s, \nError: %v", res.String(), err)
 	}
+	if m := server.Mux; m != nil {
+		nodeInfo.Mux = &api.MuxInfo{
+			RejectInbound:   m.RejectInbound,
+			Outbound:        m.Enabled,
+			Concurrency:     m.Concurrency,
+			XudpConcurrency: m.XudpConcurrency,
+			XudpProxyUDP443: m.XudpProxyUDP443,
+		}
+	}
 
 	return nodeInfo, nil
 }
@@ -208,16 +283,25 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 	path := "/api/v1/server/UniProxy/user"
 
 	switch c.NodeType {
-	case "V2ray", "Trojan", "Shadowsocks":
+	case "V2ray", "Trojan", "Shadowsocks", "AnyTLS", "Naive", "Juicity", "WireGuard", "Mixed", "SSH", "Forward":
 		break
 	default:
 		return nil, fmt.Errorf("unsupported node type: %s", c.NodeType)
 	}
 
-	res, err := c.client.R().
+	ctx, cancel := c.timeouts.Context(c.timeouts.UserList)
+	defer cancel()
+	req := c.client.R().
+		SetContext(ctx).
 		SetHeader("If-None-Match", c.eTags["users"]).
-		ForceContentType("application/json").
-		Get(path)
+		SetDoNotParseResponse(true)
+	if c.enableUserDelta && c.userVersion != "" {
+		req.SetQueryParam("version", c.userVersion)
+	}
+	res, err := req.Get(path)
+	if res != nil && res.RawBody() != nil {
+		defer res.RawBody().Close()
+	}
 
 	// Etag identifier for a specific version of a resource. StatusCode = 304 means no changed
 	if res.StatusCode() == 304 {
@@ -228,12 +312,19 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 		c.eTags["users"] = res.Header().Get("Etag")
 	}
 
-	usersResp, err := c.parseResponse(res, path, err)
-	if err != nil {
+	list := new(userList)
+	if err := c.decodeResponse(res, path, err, list); err != nil {
+		// Ask for the full list next time
+		c.userVersion = ""
 		return nil, err
 	}
-	b, _ := usersResp.Get("users").Encode()
-	json.Unmarshal(b, &users)
+	if c.enableUserDelta {
+		if users, err = c.applyUserDelta(list); err != nil {
+			return nil, err
+		}
+	} else {
+		users = list.Users
+	}
 	if len(users) == 0 {
 		return nil, errors.New("users is null")
 	}
@@ -241,8 +332,24 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 	userList := make([]api.UserInfo, len(users))
 	for i := 0; i < len(users); i++ {
 		u := api.UserInfo{
-			UID:  users[i].Id,
-			UUID: users[i].Uuid,
+			UID:       users[i].Id,
+			UUID:      users[i].Uuid,
+			Tag:       users[i].Tag,
+			ExpiredAt: users[i].ExpiredAt,
+			Disabled:  users[i].Banned || (users[i].Enabled != nil && !*users[i].Enabled),
+			PublicKey: users[i].PublicKey,
+		}
+		if udp := users[i].UDP; udp != nil {
+			u.UDP = -1
+			if *udp {
+				u.UDP = 1
+			}
+		}
+		if users[i].TransferEnable > 0 {
+			u.Quota = -1
+			if left := users[i].TransferEnable - users[i].U - users[i].D; left > 0 {
+				u.Quota = left
+			}
 		}
 
 		// Support 1.7.1 speed limit
@@ -252,7 +359,10 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 			u.SpeedLimit = uint64(users[i].SpeedLimit * 1000000 / 8)
 		}
 
-		u.DeviceLimit = c.DeviceLimit // todo waiting v2board send configuration
+		u.DeviceLimit = users[i].DeviceLimit
+		if u.DeviceLimit <= 0 {
+			u.DeviceLimit = c.DeviceLimit
+		}
 		u.Email = u.UUID + "@v2board.user"
 		if c.NodeType == "Shadowsocks" {
 			u.Passwd = u.UUID
@@ -263,17 +373,64 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 	return &userList, nil
 }
 
+// applyUserDelta returns the user list of a response, either in full or as
+// the changes since the version sent, which are applied to the last list
+func (c *APIClient) applyUserDelta(list *userList) ([]*user, error) {
+	if list.Delta == nil {
+		c.users = make(map[int]*user, len(list.Users))
+		for _, u := range list.Users {
+			c.users[u.Id] = u
+		}
+		c.userVersion = list.Version
+		return list.Users, nil
+	}
+	if c.users == nil {
+		c.userVersion = ""
+		return nil, errors.New("received a user delta without a user list to apply it to")
+	}
+	d := list.Delta
+	c.userVersion = list.Version
+	if len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0 {
+		return nil, errors.New(api.UserNotModified)
+	}
+	for _, id := range d.Removed {
+		delete(c.users, id)
+	}
+	for _, u := range append(d.Added, d.Changed...) {
+		c.users[u.Id] = u
+	}
+	users := make([]*user, 0, len(c.users))
+	for _, u := range c.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
+}
+
 // ReportUserTraffic reports the user traffic
 func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+	return c.ReportUserTrafficWithKey("", userTraffic)
+}
+
+// ReportUserTrafficWithKey reports the user traffic, tagged with the
+// idempotency key unless it is empty
+func (c *APIClient) ReportUserTrafficWithKey(key string, userTraffic *[]api.UserTraffic) error {
 	path := "/api/v1/server/UniProxy/push"
 
 	// json structure: {uid1: [u, d], uid2: [u, d], uid1: [u, d], uid3: [u, d]}
-	data := make(map[int][]int64, len(*userTraffic))
-	for _, traffic := range *userTraffic {
-		data[traffic.UID] = []int64{traffic.Upload, traffic.Download}
-	}
+	body := api.GetTrafficBody()
+	defer api.PutTrafficBody(body)
+	*body = api.AppendTrafficMap(*body, *userTraffic)
+	ctx, cancel := c.timeouts.Context(c.timeouts.Traffic)
+	defer cancel()
 
-	res, err := c.client.R().SetBody(data).ForceContentType("application/json").Post(path)
+	res, err := c.client.R().
+		SetContext(ctx).
+		SetHeaders(api.IdempotencyHeaders(key)).
+		SetHeader("Content-Type", "application/json").
+		SetBody(*body).
+		ForceContentType("application/json").
+		Post(path)
 	_, err = c.parseResponse(res, path, err)
 	if err != nil {
 		return err
@@ -282,6 +439,52 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 	return nil
 }
 
+// GetCommands returns the commands queued for the node by the panel
+func (c *APIClient) GetCommands() ([]api.Command, error) {
+	path := "/api/v1/server/UniProxy/commands"
+	ctx, cancel := c.timeouts.Context(0)
+	defer cancel()
+	res, err := c.client.R().
+		SetContext(ctx).
+		SetDoNotParseResponse(true).
+		Get(path)
+	if res != nil && res.RawBody() != nil {
+		defer res.RawBody().Close()
+	}
+	var body struct {
+		Commands []command `json:"commands"`
+	}
+	if err := c.decodeResponse(res, path, err, &body); err != nil {
+		return nil, err
+	}
+	commands := make([]api.Command, len(body.Commands))
+	for i, cmd := range body.Commands {
+		commands[i] = api.Command{ID: cmd.ID, Type: cmd.Type, UID: cmd.UID}
+	}
+	return commands, nil
+}
+
+// ReportCommandResults reports the outcome of the commands to the panel,
+// dequeuing them
+func (c *APIClient) ReportCommandResults(results []api.CommandResult) error {
+	path := "/api/v1/server/UniProxy/commands"
+	body := struct {
+		Results []commandResult `json:"results"`
+	}{Results: make([]commandResult, len(results))}
+	for i, r := range results {
+		body.Results[i] = commandResult{ID: r.ID, OK: r.OK, Message: r.Message}
+	}
+	ctx, cancel := c.timeouts.Context(0)
+	defer cancel()
+	res, err := c.client.R().
+		SetContext(ctx).
+		SetBody(body).
+		ForceContentType("application/json").
+		Post(path)
+	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
 // GetNodeRule implements the API interface
 func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	routes := c.resp.Load().(*serverConfig).Routes
@@ -319,9 +522,12 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 		}
 	}
 	c.LastReportOnline = reportOnline // Update LastReportOnline
+	c.onlineState.Save(reportOnline)
 
 	path := "/api/v1/server/UniProxy/alive"
-	res, err := c.client.R().SetBody(data).ForceContentType("application/json").Post(path)
+	ctx, cancel := c.timeouts.Context(c.timeouts.Online)
+	defer cancel()
+	res, err := c.client.R().SetContext(ctx).SetBody(data).ForceContentType("application/json").Post(path)
 	_, err = c.parseResponse(res, path, err)
 	// 面板无对应接口时先不报错
 	if err != nil {
@@ -331,6 +537,19 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 	return nil
 }
 
+// ReportAlive posts the alive report of the node to path
+func (c *APIClient) ReportAlive(path string, alive map[string]any) error {
+	ctx, cancel := c.timeouts.Context(c.timeouts.Alive)
+	defer cancel()
+	res, err := c.client.R().
+		SetContext(ctx).
+		SetBody(alive).
+		ForceContentType("application/json").
+		Post(path)
+	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
 // ReportIllegal implements the API interface
 func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 	return nil
@@ -352,6 +571,88 @@ func (c *APIClient) parseTrojanNodeResponse(s *serverConfig) (*api.NodeInfo, err
 	return nodeInfo, nil
 }
 
+// parseAnyTLSNodeResponse parse the response for the given nodeInfo format
+func (c *APIClient) parseAnyTLSNodeResponse(s *serverConfig) (*api.NodeInfo, error) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          c.NodeType,
+		NodeID:            c.NodeID,
+		Port:              uint32(s.ServerPort),
+		TransportProtocol: "tcp",
+		EnableTLS:         true,
+		Host:              s.ServerName,
+		PaddingScheme:     strings.Join(s.PaddingScheme, "\n"),
+		NameServerConfig:  s.parseDNSConfig(),
+	}
+	return nodeInfo, nil
+}
+
+// parseJuicityNodeResponse parse the response for the given nodeInfo format
+func (c *APIClient) parseJuicityNodeResponse(s *serverConfig) (*api.NodeInfo, error) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          c.NodeType,
+		NodeID:            c.NodeID,
+		Port:              uint32(s.ServerPort),
+		TransportProtocol: "quic",
+		EnableTLS:         true,
+		Host:              s.ServerName,
+		CongestionControl: s.CongestionControl,
+		NameServerConfig:  s.parseDNSConfig(),
+	}
+	return nodeInfo, nil
+}
+
+// parseWireGuardNodeResponse parse the response for the given nodeInfo format
+func (c *APIClient) parseWireGuardNodeResponse(s *serverConfig) (*api.NodeInfo, error) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          c.NodeType,
+		NodeID:            c.NodeID,
+		Port:              uint32(s.ServerPort),
+		TransportProtocol: "udp",
+		ServerKey:         s.ServerKey, // Private key of the interface
+		NameServerConfig:  s.parseDNSConfig(),
+	}
+	return nodeInfo, nil
+}
+
+// parseMixedNodeResponse parse the response for the given nodeInfo format
+func (c *APIClient) parseMixedNodeResponse(s *serverConfig) (*api.NodeInfo, error) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          c.NodeType,
+		NodeID:            c.NodeID,
+		Port:              uint32(s.ServerPort),
+		TransportProtocol: "tcp",
+		NameServerConfig:  s.parseDNSConfig(),
+	}
+	return nodeInfo, nil
+}
+
+// parseSSHNodeResponse parse the response for the given nodeInfo format
+func (c *APIClient) parseSSHNodeResponse(s *serverConfig) (*api.NodeInfo, error) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          c.NodeType,
+		NodeID:            c.NodeID,
+		Port:              uint32(s.ServerPort),
+		TransportProtocol: "tcp",
+		ServerKey:         s.ServerKey, // Seed of the Ed25519 host key
+		NameServerConfig:  s.parseDNSConfig(),
+	}
+	return nodeInfo, nil
+}
+
+// parseForwardNodeResponse parse the response for the given nodeInfo format
+func (c *APIClient) parseForwardNodeResponse(s *serverConfig) (*api.NodeInfo, error) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          c.NodeType,
+		NodeID:            c.NodeID,
+		Port:              uint32(s.ServerPort),
+		TransportProtocol: "tcp",
+		ForwardAddress:    net.TCPDestination(net.ParseAddress(s.ForwardHost), net.Port(s.ForwardPort)).NetAddr(),
+		ForwardNetwork:    s.ForwardNetwork,
+		NameServerConfig:  s.parseDNSConfig(),
+	}
+	return nodeInfo, nil
+}
+
 // parseSSNodeResponse parse the response for the given nodeInfo format
 func (c *APIClient) parseSSNodeResponse(s *serverConfig) (*api.NodeInfo, error) {
 	var header json.RawMessage
@@ -380,6 +681,8 @@ func (c *APIClient) parseSSNodeResponse(s *serverConfig) (*api.NodeInfo, error)
 		ServerKey:         s.ServerKey, // shadowsocks2022 share key
 		NameServerConfig:  s.parseDNSConfig(),
 		Header:            header,
+		Plugin:            s.Plugin,
+		PluginOpts:        s.PluginOpts,
 	}, nil
 }
 
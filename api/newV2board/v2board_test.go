@@ -1,6 +1,8 @@
 package newV2board_test
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/qtai2901/new_xrayr/api"
@@ -68,6 +70,43 @@ func TestGetUserList(t *testing.T) {
 	t.Log(userList)
 }
 
+func TestGetUserListDelta(t *testing.T) {
+	responses := []string{
+		`{"version":"1","users":[{"id":1,"uuid":"a"},{"id":2,"uuid":"b"}]}`,
+		`{"version":"2","delta":{"added":[{"id":3,"uuid":"c"}],"changed":[{"id":1,"uuid":"d"}],"removed":[2]}}`,
+		`{"version":"2","delta":{}}`,
+	}
+	var versions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versions = append(versions, r.URL.Query().Get("version"))
+		w.Write([]byte(responses[len(versions)-1]))
+	}))
+	defer server.Close()
+	client := newV2board.New(&api.Config{
+		APIHost:         server.URL,
+		NodeID:          1,
+		NodeType:        "V2ray",
+		EnableUserDelta: true,
+	})
+
+	if userList, err := client.GetUserList(); err != nil || len(*userList) != 2 {
+		t.Fatalf("unexpected full list: %v %v", userList, err)
+	}
+	userList, err := client.GetUserList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*userList) != 2 || (*userList)[0].UUID != "d" || (*userList)[1].UUID != "c" {
+		t.Fatalf("unexpected list after delta: %v", userList)
+	}
+	if _, err := client.GetUserList(); err == nil || err.Error() != api.UserNotModified {
+		t.Fatalf("empty delta should not modify the list: %v", err)
+	}
+	if versions[0] != "" || versions[1] != "1" || versions[2] != "2" {
+		t.Fatalf("unexpected versions sent: %v", versions)
+	}
+}
+
 func TestReportReportUserTraffic(t *testing.T) {
 	client := CreateClient()
 	userList, err := client.GetUserList()
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// onlineStateMaxAge is how long the saved online counts stay meaningful,
+// the panels forget the devices not reported for longer than that
+const onlineStateMaxAge = 10 * time.Minute
+
+// OnlineState persists the online device counts last reported by a client,
+// so the device limit math is right from the first user sync after a restart
+type OnlineState struct {
+	path string
+}
+
+type onlineStateFile struct {
+	Online  map[int]int // Key: UID, value: online device count
+	SavedAt time.Time
+}
+
+// NewOnlineState creates the state of the node described by config, kept in
+// its DataDir. Without a DataDir the state is not persisted.
+func NewOnlineState(config *Config) *OnlineState {
+	if config.DataDir == "" {
+		return &OnlineState{}
+	}
+	host := fnv.New32a()
+	host.Write([]byte(config.APIHost))
+	name := fmt.Sprintf("online_%s_%d_%08x.json", config.NodeType, config.NodeID, host.Sum32())
+	return &OnlineState{path: filepath.Join(config.DataDir, name)}
+}
+
+// Load returns the saved online counts, empty if there are none or they are stale
+func (s *OnlineState) Load() map[int]int {
+	online := make(map[int]int)
+	if s.path == "" {
+		return online
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Read online state failed: %s", err)
+		}
+		return online
+	}
+	state := &onlineStateFile{}
+	if err := json.Unmarshal(data, state); err != nil {
+		log.Printf("Parse online state %s failed: %s", s.path, err)
+		return online
+	}
+	if time.Since(state.SavedAt) > onlineStateMaxAge || state.Online == nil {
+		return online
+	}
+	return state.Online
+}
+
+// Save replaces the saved online counts
+func (s *OnlineState) Save(online map[int]int) {
+	if s.path == "" {
+		return
+	}
+	if err := s.save(online); err != nil {
+		log.Printf("Save online state failed: %s", err)
+	}
+}
+
+func (s *OnlineState) save(online map[int]int) error {
+	data, err := json.Marshal(&onlineStateFile{Online: online, SavedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
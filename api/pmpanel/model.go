@@ -49,8 +49,10 @@ type SystemLoad struct {
 
 // OnlineUser is the data structure of online user
 type OnlineUser struct {
-	UID int    `json:"user_id"`
-	IP  string `json:"ip"`
+	UID       int    `json:"user_id"`
+	IP        string `json:"ip"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
 }
 
 // UserTraffic is the data structure of traffic
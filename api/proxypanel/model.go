@@ -59,8 +59,10 @@ type NodeStatus struct {
 }
 
 type NodeOnline struct {
-	UID int    `json:"uid"`
-	IP  string `json:"ip"`
+	UID       int    `json:"uid"`
+	IP        string `json:"ip"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
 }
 
 type VMessUser struct {
@@ -81,12 +83,6 @@ type SSUser struct {
 	SpeedLimit uint64 `json:"speed_limit"`
 }
 
-type UserTraffic struct {
-	UID      int   `json:"uid"`
-	Upload   int64 `json:"upload"`
-	Download int64 `json:"download"`
-}
-
 type NodeRule struct {
 	Mode  string         `json:"mode"`
 	Rules []NodeRuleItem `json:"rules"`
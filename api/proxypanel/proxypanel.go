@@ -29,13 +29,21 @@ type APIClient struct {
 	SpeedLimit    float64
 	DeviceLimit   int
 	LocalRuleList []api.DetectRule
+	breaker       *api.Breaker
+	health        *api.SyncHealth
 }
 
 // New creat a api instance
 func New(apiConfig *api.Config) *APIClient {
 
 	client := resty.New()
-	client.SetRetryCount(3)
+	api.SetRetryPolicy(client, apiConfig)
+	api.SetConnection(client, apiConfig)
+	api.SetResolver(client, apiConfig)
+	api.LimitResponseSize(client, apiConfig)
+	api.RecordResponses(client, apiConfig)
+	breaker := api.NewBreaker(client, apiConfig)
+	health := api.NewSyncHealth(client)
 	if apiConfig.Timeout > 0 {
 		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
 	} else {
@@ -48,6 +56,9 @@ func New(apiConfig *api.Config) *APIClient {
 			log.Print(v.Err)
 		}
 	})
+	if apiConfig.EnableGzip {
+		api.EnableGzipRequest(client)
+	}
 	client.SetBaseURL(apiConfig.APIHost)
 	// Read local rule list
 	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
@@ -62,6 +73,8 @@ func New(apiConfig *api.Config) *APIClient {
 		SpeedLimit:    apiConfig.SpeedLimit,
 		DeviceLimit:   apiConfig.DeviceLimit,
 		LocalRuleList: localRuleList,
+		breaker:       breaker,
+		health:        health,
 	}
 	return apiClient
 }
@@ -84,14 +97,19 @@ func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
 
 		// read line by line
 		for fileScanner.Scan() {
+			pattern, err := regexp.Compile(fileScanner.Text())
+			if err != nil {
+				log.Printf("Skip invalid rule %q: %s", fileScanner.Text(), err)
+				continue
+			}
 			LocalRuleList = append(LocalRuleList, api.DetectRule{
 				ID:      -1,
-				Pattern: regexp.MustCompile(fileScanner.Text()),
+				Pattern: pattern,
 			})
 		}
 		// handle first encountered error while reading
 		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
+			log.Printf("Error while reading file: %s", err)
 			return
 		}
 
@@ -106,6 +124,16 @@ func (c *APIClient) Describe() api.ClientInfo {
 	return api.ClientInfo{APIHost: c.APIHost, NodeID: c.NodeID, Key: c.Key, NodeType: c.NodeType}
 }
 
+// Breaker returns the circuit breaker of the client, nil if it has none
+func (c *APIClient) Breaker() *api.Breaker {
+	return c.breaker
+}
+
+// Health returns the health of the endpoints of the panel called so far
+func (c *APIClient) Health() []api.EndpointHealth {
+	return c.health.Endpoints()
+}
+
 // Debug set the client debug for client
 func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
@@ -128,9 +156,8 @@ func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (
 		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
 	}
 
-	if res.StatusCode() > 400 {
-		body := res.Body()
-		return nil, fmt.Errorf("request %s failed: %s, %s", c.assembleURL(path), string(body), err)
+	if err := api.CheckStatus(res, c.assembleURL(path)); err != nil {
+		return nil, err
 	}
 	response := res.Result().(*Response)
 
@@ -277,7 +304,7 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 
 	data := make([]NodeOnline, len(*onlineUserList))
 	for i, user := range *onlineUserList {
-		data[i] = NodeOnline{UID: user.UID, IP: user.IP}
+		data[i] = NodeOnline{UID: user.UID, IP: user.IP, FirstSeen: user.FirstSeen, LastSeen: user.LastSeen}
 	}
 
 	res, err := c.createCommonRequest().
@@ -296,6 +323,12 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 
 // ReportUserTraffic reports the user traffic
 func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+	return c.ReportUserTrafficWithKey("", userTraffic)
+}
+
+// ReportUserTrafficWithKey reports the user traffic, tagged with the
+// idempotency key unless it is empty
+func (c *APIClient) ReportUserTrafficWithKey(key string, userTraffic *[]api.UserTraffic) error {
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -308,15 +341,13 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 		return fmt.Errorf("unsupported Node type: %s", c.NodeType)
 	}
 
-	data := make([]UserTraffic, len(*userTraffic))
-	for i, traffic := range *userTraffic {
-		data[i] = UserTraffic{
-			UID:      traffic.UID,
-			Upload:   traffic.Upload,
-			Download: traffic.Download}
-	}
+	body := api.GetTrafficBody()
+	defer api.PutTrafficBody(body)
+	*body = api.AppendTrafficList(*body, *userTraffic, "uid", "upload", "download")
 	res, err := c.createCommonRequest().
-		SetBody(data).
+		SetHeaders(api.IdempotencyHeaders(key)).
+		SetHeader("Content-Type", "application/json").
+		SetBody(*body).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Post(path)
@@ -377,6 +408,17 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	return &ruleList, nil
 }
 
+// ReportAlive posts the alive report of the node to path
+func (c *APIClient) ReportAlive(path string, alive map[string]any) error {
+	res, err := c.createCommonRequest().
+		SetBody(alive).
+		SetResult(&Response{}).
+		ForceContentType("application/json").
+		Post(path)
+	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
 // ReportIllegal reports the user illegal behaviors
 func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 	var path string
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// RecordedHeaders are the headers of the responses kept in a Recording
+var RecordedHeaders = []string{"Content-Type", "ETag", "Last-Modified", "Retry-After"}
+
+// Recording is a response of the panel recorded to the RecordDir of a
+// client, for the replay package to serve it again
+type Recording struct {
+	Time       int64             `json:"Time"` // Unix time it was answered at
+	Method     string            `json:"Method"`
+	Path       string            `json:"Path"`
+	Query      string            `json:"Query"`              // Encoded, without the params holding the ApiKey
+	Redacted   []string          `json:"Redacted,omitempty"` // The params left out of Query for holding the ApiKey
+	StatusCode int               `json:"StatusCode"`
+	Header     map[string]string `json:"Header,omitempty"` // Of RecordedHeaders
+	Body       string            `json:"Body"`
+}
+
+// Key returns what the requests answered by the recording have in common
+func (r *Recording) Key() string {
+	return r.Method + " " + r.Path + "?" + r.Query
+}
+
+// RecordResponses makes the client save each response of the panel to the
+// RecordDir of config, if set, as a Recording in its own JSON file. The ApiKey
+// is left out, the rest of the response is kept as is. It must be called last
+// of the functions wrapping the transport, to record what the client gets.
+func RecordResponses(client *resty.Client, config *Config) {
+	if config.RecordDir == "" {
+		return
+	}
+	if err := os.MkdirAll(config.RecordDir, 0o700); err != nil {
+		log.Printf("Create record dir %s failed: %s", config.RecordDir, err)
+		return
+	}
+	base := client.GetClient().Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.SetTransport(&recordTransport{base: base, dir: config.RecordDir, key: config.Key})
+}
+
+type recordTransport struct {
+	base http.RoundTripper
+	dir  string
+	key  string
+	seq  atomic.Uint64
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// The body is bounded by the MaxResponseSize of the transport below
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if err := t.save(req, res, body); err != nil {
+		log.Printf("Record response of %s failed: %s", req.URL.Path, err)
+	}
+	return res, nil
+}
+
+func (t *recordTransport) save(req *http.Request, res *http.Response, body []byte) error {
+	query, redacted := RedactQuery(req.URL.Query(), t.key)
+	r := Recording{
+		Time:       time.Now().Unix(),
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Query:      query,
+		Redacted:   redacted,
+		StatusCode: res.StatusCode,
+		Header:     make(map[string]string),
+		Body:       string(body),
+	}
+	for _, h := range RecordedHeaders {
+		if v := res.Header.Get(h); v != "" {
+			r.Header[h] = v
+		}
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Named so they sort in the order they were answered in
+	name := fmt.Sprintf("%d-%06d-%s.json", time.Now().UnixNano(), t.seq.Add(1), strings.ToLower(req.Method))
+	return os.WriteFile(filepath.Join(t.dir, name), data, 0o600)
+}
+
+// RedactQuery returns the encoded query without the params holding key, and
+// the names of those params
+func RedactQuery(query url.Values, key string) (string, []string) {
+	var redacted []string
+	for name, values := range query {
+		for _, v := range values {
+			if key != "" && v == key {
+				redacted = append(redacted, name)
+				query.Del(name)
+				break
+			}
+		}
+	}
+	slices.Sort(redacted)
+	return query.Encode(), redacted
+}
@@ -0,0 +1,96 @@
+// Package replay serves the panel responses recorded to a RecordDir as a fake
+// panel, for reproducible tests and the offline debugging of the parsing of
+// a panel
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// Handler answers each request with the recordings made for the same method,
+// path and query, the ApiKey aside. The recordings for a request are
+// answered in the order they were made in, the last one again once they
+// are all used, so a client sees the panel change like it did.
+type Handler struct {
+	access     sync.Mutex
+	recordings map[string][]*api.Recording // By Key
+	redacted   map[string][]string         // Params holding the ApiKey, by path
+	served     map[string]int              // Recordings answered, by Key
+}
+
+// Load reads the recordings of dir
+func Load(dir string) (*Handler, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recording in %s", dir)
+	}
+	// The names sort in the order the recordings were made in
+	sort.Strings(files)
+	h := &Handler{
+		recordings: make(map[string][]*api.Recording),
+		redacted:   make(map[string][]string),
+		served:     make(map[string]int),
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		r := new(api.Recording)
+		if err := json.Unmarshal(data, r); err != nil {
+			return nil, fmt.Errorf("read recording %s failed: %s", file, err)
+		}
+		h.recordings[r.Key()] = append(h.recordings[r.Key()], r)
+		if len(r.Redacted) > 0 {
+			h.redacted[r.Path] = r.Redacted
+		}
+	}
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	for _, name := range h.redacted[req.URL.Path] {
+		query.Del(name)
+	}
+	key := (&api.Recording{Method: req.Method, Path: req.URL.Path, Query: query.Encode()}).Key()
+	h.access.Lock()
+	recordings := h.recordings[key]
+	n := h.served[key]
+	if n < len(recordings)-1 {
+		h.served[key]++
+	}
+	h.access.Unlock()
+	if len(recordings) == 0 {
+		http.Error(w, "no recording for "+key, http.StatusNotFound)
+		return
+	}
+	r := recordings[n]
+	for name, value := range r.Header {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(r.StatusCode)
+	w.Write([]byte(r.Body))
+}
+
+// NewServer starts a fake panel serving the recordings of dir, to be closed
+// once done with
+func NewServer(dir string) (*httptest.Server, error) {
+	h, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	return httptest.NewServer(h), nil
+}
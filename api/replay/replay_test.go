@@ -0,0 +1,72 @@
+package replay_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/replay"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var version atomic.Int32
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("ETag", "v"+string(rune('0'+version.Add(1))))
+		w.Write([]byte(`{"users":[]}`))
+	}))
+	defer panel.Close()
+	dir := t.TempDir()
+	get := func(host, token string) *resty.Response {
+		config := &api.Config{APIHost: host, Key: token, RecordDir: dir}
+		client := resty.New().SetBaseURL(host).SetQueryParams(map[string]string{"node_id": "1", "token": token})
+		if token == "secret" {
+			api.RecordResponses(client, config)
+		}
+		res, err := client.R().Get("/api/v1/server/UniProxy/user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	get(panel.URL, "secret")
+	get(panel.URL, "secret")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 2 {
+		t.Fatalf("%d recordings, want 2", len(files))
+	}
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		if strings.Contains(string(data), "secret") {
+			t.Errorf("%s holds the ApiKey", file)
+		}
+	}
+
+	server, err := replay.NewServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// Answered in order with any key, then the last one again
+	for _, etag := range []string{"v1", "v2", "v2"} {
+		res := get(server.URL, "other")
+		if res.StatusCode() != http.StatusOK || res.String() != `{"users":[]}` || res.Header().Get("ETag") != etag {
+			t.Errorf("got %d %s with ETag %s, want ETag %s", res.StatusCode(), res.String(), res.Header().Get("ETag"), etag)
+		}
+	}
+	res, _ := resty.New().R().Get(server.URL + "/api/v1/server/UniProxy/config")
+	if res.StatusCode() != http.StatusNotFound {
+		t.Errorf("got %d for a request not recorded", res.StatusCode())
+	}
+}
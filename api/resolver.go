@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ResolverConfig controls how the ApiHost is resolved, for the nodes whose
+// system resolver is unreliable or poisoned
+type ResolverConfig struct {
+	DNSServer string `mapstructure:"DNSServer"` // IP or IP:port of the DNS server asked instead of the system one, port 53 if none
+	StaticIP  string `mapstructure:"StaticIP"`  // Dial this IP, the ApiHost is not resolved
+	Strategy  string `mapstructure:"Strategy"`  // AsIs, UseIPv4, UseIPv6, PreferIPv4 or PreferIPv6
+}
+
+var resolverStrategies = []string{"", "AsIs", "UseIPv4", "UseIPv6", "PreferIPv4", "PreferIPv6"}
+
+// Check returns an error if the config is invalid
+func (r *ResolverConfig) Check() error {
+	if r == nil {
+		return nil
+	}
+	if !slices.Contains(resolverStrategies, r.Strategy) {
+		return fmt.Errorf("unknown resolver strategy %s, use one of %v", r.Strategy, resolverStrategies[1:])
+	}
+	if r.StaticIP != "" && net.ParseIP(r.StaticIP) == nil {
+		return fmt.Errorf("resolver StaticIP %s is not an IP", r.StaticIP)
+	}
+	if r.DNSServer != "" && net.ParseIP(dnsServerHost(r.DNSServer)) == nil {
+		return fmt.Errorf("resolver DNSServer %s is not an IP or IP:port", r.DNSServer)
+	}
+	return nil
+}
+
+// SetResolver makes the client resolve the ApiHost of config by its Resolver.
+// Only the address dialed changes, TLS still checks the certificate of the
+// ApiHost and sends it as SNI. It must be called before the transport of the
+// client is wrapped, and the Resolver checked before.
+func SetResolver(client *resty.Client, config *Config) {
+	r := config.Resolver
+	if r == nil || (r.DNSServer == "" && r.StaticIP == "" && (r.Strategy == "" || r.Strategy == "AsIs")) {
+		return
+	}
+	transport, ok := client.GetClient().Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	apiHost := config.APIHost
+	if u, err := url.Parse(config.APIHost); err == nil {
+		apiHost = u.Hostname()
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	resolver := net.DefaultResolver
+	if r.DNSServer != "" {
+		server := r.DNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = dialer.DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		// The other hosts, like a proxy in between, are dialed as usual
+		if err != nil || host != apiHost {
+			return dial(ctx, network, address)
+		}
+		ips, err := r.lookup(ctx, resolver, host)
+		if err != nil {
+			return nil, err
+		}
+		// Each address is tried in turn, like the default dialer does
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// lookup returns the addresses to dial for host, in the order of the strategy
+func (r *ResolverConfig) lookup(ctx context.Context, resolver *net.Resolver, host string) ([]net.IP, error) {
+	if r.StaticIP != "" {
+		return []net.IP{net.ParseIP(r.StaticIP)}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	network := "ip"
+	switch r.Strategy {
+	case "UseIPv4":
+		network = "ip4"
+	case "UseIPv6":
+		network = "ip6"
+	}
+	ips, err := resolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address of %s", host)
+	}
+	switch r.Strategy {
+	case "PreferIPv4":
+		slices.SortStableFunc(ips, ipv4First)
+	case "PreferIPv6":
+		slices.SortStableFunc(ips, func(a, b net.IP) int { return ipv4First(b, a) })
+	}
+	return ips, nil
+}
+
+// ipv4First orders the IPv4 addresses before the IPv6 ones
+func ipv4First(a, b net.IP) int {
+	a4, b4 := a.To4() != nil, b.To4() != nil
+	switch {
+	case a4 && !b4:
+		return -1
+	case !a4 && b4:
+		return 1
+	}
+	return 0
+}
+
+// dnsServerHost returns the host of a DNSServer, with or without a port
+func dnsServerHost(server string) string {
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		return host
+	}
+	return server
+}
@@ -0,0 +1,55 @@
+package api_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+func TestResolverStaticIP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	config := &api.Config{
+		APIHost:  "http://panel.invalid:" + port,
+		Resolver: &api.ResolverConfig{StaticIP: "127.0.0.1"},
+	}
+	if err := config.Resolver.Check(); err != nil {
+		t.Fatal(err)
+	}
+	client := resty.New().SetBaseURL(config.APIHost)
+	api.SetResolver(client, config)
+	res, err := client.R().Get("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The host is kept, only the address dialed changes
+	if got := res.String(); got != "panel.invalid:"+port {
+		t.Errorf("got host %s", got)
+	}
+}
+
+func TestResolverCheck(t *testing.T) {
+	for _, test := range []struct {
+		config *api.ResolverConfig
+		valid  bool
+	}{
+		{nil, true},
+		{&api.ResolverConfig{DNSServer: "1.1.1.1", Strategy: "PreferIPv4"}, true},
+		{&api.ResolverConfig{DNSServer: "[2606:4700::1111]:53", Strategy: "UseIPv6"}, true},
+		{&api.ResolverConfig{DNSServer: "dns.google"}, false},
+		{&api.ResolverConfig{StaticIP: "panel.example.com"}, false},
+		{&api.ResolverConfig{Strategy: "IPv4"}, false},
+	} {
+		if err := test.config.Check(); (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %t", test.config, err, test.valid)
+		}
+	}
+}
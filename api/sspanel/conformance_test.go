@@ -0,0 +1,28 @@
+package sspanel_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/apitest"
+	"github.com/qtai2901/new_xrayr/api/sspanel"
+)
+
+func TestConformance(t *testing.T) {
+	apitest.Run(t, apitest.Panel{
+		New: func(config *api.Config) api.API { return sspanel.New(config) },
+		NodeInfo: apitest.Endpoint{
+			Path: "/mod_mu/nodes/1/info",
+			Body: `{"ret":1,"data":{"version":"2023.3","custom_config":{"offset_port_node":"10086","network":"tcp"}}}`,
+		},
+		UserList: apitest.Endpoint{
+			Path: "/mod_mu/users",
+			Body: `{"ret":1,"data":[
+				{"id":1,"uuid":"7f2b7cbb-0e0b-4b56-9b1a-2b5a3f7c1a01","passwd":"apitest-passwd-1"},
+				{"id":2,"uuid":"7f2b7cbb-0e0b-4b56-9b1a-2b5a3f7c1a02","passwd":"apitest-passwd-2"}]}`,
+		},
+		Traffic: apitest.Endpoint{Method: http.MethodPost, Path: "/mod_mu/users/traffic", Body: `{"ret":1,"data":"ok"}`},
+		Online:  apitest.Endpoint{Method: http.MethodPost, Path: "/mod_mu/users/aliveip", Body: `{"ret":1,"data":"ok"}`},
+	})
+}
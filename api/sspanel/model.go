@@ -66,15 +66,10 @@ type SystemLoad struct {
 
 // OnlineUser is the data structure of online user
 type OnlineUser struct {
-	UID int    `json:"user_id"`
-	IP  string `json:"ip"`
-}
-
-// UserTraffic is the data structure of traffic
-type UserTraffic struct {
-	UID      int   `json:"user_id"`
-	Upload   int64 `json:"u"`
-	Download int64 `json:"d"`
+	UID       int    `json:"user_id"`
+	IP        string `json:"ip"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
 }
 
 type RuleItem struct {
@@ -40,16 +40,25 @@ type APIClient struct {
 	DisableCustomConfig bool
 	LocalRuleList       []api.DetectRule
 	LastReportOnline    map[int]int
+	onlineState         *api.OnlineState
 	access              sync.Mutex
 	version             string
 	eTags               map[string]string
+	breaker             *api.Breaker
+	health              *api.SyncHealth
 }
 
 // New create api instance
 func New(apiConfig *api.Config) *APIClient {
 	client := resty.New()
 
-	client.SetRetryCount(3)
+	api.SetRetryPolicy(client, apiConfig)
+	api.SetConnection(client, apiConfig)
+	api.SetResolver(client, apiConfig)
+	api.LimitResponseSize(client, apiConfig)
+	api.RecordResponses(client, apiConfig)
+	breaker := api.NewBreaker(client, apiConfig)
+	health := api.NewSyncHealth(client)
 	if apiConfig.Timeout > 0 {
 		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
 	} else {
@@ -63,6 +72,9 @@ func New(apiConfig *api.Config) *APIClient {
 			log.Print(v.Err)
 		}
 	})
+	if apiConfig.EnableGzip {
+		api.EnableGzipRequest(client)
+	}
 
 	client.SetBaseURL(apiConfig.APIHost)
 	// Create Key for each requests
@@ -72,6 +84,8 @@ func New(apiConfig *api.Config) *APIClient {
 	// Read local rule list
 	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
 
+	onlineState := api.NewOnlineState(apiConfig)
+
 	return &APIClient{
 		client:              client,
 		NodeID:              apiConfig.NodeID,
@@ -84,8 +98,11 @@ func New(apiConfig *api.Config) *APIClient {
 		DeviceLimit:         apiConfig.DeviceLimit,
 		LocalRuleList:       localRuleList,
 		DisableCustomConfig: apiConfig.DisableCustomConfig,
-		LastReportOnline:    make(map[int]int),
+		LastReportOnline:    onlineState.Load(),
+		onlineState:         onlineState,
 		eTags:               make(map[string]string),
+		breaker:             breaker,
+		health:              health,
 	}
 }
 
@@ -107,14 +124,19 @@ func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
 
 		// read line by line
 		for fileScanner.Scan() {
+			pattern, err := regexp.Compile(fileScanner.Text())
+			if err != nil {
+				log.Printf("Skip invalid rule %q: %s", fileScanner.Text(), err)
+				continue
+			}
 			LocalRuleList = append(LocalRuleList, api.DetectRule{
 				ID:      -1,
-				Pattern: regexp.MustCompile(fileScanner.Text()),
+				Pattern: pattern,
 			})
 		}
 		// handle first encountered error while reading
 		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
+			log.Printf("Error while reading file: %s", err)
 			return
 		}
 	}
@@ -127,6 +149,16 @@ func (c *APIClient) Describe() api.ClientInfo {
 	return api.ClientInfo{APIHost: c.APIHost, NodeID: c.NodeID, Key: c.Key, NodeType: c.NodeType}
 }
 
+// Breaker returns the circuit breaker of the client, nil if it has none
+func (c *APIClient) Breaker() *api.Breaker {
+	return c.breaker
+}
+
+// Health returns the health of the endpoints of the panel called so far
+func (c *APIClient) Health() []api.EndpointHealth {
+	return c.health.Endpoints()
+}
+
 // Debug set the client debug for client
 func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
@@ -141,9 +173,8 @@ func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (
 		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
 	}
 
-	if res.StatusCode() > 400 {
-		body := res.Body()
-		return nil, fmt.Errorf("request %s failed: %s, %v", c.assembleURL(path), string(body), err)
+	if err := api.CheckStatus(res, c.assembleURL(path)); err != nil {
+		return nil, err
 	}
 	response := res.Result().(*Response)
 
@@ -154,6 +185,22 @@ func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (
 	return response, nil
 }
 
+// decodeResponse decodes the JSON body of a response requested with
+// SetDoNotParseResponse into v as it is read, so the body is neither held in
+// memory nor parsed twice
+func (c *APIClient) decodeResponse(res *resty.Response, path string, err error, v any) error {
+	if err != nil {
+		return fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
+	}
+	if err := api.CheckStatus(res, c.assembleURL(path)); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(res.RawBody()).Decode(v); err != nil {
+		return fmt.Errorf("ret of %s invalid: %s", c.assembleURL(path), err)
+	}
+	return nil
+}
+
 // GetNodeInfo will pull NodeInfo Config from ssPanel
 func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 	path := fmt.Sprintf("/mod_mu/nodes/%d/info", c.NodeID)
@@ -228,9 +275,11 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 	res, err := c.client.R().
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
 		SetHeader("If-None-Match", c.eTags["users"]).
-		SetResult(&Response{}).
-		ForceContentType("application/json").
+		SetDoNotParseResponse(true).
 		Get(path)
+	if res != nil && res.RawBody() != nil {
+		defer res.RawBody().Close()
+	}
 	// Etag identifier for a specific version of a resource. StatusCode = 304 means no changed
 	if res.StatusCode() == 304 {
 		return nil, errors.New(api.UserNotModified)
@@ -240,19 +289,19 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 		c.eTags["users"] = res.Header().Get("ETag")
 	}
 
-	response, err := c.parseResponse(res, path, err)
-	if err != nil {
+	var response struct {
+		Ret  uint           `json:"ret"`
+		Data []UserResponse `json:"data"`
+	}
+	if err := c.decodeResponse(res, path, err, &response); err != nil {
 		return nil, err
 	}
-
-	userListResponse := new([]UserResponse)
-
-	if err := json.Unmarshal(response.Data, userListResponse); err != nil {
-		return nil, fmt.Errorf("unmarshal %s failed: %s", reflect.TypeOf(userListResponse), err)
+	if response.Ret != 1 {
+		return nil, fmt.Errorf("ret %d of %s invalid", response.Ret, c.assembleURL(path))
 	}
-	userList, err := c.ParseUserListResponse(userListResponse)
+	userList, err := c.ParseUserListResponse(&response.Data)
 	if err != nil {
-		res, _ := json.Marshal(userListResponse)
+		res, _ := json.Marshal(response.Data)
 		return nil, fmt.Errorf("parse user list failed: %s", string(res))
 	}
 	return userList, nil
@@ -290,7 +339,7 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 	reportOnline := make(map[int]int)
 	data := make([]OnlineUser, len(*onlineUserList))
 	for i, user := range *onlineUserList {
-		data[i] = OnlineUser{UID: user.UID, IP: user.IP}
+		data[i] = OnlineUser{UID: user.UID, IP: user.IP, FirstSeen: user.FirstSeen, LastSeen: user.LastSeen}
 		if _, ok := reportOnline[user.UID]; ok {
 			reportOnline[user.UID]++
 		} else {
@@ -298,6 +347,7 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 		}
 	}
 	c.LastReportOnline = reportOnline // Update LastReportOnline
+	c.onlineState.Save(reportOnline)
 
 	postData := &PostData{Data: data}
 	path := fmt.Sprintf("/mod_mu/users/aliveip")
@@ -318,19 +368,24 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 
 // ReportUserTraffic reports the user traffic
 func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+	return c.ReportUserTrafficWithKey("", userTraffic)
+}
 
-	data := make([]UserTraffic, len(*userTraffic))
-	for i, traffic := range *userTraffic {
-		data[i] = UserTraffic{
-			UID:      traffic.UID,
-			Upload:   traffic.Upload,
-			Download: traffic.Download}
-	}
-	postData := &PostData{Data: data}
+// ReportUserTrafficWithKey reports the user traffic, tagged with the
+// idempotency key unless it is empty
+func (c *APIClient) ReportUserTrafficWithKey(key string, userTraffic *[]api.UserTraffic) error {
+
+	body := api.GetTrafficBody()
+	defer api.PutTrafficBody(body)
+	*body = append(*body, `{"data":`...)
+	*body = api.AppendTrafficList(*body, *userTraffic, "user_id", "u", "d")
+	*body = append(*body, '}')
 	path := "/mod_mu/users/traffic"
 	res, err := c.client.R().
+		SetHeaders(api.IdempotencyHeaders(key)).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
-		SetBody(postData).
+		SetHeader("Content-Type", "application/json").
+		SetBody(*body).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Post(path)
@@ -381,6 +436,17 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	return &ruleList, nil
 }
 
+// ReportAlive posts the alive report of the node to path
+func (c *APIClient) ReportAlive(path string, alive map[string]any) error {
+	res, err := c.client.R().
+		SetBody(alive).
+		SetResult(&Response{}).
+		ForceContentType("application/json").
+		Post(path)
+	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
 // ReportIllegal reports the user illegal behaviors
 func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 
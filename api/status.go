@@ -0,0 +1,174 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Classes of the error statuses answered by the panel, for errors.Is
+var (
+	ErrUnauthorized = errors.New("refused by the panel, check ApiKey")                         // 401 and 403, not retried
+	ErrNotFound     = errors.New("not found on the panel, check ApiHost, NodeID and NodeType") // 404, not retried
+	ErrRateLimited  = errors.New("rate limited by the panel")                                  // 429, retried after Retry-After
+	ErrServer       = errors.New("panel failed")                                               // 5xx, retried with backoff
+	ErrBadRequest   = errors.New("bad request")                                                // The other 4xx, not retried
+)
+
+const (
+	defaultRetryCount = 3
+	defaultRetryWait  = 100 * time.Millisecond
+	// Longest wait between retries, the request fails at once for a longer
+	// Retry-After
+	defaultRetryMaxWait = 10 * time.Second
+	// Part of the body of an error status kept in StatusError
+	maxErrorBody = 512
+)
+
+// RetryConfig is the retry policy of the calls to the panel
+type RetryConfig struct {
+	Count   int    `mapstructure:"Count"`   // Retries of a failed call, -1 to never retry
+	Wait    int    `mapstructure:"Wait"`    // Millisecond before the first retry, doubled at each next one
+	MaxWait int    `mapstructure:"MaxWait"` // Second, the longest wait between retries and the longest Retry-After waited for
+	Reports string `mapstructure:"Reports"` // The reports (POST) retried: All, Idempotent (only the ones with an Idempotency-Key) or None
+}
+
+var retryReports = []string{"", "All", "Idempotent", "None"}
+
+// Check returns an error if the config is invalid
+func (r *RetryConfig) Check() error {
+	if r == nil {
+		return nil
+	}
+	if !slices.Contains(retryReports, r.Reports) {
+		return fmt.Errorf("unknown retry Reports %s, use one of %v", r.Reports, retryReports[1:])
+	}
+	return nil
+}
+
+// StatusError is an error status answered by the panel
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // Asked for with Retry-After, 0 if not
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request %s failed: %d, %s: %s", e.URL, e.StatusCode, e.Unwrap(), e.Body)
+}
+
+// Unwrap returns the class of the status
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode >= 500:
+		return ErrServer
+	default:
+		return ErrBadRequest
+	}
+}
+
+// CheckStatus returns a *StatusError if res has an error status, 400 and
+// above. The body of a response not parsed by resty is read from its raw body.
+func CheckStatus(res *resty.Response, url string) error {
+	if res.StatusCode() < 400 {
+		return nil
+	}
+	body := res.Body()
+	if len(body) == 0 && res.RawBody() != nil {
+		body, _ = io.ReadAll(io.LimitReader(res.RawBody(), maxErrorBody))
+	}
+	if len(body) > maxErrorBody {
+		body = body[:maxErrorBody]
+	}
+	return &StatusError{
+		URL:        url,
+		StatusCode: res.StatusCode(),
+		Body:       string(body),
+		RetryAfter: retryAfter(res),
+	}
+}
+
+// SetRetryPolicy makes the client retry only what may succeed later, by the
+// Retry of config: the failed connections and the 5xx with backoff, and the
+// 429 after the wait asked for by the panel. A report is only retried if
+// Reports allows it, the panel may have counted the one that failed.
+func SetRetryPolicy(client *resty.Client, config *Config) {
+	var r RetryConfig
+	if config.Retry != nil {
+		r = *config.Retry
+	}
+	count, wait, maxWait := defaultRetryCount, defaultRetryWait, defaultRetryMaxWait
+	if r.Count != 0 {
+		count = max(r.Count, 0)
+	}
+	if r.Wait > 0 {
+		wait = time.Duration(r.Wait) * time.Millisecond
+	}
+	if r.MaxWait > 0 {
+		maxWait = time.Duration(r.MaxWait) * time.Second
+	}
+	client.SetRetryCount(count)
+	client.SetRetryWaitTime(wait)
+	client.SetRetryMaxWaitTime(maxWait)
+	client.SetRetryAfter(func(_ *resty.Client, res *resty.Response) (time.Duration, error) {
+		return retryAfter(res), nil
+	})
+	client.AddRetryCondition(func(res *resty.Response, err error) bool {
+		retry := err != nil && !errors.Is(err, ErrResponseTooLarge)
+		if res != nil && err == nil {
+			code := res.StatusCode()
+			retry = (code == http.StatusTooManyRequests || code >= 500) && retryAfter(res) <= maxWait
+		}
+		if retry && res != nil && res.Request != nil {
+			retry = retrySafe(res.Request, r.Reports)
+		}
+		// The body of a response not parsed by resty is left to be closed
+		if retry && res != nil && res.RawBody() != nil {
+			res.RawBody().Close()
+		}
+		return retry
+	})
+}
+
+// retrySafe reports whether req may be sent again under the Reports policy
+func retrySafe(req *resty.Request, reports string) bool {
+	if req.Method != http.MethodPost {
+		return true
+	}
+	switch reports {
+	case "None":
+		return false
+	case "Idempotent":
+		return req.Header.Get(IdempotencyKeyHeader) != ""
+	}
+	return true
+}
+
+// retryAfter returns the wait asked for by the Retry-After of res, in seconds
+// or as a date, 0 if there is none
+func retryAfter(res *resty.Response) time.Duration {
+	value := res.Header().Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+package api_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+func TestStatusRetry(t *testing.T) {
+	for _, test := range []struct {
+		status   int
+		header   string
+		class    error
+		attempts int32
+	}{
+		{http.StatusBadRequest, "", api.ErrBadRequest, 1},
+		{http.StatusUnauthorized, "", api.ErrUnauthorized, 1},
+		{http.StatusForbidden, "", api.ErrUnauthorized, 1},
+		{http.StatusNotFound, "", api.ErrNotFound, 1},
+		{http.StatusTooManyRequests, "1", api.ErrRateLimited, 3},
+		{http.StatusTooManyRequests, "3600", api.ErrRateLimited, 1},
+		{http.StatusBadGateway, "", api.ErrServer, 3},
+	} {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			if test.header != "" {
+				w.Header().Set("Retry-After", test.header)
+			}
+			w.WriteHeader(test.status)
+			w.Write([]byte("failed"))
+		}))
+		client := resty.New()
+		api.SetRetryPolicy(client, &api.Config{Retry: &api.RetryConfig{Count: 2}})
+		res, err := client.R().Get(server.URL)
+		if err == nil {
+			err = api.CheckStatus(res, server.URL)
+		}
+		server.Close()
+
+		var statusErr *api.StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != test.status || statusErr.Body != "failed" {
+			t.Errorf("%d: got %v", test.status, err)
+		}
+		if !errors.Is(err, test.class) {
+			t.Errorf("%d: %v is not %v", test.status, err, test.class)
+		}
+		if n := attempts.Load(); n != test.attempts {
+			t.Errorf("%d Retry-After %q: %d attempts, want %d", test.status, test.header, n, test.attempts)
+		}
+	}
+}
+
+func TestStatusOK(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	res, err := resty.New().R().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.CheckStatus(res, server.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRetryReports(t *testing.T) {
+	for _, test := range []struct {
+		reports  string
+		key      string
+		attempts int32
+	}{
+		{"", "", 3},
+		{"None", "key", 1},
+		{"Idempotent", "", 1},
+		{"Idempotent", "key", 3},
+	} {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		client := resty.New()
+		api.SetRetryPolicy(client, &api.Config{Retry: &api.RetryConfig{Count: 2, Wait: 1, Reports: test.reports}})
+		client.R().SetHeaders(api.IdempotencyHeaders(test.key)).Post(server.URL)
+		server.Close()
+		if n := attempts.Load(); n != test.attempts {
+			t.Errorf("Reports %q with key %q: %d attempts, want %d", test.reports, test.key, n, test.attempts)
+		}
+	}
+	if err := (&api.RetryConfig{Reports: "Some"}).Check(); err == nil {
+		t.Error("unknown Reports accepted")
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// TimeoutConfig holds the timeouts of the calls to the panel by what they do,
+// Second. Each one bounds the whole call, its retries included. Timeout of
+// the ApiConfig applies to the calls left 0.
+type TimeoutConfig struct {
+	NodeInfo int `mapstructure:"NodeInfo"`
+	UserList int `mapstructure:"UserList"`
+	Traffic  int `mapstructure:"Traffic"`
+	Online   int `mapstructure:"Online"`
+	Alive    int `mapstructure:"Alive"`
+}
+
+// Timeouts are the timeouts of the calls of a client, from Timeout and
+// Timeouts of its Config
+type Timeouts struct {
+	TimeoutConfig
+	Default time.Duration // Of each attempt of the calls without their own
+	Client  time.Duration // Of each attempt, the longest timeout so it cuts no call short
+}
+
+func NewTimeouts(config *Config) *Timeouts {
+	t := &Timeouts{Default: defaultTimeout}
+	if config.Timeout > 0 {
+		t.Default = time.Duration(config.Timeout) * time.Second
+	}
+	if config.Timeouts != nil {
+		t.TimeoutConfig = *config.Timeouts
+	}
+	t.Client = t.Default
+	for _, seconds := range []int{t.NodeInfo, t.UserList, t.Traffic, t.Online, t.Alive} {
+		if timeout := time.Duration(seconds) * time.Second; timeout > t.Client {
+			t.Client = timeout
+		}
+	}
+	return t
+}
+
+// Context returns the context of a call given its timeout, Second. A call
+// without one is left to the client timeout, unless it was raised for
+// another call.
+func (t *Timeouts) Context(seconds int) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(seconds) * time.Second
+	if seconds <= 0 {
+		if t.Client == t.Default {
+			return context.WithCancel(context.Background())
+		}
+		timeout = t.Default
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
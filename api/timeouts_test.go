@@ -0,0 +1,36 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+func TestTimeouts(t *testing.T) {
+	timeouts := api.NewTimeouts(&api.Config{Timeout: 10, Timeouts: &api.TimeoutConfig{UserList: 60, Online: 5}})
+	if timeouts.Client != 60*time.Second {
+		t.Fatalf("client timeout %s, want 60s", timeouts.Client)
+	}
+	for seconds, want := range map[int]time.Duration{0: 10 * time.Second, 5: 5 * time.Second, 60: 60 * time.Second} {
+		ctx, cancel := timeouts.Context(seconds)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if !ok || time.Until(deadline) > want || time.Until(deadline) < want-time.Second {
+			t.Errorf("timeout of %d: deadline in %s, want %s", seconds, time.Until(deadline), want)
+		}
+	}
+}
+
+func TestTimeoutsDefault(t *testing.T) {
+	timeouts := api.NewTimeouts(&api.Config{})
+	if timeouts.Client != 5*time.Second {
+		t.Fatalf("client timeout %s, want 5s", timeouts.Client)
+	}
+	// Left to the client timeout, for each attempt
+	ctx, cancel := timeouts.Context(0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("context has a deadline")
+	}
+}
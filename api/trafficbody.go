@@ -0,0 +1,77 @@
+package api
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Bodies grown past it by a huge report are left to the GC instead of being
+// kept around in the pool
+const maxPooledTrafficBody = 4 << 20
+
+var trafficBodies = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 64<<10)
+		return &b
+	},
+}
+
+// GetTrafficBody returns an empty buffer for the JSON of a traffic report,
+// to be handed back with PutTrafficBody once the request is done
+func GetTrafficBody() *[]byte {
+	b := trafficBodies.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// PutTrafficBody hands a buffer of GetTrafficBody back for the next report
+func PutTrafficBody(b *[]byte) {
+	if cap(*b) > maxPooledTrafficBody {
+		return
+	}
+	trafficBodies.Put(b)
+}
+
+// AppendTrafficMap appends the traffic as {"uid": [upload, download], ...}
+func AppendTrafficMap(b []byte, userTraffic []UserTraffic) []byte {
+	b = append(b, '{')
+	for i, t := range userTraffic {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '"')
+		b = strconv.AppendInt(b, int64(t.UID), 10)
+		b = append(b, `":[`...)
+		b = strconv.AppendInt(b, t.Upload, 10)
+		b = append(b, ',')
+		b = strconv.AppendInt(b, t.Download, 10)
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// AppendTrafficList appends the traffic as [{uidKey: uid, uploadKey: upload,
+// downloadKey: download}, ...]. The keys are written as they are, they must
+// not need escaping.
+func AppendTrafficList(b []byte, userTraffic []UserTraffic, uidKey, uploadKey, downloadKey string) []byte {
+	b = append(b, '[')
+	for i, t := range userTraffic {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, `{"`...)
+		b = append(b, uidKey...)
+		b = append(b, `":`...)
+		b = strconv.AppendInt(b, int64(t.UID), 10)
+		b = append(b, `,"`...)
+		b = append(b, uploadKey...)
+		b = append(b, `":`...)
+		b = strconv.AppendInt(b, t.Upload, 10)
+		b = append(b, `,"`...)
+		b = append(b, downloadKey...)
+		b = append(b, `":`...)
+		b = strconv.AppendInt(b, t.Download, 10)
+		b = append(b, '}')
+	}
+	return append(b, ']')
+}
@@ -0,0 +1,46 @@
+package api_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+var userTraffic = []api.UserTraffic{
+	{UID: 1, Email: "a", Upload: 100, Download: 2000},
+	{UID: 42, Email: "b", Upload: 0, Download: 1 << 40},
+}
+
+func TestAppendTrafficMap(t *testing.T) {
+	var got map[int][]int64
+	if err := json.Unmarshal(api.AppendTrafficMap(nil, userTraffic), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int][]int64{1: {100, 2000}, 42: {0, 1 << 40}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAppendTrafficList(t *testing.T) {
+	body := api.GetTrafficBody()
+	defer api.PutTrafficBody(body)
+	*body = api.AppendTrafficList(*body, userTraffic, "user_id", "u", "d")
+
+	var got []map[string]int64
+	if err := json.Unmarshal(*body, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]int64{
+		{"user_id": 1, "u": 100, "d": 2000},
+		{"user_id": 42, "u": 0, "d": 1 << 40},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if string(api.AppendTrafficList(nil, nil, "uid", "u", "d")) != "[]" {
+		t.Error("empty list is not []")
+	}
+}
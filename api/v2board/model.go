@@ -1,12 +1,9 @@
 // Deprecated: after 2023.6.1
 package v2board
 
-type UserTraffic struct {
-	UID      int   `json:"user_id"`
-	Upload   int64 `json:"u"`
-	Download int64 `json:"d"`
-}
 type OnlineUser struct {
-	UID int    `json:"user_id"`
-	IP  string `json:"ip"`
+	UID       int    `json:"user_id"`
+	IP        string `json:"ip"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
 }
\ No newline at end of file
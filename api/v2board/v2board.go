@@ -11,7 +11,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/bitly/go-simplejson"
 	"github.com/go-resty/resty/v2"
@@ -33,20 +32,27 @@ type APIClient struct {
 	DeviceOnline     int
 	LocalRuleList    []api.DetectRule
 	LastReportOnline map[int]int
+	onlineState      *api.OnlineState
 	ConfigResp       *simplejson.Json
 	access           sync.Mutex
+	timeouts         *api.Timeouts
+	breaker          *api.Breaker
+	health           *api.SyncHealth
 }
 
 // New create an api instance
 func New(apiConfig *api.Config) *APIClient {
 
 	client := resty.New()
-	client.SetRetryCount(3)
-	if apiConfig.Timeout > 0 {
-		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
-	} else {
-		client.SetTimeout(5 * time.Second)
-	}
+	api.SetRetryPolicy(client, apiConfig)
+	api.SetConnection(client, apiConfig)
+	api.SetResolver(client, apiConfig)
+	api.LimitResponseSize(client, apiConfig)
+	api.RecordResponses(client, apiConfig)
+	breaker := api.NewBreaker(client, apiConfig)
+	health := api.NewSyncHealth(client)
+	timeouts := api.NewTimeouts(apiConfig)
+	client.SetTimeout(timeouts.Client)
 	client.OnError(func(req *resty.Request, err error) {
 		if v, ok := err.(*resty.ResponseError); ok {
 			// v.Response contains the last response from the server
@@ -54,6 +60,9 @@ func New(apiConfig *api.Config) *APIClient {
 			log.Print(v.Err)
 		}
 	})
+	if apiConfig.EnableGzip {
+		api.EnableGzipRequest(client)
+	}
 	client.SetBaseURL(apiConfig.APIHost)
 	// Create Key for each requests
 	
@@ -63,17 +72,23 @@ func New(apiConfig *api.Config) *APIClient {
 	})
 	// Read local rule list
 	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
+	onlineState := api.NewOnlineState(apiConfig)
 	apiClient := &APIClient{
-		client:        client,
-		NodeID:        apiConfig.NodeID,
-		Key:           apiConfig.Key,
-		APIHost:       apiConfig.APIHost,
-		NodeType:      apiConfig.NodeType,
-		EnableVless:   apiConfig.EnableVless,
-		VlessFlow:     apiConfig.VlessFlow,
-		SpeedLimit:    apiConfig.SpeedLimit,
-		DeviceLimit:   apiConfig.DeviceLimit,
-		LocalRuleList: localRuleList,
+		client:           client,
+		NodeID:           apiConfig.NodeID,
+		Key:              apiConfig.Key,
+		APIHost:          apiConfig.APIHost,
+		NodeType:         apiConfig.NodeType,
+		EnableVless:      apiConfig.EnableVless,
+		VlessFlow:        apiConfig.VlessFlow,
+		SpeedLimit:       apiConfig.SpeedLimit,
+		DeviceLimit:      apiConfig.DeviceLimit,
+		LocalRuleList:    localRuleList,
+		LastReportOnline: onlineState.Load(),
+		onlineState:      onlineState,
+		timeouts:         timeouts,
+		breaker:          breaker,
+		health:           health,
 	}
 	return apiClient
 }
@@ -96,14 +111,19 @@ func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
 
 		// read line by line
 		for fileScanner.Scan() {
+			pattern, err := regexp.Compile(fileScanner.Text())
+			if err != nil {
+				log.Printf("Skip invalid rule %q: %s", fileScanner.Text(), err)
+				continue
+			}
 			LocalRuleList = append(LocalRuleList, api.DetectRule{
 				ID:      -1,
-				Pattern: regexp.MustCompile(fileScanner.Text()),
+				Pattern: pattern,
 			})
 		}
 		// handle first encountered error while reading
 		if err := fileScanner.Err(); err != nil {
-			log.Fatalf("Error while reading file: %s", err)
+			log.Printf("Error while reading file: %s", err)
 			return
 		}
 
@@ -118,6 +138,16 @@ func (c *APIClient) Describe() api.ClientInfo {
 	return api.ClientInfo{APIHost: c.APIHost, NodeID: c.NodeID, Key: c.Key, NodeType: c.NodeType}
 }
 
+// Breaker returns the circuit breaker of the client, nil if it has none
+func (c *APIClient) Breaker() *api.Breaker {
+	return c.breaker
+}
+
+// Health returns the health of the endpoints of the panel called so far
+func (c *APIClient) Health() []api.EndpointHealth {
+	return c.health.Endpoints()
+}
+
 // Debug set the client debug for client
 func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
@@ -132,9 +162,8 @@ func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (
 		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
 	}
 
-	if res.StatusCode() > 400 {
-		body := res.Body()
-		return nil, fmt.Errorf("request %s failed: %s, %s", c.assembleURL(path), string(body), err)
+	if err := api.CheckStatus(res, c.assembleURL(path)); err != nil {
+		return nil, err
 	}
 	rtn, err := simplejson.NewJson(res.Body())
 	if err != nil {
@@ -162,7 +191,10 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 	}
 	
 
+	ctx, cancel := c.timeouts.Context(c.timeouts.NodeInfo)
+	defer cancel()
 	res, err := c.client.R().
+		SetContext(ctx).
 		SetQueryParam("local_port", "1").
 		ForceContentType("application/json").
 		Get(path)
@@ -206,7 +238,10 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 	default:
 		return nil, fmt.Errorf("unsupported Node type: %s", c.NodeType)
 	}
+	ctx, cancel := c.timeouts.Context(c.timeouts.UserList)
+	defer cancel()
 	res, err := c.client.R().
+		SetContext(ctx).
 		ForceContentType("application/json").
 		Get(path)
 
@@ -287,7 +322,7 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 	reportOnline := make(map[int]int)
 	data := make([]OnlineUser, len(*onlineUserList))
 	for i, user := range *onlineUserList {
-		data[i] = OnlineUser{UID: user.UID, IP: user.IP}
+		data[i] = OnlineUser{UID: user.UID, IP: user.IP, FirstSeen: user.FirstSeen, LastSeen: user.LastSeen}
 		if _, ok := reportOnline[user.UID]; ok {
 			reportOnline[user.UID]++
 		} else {
@@ -295,6 +330,7 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 		}
 	}
 	c.LastReportOnline = reportOnline // Update LastReportOnline
+	c.onlineState.Save(reportOnline)
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -306,7 +342,10 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 	default:
 		return fmt.Errorf("unsupported Node type: %s", c.NodeType)
 	}
+	ctx, cancel := c.timeouts.Context(c.timeouts.Online)
+	defer cancel()
 	res, err := c.client.R().
+		SetContext(ctx).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
 		SetBody(data).
 		ForceContentType("application/json").
@@ -321,6 +360,12 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 
 // ReportUserTraffic reports the user traffic
 func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+	return c.ReportUserTrafficWithKey("", userTraffic)
+}
+
+// ReportUserTrafficWithKey reports the user traffic, tagged with the
+// idempotency key unless it is empty
+func (c *APIClient) ReportUserTrafficWithKey(key string, userTraffic *[]api.UserTraffic) error {
 	var path string
 	switch c.NodeType {
 	case "V2ray":
@@ -331,17 +376,18 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 		path = "/api/v1/server/SkyhtShadowsocks/submit"
 	}
 
-	data := make([]UserTraffic, len(*userTraffic))
-	for i, traffic := range *userTraffic {
-		data[i] = UserTraffic{
-			UID:      traffic.UID,
-			Upload:   traffic.Upload,
-			Download: traffic.Download}
-	}
+	body := api.GetTrafficBody()
+	defer api.PutTrafficBody(body)
+	*body = api.AppendTrafficList(*body, *userTraffic, "user_id", "u", "d")
+	ctx, cancel := c.timeouts.Context(c.timeouts.Traffic)
+	defer cancel()
 
 	res, err := c.client.R().
+		SetContext(ctx).
+		SetHeaders(api.IdempotencyHeaders(key)).
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
-		SetBody(data).
+		SetHeader("Content-Type", "application/json").
+		SetBody(*body).
 		ForceContentType("application/json").
 		Post(path)
 	_, err = c.parseResponse(res, path, err)
@@ -379,6 +425,19 @@ func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
 	return nil
 }
 
+// ReportAlive posts the alive report of the node to path
+func (c *APIClient) ReportAlive(path string, alive map[string]any) error {
+	ctx, cancel := c.timeouts.Context(c.timeouts.Alive)
+	defer cancel()
+	res, err := c.client.R().
+		SetContext(ctx).
+		SetBody(alive).
+		ForceContentType("application/json").
+		Post(path)
+	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
 // ReportIllegal implements the API interface
 func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 	return nil
@@ -1,6 +1,12 @@
 package v2board_test
 
 import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/qtai2901/new_xrayr/api"
@@ -89,6 +95,50 @@ func TestReportReportUserTraffic(t *testing.T) {
 	}
 }
 
+func TestReportBodies(t *testing.T) {
+	var (
+		access sync.Mutex
+		bodies = make(map[string][]byte)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		access.Lock()
+		bodies[r.URL.Path] = body
+		access.Unlock()
+		w.Write([]byte(`{"data":true}`))
+	}))
+	defer server.Close()
+	client := v2board.New(&api.Config{
+		APIHost:  server.URL,
+		Key:      "qwertyuiopasdfghjkl",
+		NodeID:   1,
+		NodeType: "V2ray",
+	})
+
+	traffic := []api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}
+	if err := client.ReportUserTraffic(&traffic); err != nil {
+		t.Fatal(err)
+	}
+	online := []api.OnlineUser{{UID: 2, IP: "192.0.2.1"}}
+	if err := client.ReportNodeOnlineUsers(&online); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string][]map[string]any{
+		"/api/v1/server/SkyhtV2ray/submit": {{"user_id": float64(1), "u": float64(100), "d": float64(200)}},
+		"/api/v1/server/SkyhtV2ray/online": {{"user_id": float64(2), "ip": "192.0.2.1"}},
+	} {
+		var got []map[string]any
+		if err := json.Unmarshal(bodies[path], &got); err != nil {
+			t.Errorf("%s: %v in %s", path, err, bodies[path])
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s got %v, want %v", path, got, want)
+		}
+	}
+}
+
 func TestGetNodeRule(t *testing.T) {
 	client := CreateClient()
 	client.Debug()
@@ -1,11 +1,5 @@
 package v2raysocks
 
-type UserTraffic struct {
-	UID      int   `json:"user_id"`
-	Upload   int64 `json:"u"`
-	Download int64 `json:"d"`
-}
-
 type NodeStatus struct {
 	CPU    string `json:"cpu"`
 	Mem    string `json:"mem"`
@@ -15,8 +9,10 @@ type NodeStatus struct {
 }
 
 type NodeOnline struct {
-	UID int    `json:"uid"`
-	IP  string `json:"ip"`
+	UID       int    `json:"uid"`
+	IP        string `json:"ip"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
 }
 
 type REALITYConfig struct {
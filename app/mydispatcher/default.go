@@ -5,8 +5,10 @@ package mydispatcher
 import (
 	"context"
 	"fmt"
+	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xtls/xray-core/common"
@@ -25,8 +27,14 @@ import (
 	"github.com/xtls/xray-core/transport"
 	"github.com/xtls/xray-core/transport/pipe"
 
+	"github.com/qtai2901/new_xrayr/common/ban"
+	"github.com/qtai2901/new_xrayr/common/blocklist"
+	"github.com/qtai2901/new_xrayr/common/connlimit"
 	"github.com/qtai2901/new_xrayr/common/limiter"
+	"github.com/qtai2901/new_xrayr/common/noderoute"
+	"github.com/qtai2901/new_xrayr/common/portscan"
 	"github.com/qtai2901/new_xrayr/common/rule"
+	"github.com/qtai2901/new_xrayr/common/speedtest"
 )
 
 var errSniffingTimeout = newError("timeout on sniffing")
@@ -100,6 +108,32 @@ type DefaultDispatcher struct {
 	fdns        dns.FakeDNSEngine
 	Limiter     *limiter.Limiter
 	RuleManager *rule.Manager
+	NodeRoute   *noderoute.Manager
+	Blocklist   *blocklist.Manager
+	Ban         *ban.Manager
+	Speedtest   *speedtest.Manager
+	ConnLimit   *connlimit.Manager
+	PortScan    *portscan.Manager
+	// Key: tag of an extra inbound of a node, value: tag of the node
+	InboundAliases sync.Map
+	// Key: tag of an inbound without users, value: *protocol.MemoryUser its
+	// connections are counted to, nil to refuse them
+	InboundOwners sync.Map
+	// Key: tag of a node, value: LinkBuffer of its connections
+	LinkBuffers sync.Map
+	// Key: tag of a node whose connections may be spliced, value: true
+	SpliceInbounds sync.Map
+	// Key: tag of a node, value: *atomic.Int64 of its connections open
+	openConnections sync.Map
+}
+
+// LinkBuffer is the size of the buffers between the inbound and the outbound
+// of the connections of a node, Byte. Read holds the data read from the
+// client, Write the data written back to it. 0 keeps the size of the policy,
+// -1 for no limit.
+type LinkBuffer struct {
+	Read  int32
+	Write int32
 }
 
 func init() {
@@ -109,7 +143,11 @@ func init() {
 			core.RequireFeatures(ctx, func(fdns dns.FakeDNSEngine) {
 				d.fdns = fdns
 			})
-			return d.Init(config.(*Config), om, router, pm, sm, dc)
+			if err := d.Init(config.(*Config), om, router, pm, sm, dc); err != nil {
+				return err
+			}
+			d.NodeRoute = noderoute.New(ctx, dc, om, d)
+			return nil
 		}); err != nil {
 			return nil, err
 		}
@@ -125,6 +163,11 @@ func (d *DefaultDispatcher) Init(config *Config, om outbound.Manager, router rou
 	d.stats = sm
 	d.Limiter = limiter.New()
 	d.RuleManager = rule.New()
+	d.Blocklist = blocklist.NewManager()
+	d.Ban = ban.NewManager()
+	d.Speedtest = speedtest.NewManager()
+	d.ConnLimit = connlimit.NewManager()
+	d.PortScan = portscan.NewManager()
 	d.dns = dns
 	return nil
 }
@@ -145,9 +188,22 @@ func (*DefaultDispatcher) Close() error {
 }
 
 func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *transport.Link, error) {
+	sessionInbound := session.InboundFromContext(ctx)
 	opt := pipe.OptionsFromContext(ctx)
-	uplinkReader, uplinkWriter := pipe.New(opt...)
-	downlinkReader, downlinkWriter := pipe.New(opt...)
+	uplinkOpt, downlinkOpt := opt, opt
+	if sessionInbound != nil {
+		if b, ok := d.LinkBuffers.Load(sessionInbound.Tag); ok {
+			// The last size option wins
+			if size := b.(LinkBuffer).Read; size != 0 {
+				uplinkOpt = append(opt[:len(opt):len(opt)], pipe.WithSizeLimit(size))
+			}
+			if size := b.(LinkBuffer).Write; size != 0 {
+				downlinkOpt = append(opt[:len(opt):len(opt)], pipe.WithSizeLimit(size))
+			}
+		}
+	}
+	uplinkReader, uplinkWriter := pipe.New(uplinkOpt...)
+	downlinkReader, downlinkWriter := pipe.New(downlinkOpt...)
 
 	inboundLink := &transport.Link{
 		Reader: downlinkReader,
@@ -159,7 +215,6 @@ func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *tran
 		Writer: downlinkWriter,
 	}
 
-	sessionInbound := session.InboundFromContext(ctx)
 	var user *protocol.MemoryUser
 	if sessionInbound != nil {
 		user = sessionInbound.User
@@ -176,28 +231,48 @@ func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *tran
 			common.Interrupt(inboundLink.Reader)
 			return nil, nil, newError("Devices reach the limit: ", user.Email)
 		}
+		// Traffic quota
+		quota, reject := d.Limiter.GetUserQuota(sessionInbound.Tag, user.Email)
+		if reject {
+			newError("Traffic quota used up: ", user.Email).AtWarning().WriteToLog()
+			common.Close(outboundLink.Writer)
+			common.Close(inboundLink.Writer)
+			common.Interrupt(outboundLink.Reader)
+			common.Interrupt(inboundLink.Reader)
+			return nil, nil, newError("Traffic quota used up: ", user.Email)
+		} else if quota != nil {
+			inboundLink.Writer = d.Limiter.QuotaWriter(inboundLink.Writer, quota)
+			outboundLink.Writer = d.Limiter.QuotaWriter(outboundLink.Writer, quota)
+		}
+		// Kicked along with the other links of the user
+		if session := d.Limiter.GetUserSession(sessionInbound.Tag, user.Email); session != nil {
+			inboundLink.Writer = d.Limiter.KickWriter(inboundLink.Writer, session)
+			outboundLink.Writer = d.Limiter.KickWriter(outboundLink.Writer, session)
+		}
 		if ok {
 			inboundLink.Writer = d.Limiter.RateWriter(inboundLink.Writer, bucket)
 			outboundLink.Writer = d.Limiter.RateWriter(outboundLink.Writer, bucket)
 		}
+		// The bandwidth of the inbound shared with its other users
+		share := d.Limiter.GetUserShare(sessionInbound.Tag, user.Email)
+		if share != nil {
+			inboundLink.Writer = d.Limiter.ShareWriter(inboundLink.Writer, share)
+			outboundLink.Writer = d.Limiter.ShareWriter(outboundLink.Writer, share)
+		}
+
+		// A spliced connection skips the writers above, only the traffic is
+		// counted, so only the ones they have nothing to do for are spliced
+		if _, splice := d.SpliceInbounds.Load(sessionInbound.Tag); !splice || ok || quota != nil || share != nil {
+			sessionInbound.SetCanSpliceCopy(3)
+		}
 
 		p := d.policy.ForLevel(user.Level)
-		if p.Stats.UserUplink {
-			name := "user>>>" + user.Email + ">>>traffic>>>uplink"
-			if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
-				inboundLink.Writer = &SizeStatWriter{
-					Counter: c,
-					Writer:  inboundLink.Writer,
-				}
+		if traffic := d.Limiter.GetUserTraffic(sessionInbound.Tag, user.Email); traffic != nil {
+			if p.Stats.UserUplink {
+				inboundLink.Writer = d.Limiter.TrafficWriter(inboundLink.Writer, &traffic.Up)
 			}
-		}
-		if p.Stats.UserDownlink {
-			name := "user>>>" + user.Email + ">>>traffic>>>downlink"
-			if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
-				outboundLink.Writer = &SizeStatWriter{
-					Counter: c,
-					Writer:  outboundLink.Writer,
-				}
+			if p.Stats.UserDownlink {
+				outboundLink.Writer = d.Limiter.TrafficWriter(outboundLink.Writer, &traffic.Down)
 			}
 		}
 	}
@@ -240,6 +315,10 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 	if !destination.IsValid() {
 		panic("Dispatcher: Invalid destination.")
 	}
+	d.aliasInbound(ctx)
+	if err := d.ownInbound(ctx); err != nil {
+		return nil, err
+	}
 	ob := &session.Outbound{
 		Target: destination,
 	}
@@ -288,6 +367,10 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 	if !destination.IsValid() {
 		return newError("Dispatcher: Invalid destination.")
 	}
+	d.aliasInbound(ctx)
+	if err := d.ownInbound(ctx); err != nil {
+		return err
+	}
 	ob := &session.Outbound{
 		Target: destination,
 	}
@@ -390,18 +473,63 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 
 	var handler outbound.Handler
 
-	// Check if domain and protocol hit the rule
 	sessionInbound := session.InboundFromContext(ctx)
+	source, hasSource := sourceAddr(sessionInbound)
+	if hasSource && d.Ban.Banned(source) {
+		newError("source ", source, " is banned").AtInfo().WriteToLog(session.ExportIDToError(ctx))
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+
+	// Check if domain and protocol hit the rule
 	// Whether the inbound connection contains a user
 	if sessionInbound.User != nil {
 		if d.RuleManager.Detect(sessionInbound.Tag, destination.String(), sessionInbound.User.Email) {
 			newError(fmt.Sprintf("User %s access %s reject by rule", sessionInbound.User.Email, destination.String())).AtError().WriteToLog()
 			newError("destination is reject by rule")
+			if hasSource && d.Ban.Violated(source) {
+				newError("source ", source, " is banned for breaking the audit rules").AtWarning().WriteToLog()
+			}
 			common.Close(link.Writer)
 			common.Interrupt(link.Reader)
 			return
 		}
 	}
+	if sessionInbound.User != nil && destination.Network == net.Network_UDP && !d.Limiter.UDPAllowed(sessionInbound.Tag, sessionInbound.User.Email) {
+		newError("User ", sessionInbound.User.Email, " is not allowed to use UDP").AtInfo().WriteToLog(session.ExportIDToError(ctx))
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+	if d.blocklisted(sessionInbound.Tag, destination) {
+		newError("destination ", destination, " is reject by blocklist").AtInfo().WriteToLog(session.ExportIDToError(ctx))
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+	if !d.limitSpeedtest(ctx, sessionInbound, link, destination) {
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+	if !d.limitPortScan(ctx, sessionInbound, link, destination, source, hasSource) {
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+	// The slot is held until the outbound is done with the link
+	release, ok := d.ConnLimit.Acquire(ctx, sessionInbound.Tag)
+	if !ok {
+		newError("connection to ", destination, " is reject by the connection limit of ", sessionInbound.Tag).AtInfo().WriteToLog(session.ExportIDToError(ctx))
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+	defer release()
+	open := d.openCounter(sessionInbound.Tag)
+	open.Add(1)
+	defer open.Add(-1)
 
 	routingLink := routingSession.AsRoutingContext(ctx)
 	inTag := routingLink.GetInboundTag()
@@ -418,6 +546,9 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 			common.Interrupt(link.Reader)
 			return
 		}
+	} else if h := d.pickNodeRoute(ctx, routingLink, destination); h != nil {
+		isPickRoute = 2
+		handler = h
 	} else if d.router != nil {
 		if route, err := d.router.PickRoute(routingLink); err == nil {
 			outTag := route.GetOutboundTag()
@@ -466,3 +597,173 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 
 	handler.Dispatch(ctx, link)
 }
+
+// pickNodeRoute returns the outbound picked by the routing rules of the node
+// the connection came in from, or nil to fall back to the global routing.
+func (d *DefaultDispatcher) pickNodeRoute(ctx context.Context, routingLink routing.Context, destination net.Destination) outbound.Handler {
+	if d.NodeRoute == nil {
+		return nil
+	}
+	outTag, ok := d.NodeRoute.PickRoute(routingLink)
+	if !ok {
+		return nil
+	}
+	h := d.ohm.GetHandler(outTag)
+	if h == nil {
+		newError("non existing node outTag: ", outTag).AtWarning().WriteToLog(session.ExportIDToError(ctx))
+		return nil
+	}
+	newError("taking node detour [", outTag, "] for [", destination, "]").WriteToLog(session.ExportIDToError(ctx))
+	return h
+}
+
+// blocklisted reports whether the destination is in the blocklist used by
+// the node the connection came in from. Domains are resolved first when the
+// node asks for it.
+func (d *DefaultDispatcher) blocklisted(tag string, destination net.Destination) bool {
+	if d.Blocklist == nil {
+		return false
+	}
+	enabled, resolveDomain := d.Blocklist.Enabled(tag)
+	if !enabled {
+		return false
+	}
+	var ips []net.IP
+	if destination.Address.Family().IsDomain() {
+		if !resolveDomain || d.dns == nil {
+			return false
+		}
+		resolved, err := d.dns.LookupIP(destination.Address.Domain(), dns.IPOption{IPv4Enable: true, IPv6Enable: true})
+		if err != nil {
+			return false
+		}
+		ips = resolved
+	} else {
+		ips = []net.IP{destination.Address.IP()}
+	}
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return d.Blocklist.Blocked(tag, addrs...)
+}
+
+// OpenConnections returns the connections of the node with tag handed to an
+// outbound and not closed yet
+func (d *DefaultDispatcher) OpenConnections(tag string) int64 {
+	return d.openCounter(tag).Load()
+}
+
+func (d *DefaultDispatcher) openCounter(tag string) *atomic.Int64 {
+	counter, _ := d.openConnections.LoadOrStore(tag, new(atomic.Int64))
+	return counter.(*atomic.Int64)
+}
+
+// aliasInbound renames the connections of the extra inbounds of a node after
+// the node, so its limits, rules and routes apply to them as well
+func (d *DefaultDispatcher) aliasInbound(ctx context.Context) {
+	inbound := session.InboundFromContext(ctx)
+	if inbound == nil || inbound.Tag == "" {
+		return
+	}
+	if tag, ok := d.InboundAliases.Load(inbound.Tag); ok {
+		inbound.Tag = tag.(string)
+	}
+}
+
+// ownInbound counts the connections of an inbound without users, like the
+// one of a Forward node, to the user owning it, and refuses them while it has
+// no owner
+func (d *DefaultDispatcher) ownInbound(ctx context.Context) error {
+	inbound := session.InboundFromContext(ctx)
+	if inbound == nil || inbound.User != nil {
+		return nil
+	}
+	owner, ok := d.InboundOwners.Load(inbound.Tag)
+	if !ok {
+		return nil
+	}
+	if inbound.User = owner.(*protocol.MemoryUser); inbound.User == nil {
+		return newError("inbound ", inbound.Tag, " has no user")
+	}
+	return nil
+}
+
+// sourceAddr returns the client address of the inbound connection
+func sourceAddr(inbound *session.Inbound) (netip.Addr, bool) {
+	if inbound == nil || !inbound.Source.IsValid() || !inbound.Source.Address.Family().IsIP() {
+		return netip.Addr{}, false
+	}
+	addr, ok := netip.AddrFromSlice(inbound.Source.Address.IP())
+	return addr.Unmap(), ok
+}
+
+// limitSpeedtest throttles the link if the destination is a speed test
+// throttled by the node, and returns false if the node blocks it
+func (d *DefaultDispatcher) limitSpeedtest(ctx context.Context, inbound *session.Inbound, link *transport.Link, destination net.Destination) bool {
+	if d.Speedtest == nil {
+		return true
+	}
+	var (
+		domain string
+		addr   netip.Addr
+	)
+	if destination.Address.Family().IsDomain() {
+		domain = destination.Address.Domain()
+	} else {
+		addr, _ = netip.AddrFromSlice(destination.Address.IP())
+	}
+	action := d.Speedtest.Match(inbound.Tag, domain, addr)
+	if action == "" {
+		return true
+	}
+	email := ""
+	if inbound.User != nil {
+		email = inbound.User.Email
+	}
+	if action == speedtest.ActionBlock {
+		newError("User ", email, " speedtest to ", destination, " is blocked").AtInfo().WriteToLog(session.ExportIDToError(ctx))
+		return false
+	}
+	if bucket := d.Speedtest.Bucket(inbound.Tag, email); bucket != nil {
+		newError("User ", email, " speedtest to ", destination, " is throttled").AtInfo().WriteToLog(session.ExportIDToError(ctx))
+		inbound.SetCanSpliceCopy(3) // Would skip the throttle
+		link.Reader = d.Limiter.RateReader(link.Reader, bucket)
+		link.Writer = d.Limiter.RateWriter(link.Writer, bucket)
+	}
+	return true
+}
+
+// limitPortScan counts the destination of the user, reporting the user when
+// detected scanning. It throttles the link if the user is throttled by the
+// node, and returns false if the node blocks the user.
+func (d *DefaultDispatcher) limitPortScan(ctx context.Context, inbound *session.Inbound, link *transport.Link, destination net.Destination, source netip.Addr, hasSource bool) bool {
+	if d.PortScan == nil || inbound.User == nil {
+		return true
+	}
+	email := inbound.User.Email
+	action, detected := d.PortScan.Check(inbound.Tag, email, destination.NetAddr())
+	if detected {
+		newError("User ", email, " is detected scanning, last to ", destination).AtWarning().WriteToLog(session.ExportIDToError(ctx))
+		if ruleID := d.PortScan.RuleID(inbound.Tag); ruleID != -1 {
+			d.RuleManager.Record(inbound.Tag, email, ruleID)
+		}
+		if hasSource && d.Ban.Violated(source) {
+			newError("source ", source, " is banned for scanning").AtWarning().WriteToLog()
+		}
+	}
+	switch action {
+	case portscan.ActionBlock:
+		newError("User ", email, " connection to ", destination, " is blocked for scanning").AtInfo().WriteToLog(session.ExportIDToError(ctx))
+		return false
+	case portscan.ActionThrottle:
+		if bucket := d.PortScan.Bucket(inbound.Tag, email); bucket != nil {
+			inbound.SetCanSpliceCopy(3) // Would skip the throttle
+			link.Reader = d.Limiter.RateReader(link.Reader, bucket)
+			link.Writer = d.Limiter.RateWriter(link.Writer, bucket)
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/qtai2901/new_xrayr/common/ban"
+)
+
+func init() {
+	banCmd := &cobra.Command{
+		Use:   "ban",
+		Short: "Manage the client IPs banned by a running XrayR through its control socket",
+	}
+	banCmd.PersistentFlags().StringVarP(&controlSocket, "socket", "s", defaultControlSocket, "Control socket of the running XrayR.")
+
+	banCmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the banned IPs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := callControl(controlSocket, http.MethodGet, "/bans", nil)
+			if err != nil {
+				return err
+			}
+			var bans []ban.Ban
+			if err := json.Unmarshal(data, &bans); err != nil {
+				return err
+			}
+			for _, b := range bans {
+				fmt.Printf("%s\t%s\tuntil %s\n", b.IP, b.Reason, b.Until.Local().Format(time.DateTime))
+			}
+			return nil
+		},
+	})
+
+	banCmd.AddCommand(&cobra.Command{
+		Use:   "remove <ip>",
+		Short: "Lift the ban of an IP",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			body, _ := json.Marshal(map[string]string{"IP": args[0]})
+			if _, err := callControl(controlSocket, http.MethodDelete, "/bans", bytes.NewReader(body)); err != nil {
+				return err
+			}
+			fmt.Printf("%s is unbanned\n", args[0])
+			return nil
+		},
+	})
+
+	rootCmd.AddCommand(banCmd)
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/qtai2901/new_xrayr/panel"
+)
+
+func init() {
+	blocklistCmd := &cobra.Command{
+		Use:   "blocklist",
+		Short: "Show the ranges of the blocklist and the connections it blocked",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := callControl(controlSocket, http.MethodGet, "/blocklist", nil)
+			if err != nil {
+				return err
+			}
+			var stats panel.BlocklistStats
+			if err := json.Unmarshal(data, &stats); err != nil {
+				return err
+			}
+			fmt.Printf("Ranges: %d\n", stats.Ranges)
+			tags := make([]string, 0, len(stats.Hits))
+			for tag := range stats.Hits {
+				tags = append(tags, tag)
+			}
+			sort.Strings(tags)
+			for _, tag := range tags {
+				fmt.Printf("%s: %d blocked\n", tag, stats.Hits[tag])
+			}
+			return nil
+		},
+	}
+	blocklistCmd.Flags().StringVarP(&controlSocket, "socket", "s", defaultControlSocket, "Control socket of the running XrayR.")
+	rootCmd.AddCommand(blocklistCmd)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const defaultControlSocket = "/var/run/XrayR.sock"
+
+// controlClient returns a client of the control API on the socket
+func controlClient(socket string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// callControl sends a request to the control API of a running XrayR and
+// returns the response body, or the error reported by the API.
+func callControl(socket, method, path string, body io.Reader) ([]byte, error) {
+	client := controlClient(socket, 2*time.Minute)
+	req, err := http.NewRequest(method, "http://XrayR"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("connect to control socket %s failed: %s", socket, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode > 399 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s", apiErr.Error)
+		}
+		return nil, fmt.Errorf("request %s failed: %s", path, res.Status)
+	}
+	return data, nil
+}
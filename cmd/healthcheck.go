@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const healthcheckTimeout = 5 * time.Second
+
+func init() {
+	var socket string
+	healthcheckCmd := &cobra.Command{
+		Use:   "healthcheck",
+		Short: "Exit with 0 when the running XrayR and all its nodes are healthy, 1 otherwise, like for a Docker HEALTHCHECK",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return healthcheck(socket)
+		},
+	}
+	healthcheckCmd.Flags().StringVarP(&socket, "socket", "s", defaultControlSocket, "Control socket of the running XrayR.")
+	rootCmd.AddCommand(healthcheckCmd)
+}
+
+// healthcheck returns why the XrayR on the control socket is unhealthy, nil if
+// it is healthy
+func healthcheck(socket string) error {
+	res, err := controlClient(socket, healthcheckTimeout).Get("http://XrayR/health")
+	if err != nil {
+		return fmt.Errorf("connect to control socket %s failed: %s", socket, err)
+	}
+	defer res.Body.Close()
+	var health struct {
+		Healthy bool `json:"Healthy"`
+		Nodes   []struct {
+			APIHost  string `json:"ApiHost"`
+			NodeID   int    `json:"NodeID"`
+			NodeType string `json:"NodeType"`
+			Healthy  bool   `json:"Healthy"`
+			Error    string `json:"Error"`
+		} `json:"Nodes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&health); err != nil {
+		return fmt.Errorf("health check failed: %s", res.Status)
+	}
+	if health.Healthy && res.StatusCode == http.StatusOK {
+		return nil
+	}
+	var unhealthy []string
+	for _, n := range health.Nodes {
+		if !n.Healthy {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s(ID=%d) of %s: %s", n.NodeType, n.NodeID, n.APIHost, n.Error))
+		}
+	}
+	if len(unhealthy) == 0 {
+		return errors.New("XrayR is not running")
+	}
+	return errors.New("unhealthy nodes: " + strings.Join(unhealthy, "; "))
+}
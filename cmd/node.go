@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/qtai2901/new_xrayr/panel"
+)
+
+var controlSocket string
+
+func init() {
+	nodeCmd := &cobra.Command{
+		Use:   "node",
+		Short: "Manage the nodes of a running XrayR through its control socket",
+	}
+	nodeCmd.PersistentFlags().StringVarP(&controlSocket, "socket", "s", defaultControlSocket, "Control socket of the running XrayR.")
+
+	nodeCmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the nodes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := callControl(controlSocket, http.MethodGet, "/nodes", nil)
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(data))
+			return nil
+		},
+	})
+
+	nodeCmd.AddCommand(&cobra.Command{
+		Use:   "add <node config file>",
+		Short: "Add a node, the file holds one entry of Nodes in YAML or JSON",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			body, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			data, err := callControl(controlSocket, http.MethodPost, "/nodes", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(data))
+			return nil
+		},
+	})
+
+	var key panel.NodeKey
+	removeCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove a node",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			body, _ := json.Marshal(key)
+			data, err := callControl(controlSocket, http.MethodDelete, "/nodes", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(data))
+			return nil
+		},
+	}
+	removeCmd.Flags().StringVar(&key.APIHost, "host", "", "ApiHost of the node")
+	removeCmd.Flags().IntVar(&key.NodeID, "id", 0, "NodeID of the node")
+	removeCmd.Flags().StringVar(&key.NodeType, "type", "", "NodeType of the node")
+	removeCmd.MarkFlagRequired("host")
+	removeCmd.MarkFlagRequired("id")
+	removeCmd.MarkFlagRequired("type")
+	nodeCmd.AddCommand(removeCmd)
+
+	var drain struct {
+		panel.NodeKey
+		Timeout int `json:"Timeout"`
+	}
+	drainCmd := &cobra.Command{
+		Use:   "drain",
+		Short: "Put a node, or every node if none is given, in maintenance and stop it once its connections are closed",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			body, _ := json.Marshal(drain)
+			data, err := callControl(controlSocket, http.MethodPost, "/drain", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(data))
+			return nil
+		},
+	}
+	drainCmd.Flags().StringVar(&drain.APIHost, "host", "", "ApiHost of the node")
+	drainCmd.Flags().IntVar(&drain.NodeID, "id", 0, "NodeID of the node, every node if not set")
+	drainCmd.Flags().StringVar(&drain.NodeType, "type", "", "NodeType of the node")
+	drainCmd.Flags().IntVar(&drain.Timeout, "timeout", 600, "Seconds the connections are waited for before the node is stopped")
+	drainCmd.MarkFlagsRequiredTogether("host", "id", "type")
+	nodeCmd.AddCommand(drainCmd)
+
+	rootCmd.AddCommand(nodeCmd)
+}
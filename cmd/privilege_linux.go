@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Header of the file capabilities, see vfs_cap_data in linux/capability.h
+	vfsCapRevision2      = 0x02000000
+	vfsCapFlagsEffective = 0x000001
+	netBindService       = 1 << unix.CAP_NET_BIND_SERVICE
+)
+
+// setupUser creates the user if it doesn't exist, lets the binary bind the
+// ports below 1024 without root and hands paths over to the user
+func setupUser(name string, paths []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("setup needs root")
+	}
+	if _, err := user.Lookup(name); err != nil {
+		if err := createUser(name); err != nil {
+			return fmt.Errorf("create user %s failed: %s", name, err)
+		}
+		fmt.Printf("User %s created\n", name)
+	}
+	uid, gid, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	// The same as setcap cap_net_bind_service=+ep, without needing libcap
+	capability := make([]byte, 20)
+	binary.LittleEndian.PutUint32(capability[0:], vfsCapRevision2|vfsCapFlagsEffective)
+	binary.LittleEndian.PutUint32(capability[4:], netBindService)
+	if err := unix.Setxattr(exe, "security.capability", capability, 0); err != nil {
+		return fmt.Errorf("grant CAP_NET_BIND_SERVICE to %s failed: %s", exe, err)
+	}
+	fmt.Printf("%s may bind the ports below 1024\n", exe)
+
+	if err := chownPaths(paths, uid, gid); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			fmt.Printf("%s handed over to %s\n", path, name)
+		}
+	}
+	fmt.Printf("Run XrayR as %s, with User=%s in its systemd unit, or set User: %s in the config to switch to it once started\n", name, name, name)
+	return nil
+}
+
+// createUser creates a system user without a home and a login shell, with
+// useradd or the adduser of BusyBox
+func createUser(name string) error {
+	shell := "/bin/false"
+	for _, nologin := range []string{"/usr/sbin/nologin", "/sbin/nologin"} {
+		if _, err := os.Stat(nologin); err == nil {
+			shell = nologin
+			break
+		}
+	}
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("useradd"); err == nil {
+		cmd = exec.Command("useradd", "--system", "--user-group", "--no-create-home", "--shell", shell, name)
+	} else if _, err := exec.LookPath("adduser"); err == nil {
+		cmd = exec.Command("adduser", "-S", "-D", "-H", "-s", shell, name)
+	} else {
+		return errors.New("neither useradd nor adduser is installed")
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, output)
+	}
+	return nil
+}
+
+func lookupUser(name string) (uid, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(u.Gid); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// chownPaths hands the paths and everything in them over to the user, the
+// missing ones are skipped
+func chownPaths(paths []string, uid, gid int) error {
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, uid, gid)
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("chown %s failed: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// dropPrivileges switches XrayR running as root to the user, keeping only
+// CAP_NET_BIND_SERVICE so the nodes restarted later still bind their ports.
+// The paths are handed over to the user first, for the files created as root
+// while starting. The capability is raised to the ambient set too, for the
+// process started by an upgrade.
+func dropPrivileges(name string, paths []string) error {
+	if os.Geteuid() != 0 {
+		log.Warnf("Not running as root, keep running as the current user instead of %s", name)
+		return nil
+	}
+	uid, gid, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	if err := chownPaths(paths, uid, gid); err != nil {
+		return err
+	}
+
+	// Every thread has to switch, Go only does it for all of them without cgo
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return errors.New("XrayR built with cgo can't switch user, run it as the user instead")
+		}
+		return fmt.Errorf("keep the capabilities failed: %s", errno)
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("drop the groups failed: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("switch to group %d failed: %s", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("switch to user %s failed: %s", name, err)
+	}
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{{Effective: netBindService, Permitted: netBindService, Inheritable: netBindService}}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("set the capabilities failed: %s", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, unix.CAP_NET_BIND_SERVICE); errno != 0 {
+		log.Warnf("Raise the ambient capabilities failed, an upgrade may not bind the ports below 1024: %s", errno)
+	}
+	log.Printf("Running as %s", name)
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package cmd
+
+import "errors"
+
+var errNotLinux = errors.New("running as another user is only supported on Linux")
+
+func setupUser(name string, paths []string) error {
+	return errNotLinux
+}
+
+func dropPrivileges(name string, paths []string) error {
+	return errNotLinux
+}
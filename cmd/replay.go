@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+
+	"github.com/qtai2901/new_xrayr/api/replay"
+)
+
+func init() {
+	var listen string
+	replayCmd := &cobra.Command{
+		Use:   "replay <record dir>",
+		Short: "Serve the panel responses recorded to a RecordDir as a fake panel, to debug a node offline",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			h, err := replay.Load(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Replaying %s on http://%s, set it as the ApiHost of the node\n", args[0], listen)
+			return http.ListenAndServe(listen, h)
+		},
+	}
+	replayCmd.Flags().StringVarP(&listen, "listen", "l", "127.0.0.1:8080", "Address the fake panel listens on.")
+	rootCmd.AddCommand(replayCmd)
+}
@@ -7,6 +7,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/qtai2901/new_xrayr/common/sdnotify"
 	"github.com/qtai2901/new_xrayr/panel"
 )
 
@@ -24,7 +26,7 @@ var (
 	rootCmd = &cobra.Command{
 		Use: "XrayR",
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := run(); err != nil {
+			if err := runService(); err != nil {
 				log.Fatal(err)
 			}
 		},
@@ -67,7 +69,9 @@ func getConfig() *viper.Viper {
 	return config
 }
 
-func run() error {
+// run runs the panel until a signal or stop, nil unless it is run as a
+// service, asks it to shut down
+func run(stop <-chan struct{}) error {
 	showVersion()
 
 	config := getConfig()
@@ -81,8 +85,11 @@ func run() error {
 	}
 
 	p := panel.New(panelConfig)
+	var reloading sync.Mutex
 	lastTime := time.Now()
 	config.OnConfigChange(func(e fsnotify.Event) {
+		reloading.Lock()
+		defer reloading.Unlock()
 		// Discarding event received within a short period of time after receiving an event.
 		if time.Now().After(lastTime.Add(3 * time.Second)) {
 			// Hot reload function
@@ -102,16 +109,91 @@ func run() error {
 			lastTime = time.Now()
 		}
 	})
+	// Reload asked through the admin API, the config is checked before the
+	// running panel is closed
+	p.SetReload(func() error {
+		reloading.Lock()
+		defer reloading.Unlock()
+		if err := config.ReadInConfig(); err != nil {
+			return fmt.Errorf("read config file %v failed: %s", cfgFile, err)
+		}
+		if err := config.Unmarshal(&panel.Config{}); err != nil {
+			return fmt.Errorf("parse config file %v failed: %s", cfgFile, err)
+		}
+		log.Print("Reloading the config")
+		p.Close()
+		runtime.GC()
+		if err := config.Unmarshal(panelConfig); err != nil {
+			return fmt.Errorf("parse config file %v failed: %s", cfgFile, err)
+		}
+		if panelConfig.LogConfig.Level == "debug" {
+			log.SetReportCaller(true)
+		}
+		p.Start()
+		lastTime = time.Now()
+		return nil
+	})
 
 	p.Start()
-	defer p.Close()
 
 	// Explicitly triggering GC to remove garbage from config loading.
 	runtime.GC()
 	// Running backend
 	osSignals := make(chan os.Signal, 1)
 	signal.Notify(osSignals, os.Interrupt, os.Kill, syscall.SIGTERM)
-	<-osSignals
+	upgradeSignals := make(chan os.Signal, 1)
+	notifyUpgrade(upgradeSignals)
+
+	// Let the old process know we took over, in case we were started by an upgrade
+	p.WaitStarted()
+	if err := restrict(panelConfig); err != nil {
+		p.Close()
+		return err
+	}
+	notifyUpgradeReady()
+	if _, err := sdnotify.Notify(sdnotify.Ready); err != nil {
+		log.Errorf("Notify systemd failed: %s", err)
+	}
+	stopWatchdog := make(chan struct{})
+	go watchdog(p, stopWatchdog)
+
+	drain := time.Duration(panelConfig.ShutdownDrainTime) * time.Second
+wait:
+	for {
+		select {
+		case <-osSignals:
+			break wait
+		case <-stop:
+			break wait
+		case <-p.Maintained():
+			log.Print("Every node is done with its maintenance")
+			drain = 0
+			break wait
+		case <-upgradeSignals:
+			log.Print("Upgrade requested, starting the new process")
+			if err := startUpgrade(); err != nil {
+				log.Errorf("Upgrade failed, keep running: %s", err)
+				continue
+			}
+			log.Print("New process is ready, handing over")
+			break wait
+		}
+	}
+
+	close(stopWatchdog)
+	sdnotify.Notify(sdnotify.Stopping)
+	// Drain the connections and flush the reports, a second signal exits at once
+	log.Print("Shutting down, send the signal again to exit immediately")
+	done := make(chan struct{})
+	go func() {
+		p.Shutdown(drain)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-osSignals:
+		log.Warn("Forced exit, pending reports may be lost")
+	}
 
 	return nil
 }
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+const defaultServiceName = "XrayR"
+
+func init() {
+	var windows bool
+	var name string
+	installCmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install XrayR as a service starting with the system, with the config given by -c",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !windows {
+				return errors.New("only --windows is supported, use the install script on Linux")
+			}
+			config, err := serviceConfigFile()
+			if err != nil {
+				return err
+			}
+			return installWindowsService(name, config)
+		},
+	}
+	installCmd.Flags().BoolVar(&windows, "windows", false, "Install as a Windows service")
+	installCmd.Flags().StringVar(&name, "name", defaultServiceName, "Name of the service")
+
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove the service of XrayR",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !windows {
+				return errors.New("only --windows is supported, use the install script on Linux")
+			}
+			return uninstallWindowsService(name)
+		},
+	}
+	uninstallCmd.Flags().BoolVar(&windows, "windows", false, "Remove the Windows service")
+	uninstallCmd.Flags().StringVar(&name, "name", defaultServiceName, "Name of the service")
+
+	rootCmd.AddCommand(installCmd, uninstallCmd)
+}
+
+// serviceConfigFile returns the absolute path of the config file the service
+// runs with, config.yml in the working directory if -c is not given. A
+// service doesn't start in the directory it was installed from.
+func serviceConfigFile() (string, error) {
+	file := cfgFile
+	if file == "" {
+		file = "config.yml"
+	}
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(file); err != nil {
+		return "", err
+	}
+	return file, nil
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package cmd
+
+import "errors"
+
+var errNotWindows = errors.New("Windows services are only supported on Windows")
+
+func runService() error {
+	return run(nil)
+}
+
+func installWindowsService(name, config string) error {
+	return errNotWindows
+}
+
+func uninstallWindowsService(name string) error {
+	return errNotWindows
+}
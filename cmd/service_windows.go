@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	// Time a stop is told to take to the service manager, the connections
+	// are drained meanwhile
+	serviceStopWaitHint = time.Minute
+	// Delay before the service manager restarts a crashed service
+	serviceRestartDelay = 10 * time.Second
+	// Event ID of the log entries, any of 1 to 1000 is known to EventCreate
+	serviceEventID = 1
+)
+
+// runService runs XrayR as a Windows service when the service manager started
+// it, and as a console program otherwise
+func runService() error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return run(nil)
+	}
+	// Services start in the system directory, look beside the binary
+	if cfgFile == "" {
+		if exe, err := os.Executable(); err == nil {
+			cfgFile = filepath.Join(filepath.Dir(exe), "config.yml")
+		}
+	}
+	return svc.Run(defaultServiceName, windowsService{})
+}
+
+// windowsService runs the panel for the service manager, stopping it on the
+// stop and shutdown requests
+type windowsService struct{}
+
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	// The source of the events is the name the service was installed with
+	if elog, err := eventlog.Open(args[0]); err == nil {
+		defer elog.Close()
+		log.AddHook(eventLogHook{elog})
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- run(stop) }()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	stopping := false
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Error(err)
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				if !stopping {
+					stopping = true
+					changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopWaitHint.Milliseconds())}
+					close(stop)
+				}
+			}
+		}
+	}
+}
+
+// eventLogHook writes the log to the Windows event log, a service has no
+// console for it
+type eventLogHook struct {
+	log *eventlog.Log
+}
+
+func (h eventLogHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel}
+}
+
+func (h eventLogHook) Fire(entry *log.Entry) error {
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		return h.log.Error(serviceEventID, entry.Message)
+	case log.WarnLevel:
+		return h.log.Warning(serviceEventID, entry.Message)
+	default:
+		return h.log.Info(serviceEventID, entry.Message)
+	}
+}
+
+// installWindowsService installs the running binary as a service starting
+// with the system, restarted when it crashes, and starts it
+func installWindowsService(name, config string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to the service manager failed, run as administrator: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: name,
+		Description: intro,
+		StartType:   mgr.StartAutomatic,
+		// After the network is up
+		DelayedAutoStart: true,
+	}, "-c", config)
+	if err != nil {
+		return fmt.Errorf("create service %s failed: %w", name, err)
+	}
+	defer s.Close()
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: serviceRestartDelay}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds())); err != nil {
+		log.Warnf("Set the restart on failure of service %s failed: %s", name, err)
+	}
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("register event log source %s failed: %w", name, err)
+	}
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("service %s installed, but start failed: %w", name, err)
+	}
+	fmt.Printf("Service %s installed and started, running %s -c %s\n", name, exe, config)
+	return nil
+}
+
+// uninstallWindowsService stops the service and removes it
+func uninstallWindowsService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to the service manager failed, run as administrator: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+
+	if status, err := s.Control(svc.Stop); err == nil {
+		deadline := time.Now().Add(serviceStopWaitHint)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return errors.New("service " + name + " did not stop in time")
+			}
+			time.Sleep(500 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("delete service %s failed: %w", name, err)
+	}
+	if err := eventlog.Remove(name); err != nil {
+		log.Warnf("Remove event log source %s failed: %s", name, err)
+	}
+	fmt.Printf("Service %s removed\n", name)
+	return nil
+}
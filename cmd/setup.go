@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/qtai2901/new_xrayr/common/sandbox"
+	"github.com/qtai2901/new_xrayr/panel"
+)
+
+const defaultUser = "xrayr"
+
+func init() {
+	var name string
+	setupCmd := &cobra.Command{
+		Use:   "setup",
+		Short: "Create a user for XrayR, let the binary bind the ports below 1024 and hand the directories of the config given by -c over to the user",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if cfgFile == "" {
+				return errors.New("give the config file with -c, its directory is handed over to the user")
+			}
+			config := getConfig()
+			panelConfig := &panel.Config{}
+			if err := config.Unmarshal(panelConfig); err != nil {
+				return fmt.Errorf("parse config file %v failed: %s", cfgFile, err)
+			}
+			paths, err := statePaths(panelConfig)
+			if err != nil {
+				return err
+			}
+			return setupUser(name, paths)
+		},
+	}
+	setupCmd.Flags().StringVar(&name, "user", defaultUser, "User to create")
+	rootCmd.AddCommand(setupCmd)
+}
+
+// statePaths returns the paths XrayR writes to: the directory of the config
+// file, where the certificates and the geo files are kept, the log files and
+// the data directories of the nodes. The directory of the config file is left
+// out when -c is not given, it would be the working directory.
+func statePaths(panelConfig *panel.Config) ([]string, error) {
+	var paths []string
+	if cfgFile != "" {
+		dir, err := filepath.Abs(filepath.Dir(cfgFile))
+		if err != nil {
+			return nil, err
+		}
+		if dir == "/" {
+			return nil, errors.New("the config file must be in a directory of its own, like /etc/XrayR")
+		}
+		paths = append(paths, dir)
+	}
+	if c := panelConfig.LogConfig; c != nil {
+		for _, path := range []string{c.AccessPath, c.ErrorPath} {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	for _, nodeConfig := range panelConfig.NodesConfig {
+		if c := nodeConfig.ControllerConfig; c != nil && c.DataDir != "" {
+			paths = append(paths, c.DataDir)
+		}
+	}
+	return paths, nil
+}
+
+// restrict switches to the user and applies the sandbox set by the config,
+// once the nodes are started
+func restrict(panelConfig *panel.Config) error {
+	if panelConfig.User == "" && !panelConfig.SandboxConfig.Enabled() {
+		return nil
+	}
+	paths, err := statePaths(panelConfig)
+	if err != nil {
+		return err
+	}
+	if panelConfig.User != "" {
+		if err := dropPrivileges(panelConfig.User, paths); err != nil {
+			return fmt.Errorf("switch to user %s failed: %s", panelConfig.User, err)
+		}
+	}
+	if panelConfig.SandboxConfig.Enabled() {
+		// The control socket is created again by a reload
+		if panelConfig.ControlSocket != "" {
+			paths = append(paths, filepath.Dir(panelConfig.ControlSocket))
+		}
+		paths = append(paths, os.TempDir(), os.DevNull)
+		if err := sandbox.Apply(panelConfig.SandboxConfig, paths); err != nil {
+			return fmt.Errorf("sandbox failed: %s", err)
+		}
+		log.Print("Sandbox applied")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// upgradeReadyEnv tells the new process which fd to report readiness on
+const upgradeReadyEnv = "XRAYR_UPGRADE_READY_FD"
+
+const upgradeReadyTimeout = 2 * time.Minute
+
+func init() {
+	var pid int
+	upgradeCmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Hand a running XrayR over to the binary on disk without dropping connections",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			process, err := os.FindProcess(pid)
+			if err != nil {
+				return err
+			}
+			if err := process.Signal(syscall.SIGUSR2); err != nil {
+				return fmt.Errorf("signal XrayR(pid=%d) failed: %s", pid, err)
+			}
+			fmt.Printf("Upgrade requested, check the log of XrayR(pid=%d) for the result\n", pid)
+			return nil
+		},
+	}
+	upgradeCmd.Flags().IntVarP(&pid, "pid", "p", 0, "PID of the running XrayR")
+	upgradeCmd.MarkFlagRequired("pid")
+	rootCmd.AddCommand(upgradeCmd)
+}
+
+// notifyUpgrade relays the upgrade requests to c
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// startUpgrade executes the binary on disk with the same arguments and waits
+// until it reports ready. The listeners are opened with SO_REUSEPORT, so both
+// processes can serve the same ports while the old one drains.
+func startUpgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	child := exec.Command(exe, os.Args[1:]...)
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	child.ExtraFiles = []*os.File{w} // fd 3 in the child
+	child.Env = append(os.Environ(), upgradeReadyEnv+"=3")
+	err = child.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("start %s failed: %s", exe, err)
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := r.Read(buf); err != nil {
+			ready <- fmt.Errorf("new process exited before ready: %s", err)
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("new process not ready after %s", upgradeReadyTimeout)
+	}
+	if err != nil {
+		child.Process.Kill()
+		child.Wait()
+		return err
+	}
+	child.Process.Release()
+	return nil
+}
+
+// notifyUpgradeReady tells the process that started us, if any, that the
+// nodes are up and it can drain and exit.
+func notifyUpgradeReady() {
+	value := os.Getenv(upgradeReadyEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	f.Write([]byte{1})
+	f.Close()
+}
@@ -0,0 +1,14 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+)
+
+func notifyUpgrade(c chan<- os.Signal) {}
+
+func startUpgrade() error {
+	return errors.New("upgrade is not supported on windows")
+}
+
+func notifyUpgradeReady() {}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+
+	"github.com/qtai2901/new_xrayr/service/controller"
 )
 
 var (
@@ -13,6 +15,7 @@ var (
 )
 
 func init() {
+	controller.Version = version
 	rootCmd.AddCommand(&cobra.Command{
 		Use:   "version",
 		Short: "Print current version of XrayR",
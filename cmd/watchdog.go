@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/common/sdnotify"
+	"github.com/qtai2901/new_xrayr/panel"
+)
+
+// watchdog pings the watchdog of systemd as long as the user syncs of the
+// nodes run, so systemd restarts a hung XrayR, not only one that exited. It
+// returns when stop is closed, at once if the watchdog is off.
+func watchdog(p *panel.Panel, stop <-chan struct{}) {
+	interval, ok := sdnotify.WatchdogInterval()
+	if !ok {
+		return
+	}
+	log.Printf("Pinging the systemd watchdog every %s", interval/2)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := p.Stalled(); err != nil {
+			log.Errorf("Watchdog not pinged, %s", err)
+			continue
+		}
+		if _, err := sdnotify.Notify(sdnotify.Watchdog); err != nil {
+			log.Errorf("Ping the systemd watchdog failed: %s", err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package anytls
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultPaddingScheme is the padding scheme of the reference implementation,
+// used when neither the panel nor the config gives one
+const DefaultPaddingScheme = `stop=8
+0=30-30
+1=100-400
+2=400-500,c,500-1000,c,500-1000,c,500-1000,c,500-1000
+3=9-9,500-1000
+4=500-1000
+5=500-1000
+6=500-1000
+7=500-1000`
+
+// PaddingScheme tells the clients how to pad their first packets. The server
+// sends it to the clients having another one, and doesn't pad itself.
+type PaddingScheme struct {
+	raw []byte
+	md5 string
+}
+
+// ParsePaddingScheme checks a padding scheme made of a stop line, giving the
+// number of packets padded, and of a line per packet listing the sizes, as
+// ranges like 100-400, the packet is split into. A c between them stops the
+// padding of the packet once its data is sent.
+func ParsePaddingScheme(scheme string) (*PaddingScheme, error) {
+	scheme = strings.TrimSpace(strings.ReplaceAll(scheme, "\r\n", "\n"))
+	if scheme == "" {
+		scheme = DefaultPaddingScheme
+	}
+	stop := -1
+	for i, line := range strings.Split(scheme, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			return nil, fmt.Errorf("padding scheme line %d: missing =", i+1)
+		}
+		if key == "stop" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("padding scheme line %d: invalid stop: %s", i+1, value)
+			}
+			stop = n
+			continue
+		}
+		if _, err := strconv.Atoi(key); err != nil {
+			return nil, fmt.Errorf("padding scheme line %d: invalid packet: %s", i+1, key)
+		}
+		for _, size := range strings.Split(value, ",") {
+			if size == "c" {
+				continue
+			}
+			from, to, _ := strings.Cut(size, "-")
+			min, err := strconv.Atoi(from)
+			if err != nil || min < 0 {
+				return nil, fmt.Errorf("padding scheme line %d: invalid size: %s", i+1, size)
+			}
+			if to != "" {
+				if max, err := strconv.Atoi(to); err != nil || max < min {
+					return nil, fmt.Errorf("padding scheme line %d: invalid size: %s", i+1, size)
+				}
+			}
+		}
+	}
+	if stop < 0 {
+		return nil, fmt.Errorf("padding scheme has no stop")
+	}
+	sum := md5.Sum([]byte(scheme))
+	return &PaddingScheme{raw: []byte(scheme), md5: hex.EncodeToString(sum[:])}, nil
+}
+
+// String returns the scheme as sent to the clients
+func (p *PaddingScheme) String() string {
+	return string(p.raw)
+}
@@ -0,0 +1,31 @@
+package anytls_test
+
+import (
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/anytls"
+)
+
+func TestParsePaddingScheme(t *testing.T) {
+	p, err := anytls.ParsePaddingScheme("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != anytls.DefaultPaddingScheme {
+		t.Errorf("empty scheme should be the default one, got %q", p.String())
+	}
+	if _, err := anytls.ParsePaddingScheme("stop=2\r\n0=30-30\r\n1=100-400,c,500\r\n"); err != nil {
+		t.Error(err)
+	}
+	for _, scheme := range []string{
+		"0=30-30",          // No stop
+		"stop=2\n0=400-30", // Reversed range
+		"stop=2\n0=a-b",
+		"stop=2\nx=30",
+		"stop",
+	} {
+		if _, err := anytls.ParsePaddingScheme(scheme); err == nil {
+			t.Errorf("scheme %q should be invalid", scheme)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Package anytls is the server side of the AnyTLS protocol
+// (https://github.com/anytls/anytls-go). The clients authenticate with their
+// password over TLS, then open streams multiplexed on the connection, each of
+// them handed to the dispatcher like the connections of the other inbounds.
+package anytls
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	gonet "net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/trojan"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+type Config struct {
+	Tag           string
+	Listen        string // Address listened on, every one if empty
+	Port          uint32
+	TLSConfig     *tls.Config
+	PaddingScheme *PaddingScheme
+	Sniffing      session.SniffingRequest
+}
+
+// Handler is the inbound.Handler listening for the AnyTLS clients of a node
+type Handler struct {
+	config     *Config
+	server     *Server
+	dispatcher routing.Dispatcher
+
+	access   sync.Mutex
+	listener gonet.Listener
+}
+
+func NewHandler(config *Config, dispatcher routing.Dispatcher, policyManager policy.Manager) *Handler {
+	return &Handler{
+		config:     config,
+		dispatcher: dispatcher,
+		server: &Server{
+			policyManager: policyManager,
+			padding:       config.PaddingScheme,
+			sniffing:      config.Sniffing,
+			users:         make(map[[32]byte]*protocol.MemoryUser),
+			keys:          make(map[string][32]byte),
+		},
+	}
+}
+
+// Start implements common.Runnable.
+func (h *Handler) Start() error {
+	listener, err := gonet.Listen("tcp", gonet.JoinHostPort(h.config.Listen, strconv.Itoa(int(h.config.Port))))
+	if err != nil {
+		return newError("failed to listen on port ", h.config.Port).Base(err)
+	}
+	h.access.Lock()
+	h.listener = listener
+	h.access.Unlock()
+	go h.serve(listener)
+	return nil
+}
+
+// Close implements common.Closable. The connections accepted so far are
+// left to end by themselves, like the ones of the other inbounds.
+func (h *Handler) Close() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Close()
+}
+
+// Tag implements inbound.Handler.
+func (h *Handler) Tag() string {
+	return h.config.Tag
+}
+
+// GetRandomInboundProxy implements inbound.Handler.
+func (h *Handler) GetRandomInboundProxy() (interface{}, net.Port, int) {
+	return h.server, net.Port(h.config.Port), 9999
+}
+
+// GetInbound implements proxy.GetInbound.
+func (h *Handler) GetInbound() proxy.Inbound {
+	return h.server
+}
+
+func (h *Handler) serve(listener gonet.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, gonet.ErrClosed) {
+				return
+			}
+			newError("failed to accept connection").Base(err).AtWarning().WriteToLog()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go h.handle(conn)
+	}
+}
+
+func (h *Handler) handle(conn gonet.Conn) {
+	defer conn.Close()
+	gateway := net.AnyIP
+	if h.config.Listen != "" {
+		gateway = net.ParseAddress(h.config.Listen)
+	}
+	ctx := session.ContextWithID(context.Background(), session.NewID())
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{
+		Source:  net.DestinationFromAddr(conn.RemoteAddr()),
+		Gateway: net.TCPDestination(gateway, net.Port(h.config.Port)),
+		Tag:     h.config.Tag,
+		Conn:    conn,
+	})
+	if err := h.server.Process(ctx, net.Network_TCP, tls.Server(conn, h.config.TLSConfig), h.dispatcher); err != nil {
+		newError("connection ends").Base(err).WriteToLog(session.ExportIDToError(ctx))
+	}
+}
+
+// Server authenticates the AnyTLS clients by the password of their trojan
+// account, and serves their streams
+type Server struct {
+	policyManager policy.Manager
+	padding       *PaddingScheme
+	sniffing      session.SniffingRequest
+
+	access sync.RWMutex
+	users  map[[32]byte]*protocol.MemoryUser // Key: SHA-256 of the password
+	keys   map[string][32]byte               // Key: lower case email
+}
+
+// AddUser implements proxy.UserManager.AddUser().
+func (s *Server) AddUser(ctx context.Context, u *protocol.MemoryUser) error {
+	account, ok := u.Account.(*trojan.MemoryAccount)
+	if !ok {
+		return newError("user ", u.Email, " has no password")
+	}
+	email := strings.ToLower(u.Email)
+	key := sha256.Sum256([]byte(account.Password))
+	s.access.Lock()
+	defer s.access.Unlock()
+	if _, found := s.keys[email]; found {
+		return newError("User ", u.Email, " already exists.")
+	}
+	s.users[key] = u
+	s.keys[email] = key
+	return nil
+}
+
+// RemoveUser implements proxy.UserManager.RemoveUser().
+func (s *Server) RemoveUser(ctx context.Context, e string) error {
+	email := strings.ToLower(e)
+	s.access.Lock()
+	defer s.access.Unlock()
+	key, found := s.keys[email]
+	if !found {
+		return newError("User ", e, " not found.")
+	}
+	delete(s.keys, email)
+	delete(s.users, key)
+	return nil
+}
+
+func (s *Server) getUser(key [32]byte) *protocol.MemoryUser {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	return s.users[key]
+}
+
+// Network implements proxy.Inbound.Network().
+func (s *Server) Network() []net.Network {
+	return []net.Network{net.Network_TCP}
+}
+
+// Process implements proxy.Inbound.Process(). The client starts with the
+// SHA-256 of its password and a padding of the length given after it.
+func (s *Server) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	sessionPolicy := s.policyManager.ForLevel(0)
+	if err := conn.SetReadDeadline(time.Now().Add(sessionPolicy.Timeouts.Handshake)); err != nil {
+		return newError("unable to set read deadline").Base(err).AtWarning()
+	}
+	reader := bufio.NewReader(conn)
+	var auth [sha256.Size + 2]byte
+	if _, err := io.ReadFull(reader, auth[:]); err != nil {
+		return newError("failed to read authentication").Base(err)
+	}
+	user := s.getUser([32]byte(auth[:sha256.Size]))
+	if user == nil {
+		log.Record(&log.AccessMessage{
+			From:   conn.RemoteAddr(),
+			To:     "",
+			Status: log.AccessRejected,
+			Reason: newError("invalid user"),
+		})
+		return newError("invalid user from ", conn.RemoteAddr())
+	}
+	if _, err := reader.Discard(int(binary.BigEndian.Uint16(auth[sha256.Size:]))); err != nil {
+		return newError("failed to read padding").Base(err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return newError("unable to set read deadline").Base(err).AtWarning()
+	}
+
+	inbound := session.InboundFromContext(ctx)
+	inbound.Name = "anytls"
+	inbound.SetCanSpliceCopy(3)
+	inbound.User = user
+	return newMuxSession(ctx, s, conn, reader, user, dispatcher).run()
+}
@@ -0,0 +1,366 @@
+package anytls
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// Commands of the frames, made of the command, the stream id and the length
+// of the data after them
+const (
+	cmdWaste               = 0  // Padding, discarded
+	cmdSYN                 = 1  // Opens a stream
+	cmdPSH                 = 2  // Data of a stream
+	cmdFIN                 = 3  // Closes a stream
+	cmdSettings            = 4  // Settings of the client
+	cmdAlert               = 5  // Error message, the connection is closed after it
+	cmdUpdatePaddingScheme = 6  // Padding scheme the client should use
+	cmdSYNACK              = 7  // Stream opened, or the error opening it, from version 2
+	cmdHeartRequest        = 8  // Keep-alive
+	cmdHeartResponse       = 9  // Keep-alive answer
+	cmdServerSettings      = 10 // Settings of the server, from version 2
+)
+
+const headerSize = 1 + 4 + 2
+
+// maxFrameData is the most data a frame carries
+const maxFrameData = 65535
+
+var addrParser = protocol.NewAddressParser(
+	protocol.AddressFamilyByte(0x01, net.AddressFamilyIPv4),
+	protocol.AddressFamilyByte(0x04, net.AddressFamilyIPv6),
+	protocol.AddressFamilyByte(0x03, net.AddressFamilyDomain),
+)
+
+// muxSession serves the streams a client opens on a connection
+type muxSession struct {
+	ctx        context.Context
+	server     *Server
+	conn       net.Conn
+	reader     *bufio.Reader
+	user       *protocol.MemoryUser
+	dispatcher routing.Dispatcher
+
+	peerVersion int // Set by the settings, before the client opens any stream
+
+	writeAccess sync.Mutex
+	access      sync.Mutex
+	streams     map[uint32]*stream
+}
+
+type stream struct {
+	id        uint32
+	reader    *pipe.Reader
+	writer    *pipe.Writer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// close ends the request of the stream once its data is read, and fails its
+// response
+func (st *stream) close() {
+	st.closeOnce.Do(func() {
+		close(st.done)
+		common.Close(st.writer)
+	})
+}
+
+func newMuxSession(ctx context.Context, server *Server, conn net.Conn, reader *bufio.Reader, user *protocol.MemoryUser, dispatcher routing.Dispatcher) *muxSession {
+	return &muxSession{
+		ctx:        ctx,
+		server:     server,
+		conn:       conn,
+		reader:     reader,
+		user:       user,
+		dispatcher: dispatcher,
+		streams:    make(map[uint32]*stream),
+	}
+}
+
+// run reads the frames of the client until the connection is closed
+func (s *muxSession) run() error {
+	defer s.closeStreams()
+	settingsReceived := false
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return newError("failed to read frame").Base(err)
+		}
+		cmd := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := int(binary.BigEndian.Uint16(header[5:]))
+
+		if cmd == cmdPSH {
+			mb, err := buf.ReadFrom(io.LimitReader(s.reader, int64(length)))
+			if err != nil || int(mb.Len()) != length {
+				buf.ReleaseMulti(mb)
+				return newError("failed to read frame data").Base(err)
+			}
+			if st := s.getStream(id); st != nil {
+				st.writer.WriteMultiBuffer(mb)
+			} else {
+				buf.ReleaseMulti(mb)
+			}
+			continue
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(s.reader, data); err != nil {
+			return newError("failed to read frame data").Base(err)
+		}
+		switch cmd {
+		case cmdSYN:
+			if !settingsReceived {
+				s.writeFrame(cmdAlert, 0, []byte("client did not send its settings"))
+				return newError("client did not send its settings")
+			}
+			s.openStream(id)
+		case cmdFIN:
+			if st := s.removeStream(id); st != nil {
+				st.close()
+			}
+		case cmdSettings:
+			settingsReceived = true
+			if err := s.receiveSettings(data); err != nil {
+				return err
+			}
+		case cmdAlert:
+			return newError("alert from client: ", string(data))
+		case cmdHeartRequest:
+			if err := s.writeFrame(cmdHeartResponse, id, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receiveSettings answers the settings of the client, made of key=value
+// lines, with the padding scheme if it has another one and with the settings
+// of the server if it speaks version 2
+func (s *muxSession) receiveSettings(data []byte) error {
+	settings := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			settings[key] = value
+		}
+	}
+	if settings["padding-md5"] != s.server.padding.md5 {
+		if err := s.writeFrame(cmdUpdatePaddingScheme, 0, s.server.padding.raw); err != nil {
+			return err
+		}
+	}
+	if v, _ := strconv.Atoi(settings["v"]); v >= 2 {
+		s.peerVersion = v
+		return s.writeFrame(cmdServerSettings, 0, []byte("v=2"))
+	}
+	return nil
+}
+
+func (s *muxSession) writeFrame(cmd byte, id uint32, data []byte) error {
+	frame := make([]byte, headerSize+len(data))
+	frame[0] = cmd
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint16(frame[5:7], uint16(len(data)))
+	copy(frame[headerSize:], data)
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	if _, err := s.conn.Write(frame); err != nil {
+		return newError("failed to write frame").Base(err)
+	}
+	return nil
+}
+
+func (s *muxSession) openStream(id uint32) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if _, found := s.streams[id]; found {
+		return
+	}
+	reader, writer := pipe.New(pipe.WithSizeLimit(buf.Size * 64))
+	st := &stream{
+		id:     id,
+		reader: reader,
+		writer: writer,
+		done:   make(chan struct{}),
+	}
+	s.streams[id] = st
+	go s.handleStream(st)
+}
+
+func (s *muxSession) getStream(id uint32) *stream {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.streams[id]
+}
+
+// removeStream returns the stream with id, nil if it is closed already
+func (s *muxSession) removeStream(id uint32) *stream {
+	s.access.Lock()
+	defer s.access.Unlock()
+	st := s.streams[id]
+	delete(s.streams, id)
+	return st
+}
+
+func (s *muxSession) closeStreams() {
+	s.access.Lock()
+	defer s.access.Unlock()
+	for id, st := range s.streams {
+		st.close()
+		delete(s.streams, id)
+	}
+}
+
+// finishStream closes the stream, telling the client unless it closed it
+func (s *muxSession) finishStream(st *stream) {
+	if s.removeStream(st.id) != nil {
+		s.writeFrame(cmdFIN, st.id, nil)
+	}
+	st.close()
+}
+
+// synAck tells the client of version 2 whether the stream is opened
+func (s *muxSession) synAck(st *stream, err error) {
+	if s.peerVersion < 2 {
+		return
+	}
+	var data []byte
+	if err != nil {
+		data = []byte(err.Error())
+	}
+	s.writeFrame(cmdSYNACK, st.id, data)
+}
+
+func (s *muxSession) handleStream(st *stream) {
+	defer s.finishStream(st)
+	if err := s.proxyStream(st); err != nil {
+		newError("stream ", st.id, " ends").Base(err).WriteToLog(session.ExportIDToError(s.ctx))
+	}
+}
+
+// proxyStream dispatches the stream to the destination at its start
+func (s *muxSession) proxyStream(st *stream) error {
+	reader := &buf.BufferedReader{Reader: st.reader}
+	b := buf.New()
+	addr, port, err := addrParser.ReadAddressPort(b, reader)
+	b.Release()
+	if err != nil {
+		return newError("failed to read destination").Base(err)
+	}
+
+	ctx := session.ContextWithContent(s.ctx, &session.Content{
+		SniffingRequest: s.server.sniffing,
+	})
+	if addr.Family().IsDomain() && addr.Domain() == uotMagicAddress {
+		return s.proxyUDP(ctx, st, reader)
+	}
+	destination := net.TCPDestination(addr, port)
+	return s.proxy(ctx, st, destination, reader, &streamWriter{session: s, stream: st})
+}
+
+func (s *muxSession) proxy(ctx context.Context, st *stream, destination net.Destination, clientReader buf.Reader, clientWriter buf.Writer) error {
+	sessionPolicy := s.server.policyManager.ForLevel(s.user.Level)
+	ctx, cancel := context.WithCancel(ctx)
+	timer := signal.CancelAfterInactivity(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle)
+	ctx = policy.ContextWithBufferPolicy(ctx, sessionPolicy.Buffer)
+	ctx = log.ContextWithAccessMessage(ctx, &log.AccessMessage{
+		From:   s.conn.RemoteAddr(),
+		To:     destination,
+		Status: log.AccessAccepted,
+		Reason: "",
+		Email:  s.user.Email,
+	})
+
+	newError("received request for ", destination).WriteToLog(session.ExportIDToError(ctx))
+	link, err := s.dispatcher.Dispatch(ctx, destination)
+	s.synAck(st, err)
+	if err != nil {
+		return newError("failed to dispatch request to ", destination).Base(err)
+	}
+
+	requestDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.DownlinkOnly)
+		if err := buf.Copy(clientReader, link.Writer, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to transfer request").Base(err)
+		}
+		return nil
+	}
+
+	responseDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.UplinkOnly)
+		if err := buf.Copy(link.Reader, clientWriter, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to write response").Base(err)
+		}
+		return nil
+	}
+
+	// The client closes the whole stream on FIN, so it is sent once the
+	// response is done, which ends the request too
+	requestDonePost := task.OnSuccess(requestDone, task.Close(link.Writer))
+	responseDonePost := task.OnSuccess(responseDone, func() error {
+		s.finishStream(st)
+		return nil
+	})
+	if err := task.Run(ctx, requestDonePost, responseDonePost); err != nil {
+		common.Must(common.Interrupt(link.Reader))
+		common.Must(common.Interrupt(link.Writer))
+		return newError("connection ends").Base(err)
+	}
+	return nil
+}
+
+// streamWriter writes the response of a stream as PSH frames
+type streamWriter struct {
+	session *muxSession
+	stream  *stream
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		select {
+		case <-w.stream.done:
+			return n, io.ErrClosedPipe
+		default:
+		}
+		data := p[n:]
+		if len(data) > maxFrameData {
+			data = data[:maxFrameData]
+		}
+		if err := w.session.writeFrame(cmdPSH, w.stream.id, data); err != nil {
+			return n, err
+		}
+		n += len(data)
+	}
+	return len(p), nil
+}
+
+func (w *streamWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	defer buf.ReleaseMulti(mb)
+	for _, b := range mb {
+		if _, err := w.Write(b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
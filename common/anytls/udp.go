@@ -0,0 +1,104 @@
+package anytls
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+)
+
+// uotMagicAddress is the destination of the streams carrying UDP, in the
+// UDP over TCP version 2 format of sing-box. Version 1 is not supported.
+const uotMagicAddress = "sp.v2.udp-over-tcp.arpa"
+
+// proxyUDP serves a UDP over TCP stream. It starts with whether it is
+// connected and the destination. The packets are then made of their length
+// and their payload, after their own destination unless connected.
+func (s *muxSession) proxyUDP(ctx context.Context, st *stream, reader *buf.BufferedReader) error {
+	var connect [1]byte
+	if _, err := io.ReadFull(reader, connect[:]); err != nil {
+		return newError("failed to read UDP request").Base(err)
+	}
+	b := buf.New()
+	addr, port, err := addrParser.ReadAddressPort(b, reader)
+	b.Release()
+	if err != nil {
+		return newError("failed to read UDP destination").Base(err)
+	}
+	destination := net.UDPDestination(addr, port)
+	return s.proxy(ctx, st, destination,
+		&packetReader{reader: reader, connect: connect[0] != 0},
+		&packetWriter{writer: &streamWriter{session: s, stream: st}, connect: connect[0] != 0, destination: destination})
+}
+
+type packetReader struct {
+	reader  *buf.BufferedReader
+	connect bool
+}
+
+func (r *packetReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	for {
+		var destination *net.Destination
+		if !r.connect {
+			b := buf.New()
+			addr, port, err := addrParser.ReadAddressPort(b, r.reader)
+			b.Release()
+			if err != nil {
+				return nil, newError("failed to read packet destination").Base(err)
+			}
+			dest := net.UDPDestination(addr, port)
+			destination = &dest
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(r.reader, size[:]); err != nil {
+			return nil, newError("failed to read packet length").Base(err)
+		}
+		length := int32(binary.BigEndian.Uint16(size[:]))
+		if length > buf.Size {
+			// Over the buffers of the outbounds, dropped like the ones lost on the way
+			if _, err := io.CopyN(io.Discard, r.reader, int64(length)); err != nil {
+				return nil, newError("failed to read packet").Base(err)
+			}
+			continue
+		}
+		b := buf.New()
+		if _, err := b.ReadFullFrom(r.reader, length); err != nil {
+			b.Release()
+			return nil, newError("failed to read packet").Base(err)
+		}
+		b.UDP = destination
+		return buf.MultiBuffer{b}, nil
+	}
+}
+
+type packetWriter struct {
+	writer      *streamWriter
+	connect     bool
+	destination net.Destination
+}
+
+func (w *packetWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	defer buf.ReleaseMulti(mb)
+	var packet bytes.Buffer
+	for _, b := range mb {
+		packet.Reset()
+		if !w.connect {
+			source := w.destination
+			if b.UDP != nil {
+				source = *b.UDP
+			}
+			if err := addrParser.WriteAddressPort(&packet, source.Address, source.Port); err != nil {
+				return err
+			}
+		}
+		binary.Write(&packet, binary.BigEndian, uint16(b.Len()))
+		packet.Write(b.Bytes())
+		if _, err := w.writer.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Package asn maps autonomous system numbers to the IP prefixes they announce,
+// read from an ip2asn database (https://iptoasn.com)
+package asn
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUpdateURL is the combined IPv4 and IPv6 database of iptoasn.com
+const DefaultUpdateURL = "https://iptoasn.com/data/ip2asn-combined.tsv.gz"
+
+type Database struct {
+	prefixes map[uint32][]netip.Prefix
+}
+
+var current atomic.Pointer[Database]
+
+// Current returns the database in use, nil if none is loaded yet
+func Current() *Database {
+	return current.Load()
+}
+
+// SetCurrent replaces the database in use
+func SetCurrent(db *Database) {
+	current.Store(db)
+}
+
+// Load reads the database at path, which may be gzipped
+func Load(path string) (*Database, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(bytes.NewReader(data))
+}
+
+// Parse reads a database made of tab separated lines of range start, range
+// end, AS number, country code and description. Gzipped input is accepted.
+func Parse(r io.Reader) (*Database, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+
+	db := &Database{prefixes: make(map[uint32][]netip.Prefix)}
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		number, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid AS number %q", line, fields[2])
+		}
+		// AS0 marks the ranges not routed by anyone
+		if number == 0 {
+			continue
+		}
+		start, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		end, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if start.BitLen() != end.BitLen() || end.Less(start) {
+			return nil, fmt.Errorf("line %d: invalid range %s-%s", line, start, end)
+		}
+		db.prefixes[uint32(number)] = append(db.prefixes[uint32(number)], rangeToPrefixes(start, end)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(db.prefixes) == 0 {
+		return nil, fmt.Errorf("empty ASN database")
+	}
+	return db, nil
+}
+
+// Prefixes returns the IP prefixes announced by the AS number
+func (d *Database) Prefixes(number uint32) []netip.Prefix {
+	return d.prefixes[number]
+}
+
+// Download fetches the database from url and saves it at path. The file is
+// replaced only when the download is a valid database.
+func Download(url, path string) (*Database, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s failed: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	db, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// rangeToPrefixes splits the address range from start to end into the
+// fewest prefixes covering it
+func rangeToPrefixes(start, end netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for {
+		// Widen the prefix while it still starts at start and ends before end
+		bits := start.BitLen()
+		for bits > 0 {
+			wider := netip.PrefixFrom(start, bits-1).Masked()
+			if wider.Addr() != start || end.Less(lastAddr(wider)) {
+				break
+			}
+			bits--
+		}
+		prefix := netip.PrefixFrom(start, bits)
+		prefixes = append(prefixes, prefix)
+		last := lastAddr(prefix)
+		if last == end {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().As16()
+	offset := 128 - prefix.Addr().BitLen()
+	for i := offset + prefix.Bits(); i < 128; i++ {
+		addr[i/8] |= 1 << (7 - i%8)
+	}
+	last := netip.AddrFrom16(addr)
+	if prefix.Addr().Is4() {
+		return last.Unmap()
+	}
+	return last
+}
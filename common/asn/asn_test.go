@@ -0,0 +1,32 @@
+package asn_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/asn"
+)
+
+func TestParse(t *testing.T) {
+	data := strings.Join([]string{
+		"1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET",
+		"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed",
+		"10.0.0.1\t10.0.0.6\t64512\tZZ\tPRIVATE",
+		"2606:4700::\t2606:4700:ffff:ffff:ffff:ffff:ffff:ffff\t13335\tUS\tCLOUDFLARENET",
+	}, "\n")
+	db, err := asn.Parse(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(db.Prefixes(13335)); got != "[1.0.0.0/24 2606:4700::/32]" {
+		t.Errorf("unexpected prefixes of AS13335: %s", got)
+	}
+	// The range is split at the prefix boundaries
+	if got := fmt.Sprint(db.Prefixes(64512)); got != "[10.0.0.1/32 10.0.0.2/31 10.0.0.4/31 10.0.0.6/32]" {
+		t.Errorf("unexpected prefixes of AS64512: %s", got)
+	}
+	if got := db.Prefixes(0); len(got) != 0 {
+		t.Errorf("AS0 should not be kept: %v", got)
+	}
+}
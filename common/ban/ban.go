@@ -0,0 +1,249 @@
+// Package ban keeps the client addresses failing to authenticate or breaking
+// the audit rules too often, and bans them for a while, like fail2ban.
+package ban
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Enable          bool     `mapstructure:"Enable"`
+	MaxAuthFailures int      `mapstructure:"MaxAuthFailures"` // 0 for not banning on them
+	MaxViolations   int      `mapstructure:"MaxViolations"`   // 0 for not banning on them
+	FindTime        int      `mapstructure:"FindTime"`        // Second
+	BanTime         int      `mapstructure:"BanTime"`         // Second
+	IgnoreIPs       []string `mapstructure:"IgnoreIPs"`       // IPs or CIDRs never banned
+}
+
+// Reasons of a ban
+const (
+	ReasonAuth      = "auth"
+	ReasonViolation = "violation"
+)
+
+// Ban is a banned address
+type Ban struct {
+	IP     string    `json:"IP"`
+	Reason string    `json:"Reason"`
+	Until  time.Time `json:"Until"`
+}
+
+type record struct {
+	auth       []time.Time
+	violations []time.Time
+}
+
+// Manager is disabled until configured by SetConfig
+type Manager struct {
+	access          sync.Mutex
+	enabled         bool
+	maxAuthFailures int
+	maxViolations   int
+	findTime        time.Duration
+	banTime         time.Duration
+	ignore          []netip.Prefix
+	records         map[netip.Addr]*record
+	bans            map[netip.Addr]Ban
+	swept           time.Time
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		records: make(map[netip.Addr]*record),
+		bans:    make(map[netip.Addr]Ban),
+	}
+}
+
+// SetConfig applies the config, nil disables the manager and lifts every ban
+func (m *Manager) SetConfig(config *Config) error {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.records = make(map[netip.Addr]*record)
+	m.bans = make(map[netip.Addr]Ban)
+	if config == nil || !config.Enable {
+		m.enabled = false
+		return nil
+	}
+	// Never ban this machine
+	ignore := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	for _, s := range config.IgnoreIPs {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return err
+		}
+		ignore = append(ignore, prefix)
+	}
+	m.ignore = ignore
+	m.maxAuthFailures = config.MaxAuthFailures
+	m.maxViolations = config.MaxViolations
+	m.findTime = time.Duration(config.FindTime) * time.Second
+	if m.findTime <= 0 {
+		m.findTime = 10 * time.Minute
+	}
+	m.banTime = time.Duration(config.BanTime) * time.Second
+	if m.banTime <= 0 {
+		m.banTime = time.Hour
+	}
+	m.enabled = true
+	return nil
+}
+
+// AuthFailed counts a failed authentication of addr, and reports whether it
+// got banned for it
+func (m *Manager) AuthFailed(addr netip.Addr) bool {
+	return m.fail(addr, ReasonAuth)
+}
+
+// Violated counts an audit rule broken by addr, and reports whether it got
+// banned for it
+func (m *Manager) Violated(addr netip.Addr) bool {
+	return m.fail(addr, ReasonViolation)
+}
+
+func (m *Manager) fail(addr netip.Addr, reason string) bool {
+	addr = addr.Unmap()
+	m.access.Lock()
+	defer m.access.Unlock()
+	if !m.enabled || !addr.IsValid() || m.ignored(addr) {
+		return false
+	}
+	now := time.Now()
+	m.sweep(now)
+	if ban, ok := m.bans[addr]; ok && now.Before(ban.Until) {
+		return false
+	}
+	r, ok := m.records[addr]
+	if !ok {
+		r = &record{}
+		m.records[addr] = r
+	}
+	var (
+		times *[]time.Time
+		limit int
+	)
+	switch reason {
+	case ReasonAuth:
+		times, limit = &r.auth, m.maxAuthFailures
+	default:
+		times, limit = &r.violations, m.maxViolations
+	}
+	if limit <= 0 {
+		return false
+	}
+	*times = append(recent(*times, now.Add(-m.findTime)), now)
+	if len(*times) < limit {
+		return false
+	}
+	delete(m.records, addr)
+	m.bans[addr] = Ban{IP: addr.String(), Reason: reason, Until: now.Add(m.banTime)}
+	return true
+}
+
+// Banned reports whether addr is banned now
+func (m *Manager) Banned(addr netip.Addr) bool {
+	m.access.Lock()
+	defer m.access.Unlock()
+	if !m.enabled || len(m.bans) == 0 {
+		return false
+	}
+	ban, ok := m.bans[addr.Unmap()]
+	return ok && time.Now().Before(ban.Until)
+}
+
+// Unban lifts the ban of addr, and reports whether it was banned
+func (m *Manager) Unban(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	m.access.Lock()
+	defer m.access.Unlock()
+	_, ok := m.bans[addr]
+	delete(m.bans, addr)
+	delete(m.records, addr)
+	return ok
+}
+
+// List returns the bans in force, the ones ending first first
+func (m *Manager) List() []Ban {
+	m.access.Lock()
+	defer m.access.Unlock()
+	now := time.Now()
+	bans := make([]Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// sweep drops the expired bans and the records without recent failures,
+// at most once per find time
+func (m *Manager) sweep(now time.Time) {
+	if now.Sub(m.swept) < m.findTime {
+		return
+	}
+	m.swept = now
+	since := now.Add(-m.findTime)
+	for addr, r := range m.records {
+		r.auth = recent(r.auth, since)
+		r.violations = recent(r.violations, since)
+		if len(r.auth) == 0 && len(r.violations) == 0 {
+			delete(m.records, addr)
+		}
+	}
+	for addr, ban := range m.bans {
+		if !now.Before(ban.Until) {
+			delete(m.bans, addr)
+		}
+	}
+}
+
+func (m *Manager) ignored(addr netip.Addr) bool {
+	for _, prefix := range m.ignore {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// recent drops the times before since
+func recent(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	return times[i:]
+}
+
+// ParseSource returns the address of a connection source as logged by the
+// core, like 1.2.3.4:5678, tcp:1.2.3.4:5678 or [::1]:5678
+func ParseSource(source string) (netip.Addr, bool) {
+	source = strings.TrimPrefix(strings.TrimPrefix(source, "tcp:"), "udp:")
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	addr, err := netip.ParseAddr(source)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,55 @@
+package ban_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/ban"
+)
+
+func TestBan(t *testing.T) {
+	m := ban.NewManager()
+	client := netip.MustParseAddr("192.0.2.1")
+	if m.AuthFailed(client) || m.Banned(client) {
+		t.Fatal("a disabled manager should not ban")
+	}
+	if err := m.SetConfig(&ban.Config{Enable: true, MaxAuthFailures: 3, MaxViolations: 1, IgnoreIPs: []string{"198.51.100.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if m.AuthFailed(client) {
+			t.Fatalf("banned after %d failures", i+1)
+		}
+	}
+	if !m.AuthFailed(netip.MustParseAddr("::ffff:192.0.2.1")) || !m.Banned(client) {
+		t.Fatal("the third failure should ban")
+	}
+	if m.Violated(netip.MustParseAddr("198.51.100.7")) {
+		t.Error("an ignored IP should not be banned")
+	}
+	if !m.Violated(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("a violation should ban")
+	}
+	if bans := m.List(); len(bans) != 2 || bans[0].IP != "192.0.2.1" || bans[0].Reason != ban.ReasonAuth {
+		t.Errorf("unexpected bans: %v", bans)
+	}
+	if !m.Unban(client) || m.Banned(client) || m.Unban(client) {
+		t.Error("unban should lift the ban once")
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	for source, want := range map[string]string{
+		"1.2.3.4:5678":       "1.2.3.4",
+		"tcp:1.2.3.4:5678":   "1.2.3.4",
+		"udp:[::1]:53":       "::1",
+		"[::ffff:1.2.3.4]:1": "1.2.3.4",
+	} {
+		if addr, ok := ban.ParseSource(source); !ok || addr.String() != want {
+			t.Errorf("ParseSource(%s) = %s, %v", source, addr, ok)
+		}
+	}
+	if _, ok := ban.ParseSource(""); ok {
+		t.Error("an empty source should not parse")
+	}
+}
@@ -0,0 +1,60 @@
+package ban
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// Inbound is an inbound proxy closing the connections of the banned addresses
+// as they are accepted, before the proxy reads the handshake. The failed
+// authentications are what gets an address banned, so the ban has to stop
+// them, not only the connections that authenticate.
+type Inbound struct {
+	proxy.Inbound
+	Manager *Manager
+}
+
+// Process implements proxy.Inbound.Process().
+func (p *Inbound) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	if addr, ok := sourceOf(ctx); ok && p.Manager.Banned(addr) {
+		conn.Close()
+		return fmt.Errorf("source %s is banned", addr)
+	}
+	return p.Inbound.Process(ctx, network, conn, dispatcher)
+}
+
+// AddUser implements proxy.UserManager.AddUser().
+func (p *Inbound) AddUser(ctx context.Context, u *protocol.MemoryUser) error {
+	userManager, ok := p.Inbound.(proxy.UserManager)
+	if !ok {
+		return fmt.Errorf("proxy has no users")
+	}
+	return userManager.AddUser(ctx, u)
+}
+
+// RemoveUser implements proxy.UserManager.RemoveUser().
+func (p *Inbound) RemoveUser(ctx context.Context, email string) error {
+	userManager, ok := p.Inbound.(proxy.UserManager)
+	if !ok {
+		return fmt.Errorf("proxy has no users")
+	}
+	return userManager.RemoveUser(ctx, email)
+}
+
+// sourceOf returns the client address of the connection of ctx
+func sourceOf(ctx context.Context) (netip.Addr, bool) {
+	inbound := session.InboundFromContext(ctx)
+	if inbound == nil || !inbound.Source.IsValid() || !inbound.Source.Address.Family().IsIP() {
+		return netip.Addr{}, false
+	}
+	addr, ok := netip.AddrFromSlice(inbound.Source.Address.IP())
+	return addr.Unmap(), ok
+}
@@ -0,0 +1,65 @@
+package ban_test
+
+import (
+	"context"
+	"errors"
+	gonet "net"
+	"net/netip"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/transport/internet/stat"
+
+	"github.com/qtai2901/new_xrayr/common/ban"
+)
+
+// rejectingInbound fails the authentication of every connection, counting it
+// like the log handler of the panel does
+type rejectingInbound struct {
+	manager *ban.Manager
+	auths   int
+}
+
+func (p *rejectingInbound) Network() []net.Network {
+	return []net.Network{net.Network_TCP}
+}
+
+func (p *rejectingInbound) Process(ctx context.Context, _ net.Network, conn stat.Connection, _ routing.Dispatcher) error {
+	p.auths++
+	p.manager.AuthFailed(netip.MustParseAddr("192.0.2.1"))
+	conn.Close()
+	return errors.New("invalid user")
+}
+
+func TestInboundRefusesBanned(t *testing.T) {
+	m := ban.NewManager()
+	if err := m.SetConfig(&ban.Config{Enable: true, MaxAuthFailures: 2}); err != nil {
+		t.Fatal(err)
+	}
+	rejecting := &rejectingInbound{manager: m}
+	inbound := &ban.Inbound{Inbound: rejecting, Manager: m}
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Source: net.TCPDestination(net.ParseAddress("192.0.2.1"), 5678),
+	})
+	for i := 0; i < 3; i++ {
+		client, server := gonet.Pipe()
+		inbound.Process(ctx, net.Network_TCP, server, nil)
+		if _, err := client.Write([]byte{0}); err == nil {
+			t.Errorf("connection %d left open", i+1)
+		}
+	}
+	if rejecting.auths != 2 {
+		t.Errorf("the proxy authenticated %d connections, want the 2 before the ban", rejecting.auths)
+	}
+	other := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Source: net.TCPDestination(net.ParseAddress("192.0.2.2"), 5678),
+	})
+	auths := rejecting.auths
+	_, server := gonet.Pipe()
+	inbound.Process(other, net.Network_TCP, server, nil)
+	if rejecting.auths != auths+1 {
+		t.Error("the connection of another address did not reach the proxy")
+	}
+}
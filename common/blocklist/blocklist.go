@@ -0,0 +1,310 @@
+// Package blocklist keeps the IP ranges of external blocklists, like the
+// Spamhaus DROP lists, and counts the connections of each node blocked by them
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultURLs are the Spamhaus DROP lists of IPv4 and IPv6
+var DefaultURLs = []string{
+	"https://www.spamhaus.org/drop/drop_v4.json",
+	"https://www.spamhaus.org/drop/drop_v6.json",
+}
+
+type addrRange struct {
+	start, end netip.Addr
+}
+
+// List is a set of address ranges, sorted and merged for lookups
+type List struct {
+	ranges []addrRange
+}
+
+var current atomic.Pointer[List]
+
+// Current returns the list in use, nil if none is loaded yet
+func Current() *List {
+	return current.Load()
+}
+
+// SetCurrent replaces the list in use
+func SetCurrent(list *List) {
+	current.Store(list)
+}
+
+// Parse reads a list of one CIDR or IP per line. Text after ';' or '#' is a
+// comment, and the JSON lines of the Spamhaus lists are read by their cidr field.
+func Parse(r io.Reader) (*List, error) {
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(text), "{") {
+			var entry struct {
+				CIDR string `json:"cidr"`
+			}
+			if err := json.Unmarshal([]byte(text), &entry); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			// The metadata line has no cidr
+			if entry.CIDR == "" {
+				continue
+			}
+			text = entry.CIDR
+		}
+		if i := strings.IndexAny(text, ";#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		prefix, err := parsePrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newList(prefixes), nil
+}
+
+func parsePrefix(text string) (netip.Prefix, error) {
+	if strings.Contains(text, "/") {
+		prefix, err := netip.ParsePrefix(text)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func newList(prefixes []netip.Prefix) *List {
+	ranges := make([]addrRange, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		ranges = append(ranges, addrRange{start: prefix.Addr(), end: lastAddr(prefix)})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Less(ranges[j].start) })
+	// Merge the overlapping and adjacent ranges, so a lookup only checks the one before it
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].start.BitLen() == r.start.BitLen() && reaches(merged[n-1].end, r.start) {
+			if merged[n-1].end.Less(r.end) {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return &List{ranges: merged}
+}
+
+// reaches reports whether a range ending at end covers or touches start
+func reaches(end, start netip.Addr) bool {
+	next := end.Next()
+	return !next.IsValid() || !next.Less(start)
+}
+
+// Merge returns a list of the ranges of all the lists
+func Merge(lists ...*List) *List {
+	var prefixes []netip.Prefix
+	for _, list := range lists {
+		for _, r := range list.ranges {
+			prefixes = append(prefixes, rangePrefixes(r)...)
+		}
+	}
+	return newList(prefixes)
+}
+
+// Len returns the number of ranges
+func (l *List) Len() int {
+	return len(l.ranges)
+}
+
+// Contains reports whether addr is in one of the ranges
+func (l *List) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	i := sort.Search(len(l.ranges), func(i int) bool { return addr.Less(l.ranges[i].start) })
+	if i == 0 {
+		return false
+	}
+	r := l.ranges[i-1]
+	return r.start.BitLen() == addr.BitLen() && !r.end.Less(addr)
+}
+
+// Download fetches the lists at urls and saves them merged at path, if a
+// path is given. Nothing is replaced unless every list is valid.
+func Download(urls []string, path string) (*List, error) {
+	client := &http.Client{Timeout: 2 * time.Minute}
+	var (
+		lists []*List
+		saved bytes.Buffer
+	)
+	for _, url := range urls {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("download %s failed: %s", url, resp.Status)
+		}
+		list, err := Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("parse %s failed: %s", url, err)
+		}
+		lists = append(lists, list)
+	}
+	list := Merge(lists...)
+	if path == "" {
+		return list, nil
+	}
+	for _, r := range list.ranges {
+		for _, prefix := range rangePrefixes(r) {
+			fmt.Fprintln(&saved, prefix)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, saved.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+	return list, os.Rename(tmp, path)
+}
+
+// Load reads a list saved by Download
+func Load(path string) (*List, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// Manager keeps the nodes checking their destinations against the current
+// list, along with their hits
+type Manager struct {
+	nodes sync.Map // Key: inbound tag, value: *node
+}
+
+type node struct {
+	resolveDomain bool
+	hits          atomic.Uint64
+}
+
+func NewManager() *Manager {
+	return &Manager{}
+}
+
+// AddNode turns the blocklist on for the inbound with tag. With
+// resolveDomain the destinations given as domains are resolved and checked too.
+func (m *Manager) AddNode(tag string, resolveDomain bool) {
+	n := &node{resolveDomain: resolveDomain}
+	if old, loaded := m.nodes.LoadOrStore(tag, n); loaded {
+		old.(*node).resolveDomain = resolveDomain
+	}
+}
+
+func (m *Manager) RemoveNode(tag string) {
+	m.nodes.Delete(tag)
+}
+
+// Enabled reports whether the inbound with tag uses the blocklist, and if
+// its domains are resolved
+func (m *Manager) Enabled(tag string) (enabled bool, resolveDomain bool) {
+	value, ok := m.nodes.Load(tag)
+	if !ok || Current() == nil {
+		return false, false
+	}
+	return true, value.(*node).resolveDomain
+}
+
+// Blocked reports whether one of addrs is listed, counting a hit for the
+// inbound with tag if it is
+func (m *Manager) Blocked(tag string, addrs ...netip.Addr) bool {
+	list := Current()
+	value, ok := m.nodes.Load(tag)
+	if list == nil || !ok {
+		return false
+	}
+	for _, addr := range addrs {
+		if list.Contains(addr) {
+			value.(*node).hits.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+// Hits returns the number of connections blocked for each inbound tag
+func (m *Manager) Hits() map[string]uint64 {
+	hits := make(map[string]uint64)
+	m.nodes.Range(func(key, value any) bool {
+		hits[key.(string)] = value.(*node).hits.Load()
+		return true
+	})
+	return hits
+}
+
+// rangePrefixes splits a range into the fewest prefixes covering it
+func rangePrefixes(r addrRange) []netip.Prefix {
+	var prefixes []netip.Prefix
+	start := r.start
+	for {
+		bits := start.BitLen()
+		for bits > 0 {
+			wider := netip.PrefixFrom(start, bits-1).Masked()
+			if wider.Addr() != start || r.end.Less(lastAddr(wider)) {
+				break
+			}
+			bits--
+		}
+		prefix := netip.PrefixFrom(start, bits)
+		prefixes = append(prefixes, prefix)
+		last := lastAddr(prefix)
+		if last == r.end {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().As16()
+	offset := 128 - prefix.Addr().BitLen()
+	for i := offset + prefix.Bits(); i < 128; i++ {
+		addr[i/8] |= 1 << (7 - i%8)
+	}
+	last := netip.AddrFrom16(addr)
+	if prefix.Addr().Is4() {
+		return last.Unmap()
+	}
+	return last
+}
@@ -0,0 +1,84 @@
+package blocklist_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/blocklist"
+)
+
+func TestParse(t *testing.T) {
+	list, err := blocklist.Parse(strings.NewReader(`; Spamhaus DROP List
+1.10.16.0/20 ; SBL256894
+1.10.16.0/24
+# a single address
+192.0.2.7
+{"cidr":"2001:db8::/32","sblid":"SBL1","rir":"arin"}
+{"type":"metadata","timestamp":1700000000}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Len() != 3 {
+		t.Errorf("expected 3 merged ranges, got %d", list.Len())
+	}
+	for addr, want := range map[string]bool{
+		"1.10.16.1":        true,
+		"1.10.31.255":      true,
+		"1.10.32.0":        false,
+		"192.0.2.7":        true,
+		"192.0.2.8":        false,
+		"::ffff:1.10.20.1": true,
+		"2001:db8:ffff::1": true,
+		"2001:db9::1":      false,
+		"::1":              false,
+	} {
+		if got := list.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if _, err := blocklist.Parse(strings.NewReader("not an address\n")); err == nil {
+		t.Error("expected an error for an invalid line")
+	}
+}
+
+func TestDownloadAndHits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			w.Write([]byte("10.0.0.0/25\n"))
+		case "/b":
+			w.Write([]byte("10.0.0.128/25\n"))
+		}
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	list, err := blocklist.Download([]string{server.URL + "/a", server.URL + "/b"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Len() != 1 {
+		t.Errorf("adjacent ranges should merge, got %d ranges", list.Len())
+	}
+	cached, err := blocklist.Load(path)
+	if err != nil || cached.Len() != 1 || !cached.Contains(netip.MustParseAddr("10.0.0.200")) {
+		t.Fatalf("unexpected cached list: %v", err)
+	}
+
+	blocklist.SetCurrent(cached)
+	m := blocklist.NewManager()
+	m.AddNode("node", false)
+	if m.Blocked("other", netip.MustParseAddr("10.0.0.1")) {
+		t.Error("a node without the blocklist should not be blocked")
+	}
+	if !m.Blocked("node", netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("10.0.0.1")) {
+		t.Error("a listed address should be blocked")
+	}
+	if hits := m.Hits(); hits["node"] != 1 {
+		t.Errorf("expected 1 hit, got %v", hits)
+	}
+}
@@ -0,0 +1,102 @@
+// Package cluster coordinates the XrayR instances serving the same node on
+// different machines through redis or etcd. The instances pool their traffic,
+// and a single elected leader reports the pooled traffic, the online users
+// and the node status to the panel.
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+type Config struct {
+	Enable        bool   `mapstructure:"Enable"`
+	Type          string `mapstructure:"Type"`         // redis or etcd
+	RedisNetwork  string `mapstructure:"RedisNetwork"` // tcp or unix
+	RedisAddr     string `mapstructure:"RedisAddr"`    // host:port, or /path/to/unix.sock
+	RedisUsername string `mapstructure:"RedisUsername"`
+	RedisPassword string `mapstructure:"RedisPassword"`
+	RedisDB       int    `mapstructure:"RedisDB"`
+	EtcdAddress   string `mapstructure:"EtcdAddress"` // Like http://127.0.0.1:2379
+	EtcdUsername  string `mapstructure:"EtcdUsername"`
+	EtcdPassword  string `mapstructure:"EtcdPassword"`
+	Timeout       int    `mapstructure:"Timeout"`   // second
+	LeaseTime     int    `mapstructure:"LeaseTime"` // second
+}
+
+// Cluster is the membership of this instance in the cluster of a node
+type Cluster interface {
+	// IsLeader takes or renews the leader lease and reports whether this
+	// instance holds it. The lease is lost when it is not renewed in time,
+	// so another instance takes over when the leader is gone.
+	IsLeader() (bool, error)
+	// PushTraffic adds the traffic of this instance to the pool of the cluster
+	PushTraffic(userTraffic []api.UserTraffic) error
+	// PopTraffic takes all the traffic pooled by the cluster
+	PopTraffic() ([]api.UserTraffic, error)
+	// PushOnline replaces the online users shared by this instance. They
+	// expire after the lease time unless pushed again.
+	PushOnline(onlineUser []api.OnlineUser) error
+	// Online returns the online users shared by every instance
+	Online() ([]api.OnlineUser, error)
+	// Close leaves the cluster, handing the leader lease over at once
+	Close() error
+}
+
+// New joins the cluster of the node identified by name
+func New(config *Config, name string) (Cluster, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	id := fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(random))
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	lease := time.Duration(config.LeaseTime) * time.Second
+	if lease <= 0 {
+		lease = 2 * time.Minute
+	}
+
+	switch strings.ToLower(config.Type) {
+	case "", "redis":
+		return newRedisCluster(config, name, id, timeout, lease), nil
+	case "etcd":
+		if config.EtcdAddress == "" {
+			return nil, fmt.Errorf("cluster etcd address is empty")
+		}
+		return newEtcdCluster(config, name, id, timeout, lease), nil
+	default:
+		return nil, fmt.Errorf("unsupported cluster type: %s", config.Type)
+	}
+}
+
+// sharedOnline is the value of the online users shared by an instance
+type sharedOnline struct {
+	At    int64 // Unix millisecond
+	Users []api.OnlineUser
+}
+
+// mergeTraffic sums the traffic of each user
+func mergeTraffic(userTraffic []api.UserTraffic) []api.UserTraffic {
+	index := make(map[int]int)
+	var merged []api.UserTraffic
+	for _, t := range userTraffic {
+		if i, ok := index[t.UID]; ok {
+			merged[i].Upload += t.Upload
+			merged[i].Download += t.Download
+			continue
+		}
+		index[t.UID] = len(merged)
+		merged = append(merged, t)
+	}
+	return merged
+}
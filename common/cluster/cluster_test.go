@@ -0,0 +1,148 @@
+package cluster_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/cluster"
+)
+
+// fakeEtcd serves the part of the etcd JSON gateway used by the cluster,
+// with the keys of a lease removed when it is revoked
+type fakeEtcd struct {
+	access sync.Mutex
+	kvs    map[string][]byte
+	leases map[string]string // Key: key, value: lease
+	nextID int
+}
+
+func (e *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.access.Lock()
+	defer e.access.Unlock()
+	var req struct {
+		ID       string
+		Key      []byte `json:"key"`
+		RangeEnd []byte `json:"range_end"`
+		Value    []byte `json:"value"`
+		Lease    string `json:"lease"`
+		Success  []struct {
+			RequestPut struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+				Lease string `json:"lease"`
+			} `json:"request_put"`
+		} `json:"success"`
+		Compare []struct {
+			Key []byte `json:"key"`
+		} `json:"compare"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	reply := func(v any) { json.NewEncoder(w).Encode(v) }
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		e.nextID++
+		reply(map[string]string{"ID": string(rune('0' + e.nextID)), "TTL": "60"})
+	case "/v3/lease/keepalive":
+		reply(map[string]any{"result": map[string]string{"ID": req.ID, "TTL": "60"}})
+	case "/v3/lease/revoke":
+		for key, lease := range e.leases {
+			if lease == req.ID {
+				delete(e.kvs, key)
+				delete(e.leases, key)
+			}
+		}
+		reply(struct{}{})
+	case "/v3/kv/txn":
+		key := string(req.Compare[0].Key)
+		if value, ok := e.kvs[key]; ok {
+			reply(map[string]any{"responses": []any{map[string]any{
+				"response_range": map[string]any{"kvs": []any{map[string][]byte{"key": []byte(key), "value": value}}},
+			}}})
+			return
+		}
+		put := req.Success[0].RequestPut
+		e.kvs[key], e.leases[key] = put.Value, put.Lease
+		reply(map[string]bool{"succeeded": true})
+	case "/v3/kv/put":
+		e.kvs[string(req.Key)] = req.Value
+		if req.Lease != "" {
+			e.leases[string(req.Key)] = req.Lease
+		}
+		reply(struct{}{})
+	case "/v3/kv/range":
+		var kvs []map[string][]byte
+		for key, value := range e.kvs {
+			if key >= string(req.Key) && key < string(req.RangeEnd) {
+				kvs = append(kvs, map[string][]byte{"key": []byte(key), "value": value})
+			}
+		}
+		reply(map[string]any{"kvs": kvs})
+	case "/v3/kv/deleterange":
+		delete(e.kvs, string(req.Key))
+		reply(struct{}{})
+	}
+}
+
+func TestEtcdCluster(t *testing.T) {
+	etcd := &fakeEtcd{kvs: make(map[string][]byte), leases: make(map[string]string)}
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	config := &cluster.Config{Type: "etcd", EtcdAddress: server.URL}
+	leader, err := cluster.New(config, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := cluster.New(config, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := leader.IsLeader(); err != nil || !ok {
+		t.Fatalf("the first instance should lead: %v", err)
+	}
+	if ok, err := follower.IsLeader(); err != nil || ok {
+		t.Fatalf("the second instance should follow: %v", err)
+	}
+
+	// The leader reports the traffic and online users of both
+	if err := follower.PushTraffic([]api.UserTraffic{{UID: 1, Upload: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.PushTraffic([]api.UserTraffic{{UID: 1, Upload: 5, Download: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	traffic, err := leader.PopTraffic()
+	if err != nil || len(traffic) != 1 || traffic[0].Upload != 15 || traffic[0].Download != 1 {
+		t.Fatalf("unexpected pooled traffic: %v, %v", traffic, err)
+	}
+	if traffic, _ := leader.PopTraffic(); len(traffic) != 0 {
+		t.Fatalf("the pool should be empty, got %v", traffic)
+	}
+	if err := follower.PushOnline([]api.OnlineUser{{UID: 1, IP: "1.2.3.4"}}); err != nil {
+		t.Fatal(err)
+	}
+	if online, err := leader.Online(); err != nil || len(online) != 1 || online[0].IP != "1.2.3.4" {
+		t.Fatalf("unexpected online users: %v, %v", online, err)
+	}
+
+	// Leaving hands the leadership over at once
+	if err := leader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := follower.IsLeader(); err != nil || !ok {
+		t.Fatalf("the follower should take over: %v", err)
+	}
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for key := range etcd.kvs {
+		if !strings.Contains(key, "/traffic/") {
+			t.Errorf("key %s should go with the lease", key)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// etcdCluster talks to the JSON gateway of the etcd v3 API. The instance
+// holds a lease renewed on every IsLeader, the leader key and the shared
+// online users are attached to it, so they vanish with the instance. The
+// pooled traffic is kept in keys of its own until the leader takes it.
+type etcdCluster struct {
+	access   sync.Mutex
+	client   *http.Client
+	address  string
+	username string
+	password string
+	prefix   string
+	id       string
+	timeout  time.Duration
+	lease    time.Duration
+	token    string
+	leaseID  string
+	seq      int
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+func newEtcdCluster(config *Config, name, id string, timeout, lease time.Duration) *etcdCluster {
+	return &etcdCluster{
+		client:   &http.Client{Timeout: timeout},
+		address:  strings.TrimSuffix(config.EtcdAddress, "/"),
+		username: config.EtcdUsername,
+		password: config.EtcdPassword,
+		prefix:   "xrayr/cluster/" + name + "/",
+		id:       id,
+		timeout:  timeout,
+		lease:    lease,
+	}
+}
+
+func (c *etcdCluster) IsLeader() (bool, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if err := c.keepLease(); err != nil {
+		return false, err
+	}
+	key := []byte(c.prefix + "leader")
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+		Responses []struct {
+			ResponseRange etcdRangeResponse `json:"response_range"`
+		} `json:"responses"`
+	}
+	// Take the leader key if nobody has it, read its holder otherwise
+	if err := c.call("/v3/kv/txn", map[string]any{
+		"compare": []map[string]any{{"key": key, "result": "EQUAL", "target": "CREATE", "create_revision": "0"}},
+		"success": []map[string]any{{"request_put": map[string]any{"key": key, "value": []byte(c.id), "lease": c.leaseID}}},
+		"failure": []map[string]any{{"request_range": map[string]any{"key": key}}},
+	}, &resp); err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	for _, r := range resp.Responses {
+		for _, kv := range r.ResponseRange.Kvs {
+			if string(kv.Value) == c.id {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// keepLease renews the lease of the instance, or grants a new one if it
+// has expired
+func (c *etcdCluster) keepLease() error {
+	if c.leaseID != "" {
+		var resp struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		if err := c.call("/v3/lease/keepalive", map[string]any{"ID": c.leaseID}, &resp); err != nil {
+			return err
+		}
+		if ttl, _ := strconv.Atoi(resp.Result.TTL); ttl > 0 {
+			return nil
+		}
+		c.leaseID = ""
+	}
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	if err := c.call("/v3/lease/grant", map[string]any{"TTL": strconv.Itoa(int(c.lease.Seconds()))}, &resp); err != nil {
+		return err
+	}
+	c.leaseID = resp.ID
+	return nil
+}
+
+func (c *etcdCluster) PushTraffic(userTraffic []api.UserTraffic) error {
+	value, err := json.Marshal(userTraffic)
+	if err != nil {
+		return err
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.seq++
+	key := fmt.Sprintf("%straffic/%s/%d-%d", c.prefix, c.id, time.Now().UnixNano(), c.seq)
+	return c.call("/v3/kv/put", map[string]any{"key": []byte(key), "value": value}, &struct{}{})
+}
+
+func (c *etcdCluster) PopTraffic() ([]api.UserTraffic, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	kvs, err := c.rangePrefix(c.prefix + "traffic/")
+	if err != nil {
+		return nil, err
+	}
+	var userTraffic []api.UserTraffic
+	for _, kv := range kvs {
+		// Every key is written once, deleting the ones read leaves the new ones alone
+		if err := c.call("/v3/kv/deleterange", map[string]any{"key": kv.Key}, &struct{}{}); err != nil {
+			return mergeTraffic(userTraffic), err
+		}
+		var pushed []api.UserTraffic
+		if err := json.Unmarshal(kv.Value, &pushed); err == nil {
+			userTraffic = append(userTraffic, pushed...)
+		}
+	}
+	return mergeTraffic(userTraffic), nil
+}
+
+func (c *etcdCluster) PushOnline(onlineUser []api.OnlineUser) error {
+	value, err := json.Marshal(&sharedOnline{At: time.Now().UnixMilli(), Users: onlineUser})
+	if err != nil {
+		return err
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.leaseID == "" {
+		if err := c.keepLease(); err != nil {
+			return err
+		}
+	}
+	return c.call("/v3/kv/put", map[string]any{
+		"key":   []byte(c.prefix + "online/" + c.id),
+		"value": value,
+		"lease": c.leaseID,
+	}, &struct{}{})
+}
+
+func (c *etcdCluster) Online() ([]api.OnlineUser, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	kvs, err := c.rangePrefix(c.prefix + "online/")
+	if err != nil {
+		return nil, err
+	}
+	var onlineUser []api.OnlineUser
+	for _, kv := range kvs {
+		var s sharedOnline
+		if err := json.Unmarshal(kv.Value, &s); err != nil || time.Since(time.UnixMilli(s.At)) > c.lease {
+			continue
+		}
+		onlineUser = append(onlineUser, s.Users...)
+	}
+	return onlineUser, nil
+}
+
+// Close revokes the lease, which removes the leader key if this instance holds it
+func (c *etcdCluster) Close() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.leaseID == "" {
+		return nil
+	}
+	err := c.call("/v3/lease/revoke", map[string]any{"ID": c.leaseID}, &struct{}{})
+	c.leaseID = ""
+	return err
+}
+
+func (c *etcdCluster) rangePrefix(prefix string) ([]etcdKeyValue, error) {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	var resp etcdRangeResponse
+	if err := c.call("/v3/kv/range", map[string]any{"key": []byte(prefix), "range_end": end}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Kvs, nil
+}
+
+func (c *etcdCluster) call(path string, request any, response any) error {
+	if c.username != "" && c.token == "" && path != "/v3/auth/authenticate" {
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := c.call("/v3/auth/authenticate", map[string]string{
+			"name":     c.username,
+			"password": c.password,
+		}, &resp); err != nil {
+			return err
+		}
+		c.token = resp.Token
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.address+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// The token expired, authenticate again next time
+		if resp.StatusCode == http.StatusUnauthorized {
+			c.token = ""
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("etcd %s: %s %s", path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	// Streaming calls like the lease keepalive answer one object per line,
+	// only the first one is needed
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("parse etcd response failed: %s", err)
+	}
+	return nil
+}
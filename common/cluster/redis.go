@@ -0,0 +1,160 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// acquireScript takes or renews the leader lease held by ARGV[1]
+var acquireScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
+// releaseScript drops the leader lease if ARGV[1] still holds it
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisCluster keeps the leader lease and the pools in keys of redis
+type redisCluster struct {
+	client  *redis.Client
+	key     string
+	id      string
+	timeout time.Duration
+	lease   time.Duration
+}
+
+func newRedisCluster(config *Config, name, id string, timeout, lease time.Duration) *redisCluster {
+	return &redisCluster{
+		client: redis.NewClient(&redis.Options{
+			Network:  config.RedisNetwork,
+			Addr:     config.RedisAddr,
+			Username: config.RedisUsername,
+			Password: config.RedisPassword,
+			DB:       config.RedisDB,
+		}),
+		key:     "xrayr:cluster:" + name,
+		id:      id,
+		timeout: timeout,
+		lease:   lease,
+	}
+}
+
+func (c *redisCluster) IsLeader() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	held, err := acquireScript.Run(ctx, c.client, []string{c.key + ":leader"}, c.id, c.lease.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return held == 1, nil
+}
+
+func (c *redisCluster) PushTraffic(userTraffic []api.UserTraffic) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, t := range userTraffic {
+			uid := strconv.Itoa(t.UID)
+			pipe.HIncrBy(ctx, c.key+":upload", uid, t.Upload)
+			pipe.HIncrBy(ctx, c.key+":download", uid, t.Download)
+			pipe.HSet(ctx, c.key+":email", uid, t.Email)
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *redisCluster) PopTraffic() ([]api.UserTraffic, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	var upload, download, email *redis.MapStringStringCmd
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		upload = pipe.HGetAll(ctx, c.key+":upload")
+		download = pipe.HGetAll(ctx, c.key+":download")
+		email = pipe.HGetAll(ctx, c.key+":email")
+		pipe.Del(ctx, c.key+":upload", c.key+":download", c.key+":email")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var userTraffic []api.UserTraffic
+	for uid, value := range upload.Val() {
+		t := api.UserTraffic{Email: email.Val()[uid]}
+		t.UID, _ = strconv.Atoi(uid)
+		t.Upload, _ = strconv.ParseInt(value, 10, 64)
+		t.Download, _ = strconv.ParseInt(download.Val()[uid], 10, 64)
+		userTraffic = append(userTraffic, t)
+	}
+	return userTraffic, nil
+}
+
+// PushOnline keeps the online users of each instance in a field of a hash,
+// stamped with the time they were pushed
+func (c *redisCluster) PushOnline(onlineUser []api.OnlineUser) error {
+	data, err := json.Marshal(&sharedOnline{At: time.Now().UnixMilli(), Users: onlineUser})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, c.key+":online", c.id, data)
+		pipe.PExpire(ctx, c.key+":online", c.lease)
+		return nil
+	})
+	return err
+}
+
+func (c *redisCluster) Online() ([]api.OnlineUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	shared, err := c.client.HGetAll(ctx, c.key+":online").Result()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		onlineUser []api.OnlineUser
+		expired    []string
+	)
+	for id, data := range shared {
+		var s sharedOnline
+		if err := json.Unmarshal([]byte(data), &s); err != nil || time.Since(time.UnixMilli(s.At)) > c.lease {
+			expired = append(expired, id)
+			continue
+		}
+		onlineUser = append(onlineUser, s.Users...)
+	}
+	if len(expired) > 0 {
+		c.client.HDel(ctx, c.key+":online", expired...)
+	}
+	return onlineUser, nil
+}
+
+func (c *redisCluster) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if err := releaseScript.Run(ctx, c.client, []string{c.key + ":leader"}, c.id).Err(); err != nil && err != redis.Nil {
+		c.client.Close()
+		return err
+	}
+	return c.client.Close()
+}
@@ -0,0 +1,95 @@
+// Package connlimit caps the concurrent connections of each node, so a flood
+// of connections cannot exhaust the resources of a small server.
+package connlimit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions taken on a connection over the limit
+const (
+	ActionReject = "reject"
+	ActionQueue  = "queue"
+)
+
+type Config struct {
+	Enable       bool   `mapstructure:"Enable"`
+	Limit        int    `mapstructure:"Limit"`        // Concurrent connections of the node
+	Action       string `mapstructure:"Action"`       // reject or queue
+	QueueTimeout int    `mapstructure:"QueueTimeout"` // Second, a queued connection is rejected after it
+}
+
+type node struct {
+	slots   chan struct{}
+	queue   bool
+	timeout time.Duration
+}
+
+// Manager keeps the connection slots of each node
+type Manager struct {
+	nodes sync.Map // Key: inbound tag, value: *node
+}
+
+func NewManager() *Manager {
+	return &Manager{}
+}
+
+// AddNode turns the limit on for the inbound with tag. The connections open
+// under the previous settings are not counted by the new ones.
+func (m *Manager) AddNode(tag string, config *Config) error {
+	if config.Limit <= 0 {
+		return fmt.Errorf("connection limit needs a positive Limit")
+	}
+	n := &node{
+		slots:   make(chan struct{}, config.Limit),
+		timeout: time.Duration(config.QueueTimeout) * time.Second,
+	}
+	switch strings.ToLower(config.Action) {
+	case "", ActionReject:
+	case ActionQueue:
+		n.queue = true
+		if n.timeout <= 0 {
+			n.timeout = 5 * time.Second
+		}
+	default:
+		return fmt.Errorf("unsupported connection limit action: %s", config.Action)
+	}
+	m.nodes.Store(tag, n)
+	return nil
+}
+
+func (m *Manager) RemoveNode(tag string) {
+	m.nodes.Delete(tag)
+}
+
+// Acquire takes a connection slot of the inbound with tag, waiting for one
+// to be released when the node queues. It reports false if the connection
+// is over the limit, otherwise release must be called once it is closed.
+func (m *Manager) Acquire(ctx context.Context, tag string) (release func(), ok bool) {
+	value, ok := m.nodes.Load(tag)
+	if !ok {
+		return func() {}, true
+	}
+	n := value.(*node)
+	release = func() { <-n.slots }
+	select {
+	case n.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if n.queue {
+		timer := time.NewTimer(n.timeout)
+		defer timer.Stop()
+		select {
+		case n.slots <- struct{}{}:
+			return release, true
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	return nil, false
+}
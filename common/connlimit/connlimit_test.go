@@ -0,0 +1,51 @@
+package connlimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/common/connlimit"
+)
+
+func TestAcquire(t *testing.T) {
+	m := connlimit.NewManager()
+	if err := m.AddNode("reject", &connlimit.Config{Enable: true, Limit: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddNode("queue", &connlimit.Config{Enable: true, Limit: 1, Action: "queue", QueueTimeout: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddNode("invalid", &connlimit.Config{Enable: true}); err == nil {
+		t.Error("a limit of 0 should fail")
+	}
+	ctx := context.Background()
+
+	release, ok := m.Acquire(ctx, "reject")
+	if !ok {
+		t.Fatal("the first connection should be accepted")
+	}
+	if _, ok := m.Acquire(ctx, "reject"); ok {
+		t.Error("the second connection should be rejected")
+	}
+	release()
+	if _, ok := m.Acquire(ctx, "reject"); !ok {
+		t.Error("a released slot should be reused")
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := m.Acquire(ctx, "other"); !ok {
+			t.Error("a node without limit should accept every connection")
+		}
+	}
+
+	release, _ = m.Acquire(ctx, "queue")
+	time.AfterFunc(100*time.Millisecond, release)
+	if _, ok := m.Acquire(ctx, "queue"); !ok {
+		t.Error("a queued connection should get the released slot")
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, ok := m.Acquire(canceled, "queue"); ok {
+		t.Error("a canceled connection should not wait for a slot")
+	}
+}
@@ -0,0 +1,136 @@
+// Package eventbus publishes the traffic, online IP and audit events of a
+// node as JSON messages to NATS or Kafka, for real-time pipelines
+package eventbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+type Config struct {
+	Enable   bool   `mapstructure:"Enable"`
+	Type     string `mapstructure:"Type"`    // nats or kafka
+	Address  string `mapstructure:"Address"` // nats://host:port or tls://host:port for NATS, the REST proxy URL for Kafka
+	Username string `mapstructure:"Username"`
+	Password string `mapstructure:"Password"`
+	Subject  string `mapstructure:"Subject"` // Prefix of the subjects or topics, the events go to <Subject>.traffic, .online and .audit
+	Timeout  int    `mapstructure:"Timeout"` // second
+}
+
+// Event is the message published for every user in a report
+type Event struct {
+	Type      string    `json:"type"` // traffic, online or audit
+	Time      time.Time `json:"time"`
+	NodeType  string    `json:"node_type"`
+	NodeID    int       `json:"node_id"`
+	UID       int       `json:"uid"`
+	Email     string    `json:"email,omitempty"`
+	Upload    int64     `json:"upload,omitempty"`
+	Download  int64     `json:"download,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	FirstSeen int64     `json:"first_seen,omitempty"` // Unix time
+	LastSeen  int64     `json:"last_seen,omitempty"`  // Unix time
+	RuleID    int       `json:"rule_id,omitempty"`
+}
+
+// publisher sends the messages to a subject or topic, all of them or none
+type publisher interface {
+	Publish(topic string, messages []message) error
+	Close() error
+}
+
+type message struct {
+	Key   string
+	Value []byte
+}
+
+// Bus publishes the events of a node
+type Bus struct {
+	publisher publisher
+	subject   string
+	nodeType  string
+	nodeID    int
+}
+
+// New connects the bus of the node lazily, on the first publish
+func New(config *Config, nodeType string, nodeID int) (*Bus, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("event bus address is empty")
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	b := &Bus{
+		subject:  strings.TrimSuffix(config.Subject, "."),
+		nodeType: nodeType,
+		nodeID:   nodeID,
+	}
+	if b.subject == "" {
+		b.subject = "xrayr"
+	}
+	switch strings.ToLower(config.Type) {
+	case "nats":
+		b.publisher = newNATS(config, timeout)
+	case "kafka":
+		b.publisher = newKafka(config, timeout)
+	default:
+		return nil, fmt.Errorf("unsupported event bus type: %s", config.Type)
+	}
+	return b, nil
+}
+
+// PublishTraffic publishes the traffic of each user
+func (b *Bus) PublishTraffic(at time.Time, userTraffic []api.UserTraffic) error {
+	events := make([]*Event, len(userTraffic))
+	for i, t := range userTraffic {
+		events[i] = &Event{UID: t.UID, Email: t.Email, Upload: t.Upload, Download: t.Download}
+	}
+	return b.publish("traffic", at, events)
+}
+
+// PublishOnline publishes the IPs the users are online from
+func (b *Bus) PublishOnline(at time.Time, onlineUser []api.OnlineUser) error {
+	events := make([]*Event, len(onlineUser))
+	for i, u := range onlineUser {
+		events[i] = &Event{UID: u.UID, IP: u.IP, FirstSeen: u.FirstSeen, LastSeen: u.LastSeen}
+	}
+	return b.publish("online", at, events)
+}
+
+// PublishAudit publishes the audit rules hit by the users
+func (b *Bus) PublishAudit(at time.Time, detectResult []api.DetectResult) error {
+	events := make([]*Event, len(detectResult))
+	for i, r := range detectResult {
+		events[i] = &Event{UID: r.UID, RuleID: r.RuleID}
+	}
+	return b.publish("audit", at, events)
+}
+
+func (b *Bus) publish(eventType string, at time.Time, events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	messages := make([]message, len(events))
+	for i, event := range events {
+		event.Type, event.Time, event.NodeType, event.NodeID = eventType, at.UTC(), b.nodeType, b.nodeID
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		messages[i] = message{Key: fmt.Sprint(event.UID), Value: value}
+	}
+	if err := b.publisher.Publish(b.subject+"."+eventType, messages); err != nil {
+		return fmt.Errorf("publish %d %s events failed: %s", len(messages), eventType, err)
+	}
+	return nil
+}
+
+// Close disconnects the bus
+func (b *Bus) Close() error {
+	return b.publisher.Close()
+}
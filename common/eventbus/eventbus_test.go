@@ -0,0 +1,100 @@
+package eventbus_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/eventbus"
+)
+
+func TestPublishNATS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// A minimal server collecting the published subjects and payloads
+	published := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {}\r\n"))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "PING":
+				conn.Write([]byte("PONG\r\n"))
+			case "PUB":
+				payload, _ := reader.ReadString('\n')
+				published <- fields[1] + " " + strings.TrimSpace(payload)
+			}
+		}
+	}()
+
+	bus, err := eventbus.New(&eventbus.Config{Type: "nats", Address: "nats://" + listener.Addr().String()}, "V2ray", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := bus.PublishOnline(at, []api.OnlineUser{{UID: 1, IP: "1.2.3.4"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := `xrayr.online {"type":"online","time":"2024-01-02T03:04:05Z","node_type":"V2ray","node_id":1,"uid":1,"ip":"1.2.3.4"}`
+	if got := <-published; got != want {
+		t.Fatalf("unexpected message: %s", got)
+	}
+}
+
+func TestPublishKafka(t *testing.T) {
+	var (
+		path    string
+		records []struct {
+			Key   string
+			Value eventbus.Event
+		}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+		var request struct {
+			Records []struct {
+				Key   string
+				Value eventbus.Event
+			}
+		}
+		json.Unmarshal(body, &request)
+		records = request.Records
+		w.Write([]byte(`{"offsets":[{"partition":0,"offset":1},{"partition":0,"offset":2}]}`))
+	}))
+	defer server.Close()
+
+	bus, err := eventbus.New(&eventbus.Config{Type: "kafka", Address: server.URL, Subject: "node"}, "Trojan", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bus.PublishTraffic(time.Now(), []api.UserTraffic{{UID: 1, Upload: 10}, {UID: 2, Download: 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/topics/node.traffic" || len(records) != 2 || records[1].Key != "2" || records[1].Value.Download != 20 {
+		t.Fatalf("unexpected request to %s: %+v", path, records)
+	}
+}
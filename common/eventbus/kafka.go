@@ -0,0 +1,88 @@
+package eventbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// kafkaPublisher produces the messages through the REST proxy of Kafka
+// (Confluent REST Proxy API v2), keyed by UID so the events of a user keep
+// their order within a partition.
+type kafkaPublisher struct {
+	client   *http.Client
+	address  string
+	username string
+	password string
+}
+
+func newKafka(config *Config, timeout time.Duration) *kafkaPublisher {
+	return &kafkaPublisher{
+		client:   &http.Client{Timeout: timeout},
+		address:  strings.TrimSuffix(config.Address, "/"),
+		username: config.Username,
+		password: config.Password,
+	}
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+func (p *kafkaPublisher) Publish(topic string, messages []message) error {
+	records := make([]kafkaRecord, len(messages))
+	for i, m := range messages {
+		records[i] = kafkaRecord{Key: m.Key, Value: m.Value}
+	}
+	body, err := json.Marshal(map[string]any{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.address+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if p.username != "" {
+		req.SetBasicAuth(p.username, p.password)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	// The proxy answers 200 even when some of the records are rejected
+	var result kafkaResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("parse response failed: %s", err)
+	}
+	for _, offset := range result.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("record rejected: %s", offset.Error)
+		}
+	}
+	return nil
+}
+
+func (p *kafkaPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,168 @@
+package eventbus
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsPublisher speaks the text protocol of NATS core: the messages are sent
+// with PUB, and a PING after them is answered with PONG once the server has
+// processed all of them, or with -ERR.
+type natsPublisher struct {
+	access   sync.Mutex
+	address  string
+	tls      bool
+	username string
+	password string
+	timeout  time.Duration
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+func newNATS(config *Config, timeout time.Duration) *natsPublisher {
+	p := &natsPublisher{
+		address:  config.Address,
+		username: config.Username,
+		password: config.Password,
+		timeout:  timeout,
+	}
+	if u, err := url.Parse(config.Address); err == nil && u.Host != "" {
+		p.address = u.Host
+		p.tls = u.Scheme == "tls"
+		if u.User != nil && p.username == "" {
+			p.username = u.User.Username()
+			p.password, _ = u.User.Password()
+		}
+	}
+	return p
+}
+
+func (p *natsPublisher) Publish(subject string, messages []message) error {
+	p.access.Lock()
+	defer p.access.Unlock()
+
+	// A connection dropped while idle is found out on the first attempt,
+	// retry once on a new one
+	idle := p.conn != nil
+	err := p.publish(subject, messages)
+	if err != nil && idle {
+		err = p.publish(subject, messages)
+	}
+	return err
+}
+
+func (p *natsPublisher) publish(subject string, messages []message) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	var buf strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&buf, "PUB %s %d\r\n%s\r\n", subject, len(m.Value), m.Value)
+	}
+	buf.WriteString("PING\r\n")
+	p.conn.SetDeadline(time.Now().Add(p.timeout))
+	if _, err := p.conn.Write([]byte(buf.String())); err != nil {
+		p.close()
+		return err
+	}
+	if err := p.waitPong(); err != nil {
+		p.close()
+		return err
+	}
+	return nil
+}
+
+func (p *natsPublisher) connect() error {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if p.tls {
+		host, _, _ := net.SplitHostPort(p.address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", p.address)
+	}
+	if err != nil {
+		return err
+	}
+	p.conn, p.reader = conn, bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(p.timeout))
+
+	// The server greets with INFO
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		p.close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		p.close()
+		return fmt.Errorf("unexpected greeting from %s: %s", p.address, strings.TrimSpace(line))
+	}
+	options := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "XrayR",
+		"lang":     "go",
+	}
+	if p.username != "" {
+		options["user"], options["pass"] = p.username, p.password
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		p.close()
+		return err
+	}
+	if err := p.waitPong(); err != nil {
+		p.close()
+		return err
+	}
+	return nil
+}
+
+// waitPong reads until the PONG, answering the PINGs of the server on the way
+func (p *natsPublisher) waitPong() error {
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.Trim(strings.TrimPrefix(line, "-ERR"), " '"))
+		}
+	}
+}
+
+func (p *natsPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.reader = nil, nil
+	}
+}
+
+func (p *natsPublisher) Close() error {
+	p.access.Lock()
+	defer p.access.Unlock()
+
+	p.close()
+	return nil
+}
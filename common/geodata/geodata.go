@@ -0,0 +1,128 @@
+// Package geodata downloads the geoip.dat and geosite.dat files the geoip: and
+// geosite: rules of Xray are compiled from, and has them compiled again after
+// an update
+package geodata
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/infra/conf"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	GeoIP   = "geoip.dat"
+	GeoSite = "geosite.dat"
+)
+
+// DefaultURLs are the files of Loyalsoldier/v2ray-rules-dat, which publishes
+// their SHA-256 sums beside them
+var DefaultURLs = map[string]string{
+	GeoIP:   "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat",
+	GeoSite: "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat",
+}
+
+var generation atomic.Uint64
+
+// Generation is bumped by Reload, the routes compiled at an older one are
+// compiled from outdated files
+func Generation() uint64 {
+	return generation.Load()
+}
+
+// Reload drops the files Xray keeps in memory once read, so the next rules
+// compiled read the new ones
+func Reload() {
+	conf.FileCache = make(map[string][]byte)
+	conf.IPCache = make(map[string]*router.GeoIP)
+	conf.SiteCache = make(map[string]*router.GeoSite)
+	generation.Add(1)
+}
+
+// Update downloads the file name from url to path, checked against the
+// SHA-256 sum at url.sha256sum when verify is set. The local copy is replaced
+// only when the download is valid and differs from it, and Update reports
+// whether it was.
+func Update(name, url, path string, verify bool) (bool, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	data, err := download(client, url)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	if verify {
+		published, err := download(client, url+".sha256sum")
+		if err != nil {
+			return false, fmt.Errorf("download checksum of %s failed: %w", name, err)
+		}
+		fields := strings.Fields(string(published))
+		if len(fields) == 0 || !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+			return false, fmt.Errorf("checksum mismatch of %s", name)
+		}
+	}
+	if err := validate(name, data); err != nil {
+		return false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	if local, err := os.ReadFile(path); err == nil && bytes.Equal(local, data) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func download(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s failed: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// validate checks that data decodes as the list the file name holds, so an
+// error page served with 200 never replaces a working file
+func validate(name string, data []byte) error {
+	switch name {
+	case GeoIP:
+		var geoIP router.GeoIPList
+		if err := proto.Unmarshal(data, &geoIP); err != nil {
+			return err
+		}
+		if len(geoIP.Entry) == 0 {
+			return fmt.Errorf("no entry")
+		}
+	case GeoSite:
+		var geoSite router.GeoSiteList
+		if err := proto.Unmarshal(data, &geoSite); err != nil {
+			return err
+		}
+		if len(geoSite.Entry) == 0 {
+			return fmt.Errorf("no entry")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package geodata_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/qtai2901/new_xrayr/common/geodata"
+)
+
+func serve(t *testing.T, data []byte, sum string) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/geosite.dat", func(w http.ResponseWriter, r *http.Request) { w.Write(data) })
+	mux.HandleFunc("/geosite.dat.sha256sum", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sum + "  geosite.dat\n"))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL + "/geosite.dat"
+}
+
+func TestUpdate(t *testing.T) {
+	data, err := proto.Marshal(&router.GeoSiteList{Entry: []*router.GeoSite{{
+		CountryCode: "TEST",
+		Domain:      []*router.Domain{{Type: router.Domain_Domain, Value: "example.com"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	url := serve(t, data, hex.EncodeToString(sum[:]))
+	path := filepath.Join(t.TempDir(), geodata.GeoSite)
+
+	changed, err := geodata.Update(geodata.GeoSite, url, path, true)
+	if err != nil || !changed {
+		t.Fatalf("first update: changed %v, error %v", changed, err)
+	}
+	if saved, _ := os.ReadFile(path); string(saved) != string(data) {
+		t.Error("file not saved")
+	}
+	if changed, err := geodata.Update(geodata.GeoSite, url, path, true); err != nil || changed {
+		t.Errorf("same file: changed %v, error %v", changed, err)
+	}
+}
+
+func TestUpdateRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), geodata.GeoSite)
+	data := []byte("<html>rate limited</html>")
+	sum := sha256.Sum256(data)
+	for name, url := range map[string]string{
+		"checksum mismatch": serve(t, data, hex.EncodeToString(make([]byte, sha256.Size))),
+		"not a geosite":     serve(t, data, hex.EncodeToString(sum[:])),
+	} {
+		if _, err := geodata.Update(geodata.GeoSite, url, path, true); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("rejected file saved")
+	}
+}
+
+func TestReload(t *testing.T) {
+	before := geodata.Generation()
+	geodata.Reload()
+	if geodata.Generation() == before {
+		t.Error("generation not bumped")
+	}
+}
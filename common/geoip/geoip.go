@@ -0,0 +1,259 @@
+// Package geoip maps country codes to the IP ranges geolocated to them, read
+// from an ip2country database (https://iptoasn.com) or a DB-IP country lite CSV
+package geoip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUpdateURLs are the IPv4 and IPv6 country databases of iptoasn.com
+var DefaultUpdateURLs = []string{
+	"https://iptoasn.com/data/ip2country-v4.tsv.gz",
+	"https://iptoasn.com/data/ip2country-v6.tsv.gz",
+}
+
+type addrRange struct {
+	start, end netip.Addr
+}
+
+type Database struct {
+	ranges map[string][]addrRange // Key: upper case country code
+}
+
+var current atomic.Pointer[Database]
+
+// Current returns the database in use, nil if none is loaded yet
+func Current() *Database {
+	return current.Load()
+}
+
+// SetCurrent replaces the database in use
+func SetCurrent(db *Database) {
+	current.Store(db)
+}
+
+// Load reads the database at path, which may be gzipped
+func Load(path string) (*Database, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(bytes.NewReader(data))
+}
+
+// Parse reads a database made of lines of range start, range end and country
+// code, separated by tabs or commas. Gzipped input is accepted, including
+// several gzip streams one after another.
+func Parse(r io.Reader) (*Database, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+
+	db := &Database{ranges: make(map[string][]addrRange)}
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		sep := "\t"
+		if !strings.Contains(text, sep) {
+			sep = ","
+		}
+		fields := strings.Split(text, sep)
+		if len(fields) < 3 {
+			continue
+		}
+		country := strings.ToUpper(strings.Trim(strings.TrimSpace(fields[2]), `"`))
+		// Unassigned ranges are marked None, or ZZ by DB-IP
+		if len(country) != 2 || country == "ZZ" {
+			continue
+		}
+		start, err := netip.ParseAddr(strings.Trim(fields[0], `" `))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		end, err := netip.ParseAddr(strings.Trim(fields[1], `" `))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if start.BitLen() != end.BitLen() || end.Less(start) {
+			return nil, fmt.Errorf("line %d: invalid range %s-%s", line, start, end)
+		}
+		db.ranges[country] = append(db.ranges[country], addrRange{start: start, end: end})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(db.ranges) == 0 {
+		return nil, fmt.Errorf("empty GeoIP database")
+	}
+	return db, nil
+}
+
+// Prefixes returns the IP prefixes geolocated to the countries
+func (d *Database) Prefixes(countries ...string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range d.merged(countries) {
+		prefixes = append(prefixes, rangeToPrefixes(r.start, r.end)...)
+	}
+	return prefixes
+}
+
+// PrefixesExcept returns the IP prefixes of every address, IPv4 and IPv6,
+// not geolocated to one of the countries
+func (d *Database) PrefixesExcept(countries ...string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	ranges := d.merged(countries)
+	for _, space := range []addrRange{
+		{netip.IPv4Unspecified(), netip.MustParseAddr("255.255.255.255")},
+		{netip.IPv6Unspecified(), netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")},
+	} {
+		next, done := space.start, false
+		for _, r := range ranges {
+			if r.start.BitLen() != space.start.BitLen() {
+				continue
+			}
+			if next.Less(r.start) {
+				prefixes = append(prefixes, rangeToPrefixes(next, r.start.Prev())...)
+			}
+			if r.end == space.end {
+				done = true
+				break
+			}
+			next = r.end.Next()
+		}
+		if !done {
+			prefixes = append(prefixes, rangeToPrefixes(next, space.end)...)
+		}
+	}
+	return prefixes
+}
+
+// merged returns the ranges of the countries sorted, with the overlapping
+// and adjacent ones joined
+func (d *Database) merged(countries []string) []addrRange {
+	var ranges []addrRange
+	for _, country := range countries {
+		ranges = append(ranges, d.ranges[strings.ToUpper(country)]...)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Less(ranges[j].start) })
+	var merged []addrRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].start.BitLen() == r.start.BitLen() {
+			last := &merged[n-1]
+			if next := last.end.Next(); !next.IsValid() || !next.Less(r.start) {
+				if last.end.Less(r.end) {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Download fetches the databases at urls and saves them together at path,
+// as gzip streams one after another. The file is replaced only when every
+// download is a valid database.
+func Download(urls []string, path string) (*Database, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	var saved bytes.Buffer
+	for _, url := range urls {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("download %s failed: %s", url, resp.Status)
+		}
+		if _, err := Parse(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("parse %s failed: %s", url, err)
+		}
+		if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+			gz := gzip.NewWriter(&saved)
+			gz.Write(data)
+			if err := gz.Close(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		saved.Write(data)
+	}
+	db, err := Parse(bytes.NewReader(saved.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, saved.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// rangeToPrefixes splits the address range from start to end into the
+// fewest prefixes covering it
+func rangeToPrefixes(start, end netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for {
+		// Widen the prefix while it still starts at start and ends before end
+		bits := start.BitLen()
+		for bits > 0 {
+			wider := netip.PrefixFrom(start, bits-1).Masked()
+			if wider.Addr() != start || end.Less(lastAddr(wider)) {
+				break
+			}
+			bits--
+		}
+		prefix := netip.PrefixFrom(start, bits)
+		prefixes = append(prefixes, prefix)
+		last := lastAddr(prefix)
+		if last == end {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().As16()
+	offset := 128 - prefix.Addr().BitLen()
+	for i := offset + prefix.Bits(); i < 128; i++ {
+		addr[i/8] |= 1 << (7 - i%8)
+	}
+	last := netip.AddrFrom16(addr)
+	if prefix.Addr().Is4() {
+		return last.Unmap()
+	}
+	return last
+}
@@ -0,0 +1,68 @@
+package geoip_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/geoip"
+)
+
+func TestParse(t *testing.T) {
+	data := strings.Join([]string{
+		"1.0.0.0\t1.0.0.255\tAU",
+		"1.0.1.0\t1.0.3.255\tNone",
+		"1.0.4.0\t1.0.7.255\tAU",
+		`"2.0.0.0","2.0.0.5","fr"`,
+		"2001:db8::,2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,ZZ",
+	}, "\n")
+	db, err := geoip.Parse(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(db.Prefixes("au")); got != "[1.0.0.0/24 1.0.4.0/22]" {
+		t.Errorf("unexpected prefixes of AU: %s", got)
+	}
+	if got := fmt.Sprint(db.Prefixes("FR", "AU")); got != "[1.0.0.0/24 1.0.4.0/22 2.0.0.0/30 2.0.0.4/31]" {
+		t.Errorf("unexpected prefixes of FR and AU: %s", got)
+	}
+	except := db.PrefixesExcept("AU", "FR")
+	if got := fmt.Sprint(except[:3]); got != "[0.0.0.0/8 1.0.1.0/24 1.0.2.0/23]" {
+		t.Errorf("unexpected prefixes outside AU and FR: %s", got)
+	}
+	if got := except[len(except)-1].String(); got != "::/0" {
+		t.Errorf("the IPv6 space should be left whole, got %s", got)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("2001:db8::\t2001:db8::ffff\tUS\n"))
+	gz.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v6" {
+			w.Write(gzipped.Bytes())
+			return
+		}
+		w.Write([]byte("8.8.8.0\t8.8.8.255\tUS\n"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "geoip.tsv.gz")
+	if _, err := geoip.Download([]string{server.URL + "/v4", server.URL + "/v6"}, path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := geoip.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(db.Prefixes("US")); got != "[8.8.8.0/24 2001:db8::/112]" {
+		t.Errorf("unexpected prefixes of US: %s", got)
+	}
+}
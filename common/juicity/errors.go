@@ -0,0 +1,7 @@
+package juicity
+
+import "github.com/xtls/xray-core/common/errors"
+
+func newError(values ...interface{}) *errors.Error {
+	return errors.New(values...)
+}
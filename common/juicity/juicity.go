@@ -0,0 +1,293 @@
+// Package juicity is the server side of the Juicity protocol
+// (https://github.com/juicity/juicity), proxying over QUIC:
+//   - the client authenticates the connection on its first unidirectional
+//     stream, with the Authenticate command of TUIC v5: the version 0x05, the
+//     type 0x00, its UUID and a token exported from the TLS session with the
+//     UUID as label and its password as context
+//   - each bidirectional stream then starts with the network, 0x01 for TCP or
+//     0x03 for UDP, and the destination in the SOCKS format. The UDP packets
+//     are made of their address, their length and their payload.
+package juicity
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io"
+	gonet "net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/http"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// CongestionControls are the congestion controls the QUIC connections can
+// use. quic-go has no other than its own, a Cubic one.
+var CongestionControls = []string{"cubic"}
+
+const (
+	authVersion = 0x05
+	authCommand = 0x00
+	tokenSize   = 32
+)
+
+// Codes the connections are closed with
+const (
+	errCodeAuth quic.ApplicationErrorCode = 0x101
+)
+
+type Config struct {
+	Tag               string
+	Listen            string // Address listened on, every one if empty
+	Port              uint32
+	TLSConfig         *tls.Config
+	CongestionControl string // One of CongestionControls, the first if empty
+	Sniffing          session.SniffingRequest
+}
+
+// Handler is the inbound.Handler listening for the Juicity clients of a node
+type Handler struct {
+	config     *Config
+	server     *Server
+	dispatcher routing.Dispatcher
+
+	access   sync.Mutex
+	listener *quic.Listener
+}
+
+func NewHandler(config *Config, dispatcher routing.Dispatcher, policyManager policy.Manager) (*Handler, error) {
+	if cc := strings.ToLower(config.CongestionControl); cc != "" && cc != CongestionControls[0] {
+		return nil, newError("unsupported congestion control: ", config.CongestionControl, ", only ", strings.Join(CongestionControls, ", "), " is supported")
+	}
+	gateway := net.AnyIP
+	if config.Listen != "" {
+		gateway = net.ParseAddress(config.Listen)
+	}
+	return &Handler{
+		config:     config,
+		dispatcher: dispatcher,
+		server: &Server{
+			gateway:       net.UDPDestination(gateway, net.Port(config.Port)),
+			sniffing:      config.Sniffing,
+			policyManager: policyManager,
+			users:         make(map[uuid.UUID]*user),
+			ids:           make(map[string]uuid.UUID),
+		},
+	}, nil
+}
+
+// Start implements common.Runnable.
+func (h *Handler) Start() error {
+	tlsConfig := h.config.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{"h3"}
+	listener, err := quic.ListenAddr(gonet.JoinHostPort(h.config.Listen, strconv.Itoa(int(h.config.Port))), tlsConfig, &quic.Config{
+		MaxIdleTimeout:        30 * time.Second,
+		KeepAlivePeriod:       10 * time.Second,
+		MaxIncomingStreams:    1 << 10,
+		MaxIncomingUniStreams: 1 << 10,
+	})
+	if err != nil {
+		return newError("failed to listen on port ", h.config.Port).Base(err)
+	}
+	h.access.Lock()
+	h.listener = listener
+	h.access.Unlock()
+	go h.serve(listener)
+	return nil
+}
+
+// Close implements common.Closable. The connections accepted so far are
+// left to end by themselves, like the ones of the other inbounds.
+func (h *Handler) Close() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Close()
+}
+
+// Tag implements inbound.Handler.
+func (h *Handler) Tag() string {
+	return h.config.Tag
+}
+
+// GetRandomInboundProxy implements inbound.Handler.
+func (h *Handler) GetRandomInboundProxy() (interface{}, net.Port, int) {
+	return h.server, net.Port(h.config.Port), 9999
+}
+
+// GetInbound implements proxy.GetInbound.
+func (h *Handler) GetInbound() proxy.Inbound {
+	return h.server
+}
+
+func (h *Handler) serve(listener *quic.Listener) {
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return
+			}
+			newError("failed to accept connection").Base(err).AtWarning().WriteToLog()
+			continue
+		}
+		go h.handle(conn)
+	}
+}
+
+func (h *Handler) handle(conn quic.Connection) {
+	ctx := session.ContextWithID(context.Background(), session.NewID())
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{
+		Source:  net.DestinationFromAddr(conn.RemoteAddr()),
+		Gateway: h.server.gateway,
+		Tag:     h.config.Tag,
+		Name:    "juicity",
+	})
+	if err := h.server.serveConn(ctx, conn, h.dispatcher); err != nil {
+		newError("connection ends").Base(err).WriteToLog(session.ExportIDToError(ctx))
+	}
+}
+
+type user struct {
+	*protocol.MemoryUser
+	password string
+}
+
+// Server authenticates the Juicity clients by the user name, a UUID, and the
+// password of the HTTP account of the users, and serves their streams
+type Server struct {
+	gateway       net.Destination
+	sniffing      session.SniffingRequest
+	policyManager policy.Manager
+
+	access sync.RWMutex
+	users  map[uuid.UUID]*user
+	ids    map[string]uuid.UUID // Key: lower case email
+}
+
+// AddUser implements proxy.UserManager.AddUser().
+func (s *Server) AddUser(ctx context.Context, u *protocol.MemoryUser) error {
+	account, ok := u.Account.(*http.Account)
+	if !ok {
+		return newError("user ", u.Email, " has no user name and password")
+	}
+	id, err := uuid.ParseString(account.Username)
+	if err != nil {
+		return newError("user ", u.Email, " has no UUID").Base(err)
+	}
+	email := strings.ToLower(u.Email)
+	s.access.Lock()
+	defer s.access.Unlock()
+	if _, found := s.ids[email]; found {
+		return newError("User ", u.Email, " already exists.")
+	}
+	s.users[id] = &user{MemoryUser: u, password: account.Password}
+	s.ids[email] = id
+	return nil
+}
+
+// RemoveUser implements proxy.UserManager.RemoveUser().
+func (s *Server) RemoveUser(ctx context.Context, e string) error {
+	email := strings.ToLower(e)
+	s.access.Lock()
+	defer s.access.Unlock()
+	id, found := s.ids[email]
+	if !found {
+		return newError("User ", e, " not found.")
+	}
+	delete(s.ids, email)
+	delete(s.users, id)
+	return nil
+}
+
+func (s *Server) getUser(id uuid.UUID) *user {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	return s.users[id]
+}
+
+// Network implements proxy.Inbound.Network().
+func (s *Server) Network() []net.Network {
+	return []net.Network{net.Network_UDP}
+}
+
+// Process implements proxy.Inbound.Process(). The QUIC connections are
+// accepted by the Handler, not by Xray.
+func (s *Server) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	return newError("juicity connections are served by its own handler")
+}
+
+// authenticate reads the Authenticate command of the connection
+func (s *Server) authenticate(ctx context.Context, conn quic.Connection) (*user, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.policyManager.ForLevel(0).Timeouts.Handshake)
+	defer cancel()
+	stream, err := conn.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, newError("failed to accept authentication").Base(err)
+	}
+	var auth [2 + 16 + tokenSize]byte
+	if _, err := io.ReadFull(stream, auth[:]); err != nil {
+		return nil, newError("failed to read authentication").Base(err)
+	}
+	if auth[0] != authVersion || auth[1] != authCommand {
+		return nil, newError("unexpected command ", auth[1], " of version ", auth[0])
+	}
+	u := s.getUser(uuid.UUID(auth[2:18]))
+	if u == nil {
+		return nil, newError("invalid user")
+	}
+	state := conn.ConnectionState().TLS
+	token, err := state.ExportKeyingMaterial(string(auth[2:18]), []byte(u.password), tokenSize)
+	if err != nil {
+		return nil, newError("failed to export token").Base(err)
+	}
+	if subtle.ConstantTimeCompare(token, auth[18:]) != 1 {
+		return nil, newError("invalid password of user ", u.Email)
+	}
+	return u, nil
+}
+
+// serveConn authenticates the connection, then serves its streams
+func (s *Server) serveConn(ctx context.Context, conn quic.Connection, dispatcher routing.Dispatcher) error {
+	u, err := s.authenticate(ctx, conn)
+	if err != nil {
+		log.Record(&log.AccessMessage{
+			From:   conn.RemoteAddr(),
+			To:     "",
+			Status: log.AccessRejected,
+			Reason: err,
+		})
+		conn.CloseWithError(errCodeAuth, "")
+		return err
+	}
+	session.InboundFromContext(ctx).User = u.MemoryUser
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return nil // Closed by the client or the idle timeout
+		}
+		go func() {
+			if err := s.handleStream(ctx, u.MemoryUser, stream, dispatcher); err != nil {
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+				newError("stream ends").Base(err).WriteToLog(session.ExportIDToError(ctx))
+				return
+			}
+			stream.Close()
+		}()
+	}
+}
@@ -0,0 +1,40 @@
+package juicity_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/proxy/http"
+
+	"github.com/qtai2901/new_xrayr/common/juicity"
+)
+
+func TestHandlerUsers(t *testing.T) {
+	if _, err := juicity.NewHandler(&juicity.Config{Tag: "juicity", Port: 443, CongestionControl: "bbr"}, nil, nil); err == nil {
+		t.Error("bbr should be unsupported")
+	}
+	h, err := juicity.NewHandler(&juicity.Config{Tag: "juicity", Port: 443, CongestionControl: "Cubic"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := h.GetInbound().(*juicity.Server)
+
+	invalid := &protocol.MemoryUser{Email: "juicity|1@node|1", Account: &http.Account{Username: "user", Password: "secret"}}
+	if err := server.AddUser(context.Background(), invalid); err == nil {
+		t.Error("a user name other than a UUID should fail")
+	}
+	user := &protocol.MemoryUser{Email: "juicity|2@node|2", Account: &http.Account{Username: "b831381d-6324-4d53-ad4f-8cda48b30811", Password: "secret"}}
+	if err := server.AddUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddUser(context.Background(), user); err == nil {
+		t.Error("adding a user twice should fail")
+	}
+	if err := server.RemoveUser(context.Background(), user.Email); err != nil {
+		t.Error(err)
+	}
+	if err := server.RemoveUser(context.Background(), user.Email); err == nil {
+		t.Error("removing a user twice should fail")
+	}
+}
@@ -0,0 +1,168 @@
+package juicity
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/quic-go/quic-go"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+)
+
+// Networks of the streams
+const (
+	networkTCP = 0x01
+	networkUDP = 0x03
+)
+
+var addrParser = protocol.NewAddressParser(
+	protocol.AddressFamilyByte(0x01, net.AddressFamilyIPv4),
+	protocol.AddressFamilyByte(0x04, net.AddressFamilyIPv6),
+	protocol.AddressFamilyByte(0x03, net.AddressFamilyDomain),
+)
+
+// handleStream dispatches the stream to the destination at its start
+func (s *Server) handleStream(ctx context.Context, user *protocol.MemoryUser, stream quic.Stream, dispatcher routing.Dispatcher) error {
+	reader := &buf.BufferedReader{Reader: buf.NewReader(stream)}
+	var network [1]byte
+	if _, err := io.ReadFull(reader, network[:]); err != nil {
+		return newError("failed to read network").Base(err)
+	}
+	b := buf.New()
+	addr, port, err := addrParser.ReadAddressPort(b, reader)
+	b.Release()
+	if err != nil {
+		return newError("failed to read destination").Base(err)
+	}
+
+	ctx = session.ContextWithContent(ctx, &session.Content{
+		SniffingRequest: s.sniffing,
+	})
+	switch network[0] {
+	case networkTCP:
+		destination := net.TCPDestination(addr, port)
+		return s.proxy(ctx, user, destination, reader, buf.NewWriter(stream), dispatcher)
+	case networkUDP:
+		destination := net.UDPDestination(addr, port)
+		return s.proxy(ctx, user, destination, &packetReader{reader: reader}, &packetWriter{writer: stream, destination: destination}, dispatcher)
+	default:
+		return newError("unknown network ", network[0])
+	}
+}
+
+func (s *Server) proxy(ctx context.Context, user *protocol.MemoryUser, destination net.Destination, clientReader buf.Reader, clientWriter buf.Writer, dispatcher routing.Dispatcher) error {
+	sessionPolicy := s.policyManager.ForLevel(user.Level)
+	ctx, cancel := context.WithCancel(ctx)
+	timer := signal.CancelAfterInactivity(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle)
+	ctx = policy.ContextWithBufferPolicy(ctx, sessionPolicy.Buffer)
+	ctx = log.ContextWithAccessMessage(ctx, &log.AccessMessage{
+		From:   session.InboundFromContext(ctx).Source,
+		To:     destination,
+		Status: log.AccessAccepted,
+		Reason: "",
+		Email:  user.Email,
+	})
+
+	newError("received request for ", destination).WriteToLog(session.ExportIDToError(ctx))
+	link, err := dispatcher.Dispatch(ctx, destination)
+	if err != nil {
+		return newError("failed to dispatch request to ", destination).Base(err)
+	}
+
+	requestDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.DownlinkOnly)
+		if err := buf.Copy(clientReader, link.Writer, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to transfer request").Base(err)
+		}
+		return nil
+	}
+
+	responseDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.UplinkOnly)
+		if err := buf.Copy(link.Reader, clientWriter, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to write response").Base(err)
+		}
+		return nil
+	}
+
+	requestDonePost := task.OnSuccess(requestDone, task.Close(link.Writer))
+	if err := task.Run(ctx, requestDonePost, responseDone); err != nil {
+		common.Must(common.Interrupt(link.Reader))
+		common.Must(common.Interrupt(link.Writer))
+		return newError("connection ends").Base(err)
+	}
+	return nil
+}
+
+// packetReader reads the UDP packets of a stream, each to its own address
+type packetReader struct {
+	reader *buf.BufferedReader
+}
+
+func (r *packetReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	for {
+		b := buf.New()
+		addr, port, err := addrParser.ReadAddressPort(b, r.reader)
+		b.Release()
+		if err != nil {
+			return nil, newError("failed to read packet destination").Base(err)
+		}
+		destination := net.UDPDestination(addr, port)
+		var size [2]byte
+		if _, err := io.ReadFull(r.reader, size[:]); err != nil {
+			return nil, newError("failed to read packet length").Base(err)
+		}
+		length := int32(binary.BigEndian.Uint16(size[:]))
+		if length > buf.Size {
+			// Over the buffers of the outbounds, dropped like the ones lost on the way
+			if _, err := io.CopyN(io.Discard, r.reader, int64(length)); err != nil {
+				return nil, newError("failed to read packet").Base(err)
+			}
+			continue
+		}
+		b = buf.New()
+		if _, err := b.ReadFullFrom(r.reader, length); err != nil {
+			b.Release()
+			return nil, newError("failed to read packet").Base(err)
+		}
+		b.UDP = &destination
+		return buf.MultiBuffer{b}, nil
+	}
+}
+
+// packetWriter writes the UDP packets to a stream, each with its source
+type packetWriter struct {
+	writer      io.Writer
+	destination net.Destination
+}
+
+func (w *packetWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	defer buf.ReleaseMulti(mb)
+	var packet bytes.Buffer
+	for _, b := range mb {
+		packet.Reset()
+		source := w.destination
+		if b.UDP != nil {
+			source = *b.UDP
+		}
+		if err := addrParser.WriteAddressPort(&packet, source.Address, source.Port); err != nil {
+			return err
+		}
+		binary.Write(&packet, binary.BigEndian, uint16(b.Len()))
+		packet.Write(b.Bytes())
+		if _, err := w.writer.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package limiter
+
+import (
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+
+	"github.com/qtai2901/new_xrayr/common/userstore"
+)
+
+// Session is shared by the links of a user, and closed to kick them
+type Session struct {
+	done chan struct{}
+}
+
+// GetUserSession returns the session the links of the user join, nil if the
+// inbound or the user is unknown
+func (l *Limiter) GetUserSession(tag string, email string) *Session {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil
+	}
+	uid, ok := userstore.UID(email)
+	if !ok {
+		return nil
+	}
+	session, _ := value.(*InboundInfo).SessionHub.LoadOrStore(uid, &Session{done: make(chan struct{})})
+	return session
+}
+
+// Kick fails the links of the user opened so far, and reports whether there
+// were any. They are closed on their next write, or by the idle timeout.
+func (l *Limiter) Kick(tag string, email string) bool {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return false
+	}
+	uid, ok := userstore.UID(email)
+	if !ok {
+		return false
+	}
+	session, ok := value.(*InboundInfo).SessionHub.LoadAndDelete(uid)
+	if !ok {
+		return false
+	}
+	close(session.done)
+	return true
+}
+
+type KickWriter struct {
+	writer  buf.Writer
+	session *Session
+}
+
+// KickWriter fails the writes to writer once the session is kicked
+func (l *Limiter) KickWriter(writer buf.Writer, session *Session) buf.Writer {
+	return &KickWriter{
+		writer:  writer,
+		session: session,
+	}
+}
+
+func (w *KickWriter) Close() error {
+	return common.Close(w.writer)
+}
+
+func (w *KickWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	select {
+	case <-w.session.done:
+		buf.ReleaseMulti(mb)
+		return newError("user kicked")
+	default:
+	}
+	return w.writer.WriteMultiBuffer(mb)
+}
@@ -19,20 +19,28 @@ import (
 	"golang.org/x/time/rate"
 
 	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/userstore"
 )
 
 type UserInfo struct {
 	UID         int
 	SpeedLimit  uint64
 	DeviceLimit int
+	DisableUDP  bool
 }
 
 type InboundInfo struct {
 	Tag            string
 	NodeSpeedLimit uint64
-	UserInfo       *sync.Map // Key: Email value: UserInfo
-	BucketHub      *sync.Map // key: Email, value: *rate.Limiter
-	UserOnlineIP   *sync.Map // Key: Email, value: {Key: IP, value: UID}
+	UserInfo       *userstore.Store[UserInfo]
+	BucketHub      *userstore.Store[*rate.Limiter]
+	QuotaHub       *userstore.Store[*Quota]
+	SessionHub     *userstore.Store[*Session]
+	TrafficHub     *userstore.Store[*Traffic]
+	RejectHub      *userstore.Store[[]string] // IPs rejected by the device limit since the last snapshot
+	Reported       *Traffic                   // Traffic taken out of TrafficHub by the snapshots so far
+	OnlineStore    OnlineStore
+	Shaper         *Shaper // Nil unless the inbound shares a rate between its users
 	GlobalLimit    struct {
 		config         *GlobalDeviceLimitConfig
 		globalOnlineIP *marshaler.Marshaler
@@ -49,12 +57,22 @@ func New() *Limiter {
 	}
 }
 
-func (l *Limiter) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalLimit *GlobalDeviceLimitConfig) error {
+func (l *Limiter) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalLimit *GlobalDeviceLimitConfig, onlineStoreConfig *OnlineStoreConfig, shaperConfig *ShaperConfig) error {
+	onlineStore, err := newOnlineStore(tag, onlineStoreConfig)
+	if err != nil {
+		return err
+	}
 	inboundInfo := &InboundInfo{
 		Tag:            tag,
 		NodeSpeedLimit: nodeSpeedLimit,
-		BucketHub:      new(sync.Map),
-		UserOnlineIP:   new(sync.Map),
+		BucketHub:      userstore.New[*rate.Limiter](),
+		QuotaHub:       userstore.New[*Quota](),
+		SessionHub:     userstore.New[*Session](),
+		TrafficHub:     userstore.New[*Traffic](),
+		RejectHub:      userstore.New[[]string](),
+		Reported:       new(Traffic),
+		OnlineStore:    onlineStore,
+		Shaper:         NewShaper(shaperConfig),
 	}
 
 	if globalLimit != nil && globalLimit.Enable {
@@ -82,16 +100,19 @@ func (l *Limiter) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList
 		inboundInfo.GlobalLimit.globalOnlineIP = marshaler.New(cacheManager)
 	}
 
-	userMap := new(sync.Map)
+	userMap := userstore.New[UserInfo]()
 	for _, u := range *userList {
-		userMap.Store(fmt.Sprintf("%s|%s|%d", tag, u.Email, u.UID), UserInfo{
+		userMap.Store(u.UID, UserInfo{
 			UID:         u.UID,
 			SpeedLimit:  u.SpeedLimit,
 			DeviceLimit: u.DeviceLimit,
+			DisableUDP:  u.UDP < 0,
 		})
 	}
 	inboundInfo.UserInfo = userMap
-	l.InboundInfo.Store(tag, inboundInfo) // Replace the old inbound info
+	if old, loaded := l.InboundInfo.Swap(tag, inboundInfo); loaded { // Replace the old inbound info
+		old.(*InboundInfo).OnlineStore.Close()
+	}
 	return nil
 }
 
@@ -100,21 +121,21 @@ func (l *Limiter) UpdateInboundLimiter(tag string, updatedUserList *[]api.UserIn
 		inboundInfo := value.(*InboundInfo)
 		// Update User info
 		for _, u := range *updatedUserList {
-			inboundInfo.UserInfo.Store(fmt.Sprintf("%s|%s|%d", tag, u.Email, u.UID), UserInfo{
+			inboundInfo.UserInfo.Store(u.UID, UserInfo{
 				UID:         u.UID,
 				SpeedLimit:  u.SpeedLimit,
 				DeviceLimit: u.DeviceLimit,
+				DisableUDP:  u.UDP < 0,
 			})
 			// Update old limiter bucket
 			limit := determineRate(inboundInfo.NodeSpeedLimit, u.SpeedLimit)
 			if limit > 0 {
-				if bucket, ok := inboundInfo.BucketHub.Load(fmt.Sprintf("%s|%s|%d", tag, u.Email, u.UID)); ok {
-					limiter := bucket.(*rate.Limiter)
+				if limiter, ok := inboundInfo.BucketHub.Load(u.UID); ok {
 					limiter.SetLimit(rate.Limit(limit))
 					limiter.SetBurst(int(limit))
 				}
 			} else {
-				inboundInfo.BucketHub.Delete(fmt.Sprintf("%s|%s|%d", tag, u.Email, u.UID))
+				inboundInfo.BucketHub.Delete(u.UID)
 			}
 		}
 	} else {
@@ -123,40 +144,49 @@ func (l *Limiter) UpdateInboundLimiter(tag string, updatedUserList *[]api.UserIn
 	return nil
 }
 
+// UpdateNodeSpeedLimit changes the node level speed limit of a running inbound.
+// Existing buckets are dropped and rebuilt with the new rate on next use.
+func (l *Limiter) UpdateNodeSpeedLimit(tag string, nodeSpeedLimit uint64) error {
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		inboundInfo := *value.(*InboundInfo)
+		inboundInfo.NodeSpeedLimit = nodeSpeedLimit
+		inboundInfo.BucketHub = userstore.New[*rate.Limiter]()
+		l.InboundInfo.Store(tag, &inboundInfo)
+	} else {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	return nil
+}
+
 func (l *Limiter) DeleteInboundLimiter(tag string) error {
-	l.InboundInfo.Delete(tag)
+	if old, loaded := l.InboundInfo.LoadAndDelete(tag); loaded {
+		return old.(*InboundInfo).OnlineStore.Close()
+	}
 	return nil
 }
 
 func (l *Limiter) GetOnlineDevice(tag string) (*[]api.OnlineUser, error) {
-	var onlineUser []api.OnlineUser
-
-	if value, ok := l.InboundInfo.Load(tag); ok {
-		inboundInfo := value.(*InboundInfo)
-		// Clear Speed Limiter bucket for users who are not online
-		inboundInfo.BucketHub.Range(func(key, value interface{}) bool {
-			email := key.(string)
-			if _, exists := inboundInfo.UserOnlineIP.Load(email); !exists {
-				inboundInfo.BucketHub.Delete(email)
-			}
-			return true
-		})
-		inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
-			email := key.(string)
-			ipMap := value.(*sync.Map)
-			ipMap.Range(func(key, value interface{}) bool {
-				uid := value.(int)
-				ip := key.(string)
-				onlineUser = append(onlineUser, api.OnlineUser{UID: uid, IP: ip})
-				return true
-			})
-			inboundInfo.UserOnlineIP.Delete(email) // Reset online device
-			return true
-		})
-	} else {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
 		return nil, fmt.Errorf("no such inbound in limiter: %s", tag)
 	}
-
+	inboundInfo := value.(*InboundInfo)
+	// Get and reset online device
+	onlineUser, err := inboundInfo.OnlineStore.PopOnline()
+	if err != nil {
+		return nil, fmt.Errorf("get online device of %s failed: %s", tag, err)
+	}
+	// Clear Speed Limiter bucket for users who are not online
+	if inboundInfo.BucketHub.Len() > 0 {
+		onlineUIDs := make(map[int]struct{}, len(onlineUser))
+		for i := range onlineUser {
+			onlineUIDs[onlineUser[i].UID] = struct{}{}
+		}
+		inboundInfo.BucketHub.DeleteFunc(func(uid int, _ *rate.Limiter) bool {
+			_, ok := onlineUIDs[uid]
+			return !ok
+		})
+	}
 	return &onlineUser, nil
 }
 
@@ -170,36 +200,28 @@ func (l *Limiter) GetUserBucket(tag string, email string, ip string) (limiter *r
 		inboundInfo := value.(*InboundInfo)
 		nodeLimit := inboundInfo.NodeSpeedLimit
 
-		if v, ok := inboundInfo.UserInfo.Load(email); ok {
-			u := v.(UserInfo)
-			uid = u.UID
+		uid, _ = userstore.UID(email)
+		if u, ok := inboundInfo.UserInfo.Load(uid); ok {
 			userLimit = u.SpeedLimit
 			deviceLimit = u.DeviceLimit
 		}
 
 		// Local device limit
-		ipMap := new(sync.Map)
-		ipMap.Store(ip, uid)
-		// If any device is online
-		if v, ok := inboundInfo.UserOnlineIP.LoadOrStore(email, ipMap); ok {
-			ipMap := v.(*sync.Map)
-			// If this is a new ip
-			if _, ok := ipMap.LoadOrStore(ip, uid); !ok {
-				counter := 0
-				ipMap.Range(func(key, value interface{}) bool {
-					counter++
-					return true
-				})
-				if counter > deviceLimit && deviceLimit > 0 {
-					ipMap.Delete(ip)
-					return nil, false, true
-				}
+		if counter, added, err := inboundInfo.OnlineStore.AddIP(email, ip, uid); err != nil {
+			newError("online store").Base(err).AtError().WriteToLog()
+		} else if added && counter > deviceLimit && deviceLimit > 0 {
+			// This is a new ip beyond the limit
+			if err := inboundInfo.OnlineStore.RemoveIP(email, ip); err != nil {
+				newError("online store").Base(err).AtError().WriteToLog()
 			}
+			inboundInfo.rejectDevice(uid, ip)
+			return nil, false, true
 		}
 
 		// GlobalLimit
 		if inboundInfo.GlobalLimit.config != nil && inboundInfo.GlobalLimit.config.Enable {
 			if reject := globalLimit(inboundInfo, email, uid, ip, deviceLimit); reject {
+				inboundInfo.rejectDevice(uid, ip)
 				return nil, false, true
 			}
 		}
@@ -208,12 +230,8 @@ func (l *Limiter) GetUserBucket(tag string, email string, ip string) (limiter *r
 		limit := determineRate(nodeLimit, userLimit) // Determine the speed limit rate
 		if limit > 0 {
 			limiter := rate.NewLimiter(rate.Limit(limit), int(limit)) // Byte/s
-			if v, ok := inboundInfo.BucketHub.LoadOrStore(email, limiter); ok {
-				bucket := v.(*rate.Limiter)
-				return bucket, true, false
-			} else {
-				return limiter, true, false
-			}
+			bucket, _ := inboundInfo.BucketHub.LoadOrStore(uid, limiter)
+			return bucket, true, false
 		} else {
 			return nil, false, false
 		}
@@ -223,6 +241,19 @@ func (l *Limiter) GetUserBucket(tag string, email string, ip string) (limiter *r
 	}
 }
 
+// UDPAllowed reports whether the user may send UDP traffic
+func (l *Limiter) UDPAllowed(tag string, email string) bool {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return true
+	}
+	uid, _ := userstore.UID(email)
+	if u, ok := value.(*InboundInfo).UserInfo.Load(uid); ok {
+		return !u.DisableUDP
+	}
+	return true
+}
+
 // Global device limit
 func globalLimit(inboundInfo *InboundInfo, email string, uid int, ip string, deviceLimit int) bool {
 
@@ -10,3 +10,21 @@ type GlobalDeviceLimitConfig struct {
 	Timeout       int    `mapstructure:"Timeout"`
 	Expiry        int    `mapstructure:"Expiry"` // second
 }
+
+type OnlineStoreConfig struct {
+	Type          string `mapstructure:"Type"`         // memory or redis
+	RedisNetwork  string `mapstructure:"RedisNetwork"` // tcp or unix
+	RedisAddr     string `mapstructure:"RedisAddr"`    // host:port, or /path/to/unix.sock
+	RedisUsername string `mapstructure:"RedisUsername"`
+	RedisPassword string `mapstructure:"RedisPassword"`
+	RedisDB       int    `mapstructure:"RedisDB"`
+	Timeout       int    `mapstructure:"Timeout"`
+	Expiry        int    `mapstructure:"Expiry"`       // second
+	DeviceWindow  int    `mapstructure:"DeviceWindow"` // minute
+}
+
+// ShaperConfig shares the bandwidth of an inbound between its users
+type ShaperConfig struct {
+	Rate      int `mapstructure:"Rate"`      // mbps, 0 to disable
+	FairShare int `mapstructure:"FairShare"` // mbps assured to each user, 0 for Rate split evenly between the active users
+}
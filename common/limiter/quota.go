@@ -0,0 +1,102 @@
+package limiter
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+
+	"github.com/qtai2901/new_xrayr/common/userstore"
+)
+
+// Quota is the traffic a user may still use until the panel lists the user
+// again, Byte
+type Quota struct {
+	left atomic.Int64
+}
+
+// UpdateUserQuota sets the traffic left to the users of the inbound, keyed by
+// email. A negative quota is used up, the users missing from quotas have no
+// quota. The links already open follow the new quotas.
+func (l *Limiter) UpdateUserQuota(tag string, quotas map[string]int64) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	inboundInfo := value.(*InboundInfo)
+	uidQuotas := make(map[int]int64, len(quotas))
+	for email, left := range quotas {
+		if uid, ok := userstore.UID(email); ok {
+			uidQuotas[uid] = left
+		}
+	}
+	inboundInfo.QuotaHub.DeleteFunc(func(uid int, _ *Quota) bool {
+		_, ok := uidQuotas[uid]
+		return !ok
+	})
+	for uid, left := range uidQuotas {
+		quota, _ := inboundInfo.QuotaHub.LoadOrStore(uid, new(Quota))
+		quota.left.Store(max(left, 0))
+	}
+	return nil
+}
+
+// GetUserQuota returns the quota of the user, nil if the user has none. It
+// reports reject if the quota is used up.
+func (l *Limiter) GetUserQuota(tag string, email string) (quota *Quota, reject bool) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil, false
+	}
+	uid, ok := userstore.UID(email)
+	if !ok {
+		return nil, false
+	}
+	quota, ok = value.(*InboundInfo).QuotaHub.Load(uid)
+	if !ok {
+		return nil, false
+	}
+	return quota, quota.left.Load() <= 0
+}
+
+// UserQuotas returns the traffic the users of the inbound have left, by UID.
+// A used up quota is 0.
+func (l *Limiter) UserQuotas(tag string) map[int]int64 {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil
+	}
+	quotas := make(map[int]int64)
+	value.(*InboundInfo).QuotaHub.Range(func(uid int, quota *Quota) bool {
+		quotas[uid] = max(quota.left.Load(), 0)
+		return true
+	})
+	return quotas
+}
+
+type QuotaWriter struct {
+	writer buf.Writer
+	quota  *Quota
+}
+
+// QuotaWriter counts the traffic written to writer against the quota, and
+// fails the writes once it is used up
+func (l *Limiter) QuotaWriter(writer buf.Writer, quota *Quota) buf.Writer {
+	return &QuotaWriter{
+		writer: writer,
+		quota:  quota,
+	}
+}
+
+func (w *QuotaWriter) Close() error {
+	return common.Close(w.writer)
+}
+
+func (w *QuotaWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	if w.quota.left.Add(-int64(mb.Len())) < 0 {
+		buf.ReleaseMulti(mb)
+		return newError("traffic quota used up")
+	}
+	return w.writer.WriteMultiBuffer(mb)
+}
@@ -0,0 +1,58 @@
+package limiter_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/xtls/xray-core/common/buf"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/limiter"
+)
+
+func TestQuotaSurvivesRebuild(t *testing.T) {
+	l := limiter.New()
+	users := []api.UserInfo{{UID: 1}, {UID: 2}}
+	if err := l.AddInboundLimiter("old", 0, &users, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.UpdateUserQuota("old", map[string]int64{"old|a@node|1": 1000, "old|b@node|2": -1}); err != nil {
+		t.Fatal(err)
+	}
+	quota, reject := l.GetUserQuota("old", "old|a@node|1")
+	if quota == nil || reject {
+		t.Fatal("no quota to use")
+	}
+	b := buf.New()
+	b.Extend(400)
+	if err := l.QuotaWriter(buf.Discard, quota).WriteMultiBuffer(buf.MultiBuffer{b}); err != nil {
+		t.Fatal(err)
+	}
+	l.GetUserTraffic("old", "old|a@node|1").Up.Add(400)
+	if pending := l.PendingTraffic("old"); pending[1] != 400 {
+		t.Errorf("got pending traffic %v, want 400 of user 1", pending)
+	}
+
+	// Rebuilt under a new tag the way the controller does it
+	quotas := l.UserQuotas("old")
+	if err := l.DeleteInboundLimiter("old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AddInboundLimiter("new", 0, &users, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	tagged := make(map[string]int64, len(quotas))
+	for uid, left := range quotas {
+		tagged[fmt.Sprintf("new|user@node|%d", uid)] = left
+	}
+	if err := l.UpdateUserQuota("new", tagged); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := l.UserQuotas("new"); len(got) != 2 || got[1] != 600 || got[2] != 0 {
+		t.Errorf("got quotas %v after the rebuild, want 600 left to user 1 and user 2 used up", got)
+	}
+	if _, reject := l.GetUserQuota("new", "new|b@node|2"); !reject {
+		t.Error("used up quota accepted after the rebuild")
+	}
+}
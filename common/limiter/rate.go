@@ -31,3 +31,27 @@ func (w *Writer) WriteMultiBuffer(mb buf.MultiBuffer) error {
 	w.limiter.WaitN(ctx, int(mb.Len()))
 	return w.writer.WriteMultiBuffer(mb)
 }
+
+type Reader struct {
+	reader  buf.Reader
+	limiter *rate.Limiter
+}
+
+func (l *Limiter) RateReader(reader buf.Reader, limiter *rate.Limiter) buf.Reader {
+	return &Reader{
+		reader:  reader,
+		limiter: limiter,
+	}
+}
+
+func (r *Reader) Interrupt() {
+	common.Interrupt(r.reader)
+}
+
+func (r *Reader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	mb, err := r.reader.ReadMultiBuffer()
+	if !mb.IsEmpty() {
+		r.limiter.WaitN(context.Background(), int(mb.Len()))
+	}
+	return mb, err
+}
@@ -0,0 +1,33 @@
+package limiter
+
+import (
+	"slices"
+)
+
+// IPs of a user kept between two snapshots of the rejections
+const maxRejectedIPs = 16
+
+// rejectDevice records the IP of the user rejected by the device limit
+func (i *InboundInfo) rejectDevice(uid int, ip string) {
+	i.RejectHub.Compute(uid, func(ips []string, _ bool) ([]string, bool) {
+		if len(ips) < maxRejectedIPs && !slices.Contains(ips, ip) {
+			ips = append(ips, ip)
+		}
+		return ips, true
+	})
+}
+
+// SnapshotDeviceRejects returns the IPs of the users of the inbound rejected
+// by the device limit since the last snapshot, by UID
+func (l *Limiter) SnapshotDeviceRejects(tag string) map[int][]string {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil
+	}
+	snapshot := make(map[int][]string)
+	value.(*InboundInfo).RejectHub.DeleteFunc(func(uid int, ips []string) bool {
+		snapshot[uid] = ips
+		return true
+	})
+	return snapshot
+}
@@ -0,0 +1,175 @@
+package limiter
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"golang.org/x/time/rate"
+
+	"github.com/qtai2901/new_xrayr/common/userstore"
+)
+
+const (
+	// shaperChunk is the most a write takes from the buckets at once, their
+	// burst is at least this
+	shaperChunk = 64 << 10
+	// shaperPeriod is how often the active users are counted, a user is
+	// active if it wrote since the previous count
+	shaperPeriod = time.Second
+	// shaperIdle is how long the share of an idle user is kept
+	shaperIdle = time.Minute
+)
+
+// Shaper shares the Rate of an inbound between its users, the way an HTB
+// class shares its rate between its children. Each user is assured its fair
+// share, taken ahead of the others, and borrows what they leave unused. So a
+// user at full speed limit slows down when the others need their share,
+// instead of starving them when the uplink is smaller than the sum of the
+// speed limits. The speed limit of a user still caps it.
+type Shaper struct {
+	total     *rate.Limiter
+	rate      int64 // Byte/s
+	fairShare int64 // Byte/s, 0 for rate split between the active users
+	share     atomic.Int64
+	next      atomic.Int64 // Unix nano of the next count
+	users     *userstore.Store[*shapedUser]
+}
+
+type shapedUser struct {
+	share      *rate.Limiter
+	lastActive atomic.Int64 // Unix nano
+}
+
+// NewShaper returns the shaper of config, nil if it is disabled
+func NewShaper(config *ShaperConfig) *Shaper {
+	if config == nil || config.Rate <= 0 {
+		return nil
+	}
+	s := &Shaper{
+		rate:      int64(config.Rate) * 1000000 / 8,
+		fairShare: int64(config.FairShare) * 1000000 / 8,
+		users:     userstore.New[*shapedUser](),
+	}
+	s.total = rate.NewLimiter(rate.Limit(s.rate), int(max(s.rate, shaperChunk)))
+	if s.fairShare > 0 {
+		s.share.Store(s.fairShare)
+	} else {
+		s.share.Store(s.rate)
+	}
+	return s
+}
+
+// Share returns the byte/s the users are assured at the moment
+func (s *Shaper) Share() int64 {
+	return s.share.Load()
+}
+
+// wait blocks until the user of uid may write n bytes
+func (s *Shaper) wait(uid int, n int) {
+	now := time.Now()
+	u, ok := s.users.Load(uid)
+	if !ok {
+		u = s.users.Compute(uid, func(u *shapedUser, ok bool) (*shapedUser, bool) {
+			if !ok {
+				share := s.share.Load()
+				u = &shapedUser{share: rate.NewLimiter(rate.Limit(share), int(max(share, shaperChunk)))}
+			}
+			return u, true
+		})
+	}
+	u.lastActive.Store(now.UnixNano())
+	s.count(now)
+	for n > 0 {
+		chunk := min(n, shaperChunk)
+		if u.share.AllowN(now, chunk) {
+			// Within the share, the borrowers wait for the debt instead
+			s.total.ReserveN(now, chunk)
+		} else {
+			s.total.WaitN(context.Background(), chunk)
+			now = time.Now()
+		}
+		n -= chunk
+	}
+}
+
+// count splits the rate between the users active since the previous count,
+// once a period
+func (s *Shaper) count(now time.Time) {
+	next := s.next.Load()
+	if now.UnixNano() < next || !s.next.CompareAndSwap(next, now.Add(shaperPeriod).UnixNano()) {
+		return
+	}
+	var (
+		since  = min(next-int64(shaperPeriod), now.Add(-shaperPeriod).UnixNano())
+		idle   = now.Add(-shaperIdle).UnixNano()
+		active int64
+	)
+	s.users.DeleteFunc(func(_ int, u *shapedUser) bool {
+		lastActive := u.lastActive.Load()
+		if lastActive >= since {
+			active++
+		}
+		return lastActive < idle
+	})
+	share := s.fairShare
+	if share == 0 {
+		share = s.rate / max(active, 1)
+	}
+	if share == s.share.Swap(share) {
+		return
+	}
+	s.users.Range(func(_ int, u *shapedUser) bool {
+		u.share.SetLimit(rate.Limit(share))
+		u.share.SetBurst(int(max(share, shaperChunk)))
+		return true
+	})
+}
+
+// Share is the part of the shaper of an inbound a user gets
+type Share struct {
+	shaper *Shaper
+	uid    int
+}
+
+// GetUserShare returns the share the links of the user are shaped with, nil
+// if the inbound has no shaper
+func (l *Limiter) GetUserShare(tag string, email string) *Share {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil
+	}
+	shaper := value.(*InboundInfo).Shaper
+	if shaper == nil {
+		return nil
+	}
+	uid, ok := userstore.UID(email)
+	if !ok {
+		return nil
+	}
+	return &Share{shaper: shaper, uid: uid}
+}
+
+type ShareWriter struct {
+	writer buf.Writer
+	share  *Share
+}
+
+// ShareWriter shapes the writes to writer with the share
+func (l *Limiter) ShareWriter(writer buf.Writer, share *Share) buf.Writer {
+	return &ShareWriter{
+		writer: writer,
+		share:  share,
+	}
+}
+
+func (w *ShareWriter) Close() error {
+	return common.Close(w.writer)
+}
+
+func (w *ShareWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	w.share.shaper.wait(w.share.uid, int(mb.Len()))
+	return w.writer.WriteMultiBuffer(mb)
+}
@@ -0,0 +1,52 @@
+package limiter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/limiter"
+)
+
+func TestShaperShare(t *testing.T) {
+	if limiter.NewShaper(&limiter.ShaperConfig{}) != nil {
+		t.Error("got a shaper without a rate")
+	}
+	for _, test := range []struct {
+		config limiter.ShaperConfig
+		want   int64 // Byte/s
+	}{
+		{limiter.ShaperConfig{Rate: 80}, 5000000},
+		{limiter.ShaperConfig{Rate: 80, FairShare: 8}, 1000000},
+	} {
+		l := limiter.New()
+		users := []api.UserInfo{{UID: 1}, {UID: 2}}
+		if err := l.AddInboundLimiter("test", 0, &users, nil, nil, &test.config); err != nil {
+			t.Fatal(err)
+		}
+		var writers []buf.Writer
+		for _, email := range []string{"test|a@node|1", "test|b@node|2"} {
+			share := l.GetUserShare("test", email)
+			if share == nil {
+				t.Fatalf("no share for %s", email)
+			}
+			writers = append(writers, l.ShareWriter(buf.Discard, share))
+		}
+		// Both users write, the next period splits the rate between them
+		for _, w := range writers {
+			w.WriteMultiBuffer(buf.MultiBuffer{buf.New()})
+		}
+		time.Sleep(1100 * time.Millisecond)
+		writers[0].WriteMultiBuffer(buf.MultiBuffer{buf.New()})
+
+		value, _ := l.InboundInfo.Load("test")
+		if got := value.(*limiter.InboundInfo).Shaper.Share(); got != test.want {
+			t.Errorf("%+v: got a share of %d, want %d", test.config, got, test.want)
+		}
+	}
+	if share := limiter.New().GetUserShare("test", "test|a@node|1"); share != nil {
+		t.Error("got a share of an unknown inbound")
+	}
+}
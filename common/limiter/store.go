@@ -0,0 +1,319 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/userstore"
+)
+
+// OnlineStore keeps the IPs the users of an inbound are online from
+type OnlineStore interface {
+	// AddIP records an IP of the user. count is the number of the IPs of the
+	// user seen within the device window afterwards, added is false if the
+	// IP was already in it.
+	AddIP(email string, ip string, uid int) (count int, added bool, err error)
+	RemoveIP(email string, ip string) error
+	// PopOnline returns the IPs of every user seen since the previous call.
+	// The first seen time of an IP still within the device window is carried
+	// over, so it covers the whole session. Popping doesn't change the
+	// device count.
+	PopOnline() ([]api.OnlineUser, error)
+	Close() error
+}
+
+// defaultDeviceWindow is how long an IP counts toward the device limit after
+// it was last seen, unless the config sets it
+const defaultDeviceWindow = 3 * time.Minute
+
+// newOnlineStore creates the store of the inbound with tag, in memory
+// unless the config asks for redis
+func newOnlineStore(tag string, config *OnlineStoreConfig) (OnlineStore, error) {
+	window := defaultDeviceWindow
+	if config != nil && config.DeviceWindow > 0 {
+		window = time.Duration(config.DeviceWindow) * time.Minute
+	}
+	if config == nil || config.Type == "" || config.Type == "memory" {
+		return newMemoryStore(window), nil
+	}
+	if config.Type != "redis" {
+		return nil, fmt.Errorf("unsupported online store type: %s", config.Type)
+	}
+	return newRedisOnlineStore(tag, config, window), nil
+}
+
+type onlineIP struct {
+	firstSeen int64
+	lastSeen  int64
+	active    bool // Seen since the last pop
+}
+
+type onlineUser struct {
+	ips    map[string]onlineIP // Key: IP
+	active int                 // IPs seen since the last pop
+}
+
+// seenSince returns the number of the IPs of u last seen at since or later
+func (u *onlineUser) seenSince(since int64) int {
+	count := 0
+	for _, o := range u.ips {
+		if o.lastSeen >= since {
+			count++
+		}
+	}
+	return count
+}
+
+// memoryStore keeps the online users by UID, so the links of different users
+// don't wait on each other. A pop keeps the users and the IPs seen within the
+// device window, marked inactive, so the device count and the first seen
+// times carry over and the maps are reused instead of allocated again every
+// interval. The ones out of the window and still inactive are dropped.
+type memoryStore struct {
+	online *userstore.Store[*onlineUser]
+	pop    sync.Mutex
+	window int64 // second
+}
+
+func newMemoryStore(window time.Duration) *memoryStore {
+	return &memoryStore{online: userstore.New[*onlineUser](), window: int64(window / time.Second)}
+}
+
+func (s *memoryStore) AddIP(email string, ip string, uid int) (count int, added bool, err error) {
+	now := time.Now().Unix()
+	since := now - s.window
+	s.online.Compute(uid, func(u *onlineUser, ok bool) (*onlineUser, bool) {
+		if !ok {
+			u = &onlineUser{ips: make(map[string]onlineIP, 1)}
+		}
+		o, ok := u.ips[ip]
+		if !ok {
+			o.firstSeen = now
+		}
+		added = !ok || o.lastSeen < since
+		if !o.active {
+			o.active = true
+			u.active++
+		}
+		o.lastSeen = now
+		u.ips[ip] = o
+		count = u.seenSince(since)
+		return u, true
+	})
+	return count, added, nil
+}
+
+func (s *memoryStore) RemoveIP(email string, ip string) error {
+	uid, _ := userstore.UID(email)
+	s.online.Compute(uid, func(u *onlineUser, ok bool) (*onlineUser, bool) {
+		if !ok {
+			return nil, false
+		}
+		if o, ok := u.ips[ip]; ok {
+			if o.active {
+				u.active--
+			}
+			delete(u.ips, ip)
+		}
+		return u, true
+	})
+	return nil
+}
+
+func (s *memoryStore) PopOnline() ([]api.OnlineUser, error) {
+	s.pop.Lock()
+	defer s.pop.Unlock()
+	since := time.Now().Unix() - s.window
+	// Most users are online from a single IP
+	result := make([]api.OnlineUser, 0, s.online.Len())
+	s.online.DeleteFunc(func(uid int, u *onlineUser) bool {
+		for ip, o := range u.ips {
+			if !o.active {
+				if o.lastSeen < since {
+					delete(u.ips, ip)
+				}
+				continue
+			}
+			result = append(result, api.OnlineUser{UID: uid, IP: ip, FirstSeen: o.firstSeen, LastSeen: o.lastSeen})
+			o.active = false
+			u.ips[ip] = o
+		}
+		u.active = 0
+		return len(u.ips) == 0
+	})
+	return result, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// redisOnlineStore keeps a set of the online emails of the inbound, and
+// hashes of IP to UID and to the first and last seen times for each of them,
+// so the state is shared by all the processes serving the inbound and
+// survives restarts. The IPs of the device window of each email are a
+// sorted set by last seen time, which the pops leave alone.
+type redisOnlineStore struct {
+	client  *redis.Client
+	key     string
+	timeout time.Duration
+	expiry  time.Duration
+	window  time.Duration
+}
+
+func newRedisOnlineStore(tag string, config *OnlineStoreConfig, window time.Duration) *redisOnlineStore {
+	s := &redisOnlineStore{
+		client: redis.NewClient(&redis.Options{
+			Network:  config.RedisNetwork,
+			Addr:     config.RedisAddr,
+			Username: config.RedisUsername,
+			Password: config.RedisPassword,
+			DB:       config.RedisDB,
+		}),
+		key:     "xrayr:online:" + tag,
+		timeout: time.Duration(config.Timeout) * time.Second,
+		expiry:  time.Duration(config.Expiry) * time.Second,
+		window:  window,
+	}
+	if s.timeout <= 0 {
+		s.timeout = 5 * time.Second
+	}
+	if s.expiry <= 0 {
+		s.expiry = 5 * time.Minute
+	}
+	return s
+}
+
+func (s *redisOnlineStore) userKey(email string) string {
+	return s.key + ":" + email
+}
+
+// windowStart is the score of the first IP still within the device window
+func (s *redisOnlineStore) windowStart() string {
+	return strconv.FormatInt(time.Now().Add(-s.window).Unix(), 10)
+}
+
+func (s *redisOnlineStore) AddIP(email string, ip string, uid int) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	var (
+		added *redis.IntCmd
+		count *redis.IntCmd
+	)
+	now := time.Now().Unix()
+	seen := s.userKey(email) + ":seen"
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, seen, "-inf", "("+s.windowStart())
+		added = pipe.ZAdd(ctx, seen, redis.Z{Score: float64(now), Member: ip})
+		count = pipe.ZCard(ctx, seen)
+		pipe.HSetNX(ctx, s.userKey(email), ip, uid)
+		pipe.HSetNX(ctx, s.userKey(email)+":first", ip, now)
+		pipe.HSet(ctx, s.userKey(email)+":last", ip, now)
+		pipe.SAdd(ctx, s.key, email)
+		for _, key := range []string{s.userKey(email), s.userKey(email) + ":first", s.userKey(email) + ":last", s.key} {
+			pipe.Expire(ctx, key, s.expiry)
+		}
+		pipe.Expire(ctx, seen, max(s.expiry, s.window))
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return int(count.Val()), added.Val() > 0, nil
+}
+
+func (s *redisOnlineStore) RemoveIP(email string, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, s.userKey(email), ip)
+		pipe.ZRem(ctx, s.userKey(email)+":seen", ip)
+		return nil
+	})
+	return err
+}
+
+func (s *redisOnlineStore) PopOnline() ([]api.OnlineUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	emails, err := s.client.SMembers(ctx, s.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(emails) == 0 {
+		return nil, nil
+	}
+
+	var (
+		ipMaps    = make([]*redis.MapStringStringCmd, len(emails))
+		firstSeen = make([]*redis.MapStringStringCmd, len(emails))
+		lastSeen  = make([]*redis.MapStringStringCmd, len(emails))
+		inWindow  = make([]*redis.StringSliceCmd, len(emails))
+		since     = s.windowStart()
+	)
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, email := range emails {
+			ipMaps[i] = pipe.HGetAll(ctx, s.userKey(email))
+			firstSeen[i] = pipe.HGetAll(ctx, s.userKey(email)+":first")
+			lastSeen[i] = pipe.HGetAll(ctx, s.userKey(email)+":last")
+			inWindow[i] = pipe.ZRangeByScore(ctx, s.userKey(email)+":seen", &redis.ZRangeBy{Min: since, Max: "+inf"})
+			pipe.Del(ctx, s.userKey(email), s.userKey(email)+":last")
+		}
+		members := make([]any, len(emails))
+		for i, email := range emails {
+			members[i] = email
+		}
+		pipe.SRem(ctx, s.key, members...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]api.OnlineUser, 0, len(emails))
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, email := range emails {
+			ipMap := ipMaps[i].Val()
+			for ip, value := range ipMap {
+				uid, err := strconv.Atoi(value)
+				if err != nil {
+					continue
+				}
+				first, _ := strconv.ParseInt(firstSeen[i].Val()[ip], 10, 64)
+				last, _ := strconv.ParseInt(lastSeen[i].Val()[ip], 10, 64)
+				result = append(result, api.OnlineUser{UID: uid, IP: ip, FirstSeen: first, LastSeen: last})
+			}
+			// The first seen times are kept for the IPs still within the
+			// device window only
+			recent := make(map[string]struct{}, len(inWindow[i].Val()))
+			for _, ip := range inWindow[i].Val() {
+				recent[ip] = struct{}{}
+			}
+			var offline []string
+			for ip := range firstSeen[i].Val() {
+				_, online := ipMap[ip]
+				if _, ok := recent[ip]; !ok && !online {
+					offline = append(offline, ip)
+				}
+			}
+			if len(offline) > 0 {
+				pipe.HDel(ctx, s.userKey(email)+":first", offline...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *redisOnlineStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,41 @@
+package limiter_test
+
+import (
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/limiter"
+)
+
+func TestDeviceWindow(t *testing.T) {
+	l := limiter.New()
+	users := []api.UserInfo{{UID: 1, DeviceLimit: 1}}
+	if err := l.AddInboundLimiter("test", 0, &users, nil, &limiter.OnlineStoreConfig{DeviceWindow: 5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	email := "test|user@node|1"
+	if _, _, reject := l.GetUserBucket("test", email, "192.0.2.1"); reject {
+		t.Fatal("first device rejected")
+	}
+	// The report in between doesn't free the slot of the first device
+	if _, err := l.GetOnlineDevice("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, reject := l.GetUserBucket("test", email, "192.0.2.2"); !reject {
+		t.Error("second device accepted after a report")
+	}
+	if _, _, reject := l.GetUserBucket("test", email, "192.0.2.1"); reject {
+		t.Error("first device rejected reconnecting")
+	}
+
+	online, err := l.GetOnlineDevice("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*online) != 1 || (*online)[0].IP != "192.0.2.1" {
+		t.Errorf("got online %+v, want the first device only", *online)
+	}
+	if rejects := l.SnapshotDeviceRejects("test"); len(rejects[1]) != 1 || rejects[1][0] != "192.0.2.2" {
+		t.Errorf("got rejects %v", rejects)
+	}
+}
@@ -0,0 +1,122 @@
+package limiter
+
+import (
+	"sync/atomic"
+
+	"github.com/xtls/xray-core/app/dispatcher"
+	"github.com/xtls/xray-core/common/buf"
+
+	"github.com/qtai2901/new_xrayr/common/userstore"
+)
+
+// Traffic is the traffic of a user since the last snapshot, Byte. The links
+// of the user add to it without locking.
+type Traffic struct {
+	Up   atomic.Uint64
+	Down atomic.Uint64
+}
+
+// TrafficSnapshot is the traffic a user used between two snapshots, Byte
+type TrafficSnapshot struct {
+	Up   int64
+	Down int64
+}
+
+// GetUserTraffic returns the traffic counters of the user, nil if the inbound
+// or the user is unknown
+func (l *Limiter) GetUserTraffic(tag string, email string) *Traffic {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil
+	}
+	uid, ok := userstore.UID(email)
+	if !ok {
+		return nil
+	}
+	traffic, _ := value.(*InboundInfo).TrafficHub.LoadOrStore(uid, new(Traffic))
+	return traffic
+}
+
+// SnapshotTraffic returns the traffic of the users of the inbound by UID, and
+// starts counting again from zero. The users without traffic are left out.
+// Each counter is swapped at once, so no traffic written meanwhile is lost.
+func (l *Limiter) SnapshotTraffic(tag string) map[int]TrafficSnapshot {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil
+	}
+	inboundInfo := value.(*InboundInfo)
+	snapshot := make(map[int]TrafficSnapshot)
+	inboundInfo.TrafficHub.Range(func(uid int, traffic *Traffic) bool {
+		up, down := traffic.Up.Swap(0), traffic.Down.Swap(0)
+		if up > 0 || down > 0 {
+			snapshot[uid] = TrafficSnapshot{Up: int64(up), Down: int64(down)}
+			inboundInfo.Reported.Up.Add(up)
+			inboundInfo.Reported.Down.Add(down)
+		}
+		return true
+	})
+	return snapshot
+}
+
+// PendingTraffic returns the traffic of the users of the inbound since the
+// last snapshot by UID, upload and download added, leaving the counters as
+// they are
+func (l *Limiter) PendingTraffic(tag string) map[int]int64 {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil
+	}
+	pending := make(map[int]int64)
+	value.(*InboundInfo).TrafficHub.Range(func(uid int, traffic *Traffic) bool {
+		if used := traffic.Up.Load() + traffic.Down.Load(); used > 0 {
+			pending[uid] = int64(used)
+		}
+		return true
+	})
+	return pending
+}
+
+// TotalTraffic returns the traffic of all the users of the inbound since it
+// was added, Byte. It only grows, but for a moment while a snapshot is taken.
+func (l *Limiter) TotalTraffic(tag string) (up, down uint64) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return 0, 0
+	}
+	inboundInfo := value.(*InboundInfo)
+	up, down = inboundInfo.Reported.Up.Load(), inboundInfo.Reported.Down.Load()
+	inboundInfo.TrafficHub.Range(func(_ int, traffic *Traffic) bool {
+		up += traffic.Up.Load()
+		down += traffic.Down.Load()
+		return true
+	})
+	return up, down
+}
+
+// TrafficWriter adds the traffic written to writer to counter. It is the
+// writer Xray looks for when it splices a connection, so the spliced traffic
+// is counted too.
+func (l *Limiter) TrafficWriter(writer buf.Writer, counter *atomic.Uint64) buf.Writer {
+	return &dispatcher.SizeStatWriter{
+		Counter: trafficCounter{counter},
+		Writer:  writer,
+	}
+}
+
+// trafficCounter is a stats.Counter adding to a traffic counter
+type trafficCounter struct {
+	counter *atomic.Uint64
+}
+
+func (c trafficCounter) Value() int64 {
+	return int64(c.counter.Load())
+}
+
+func (c trafficCounter) Set(v int64) int64 {
+	return int64(c.counter.Swap(uint64(v)))
+}
+
+func (c trafficCounter) Add(v int64) int64 {
+	return int64(c.counter.Add(uint64(v)))
+}
@@ -0,0 +1,181 @@
+// Package logarchive compresses the logs of the node and ships them to an
+// S3 compatible store, removing the local copies once uploaded
+package logarchive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Enable    bool     `mapstructure:"Enable"`
+	Endpoint  string   `mapstructure:"Endpoint"` // https://s3.amazonaws.com, or the URL of MinIO
+	Region    string   `mapstructure:"Region"`
+	Bucket    string   `mapstructure:"Bucket"`
+	AccessKey string   `mapstructure:"AccessKey"`
+	SecretKey string   `mapstructure:"SecretKey"`
+	PathStyle bool     `mapstructure:"PathStyle"` // Bucket in the path instead of the host name, usually needed by MinIO
+	Prefix    string   `mapstructure:"Prefix"`    // Defaults to the host name
+	Files     []string `mapstructure:"Files"`     // Logs kept open by their writer, copied and truncated on every run
+	Rotated   []string `mapstructure:"Rotated"`   // Glob patterns of logs already rotated, removed once uploaded
+	Periodic  int      `mapstructure:"Periodic"`  // Hour
+	Retention int      `mapstructure:"Retention"` // Day
+}
+
+// Archive uploads the logs on every Run
+type Archive struct {
+	client    *s3Client
+	prefix    string
+	files     []string
+	rotated   []string
+	retention time.Duration
+	now       func() time.Time
+}
+
+func New(config *Config) (*Archive, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("log archive bucket is empty")
+	}
+	client, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix == "" {
+		if prefix, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	return &Archive{
+		client:    client,
+		prefix:    prefix,
+		files:     config.Files,
+		rotated:   config.Rotated,
+		retention: time.Duration(config.Retention) * 24 * time.Hour,
+		now:       time.Now,
+	}, nil
+}
+
+// Run compresses the logs, uploads them and removes the archives older
+// than the retention from the bucket. A failed upload leaves the compressed
+// file in place for the next run. It returns the number of files uploaded.
+func (a *Archive) Run() (int, error) {
+	stamp := a.now().UTC().Format("20060102T150405")
+	var pending []string
+	for _, file := range a.files {
+		if err := copyTruncate(file, fmt.Sprintf("%s-%s.gz", file, stamp)); err != nil {
+			return 0, err
+		}
+		// Including the ones left by the failed runs
+		matches, err := filepath.Glob(file + "-*.gz")
+		if err != nil {
+			return 0, err
+		}
+		pending = append(pending, matches...)
+	}
+	for _, pattern := range a.rotated {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return 0, err
+		}
+		for _, match := range matches {
+			if !strings.HasSuffix(match, ".gz") {
+				compressed := match + ".gz"
+				if err := compress(match, compressed); err != nil {
+					return 0, err
+				}
+				if err := os.Remove(match); err != nil {
+					return 0, err
+				}
+				match = compressed
+			}
+			pending = append(pending, match)
+		}
+	}
+
+	uploaded := 0
+	for _, file := range pending {
+		if err := a.client.PutFile(path.Join(a.prefix, filepath.Base(file)), file); err != nil {
+			return uploaded, fmt.Errorf("upload %s failed: %s", file, err)
+		}
+		if err := os.Remove(file); err != nil {
+			return uploaded, err
+		}
+		uploaded++
+	}
+	return uploaded, a.expire()
+}
+
+// expire removes the archives older than the retention
+func (a *Archive) expire() error {
+	if a.retention <= 0 {
+		return nil
+	}
+	objects, err := a.client.List(a.prefix + "/")
+	if err != nil {
+		return fmt.Errorf("list archives failed: %s", err)
+	}
+	for _, o := range objects {
+		if a.now().Sub(o.LastModified) > a.retention {
+			if err := a.client.Delete(o.Key); err != nil {
+				return fmt.Errorf("remove archive %s failed: %s", o.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyTruncate compresses the log at src into dst and empties it, the
+// writer keeps appending to the same file. Lines written between the copy
+// and the truncation are lost, as with copytruncate of logrotate.
+func copyTruncate(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	if err := compress(src, dst); err != nil {
+		return err
+	}
+	return os.Truncate(src, 0)
+}
+
+func compress(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(dst + ".tmp")
+		}
+	}()
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
@@ -0,0 +1,99 @@
+package logarchive_test
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/common/logarchive"
+)
+
+func TestArchiveRun(t *testing.T) {
+	var (
+		access   sync.Mutex
+		uploaded = make(map[string]string)
+		deleted  []string
+	)
+	old := time.Now().Add(-30 * 24 * time.Hour).UTC().Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		access.Lock()
+		defer access.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data, _ := io.ReadAll(gz)
+			uploaded[r.URL.Path] = string(data)
+		case http.MethodGet:
+			w.Write([]byte(`<ListBucketResult><Contents><Key>node/access.log-old.gz</Key><LastModified>` + old +
+				`</LastModified></Contents><IsTruncated>false</IsTruncated></ListBucketResult>`))
+		case http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	accessLog := filepath.Join(dir, "access.log")
+	if err := os.WriteFile(accessLog, []byte("accepted\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "usage_V2ray_1-20240102T030405.csv"), []byte("uid\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := logarchive.New(&logarchive.Config{
+		Endpoint:  server.URL,
+		Bucket:    "logs",
+		AccessKey: "key",
+		SecretKey: "secret",
+		PathStyle: true,
+		Prefix:    "node",
+		Files:     []string{accessLog},
+		Rotated:   []string{filepath.Join(dir, "usage_*-*.csv")},
+		Retention: 7,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := archive.Run()
+	if err != nil || n != 2 {
+		t.Fatalf("unexpected run result: %d, %v", n, err)
+	}
+
+	if uploaded["/logs/node/usage_V2ray_1-20240102T030405.csv.gz"] != "uid\n" {
+		t.Errorf("rotated file not uploaded: %v", uploaded)
+	}
+	var accessArchived bool
+	for key, data := range uploaded {
+		if strings.HasPrefix(key, "/logs/node/access.log-") && data == "accepted\n" {
+			accessArchived = true
+		}
+	}
+	if !accessArchived {
+		t.Errorf("access log not uploaded: %v", uploaded)
+	}
+	if data, _ := os.ReadFile(accessLog); len(data) != 0 {
+		t.Errorf("access log not truncated: %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("uploaded files should be removed, left %d", len(entries))
+	}
+	if len(deleted) != 1 || deleted[0] != "/logs/node/access.log-old.gz" {
+		t.Errorf("unexpected deleted archives: %v", deleted)
+	}
+}
@@ -0,0 +1,108 @@
+package logstream
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	xlog "github.com/xtls/xray-core/common/log"
+)
+
+// LogrusHook publishes the log of XrayR, as the module xrayr
+type LogrusHook struct {
+	Hub *Hub
+}
+
+func (h LogrusHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h LogrusHook) Fire(entry *log.Entry) error {
+	level := logrusLevel(entry.Level)
+	if !h.Hub.Wants(level) {
+		return nil
+	}
+	e := Entry{Time: entry.Time, Level: level, Module: "xrayr", Message: entry.Message}
+	if len(entry.Data) > 0 {
+		e.Fields = make(map[string]any, len(entry.Data))
+		for k, v := range entry.Data {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			e.Fields[k] = v
+		}
+	}
+	h.Hub.Publish(e)
+	return nil
+}
+
+func logrusLevel(l log.Level) Level {
+	switch l {
+	case log.TraceLevel, log.DebugLevel:
+		return LevelDebug
+	case log.InfoLevel:
+		return LevelInfo
+	case log.WarnLevel:
+		return LevelWarning
+	default:
+		return LevelError
+	}
+}
+
+// CoreHandler publishes the log of the core before passing it on to next.
+// The access log is the module access.
+type CoreHandler struct {
+	Hub  *Hub
+	Next xlog.Handler
+}
+
+func (h *CoreHandler) Handle(msg xlog.Message) {
+	h.Next.Handle(msg)
+	switch m := msg.(type) {
+	case *xlog.GeneralMessage:
+		level := coreLevel(m.Severity)
+		if !h.Hub.Wants(level) {
+			return
+		}
+		message := fmt.Sprint(m.Content)
+		h.Hub.Publish(Entry{Time: time.Now(), Level: level, Module: moduleOf(message), Message: message})
+	case *xlog.AccessMessage:
+		if !h.Hub.Wants(LevelInfo) {
+			return
+		}
+		h.Hub.Publish(Entry{Time: time.Now(), Level: LevelInfo, Module: "access", Message: m.String()})
+	}
+}
+
+func coreLevel(s xlog.Severity) Level {
+	switch s {
+	case xlog.Severity_Debug:
+		return LevelDebug
+	case xlog.Severity_Info:
+		return LevelInfo
+	case xlog.Severity_Warning:
+		return LevelWarning
+	default:
+		return LevelError
+	}
+}
+
+// moduleOf returns the package of the core a message starts with, after the
+// session prefixes, like app/dispatcher in
+// [1234] app/dispatcher: taking detour [direct]
+func moduleOf(message string) string {
+	s := message
+	for strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "] ")
+		if i < 0 {
+			break
+		}
+		s = s[i+2:]
+	}
+	module, _, ok := strings.Cut(s, ": ")
+	if !ok || module == "" || strings.ContainsAny(module, " []") {
+		return "core"
+	}
+	return module
+}
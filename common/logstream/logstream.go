@@ -0,0 +1,165 @@
+// Package logstream fans the log of XrayR and of the core out to the
+// subscribers tailing it live, like the log endpoint of the admin API
+package logstream
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+	levelNone // Wanted by no subscriber
+)
+
+var levelNames = [...]string{"debug", "info", "warning", "error"}
+
+// ParseLevel returns the level of the name, info if empty
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s, one of %s", name, strings.Join(levelNames[:], ", "))
+}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Entry is a line of the log
+type Entry struct {
+	Time    time.Time      `json:"time"`
+	Level   Level          `json:"level"`
+	Module  string         `json:"module"` // xrayr, access, or the package of the core like app/dispatcher
+	Message string         `json:"message"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// Filter selects the entries a subscriber gets
+type Filter struct {
+	Level   Level    // The lowest level
+	Modules []string // Module prefixes, all the modules if empty
+}
+
+func (f *Filter) match(e *Entry) bool {
+	if e.Level < f.Level {
+		return false
+	}
+	if len(f.Modules) == 0 {
+		return true
+	}
+	for _, m := range f.Modules {
+		if strings.HasPrefix(e.Module, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription gets the entries matching its filter until closed. The
+// entries it is too slow for are dropped and counted.
+type Subscription struct {
+	hub     *Hub
+	filter  Filter
+	entries chan Entry
+	dropped atomic.Uint64
+}
+
+// Entries returns the channel the entries arrive on
+func (s *Subscription) Entries() <-chan Entry {
+	return s.entries
+}
+
+// Dropped returns the entries dropped since the last call
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Swap(0)
+}
+
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+// Hub publishes the entries to the subscribers. The zero value is not
+// usable, see NewHub.
+type Hub struct {
+	access sync.RWMutex
+	subs   map[*Subscription]struct{}
+	lowest atomic.Int32 // Lowest level wanted, levelNone without subscribers
+}
+
+func NewHub() *Hub {
+	h := &Hub{subs: make(map[*Subscription]struct{})}
+	h.lowest.Store(int32(levelNone))
+	return h
+}
+
+// Subscribe returns a subscription to the entries matching filter, buffering
+// up to size of them
+func (h *Hub) Subscribe(filter Filter, size int) *Subscription {
+	s := &Subscription{hub: h, filter: filter, entries: make(chan Entry, size)}
+	h.access.Lock()
+	defer h.access.Unlock()
+	h.subs[s] = struct{}{}
+	h.updateLowest()
+	return s
+}
+
+func (h *Hub) unsubscribe(s *Subscription) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	delete(h.subs, s)
+	h.updateLowest()
+}
+
+func (h *Hub) updateLowest() {
+	lowest := levelNone
+	for s := range h.subs {
+		lowest = min(lowest, s.filter.Level)
+	}
+	h.lowest.Store(int32(lowest))
+}
+
+// Wants reports whether a subscriber may want an entry of the level, so the
+// entries nobody wants are not even built
+func (h *Hub) Wants(level Level) bool {
+	return level >= Level(h.lowest.Load())
+}
+
+// Publish sends the entry to the subscribers matching it, it never blocks
+func (h *Hub) Publish(e Entry) {
+	if !h.Wants(e.Level) {
+		return
+	}
+	h.access.RLock()
+	defer h.access.RUnlock()
+	for s := range h.subs {
+		if !s.filter.match(&e) {
+			continue
+		}
+		select {
+		case s.entries <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
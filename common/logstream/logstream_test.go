@@ -0,0 +1,50 @@
+package logstream_test
+
+import (
+	"testing"
+
+	xlog "github.com/xtls/xray-core/common/log"
+
+	"github.com/qtai2901/new_xrayr/common/logstream"
+)
+
+type discard struct{}
+
+func (discard) Handle(xlog.Message) {}
+
+func TestFilter(t *testing.T) {
+	hub := logstream.NewHub()
+	if hub.Wants(logstream.LevelError) {
+		t.Error("wants entries without subscribers")
+	}
+	s := hub.Subscribe(logstream.Filter{Level: logstream.LevelInfo, Modules: []string{"app/"}}, 10)
+	if hub.Wants(logstream.LevelDebug) || !hub.Wants(logstream.LevelInfo) {
+		t.Error("wrong levels wanted")
+	}
+
+	core := &logstream.CoreHandler{Hub: hub, Next: discard{}}
+	core.Handle(&xlog.GeneralMessage{Severity: xlog.Severity_Info, Content: "[42] app/dispatcher: taking detour"})
+	core.Handle(&xlog.GeneralMessage{Severity: xlog.Severity_Debug, Content: "app/dispatcher: sniffed"})
+	core.Handle(&xlog.GeneralMessage{Severity: xlog.Severity_Error, Content: "proxy/vless: invalid request"})
+	s.Close()
+	core.Handle(&xlog.GeneralMessage{Severity: xlog.Severity_Error, Content: "app/router: no rule"})
+
+	if len(s.Entries()) != 1 {
+		t.Fatalf("got %d entries, want 1", len(s.Entries()))
+	}
+	if e := <-s.Entries(); e.Module != "app/dispatcher" || e.Level != logstream.LevelInfo {
+		t.Errorf("entry %+v", e)
+	}
+}
+
+func TestDropsForSlowSubscriber(t *testing.T) {
+	hub := logstream.NewHub()
+	s := hub.Subscribe(logstream.Filter{}, 1)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		hub.Publish(logstream.Entry{Level: logstream.LevelError, Module: "xrayr"})
+	}
+	if d := s.Dropped(); d != 2 {
+		t.Errorf("dropped %d, want 2", d)
+	}
+}
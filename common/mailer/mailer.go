@@ -0,0 +1,211 @@
+// Package mailer sends the alerts of XrayR by email, batched so a burst of
+// them makes a single mail
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBatchInterval = 300              // Second
+	gatherDelay          = 10 * time.Second // Waited for more alerts before sending
+	maxBatch             = 200              // Alerts in a mail, the ones beyond are counted only
+	sendTimeout          = 30 * time.Second
+)
+
+type Config struct {
+	Enable        bool     `mapstructure:"Enable"`
+	Host          string   `mapstructure:"Host"`
+	Port          int      `mapstructure:"Port"` // 465 for TLS, otherwise STARTTLS when the server offers it
+	Username      string   `mapstructure:"Username"`
+	Password      string   `mapstructure:"Password"`
+	From          string   `mapstructure:"From"`
+	To            []string `mapstructure:"To"`
+	BatchInterval int      `mapstructure:"BatchInterval"` // Second, at most a mail per interval
+}
+
+// Mailer batches the alerts into mails
+type Mailer struct {
+	config   *Config
+	interval time.Duration
+	access   sync.Mutex
+	pending  []string
+	dropped  int
+	timer    *time.Timer // Set while a send is scheduled
+	lastSent time.Time
+	closed   bool
+	sending  sync.WaitGroup
+}
+
+func New(config *Config) (*Mailer, error) {
+	if config.Host == "" || config.From == "" || len(config.To) == 0 {
+		return nil, errors.New("mailer needs the Host, From and To")
+	}
+	interval := time.Duration(config.BatchInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultBatchInterval * time.Second
+	}
+	return &Mailer{config: config, interval: interval}, nil
+}
+
+// Notify queues the alert, it is sent with the others of the batch
+func (m *Mailer) Notify(text string) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	if m.closed {
+		return
+	}
+	if len(m.pending) < maxBatch {
+		m.pending = append(m.pending, fmt.Sprintf("%s %s", time.Now().Format(time.DateTime), text))
+	} else {
+		m.dropped++
+	}
+	if m.timer != nil {
+		return
+	}
+	// The first alert after a quiet interval goes out quickly, the next ones
+	// wait for the interval to pass
+	delay := max(gatherDelay, time.Until(m.lastSent.Add(m.interval)))
+	m.sending.Add(1)
+	m.timer = time.AfterFunc(delay, func() {
+		defer m.sending.Done()
+		m.flush()
+	})
+}
+
+// Close sends the alerts pending
+func (m *Mailer) Close() {
+	m.access.Lock()
+	m.closed = true
+	if m.timer != nil && m.timer.Stop() {
+		m.sending.Done()
+		m.timer = nil
+		m.access.Unlock()
+		m.flush()
+	} else {
+		m.access.Unlock()
+	}
+	m.sending.Wait()
+}
+
+func (m *Mailer) flush() {
+	m.access.Lock()
+	alerts, dropped := m.pending, m.dropped
+	m.pending, m.dropped, m.timer = nil, 0, nil
+	m.lastSent = time.Now()
+	m.access.Unlock()
+	if len(alerts) == 0 {
+		return
+	}
+	if err := m.send(alerts, dropped); err != nil {
+		log.Errorf("Send alert mail failed: %s", err)
+	}
+}
+
+func (m *Mailer) send(alerts []string, dropped int) error {
+	host, _ := os.Hostname()
+	subject := fmt.Sprintf("XrayR on %s: %d alerts", host, len(alerts)+dropped)
+	if len(alerts) == 1 && dropped == 0 {
+		subject = fmt.Sprintf("XrayR on %s: %s", host, alerts[0])
+	}
+	var body strings.Builder
+	for _, a := range alerts {
+		body.WriteString(a)
+		body.WriteString("\r\n")
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&body, "and %d more\r\n", dropped)
+	}
+	return m.sendMail(buildMessage(m.config.From, m.config.To, subject, body.String()))
+}
+
+// buildMessage returns the mail in plain text
+func buildMessage(from string, to []string, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", encodeHeader(subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(body)
+	return []byte(b.String())
+}
+
+// encodeHeader keeps a header value on a line, encoding it if it is not ASCII
+func encodeHeader(s string) string {
+	s = strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+	if len(s) > 200 {
+		s = s[:200] + "..."
+	}
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+func (m *Mailer) sendMail(message []byte) error {
+	port := m.config.Port
+	if port == 0 {
+		port = 587
+	}
+	address := net.JoinHostPort(m.config.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: m.config.Host}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: sendTimeout}
+	if port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+	client, err := smtp.NewClient(conn, m.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && port != 465 {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(m.config.From); err != nil {
+		return err
+	}
+	for _, to := range m.config.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,84 @@
+package mailer_test
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/mailer"
+)
+
+// serveSMTP accepts mails on a local port, sending their data to mails
+func serveSMTP(t *testing.T, mails chan<- string) (string, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+				reply("220 test")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+					case "EHLO", "HELO":
+						reply("250 test")
+					case "DATA":
+						reply("354 go on")
+						var data strings.Builder
+						for {
+							line, err := r.ReadString('\n')
+							if err != nil || line == ".\r\n" {
+								break
+							}
+							data.WriteString(line)
+						}
+						mails <- data.String()
+						reply("250 ok")
+					case "QUIT":
+						reply("221 bye")
+						return
+					default:
+						reply("250 ok")
+					}
+				}
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func TestBatch(t *testing.T) {
+	mails := make(chan string, 2)
+	host, port := serveSMTP(t, mails)
+	m, err := mailer.New(&mailer.Config{Host: host, Port: port, From: "xrayr@example.com", To: []string{"admin@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Notify("[V2ray 1] Panel unreachable")
+	m.Notify("[V2ray 2] Panel unreachable")
+	m.Close()
+
+	if len(mails) != 1 {
+		t.Fatalf("sent %d mails, want 1", len(mails))
+	}
+	mail := <-mails
+	if !strings.Contains(mail, "Subject: XrayR on") || !strings.Contains(mail, "[V2ray 1]") || !strings.Contains(mail, "[V2ray 2]") {
+		t.Errorf("mail %q", mail)
+	}
+}
@@ -0,0 +1,101 @@
+package mixed
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// Headers of the proxy, not passed on with the requests
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// processHTTP serves an HTTP client, which must log in with the Basic
+// credentials of a user. A CONNECT request opens a tunnel, and the other ones
+// are passed on one per connection.
+func (s *Server) processHTTP(ctx context.Context, conn stat.Connection, reader *bufio.Reader, dispatcher routing.Dispatcher) error {
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return newError("failed to read HTTP request").Base(err)
+	}
+	name, password, _ := parseProxyAuthorization(request.Header.Get("Proxy-Authorization"))
+	u := s.authenticate(name, password)
+	if u == nil {
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		return s.reject(ctx, newError("invalid user ", name))
+	}
+	s.accept(ctx, u, "http")
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return newError("unable to clear read deadline").Base(err)
+	}
+
+	if request.Method == http.MethodConnect {
+		destination, err := net.ParseDestination("tcp:" + request.Host)
+		if err != nil || destination.Port == 0 {
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return newError("invalid destination ", request.Host)
+		}
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			return newError("failed to write response").Base(err)
+		}
+		return s.proxy(ctx, u, destination, buf.NewReader(reader), buf.NewWriter(conn), dispatcher)
+	}
+
+	if request.URL.Host == "" {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		return newError("not a proxy request: ", request.URL)
+	}
+	port := net.Port(80)
+	if strings.EqualFold(request.URL.Scheme, "https") {
+		port = 443
+	}
+	if p := request.URL.Port(); p != "" {
+		if port, err = net.PortFromString(p); err != nil {
+			return newError("invalid port of ", request.URL).Base(err)
+		}
+	}
+	destination := net.TCPDestination(net.ParseAddress(request.URL.Hostname()), port)
+	for _, header := range hopHeaders {
+		request.Header.Del(header)
+	}
+	// The connection ends with the response, the next request of the client
+	// may be for another destination
+	request.Close = true
+	requestReader, requestWriter := io.Pipe()
+	defer requestReader.Close()
+	go func() {
+		requestWriter.CloseWithError(request.Write(requestWriter))
+	}()
+	return s.proxy(ctx, u, destination, buf.NewReader(requestReader), buf.NewWriter(conn), dispatcher)
+}
+
+// parseProxyAuthorization returns the user name and password of Basic
+// credentials
+func parseProxyAuthorization(auth string) (name, password string, ok bool) {
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
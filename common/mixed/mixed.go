@@ -0,0 +1,282 @@
+// Package mixed serves SOCKS5 and HTTP proxies on the same port, for the
+// clients able to use nothing else. Both ask for the user name and password of
+// the users, a SOCKS5 client being told by its first byte.
+package mixed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	gonet "net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/http"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+type Config struct {
+	Tag      string
+	Listen   string // Address listened on, every one if empty
+	Port     uint32
+	Sniffing session.SniffingRequest
+}
+
+// Handler is the inbound.Handler listening for the SOCKS5 and HTTP clients of
+// a node
+type Handler struct {
+	config     *Config
+	server     *Server
+	dispatcher routing.Dispatcher
+
+	access   sync.Mutex
+	listener gonet.Listener
+}
+
+func NewHandler(config *Config, dispatcher routing.Dispatcher, policyManager policy.Manager) *Handler {
+	return &Handler{
+		config:     config,
+		dispatcher: dispatcher,
+		server: &Server{
+			listen:        config.Listen,
+			sniffing:      config.Sniffing,
+			policyManager: policyManager,
+			users:         make(map[string]*user),
+			names:         make(map[string]string),
+		},
+	}
+}
+
+// Start implements common.Runnable.
+func (h *Handler) Start() error {
+	listener, err := gonet.Listen("tcp", gonet.JoinHostPort(h.config.Listen, strconv.Itoa(int(h.config.Port))))
+	if err != nil {
+		return newError("failed to listen on port ", h.config.Port).Base(err)
+	}
+	h.access.Lock()
+	h.listener = listener
+	h.access.Unlock()
+	go h.serve(listener)
+	return nil
+}
+
+// Close implements common.Closable. The connections accepted so far are
+// left to end by themselves, like the ones of the other inbounds.
+func (h *Handler) Close() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Close()
+}
+
+// Tag implements inbound.Handler.
+func (h *Handler) Tag() string {
+	return h.config.Tag
+}
+
+// GetRandomInboundProxy implements inbound.Handler.
+func (h *Handler) GetRandomInboundProxy() (interface{}, net.Port, int) {
+	return h.server, net.Port(h.config.Port), 9999
+}
+
+// GetInbound implements proxy.GetInbound.
+func (h *Handler) GetInbound() proxy.Inbound {
+	return h.server
+}
+
+func (h *Handler) serve(listener gonet.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, gonet.ErrClosed) {
+				return
+			}
+			newError("failed to accept connection").Base(err).AtWarning().WriteToLog()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go h.handle(conn)
+	}
+}
+
+func (h *Handler) handle(conn gonet.Conn) {
+	defer conn.Close()
+	gateway := net.AnyIP
+	if h.config.Listen != "" {
+		gateway = net.ParseAddress(h.config.Listen)
+	}
+	ctx := session.ContextWithID(context.Background(), session.NewID())
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{
+		Source:  net.DestinationFromAddr(conn.RemoteAddr()),
+		Gateway: net.TCPDestination(gateway, net.Port(h.config.Port)),
+		Tag:     h.config.Tag,
+		Conn:    conn,
+	})
+	if err := h.server.Process(ctx, net.Network_TCP, conn, h.dispatcher); err != nil {
+		newError("connection ends").Base(err).WriteToLog(session.ExportIDToError(ctx))
+	}
+}
+
+type user struct {
+	*protocol.MemoryUser
+	password string
+}
+
+// Server authenticates the clients by the user name and password of the HTTP
+// account of the users, and proxies them
+type Server struct {
+	listen        string
+	sniffing      session.SniffingRequest
+	policyManager policy.Manager
+
+	access sync.RWMutex
+	users  map[string]*user  // Key: user name
+	names  map[string]string // Key: lower case email
+}
+
+// AddUser implements proxy.UserManager.AddUser().
+func (s *Server) AddUser(ctx context.Context, u *protocol.MemoryUser) error {
+	account, ok := u.Account.(*http.Account)
+	if !ok {
+		return newError("user ", u.Email, " has no user name and password")
+	}
+	email := strings.ToLower(u.Email)
+	s.access.Lock()
+	defer s.access.Unlock()
+	if _, found := s.names[email]; found {
+		return newError("User ", u.Email, " already exists.")
+	}
+	if _, found := s.users[account.Username]; found {
+		return newError("user name ", account.Username, " of user ", u.Email, " is taken")
+	}
+	s.users[account.Username] = &user{MemoryUser: u, password: account.Password}
+	s.names[email] = account.Username
+	return nil
+}
+
+// RemoveUser implements proxy.UserManager.RemoveUser().
+func (s *Server) RemoveUser(ctx context.Context, e string) error {
+	email := strings.ToLower(e)
+	s.access.Lock()
+	defer s.access.Unlock()
+	name, found := s.names[email]
+	if !found {
+		return newError("User ", e, " not found.")
+	}
+	delete(s.names, email)
+	delete(s.users, name)
+	return nil
+}
+
+// authenticate returns the user of the credentials, nil if they are wrong
+func (s *Server) authenticate(name, password string) *protocol.MemoryUser {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	u := s.users[name]
+	if u == nil || u.password != password {
+		return nil
+	}
+	return u.MemoryUser
+}
+
+// Network implements proxy.Inbound.Network().
+func (s *Server) Network() []net.Network {
+	return []net.Network{net.Network_TCP}
+}
+
+// Process implements proxy.Inbound.Process().
+func (s *Server) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	if err := conn.SetReadDeadline(time.Now().Add(s.policyManager.ForLevel(0).Timeouts.Handshake)); err != nil {
+		return newError("unable to set read deadline").Base(err).AtWarning()
+	}
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return newError("failed to read request").Base(err)
+	}
+	if first[0] == socks5Version {
+		return s.processSocks(ctx, conn, reader, dispatcher)
+	}
+	return s.processHTTP(ctx, conn, reader, dispatcher)
+}
+
+// accept marks the connection of ctx as the one of the user
+func (s *Server) accept(ctx context.Context, u *protocol.MemoryUser, name string) {
+	inbound := session.InboundFromContext(ctx)
+	inbound.Name = name
+	inbound.User = u
+	inbound.SetCanSpliceCopy(3)
+}
+
+// reject logs the connection of ctx as rejected
+func (s *Server) reject(ctx context.Context, err error) error {
+	log.Record(&log.AccessMessage{
+		From:   session.InboundFromContext(ctx).Source,
+		To:     "",
+		Status: log.AccessRejected,
+		Reason: err,
+	})
+	return err
+}
+
+func (s *Server) proxy(ctx context.Context, u *protocol.MemoryUser, destination net.Destination, clientReader buf.Reader, clientWriter buf.Writer, dispatcher routing.Dispatcher) error {
+	sessionPolicy := s.policyManager.ForLevel(u.Level)
+	ctx, cancel := context.WithCancel(ctx)
+	timer := signal.CancelAfterInactivity(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle)
+	ctx = policy.ContextWithBufferPolicy(ctx, sessionPolicy.Buffer)
+	ctx = log.ContextWithAccessMessage(ctx, &log.AccessMessage{
+		From:   session.InboundFromContext(ctx).Source,
+		To:     destination,
+		Status: log.AccessAccepted,
+		Reason: "",
+		Email:  u.Email,
+	})
+	ctx = session.ContextWithContent(ctx, &session.Content{
+		SniffingRequest: s.sniffing,
+	})
+
+	newError("received request for ", destination).WriteToLog(session.ExportIDToError(ctx))
+	link, err := dispatcher.Dispatch(ctx, destination)
+	if err != nil {
+		return newError("failed to dispatch request to ", destination).Base(err)
+	}
+
+	requestDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.DownlinkOnly)
+		if err := buf.Copy(clientReader, link.Writer, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to transfer request").Base(err)
+		}
+		return nil
+	}
+
+	responseDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.UplinkOnly)
+		if err := buf.Copy(link.Reader, clientWriter, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to write response").Base(err)
+		}
+		return nil
+	}
+
+	requestDonePost := task.OnSuccess(requestDone, task.Close(link.Writer))
+	if err := task.Run(ctx, requestDonePost, responseDone); err != nil {
+		common.Must(common.Interrupt(link.Reader))
+		common.Must(common.Interrupt(link.Writer))
+		return newError("connection ends").Base(err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package mixed_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	gonet "net"
+	"net/http"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/policy"
+	xhttp "github.com/xtls/xray-core/proxy/http"
+
+	"github.com/qtai2901/new_xrayr/common/mixed"
+)
+
+func newServer(t *testing.T) *mixed.Server {
+	h := mixed.NewHandler(&mixed.Config{Tag: "mixed", Port: 1080}, nil, policy.DefaultManager{})
+	server := h.GetInbound().(*mixed.Server)
+	user := &protocol.MemoryUser{Email: "mixed|1@node|1", Account: &xhttp.Account{Username: "alice", Password: "secret"}}
+	if err := server.AddUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddUser(context.Background(), user); err == nil {
+		t.Error("adding a user twice should fail")
+	}
+	return server
+}
+
+// process runs the server on one end of a pipe, returning the other one
+func process(server *mixed.Server) gonet.Conn {
+	client, conn := gonet.Pipe()
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Source:  net.TCPDestination(net.LocalHostIP, 50000),
+		Gateway: net.TCPDestination(net.AnyIP, 1080),
+		Tag:     "mixed",
+	})
+	go func() {
+		server.Process(ctx, net.Network_TCP, conn, nil)
+		conn.Close()
+	}()
+	return client
+}
+
+func TestHTTPRejectsWrongUser(t *testing.T) {
+	server := newServer(t)
+	for _, auth := range []string{"", "Basic YWxpY2U6d3Jvbmc="} { // alice:wrong
+		client := process(server)
+		request, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		request.Host = "example.com:443"
+		if auth != "" {
+			request.Header.Set("Proxy-Authorization", auth)
+		}
+		go request.Write(client)
+		response, err := http.ReadResponse(bufio.NewReader(client), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("status %d with %q, want 407", response.StatusCode, auth)
+		}
+		client.Close()
+	}
+}
+
+func TestSocksRejectsWrongUser(t *testing.T) {
+	server := newServer(t)
+	client := process(server)
+	defer client.Close()
+	go client.Write([]byte{5, 1, 2, 1, 5, 'a', 'l', 'i', 'c', 'e', 5, 'w', 'r', 'o', 'n', 'g'})
+	var reply [4]byte
+	if _, err := io.ReadFull(client, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	if reply != [4]byte{5, 2, 1, 1} {
+		t.Errorf("reply %v, want the password method then a failure", reply)
+	}
+
+	if err := server.RemoveUser(context.Background(), "mixed|1@node|1"); err != nil {
+		t.Error(err)
+	}
+	if err := server.RemoveUser(context.Background(), "mixed|1@node|1"); err == nil {
+		t.Error("removing a user twice should fail")
+	}
+}
@@ -0,0 +1,201 @@
+package mixed
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	gonet "net"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	udp_proto "github.com/xtls/xray-core/common/protocol/udp"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy/socks"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"github.com/xtls/xray-core/transport/internet/udp"
+)
+
+const (
+	socks5Version = 0x05
+	authVersion   = 0x01
+
+	authPassword     = 0x02
+	authNoAcceptable = 0xff
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	statusSuccess        = 0x00
+	statusServerFailure  = 0x01
+	statusCmdNotSupport  = 0x07
+	statusAuthFailure    = 0x01
+	statusAuthSuccessful = 0x00
+)
+
+var addrParser = protocol.NewAddressParser(
+	protocol.AddressFamilyByte(0x01, net.AddressFamilyIPv4),
+	protocol.AddressFamilyByte(0x04, net.AddressFamilyIPv6),
+	protocol.AddressFamilyByte(0x03, net.AddressFamilyDomain),
+)
+
+// processSocks serves a SOCKS5 client, which must log in with a user name and
+// a password. The UDP relays have their own port, pinned to the first client
+// address they receive from, from the IP address of the connection.
+func (s *Server) processSocks(ctx context.Context, conn stat.Connection, reader *bufio.Reader, dispatcher routing.Dispatcher) error {
+	var greeting [2]byte
+	if _, err := io.ReadFull(reader, greeting[:]); err != nil {
+		return newError("failed to read greeting").Base(err)
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return newError("failed to read authentication methods").Base(err)
+	}
+	if bytes.IndexByte(methods, authPassword) < 0 {
+		conn.Write([]byte{socks5Version, authNoAcceptable})
+		return s.reject(ctx, newError("no password authentication offered"))
+	}
+	if _, err := conn.Write([]byte{socks5Version, authPassword}); err != nil {
+		return newError("failed to write authentication method").Base(err)
+	}
+	name, password, err := socks.ReadUsernamePassword(reader)
+	if err != nil {
+		return newError("failed to read user name and password").Base(err)
+	}
+	u := s.authenticate(name, password)
+	if u == nil {
+		conn.Write([]byte{authVersion, statusAuthFailure})
+		return s.reject(ctx, newError("invalid user ", name))
+	}
+	if _, err := conn.Write([]byte{authVersion, statusAuthSuccessful}); err != nil {
+		return newError("failed to write authentication result").Base(err)
+	}
+
+	var request [3]byte
+	if _, err := io.ReadFull(reader, request[:]); err != nil {
+		return newError("failed to read request").Base(err)
+	}
+	addr, port, err := addrParser.ReadAddressPort(nil, reader)
+	if err != nil {
+		return newError("failed to read destination").Base(err)
+	}
+	s.accept(ctx, u, "socks")
+	gateway := session.InboundFromContext(ctx).Gateway
+	switch request[1] {
+	case cmdConnect:
+		if err := writeSocksResponse(conn, statusSuccess, gateway.Address, gateway.Port); err != nil {
+			return err
+		}
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return newError("unable to clear read deadline").Base(err)
+		}
+		return s.proxy(ctx, u, net.TCPDestination(addr, port), buf.NewReader(reader), buf.NewWriter(conn), dispatcher)
+	case cmdUDPAssociate:
+		return s.associate(ctx, u, conn, dispatcher)
+	default:
+		writeSocksResponse(conn, statusCmdNotSupport, net.AnyIP, 0)
+		return newError("unsupported command ", request[1])
+	}
+}
+
+// associate opens the UDP relay of the client, open until the connection
+// closes
+func (s *Server) associate(ctx context.Context, u *protocol.MemoryUser, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	local := conn.LocalAddr().(*gonet.TCPAddr)
+	packetConn, err := gonet.ListenUDP("udp", &gonet.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeSocksResponse(conn, statusServerFailure, net.AnyIP, 0)
+		return newError("failed to open UDP relay").Base(err)
+	}
+	defer packetConn.Close()
+	if err := writeSocksResponse(conn, statusSuccess, net.IPAddress(local.IP), net.Port(packetConn.LocalAddr().(*gonet.UDPAddr).Port)); err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return newError("unable to clear read deadline").Base(err)
+	}
+	go func() {
+		io.Copy(io.Discard, conn)
+		packetConn.Close()
+	}()
+	return s.relay(ctx, u, packetConn, conn.RemoteAddr().(*gonet.TCPAddr).IP, dispatcher)
+}
+
+// relay dispatches the UDP packets of the client, like the SOCKS inbound of
+// Xray, all of them through the link to the first destination
+func (s *Server) relay(ctx context.Context, u *protocol.MemoryUser, packetConn *gonet.UDPConn, client gonet.IP, dispatcher routing.Dispatcher) error {
+	var peer atomic.Pointer[gonet.UDPAddr]
+	udpServer := udp.NewDispatcher(dispatcher, func(ctx context.Context, packet *udp_proto.Packet) {
+		payload := packet.Payload
+		defer payload.Release()
+		source := packet.Source
+		if payload.UDP != nil {
+			source = *payload.UDP
+		}
+		message, err := socks.EncodeUDPPacket(&protocol.RequestHeader{Address: source.Address, Port: source.Port}, payload.Bytes())
+		if err != nil {
+			newError("failed to write UDP response").Base(err).AtWarning().WriteToLog(session.ExportIDToError(ctx))
+			return
+		}
+		defer message.Release()
+		if addr := peer.Load(); addr != nil {
+			packetConn.WriteTo(message.Bytes(), addr)
+		}
+	})
+	defer udpServer.RemoveRay()
+
+	ctx = policy.ContextWithBufferPolicy(ctx, s.policyManager.ForLevel(u.Level).Buffer)
+	ctx = session.ContextWithContent(ctx, &session.Content{
+		SniffingRequest: s.sniffing,
+	})
+	var destination *net.Destination
+	for {
+		b := buf.New()
+		n, addr, err := packetConn.ReadFromUDP(b.Extend(buf.Size))
+		if err != nil {
+			b.Release()
+			return nil // Closed with the connection
+		}
+		b.Resize(0, int32(n))
+		if !addr.IP.Equal(client) || (!peer.CompareAndSwap(nil, addr) && peer.Load().String() != addr.String()) {
+			b.Release()
+			continue
+		}
+		request, err := socks.DecodeUDPPacket(b)
+		if err != nil || b.IsEmpty() {
+			b.Release()
+			continue
+		}
+		target := request.Destination()
+		b.UDP = &target
+		if destination == nil {
+			destination = &target
+			ctx = log.ContextWithAccessMessage(ctx, &log.AccessMessage{
+				From:   session.InboundFromContext(ctx).Source,
+				To:     target,
+				Status: log.AccessAccepted,
+				Reason: "",
+				Email:  u.Email,
+			})
+		}
+		udpServer.Dispatch(ctx, *destination, b)
+	}
+}
+
+func writeSocksResponse(writer io.Writer, status byte, address net.Address, port net.Port) error {
+	b := buf.New()
+	defer b.Release()
+	common.Must2(b.Write([]byte{socks5Version, status, 0x00}))
+	if err := addrParser.WriteAddressPort(b, address, port); err != nil {
+		return err
+	}
+	_, err := writer.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,24 @@
+//go:build no_acme
+
+package mylego
+
+import "errors"
+
+var errNoACME = errors.New("ACME is not built in, use CertMode file or none")
+
+// New fails, the ACME client is left out by the no_acme build tag
+func New(certConf *CertConfig) (*LegoCMD, error) {
+	return nil, errNoACME
+}
+
+func (l *LegoCMD) DNSCert() (CertPath string, KeyPath string, err error) {
+	return "", "", errNoACME
+}
+
+func (l *LegoCMD) HTTPCert() (CertPath string, KeyPath string, err error) {
+	return "", "", errNoACME
+}
+
+func (l *LegoCMD) RenewCert() (CertPath string, KeyPath string, ok bool, err error) {
+	return "", "", false, errNoACME
+}
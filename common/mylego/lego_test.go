@@ -1,3 +1,5 @@
+//go:build !no_acme
+
 package mylego_test
 
 import (
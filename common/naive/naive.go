@@ -0,0 +1,347 @@
+// Package naive serves an HTTPS forward proxy compatible with the clients of
+// NaiveProxy (https://github.com/klzgrad/naiveproxy). The users tunnel through
+// HTTP/2 CONNECT requests authenticated with their password, and the other
+// requests go to a fallback website so the node looks like one to probes.
+package naive
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	stdlog "log"
+	gonet "net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/trojan"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+type Config struct {
+	Tag         string
+	Listen      string // Address listened on, every one if empty
+	Port        uint32
+	TLSConfig   *tls.Config
+	FallbackURL string // Website the other requests are proxied to, 404 for them if empty
+	Sniffing    session.SniffingRequest
+}
+
+// Handler is the inbound.Handler listening for the NaiveProxy clients of a node
+type Handler struct {
+	config     *Config
+	server     *Server
+	dispatcher routing.Dispatcher
+
+	access     sync.Mutex
+	httpServer *http.Server
+}
+
+func NewHandler(config *Config, dispatcher routing.Dispatcher, policyManager policy.Manager) (*Handler, error) {
+	fallback := http.Handler(http.NotFoundHandler())
+	if config.FallbackURL != "" {
+		target, err := url.Parse(config.FallbackURL)
+		if err != nil || target.Host == "" {
+			return nil, newError("invalid fallback URL: ", config.FallbackURL)
+		}
+		fallback = httputil.NewSingleHostReverseProxy(target)
+	}
+	gateway := net.AnyIP
+	if config.Listen != "" {
+		gateway = net.ParseAddress(config.Listen)
+	}
+	return &Handler{
+		config:     config,
+		dispatcher: dispatcher,
+		server: &Server{
+			tag:           config.Tag,
+			gateway:       net.TCPDestination(gateway, net.Port(config.Port)),
+			sniffing:      config.Sniffing,
+			fallback:      fallback,
+			dispatcher:    dispatcher,
+			policyManager: policyManager,
+			users:         make(map[string]*protocol.MemoryUser),
+			passwords:     make(map[string]string),
+		},
+	}, nil
+}
+
+// Start implements common.Runnable.
+func (h *Handler) Start() error {
+	listener, err := gonet.Listen("tcp", gonet.JoinHostPort(h.config.Listen, strconv.Itoa(int(h.config.Port))))
+	if err != nil {
+		return newError("failed to listen on port ", h.config.Port).Base(err)
+	}
+	httpServer := &http.Server{
+		Handler:           h.server,
+		TLSConfig:         h.config.TLSConfig,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          stdlog.New(io.Discard, "", 0), // Probes fail TLS handshakes all day
+	}
+	h.access.Lock()
+	h.httpServer = httpServer
+	h.access.Unlock()
+	go func() {
+		if err := httpServer.ServeTLS(listener, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			newError("failed to serve on port ", h.config.Port).Base(err).AtError().WriteToLog()
+		}
+	}()
+	return nil
+}
+
+// Close implements common.Closable. The tunnels are closed too.
+func (h *Handler) Close() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.httpServer == nil {
+		return nil
+	}
+	return h.httpServer.Close()
+}
+
+// Tag implements inbound.Handler.
+func (h *Handler) Tag() string {
+	return h.config.Tag
+}
+
+// GetRandomInboundProxy implements inbound.Handler.
+func (h *Handler) GetRandomInboundProxy() (interface{}, net.Port, int) {
+	return h.server, net.Port(h.config.Port), 9999
+}
+
+// GetInbound implements proxy.GetInbound.
+func (h *Handler) GetInbound() proxy.Inbound {
+	return h.server
+}
+
+// Server authenticates the CONNECT requests by the password of the trojan
+// account of the users, the user name being free, and tunnels them
+type Server struct {
+	tag           string
+	gateway       net.Destination
+	sniffing      session.SniffingRequest
+	fallback      http.Handler
+	dispatcher    routing.Dispatcher
+	policyManager policy.Manager
+
+	access    sync.RWMutex
+	users     map[string]*protocol.MemoryUser // Key: password
+	passwords map[string]string               // Key: lower case email
+}
+
+// AddUser implements proxy.UserManager.AddUser().
+func (s *Server) AddUser(ctx context.Context, u *protocol.MemoryUser) error {
+	account, ok := u.Account.(*trojan.MemoryAccount)
+	if !ok {
+		return newError("user ", u.Email, " has no password")
+	}
+	email := strings.ToLower(u.Email)
+	s.access.Lock()
+	defer s.access.Unlock()
+	if _, found := s.passwords[email]; found {
+		return newError("User ", u.Email, " already exists.")
+	}
+	s.users[account.Password] = u
+	s.passwords[email] = account.Password
+	return nil
+}
+
+// RemoveUser implements proxy.UserManager.RemoveUser().
+func (s *Server) RemoveUser(ctx context.Context, e string) error {
+	email := strings.ToLower(e)
+	s.access.Lock()
+	defer s.access.Unlock()
+	password, found := s.passwords[email]
+	if !found {
+		return newError("User ", e, " not found.")
+	}
+	delete(s.passwords, email)
+	delete(s.users, password)
+	return nil
+}
+
+// authenticate returns the user of the Basic credentials of the request, nil
+// if there are none or they are wrong
+func (s *Server) authenticate(r *http.Request) *protocol.MemoryUser {
+	encoded, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil
+	}
+	_, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil
+	}
+	s.access.RLock()
+	defer s.access.RUnlock()
+	return s.users[password]
+}
+
+// Network implements proxy.Inbound.Network().
+func (s *Server) Network() []net.Network {
+	return []net.Network{net.Network_TCP}
+}
+
+// Process implements proxy.Inbound.Process(). The connections are accepted
+// by the HTTP server of the Handler, not by Xray.
+func (s *Server) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	return newError("naive connections are served by its own handler")
+}
+
+// ServeHTTP tunnels the authenticated CONNECT requests. The other requests
+// go to the fallback, and the CONNECT ones with wrong credentials get a 400
+// like from a web server, rather than a 407 giving the proxy away.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		s.fallback.ServeHTTP(w, r)
+		return
+	}
+	user := s.authenticate(r)
+	if user == nil {
+		log.Record(&log.AccessMessage{
+			From:   r.RemoteAddr,
+			To:     r.Host,
+			Status: log.AccessRejected,
+			Reason: newError("invalid user"),
+		})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	destination, err := net.ParseDestination("tcp:" + r.Host)
+	if err != nil || destination.Port == 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	source, _ := net.ParseDestination("tcp:" + r.RemoteAddr)
+	ctx := session.ContextWithID(r.Context(), session.NewID())
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{
+		Source:        source,
+		Gateway:       s.gateway,
+		Tag:           s.tag,
+		Name:          "naive",
+		User:          user,
+		CanSpliceCopy: 3,
+	})
+	ctx = session.ContextWithContent(ctx, &session.Content{
+		SniffingRequest: s.sniffing,
+	})
+
+	var (
+		reader io.Reader
+		writer io.Writer
+	)
+	if r.ProtoMajor >= 2 {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		padding := r.Header.Get("Padding") != ""
+		if padding {
+			w.Header().Set("Padding", paddingHeader())
+		}
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		reader, writer = r.Body, &flushWriter{writer: w, flusher: flusher}
+		if padding {
+			reader, writer = newPaddingReader(reader), newPaddingWriter(writer)
+		}
+	} else {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			return
+		}
+		reader, writer = rw.Reader, conn
+	}
+
+	if err := s.proxy(ctx, user, destination, buf.NewReader(reader), buf.NewWriter(writer)); err != nil {
+		newError("connection ends").Base(err).WriteToLog(session.ExportIDToError(ctx))
+	}
+}
+
+func (s *Server) proxy(ctx context.Context, user *protocol.MemoryUser, destination net.Destination, clientReader buf.Reader, clientWriter buf.Writer) error {
+	sessionPolicy := s.policyManager.ForLevel(user.Level)
+	ctx, cancel := context.WithCancel(ctx)
+	timer := signal.CancelAfterInactivity(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle)
+	ctx = policy.ContextWithBufferPolicy(ctx, sessionPolicy.Buffer)
+	ctx = log.ContextWithAccessMessage(ctx, &log.AccessMessage{
+		From:   session.InboundFromContext(ctx).Source,
+		To:     destination,
+		Status: log.AccessAccepted,
+		Reason: "",
+		Email:  user.Email,
+	})
+
+	newError("received request for ", destination).WriteToLog(session.ExportIDToError(ctx))
+	link, err := s.dispatcher.Dispatch(ctx, destination)
+	if err != nil {
+		return newError("failed to dispatch request to ", destination).Base(err)
+	}
+
+	requestDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.DownlinkOnly)
+		if err := buf.Copy(clientReader, link.Writer, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to transfer request").Base(err)
+		}
+		return nil
+	}
+
+	responseDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.UplinkOnly)
+		if err := buf.Copy(link.Reader, clientWriter, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to write response").Base(err)
+		}
+		return nil
+	}
+
+	requestDonePost := task.OnSuccess(requestDone, task.Close(link.Writer))
+	if err := task.Run(ctx, requestDonePost, responseDone); err != nil {
+		common.Must(common.Interrupt(link.Reader))
+		common.Must(common.Interrupt(link.Writer))
+		return newError("connection ends").Base(err)
+	}
+	return nil
+}
+
+// flushWriter sends the response of the tunnel as soon as it is written
+type flushWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if err == nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
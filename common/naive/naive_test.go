@@ -0,0 +1,60 @@
+package naive_test
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/proxy/trojan"
+
+	"github.com/qtai2901/new_xrayr/common/naive"
+)
+
+func TestServeHTTPProbes(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "site")
+	}))
+	defer site.Close()
+
+	h, err := naive.NewHandler(&naive.Config{Tag: "naive", Port: 443, FallbackURL: site.URL}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := h.GetInbound().(*naive.Server)
+	user := &protocol.MemoryUser{Email: "naive|1@node|1", Account: &trojan.MemoryAccount{Password: "secret"}}
+	if err := server.AddUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddUser(context.Background(), user); err == nil {
+		t.Error("adding a user twice should fail")
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "site" {
+		t.Errorf("GET should get the fallback site, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	for _, auth := range []string{"", "Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong"))} {
+		r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+		if auth != "" {
+			r.Header.Set("Proxy-Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, r)
+		if rec.Code != http.StatusBadRequest || rec.Header().Get("Proxy-Authenticate") != "" {
+			t.Errorf("CONNECT with %q should get a plain 400, got %d", auth, rec.Code)
+		}
+	}
+
+	if err := server.RemoveUser(context.Background(), user.Email); err != nil {
+		t.Error(err)
+	}
+	if err := server.RemoveUser(context.Background(), user.Email); err == nil {
+		t.Error("removing a user twice should fail")
+	}
+}
@@ -0,0 +1,116 @@
+package naive
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+)
+
+// paddingFrames is the number of frames padded at the start of each
+// direction of a tunnel. A frame is made of the payload length, the padding
+// length and the payload, with zeros as padding after it.
+const paddingFrames = 8
+
+const (
+	paddingHeaderSize = 3
+	maxPaddingSize    = 255
+	maxPaddedPayload  = 65535
+)
+
+// paddingHeader returns the value of the Padding header of the response,
+// made of characters HPACK doesn't Huffman code so its length shows
+func paddingHeader() string {
+	padding := make([]byte, 30+rand.Intn(32))
+	bits := rand.Uint64()
+	for i := 0; i < 16; i++ {
+		padding[i] = "!#$()+<>?@[]^`{}"[bits&15]
+		bits >>= 4
+	}
+	for i := 16; i < len(padding); i++ {
+		padding[i] = '~'
+	}
+	return string(padding)
+}
+
+// paddingReader removes the padding of the first frames from the client
+type paddingReader struct {
+	reader  io.Reader
+	frames  int // Padded frames left
+	payload int // Left in the current frame
+	padding int
+}
+
+func newPaddingReader(reader io.Reader) *paddingReader {
+	return &paddingReader{reader: reader, frames: paddingFrames}
+}
+
+func (r *paddingReader) Read(p []byte) (int, error) {
+	for r.payload == 0 {
+		if r.frames == 0 {
+			return r.reader.Read(p)
+		}
+		var header [paddingHeaderSize]byte
+		if _, err := io.ReadFull(r.reader, header[:]); err != nil {
+			return 0, err
+		}
+		r.frames--
+		r.payload = int(binary.BigEndian.Uint16(header[:2]))
+		r.padding = int(header[2])
+		if r.payload == 0 {
+			if err := r.skipPadding(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(p) > r.payload {
+		p = p[:r.payload]
+	}
+	n, err := r.reader.Read(p)
+	r.payload -= n
+	if r.payload == 0 && err == nil {
+		err = r.skipPadding()
+	}
+	return n, err
+}
+
+func (r *paddingReader) skipPadding() error {
+	_, err := io.CopyN(io.Discard, r.reader, int64(r.padding))
+	r.padding = 0
+	return err
+}
+
+// paddingWriter pads the first frames to the client
+type paddingWriter struct {
+	writer io.Writer
+	frames int // Padded frames left
+}
+
+func newPaddingWriter(writer io.Writer) *paddingWriter {
+	return &paddingWriter{writer: writer, frames: paddingFrames}
+}
+
+func (w *paddingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && w.frames > 0 {
+		payload := p
+		if len(payload) > maxPaddedPayload {
+			payload = payload[:maxPaddedPayload]
+		}
+		padding := rand.Intn(maxPaddingSize + 1)
+		frame := make([]byte, paddingHeaderSize+len(payload)+padding)
+		binary.BigEndian.PutUint16(frame[:2], uint16(len(payload)))
+		frame[2] = byte(padding)
+		copy(frame[paddingHeaderSize:], payload)
+		if _, err := w.writer.Write(frame); err != nil {
+			return written, err
+		}
+		w.frames--
+		written += len(payload)
+		p = p[len(payload):]
+	}
+	if len(p) == 0 {
+		return written, nil
+	}
+	n, err := w.writer.Write(p)
+	return written + n, err
+}
@@ -0,0 +1,169 @@
+// Package nodecache keeps the last node info and user list synced from the
+// panel in SQLite, so a node can start with them while the panel is
+// unreachable
+package nodecache
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS nodes (
+	node     TEXT PRIMARY KEY,
+	info     TEXT NOT NULL,
+	saved_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS users (
+	node TEXT NOT NULL,
+	seq  INTEGER NOT NULL,
+	uid  INTEGER NOT NULL,
+	info TEXT NOT NULL,
+	PRIMARY KEY (node, seq)
+);`
+
+type Snapshot struct {
+	NodeInfo *api.NodeInfo
+	UserList []api.UserInfo
+	SavedAt  time.Time
+}
+
+// Cache is the snapshot of a node in a database shared by the nodes. It holds
+// the user credentials, so the database is readable by the owner only. A nil
+// Cache is disabled.
+type Cache struct {
+	db   *sql.DB
+	node string
+}
+
+// Open opens the cache of the node in the database at path, creating it. An
+// empty path disables the cache.
+func Open(path string, node string) (*Cache, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	// SQLite keeps the permissions of an existing file
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open node cache %s failed: %s", path, err)
+	}
+	f.Close()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("open node cache %s failed: %s", path, err)
+	}
+	// The pragmas are set on the connection, the only one
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA busy_timeout = 5000", "PRAGMA journal_mode = WAL"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("open node cache %s failed: %s", path, err)
+		}
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create node cache %s failed: %s", path, err)
+	}
+	return &Cache{db: db, node: node}, nil
+}
+
+// Close closes the database
+func (c *Cache) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+// Load returns the saved snapshot, nil if there is none
+func (c *Cache) Load() (*Snapshot, error) {
+	if c == nil {
+		return nil, nil
+	}
+	var (
+		info    string
+		savedAt int64
+	)
+	err := c.db.QueryRow("SELECT info, saved_at FROM nodes WHERE node = ?", c.node).Scan(&info, &savedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read node cache of %s failed: %s", c.node, err)
+	}
+	snapshot := &Snapshot{NodeInfo: &api.NodeInfo{}, SavedAt: time.Unix(savedAt, 0)}
+	if err := json.Unmarshal([]byte(info), snapshot.NodeInfo); err != nil {
+		return nil, fmt.Errorf("parse node cache of %s failed: %s", c.node, err)
+	}
+	rows, err := c.db.Query("SELECT info FROM users WHERE node = ? ORDER BY seq", c.node)
+	if err != nil {
+		return nil, fmt.Errorf("read node cache of %s failed: %s", c.node, err)
+	}
+	defer rows.Close()
+	snapshot.UserList = []api.UserInfo{}
+	for rows.Next() {
+		var u api.UserInfo
+		if err := rows.Scan(&info); err != nil {
+			return nil, fmt.Errorf("read node cache of %s failed: %s", c.node, err)
+		}
+		if err := json.Unmarshal([]byte(info), &u); err != nil {
+			return nil, fmt.Errorf("parse node cache of %s failed: %s", c.node, err)
+		}
+		snapshot.UserList = append(snapshot.UserList, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read node cache of %s failed: %s", c.node, err)
+	}
+	return snapshot, nil
+}
+
+// Save replaces the snapshot with the given node info and user list, at once
+func (c *Cache) Save(nodeInfo *api.NodeInfo, userList *[]api.UserInfo) error {
+	if c == nil || nodeInfo == nil || userList == nil {
+		return nil
+	}
+	info, err := json.Marshal(nodeInfo)
+	if err != nil {
+		return err
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO nodes (node, info, saved_at) VALUES (?, ?, ?)
+		ON CONFLICT (node) DO UPDATE SET info = excluded.info, saved_at = excluded.saved_at`,
+		c.node, string(info), time.Now().Unix()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE node = ?", c.node); err != nil {
+		return err
+	}
+	insert, err := tx.Prepare("INSERT INTO users (node, seq, uid, info) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for i, u := range *userList {
+		info, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if _, err := insert.Exec(c.node, i, u.UID, string(info)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
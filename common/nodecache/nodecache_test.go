@@ -0,0 +1,74 @@
+package nodecache_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/nodecache"
+)
+
+func TestCacheRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodecache.db")
+	cache, err := nodecache.Open(path, "V2board_V2ray_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, err := cache.Load(); err != nil || snapshot != nil {
+		t.Fatalf("expect no snapshot, got %v, %v", snapshot, err)
+	}
+
+	nodeInfo := &api.NodeInfo{NodeType: "V2ray", NodeID: 1, Port: 443}
+	userList := &[]api.UserInfo{
+		{UID: 2, Email: "b@test", UUID: "b831381d-6324-4d53-ad4f-8cda48b30811"},
+		{UID: 1, Email: "a@test", UUID: "e4a2a9c8-3a5e-4b8e-9f59-2f1d8f0c4b1a"},
+	}
+	if err := cache.Save(nodeInfo, userList); err != nil {
+		t.Fatal(err)
+	}
+	// The next sync replaces the users
+	*userList = (*userList)[1:]
+	if err := cache.Save(nodeInfo, userList); err != nil {
+		t.Fatal(err)
+	}
+	// Another node of the same database
+	other, err := nodecache.Open(path, "V2board_Trojan_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Save(&api.NodeInfo{NodeType: "Trojan", NodeID: 2, Port: 8443}, &[]api.UserInfo{{UID: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	cache.Close()
+
+	cache, err = nodecache.Open(path, "V2board_V2ray_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	snapshot, err := cache.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.NodeInfo.Port != 443 || len(snapshot.UserList) != 1 || snapshot.UserList[0].UUID != (*userList)[0].UUID {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expect the database readable by the owner only, got %v, %v", info.Mode(), err)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	cache, err := nodecache.Open("", "V2board_V2ray_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Save(&api.NodeInfo{}, &[]api.UserInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, err := cache.Load(); err != nil || snapshot != nil {
+		t.Fatalf("expect no snapshot, got %v, %v", snapshot, err)
+	}
+}
@@ -0,0 +1,60 @@
+// Package noderoute routes the traffic of each node by its own rules,
+// ahead of the global routing config
+package noderoute
+
+import (
+	"context"
+	"sync"
+
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/routing"
+)
+
+type Manager struct {
+	ctx        context.Context
+	dns        dns.Client
+	ohm        outbound.Manager
+	dispatcher routing.Dispatcher
+	routers    *sync.Map // Key: inbound tag, Value: *router.Router
+}
+
+func New(ctx context.Context, dns dns.Client, ohm outbound.Manager, dispatcher routing.Dispatcher) *Manager {
+	return &Manager{
+		ctx:        ctx,
+		dns:        dns,
+		ohm:        ohm,
+		dispatcher: dispatcher,
+		routers:    new(sync.Map),
+	}
+}
+
+// UpdateRoute replaces the routing rules of the node with the inbound tag
+func (m *Manager) UpdateRoute(tag string, config *router.Config) error {
+	r := new(router.Router)
+	if err := r.Init(m.ctx, config, m.dns, m.ohm, m.dispatcher); err != nil {
+		return newError("build route of ", tag, " failed").Base(err)
+	}
+	m.routers.Store(tag, r)
+	return nil
+}
+
+// RemoveRoute drops the routing rules of the node with the inbound tag
+func (m *Manager) RemoveRoute(tag string) {
+	m.routers.Delete(tag)
+}
+
+// PickRoute returns the outbound tag picked by the rules of the node the
+// connection came in from, ok is false if none of them matches.
+func (m *Manager) PickRoute(ctx routing.Context) (outboundTag string, ok bool) {
+	value, found := m.routers.Load(ctx.GetInboundTag())
+	if !found {
+		return "", false
+	}
+	route, err := value.(*router.Router).PickRoute(ctx)
+	if err != nil {
+		return "", false
+	}
+	return route.GetOutboundTag(), true
+}
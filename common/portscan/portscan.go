@@ -0,0 +1,177 @@
+// Package portscan detects the users opening connections to many distinct
+// destinations in a short time, the way port scanners and spam bots do, so a
+// node can block or throttle them before its server gets suspended for abuse.
+package portscan
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Actions taken on a detected user
+const (
+	ActionBlock    = "block"
+	ActionThrottle = "throttle"
+)
+
+// window is the time the distinct destinations of a user are counted over
+const window = time.Minute
+
+type Config struct {
+	Enable          bool   `mapstructure:"Enable"`
+	MaxDestinations int    `mapstructure:"MaxDestinations"` // Distinct destination address and port pairs a user may connect to per minute
+	Action          string `mapstructure:"Action"`          // block or throttle
+	Limit           int    `mapstructure:"Limit"`           // mbps, for throttle
+	Duration        int    `mapstructure:"Duration"`        // Second a detected user stays blocked or throttled
+	RuleID          int    `mapstructure:"RuleID"`          // Audit rule the detections are reported as
+}
+
+type user struct {
+	seen   map[string]time.Time // Key: destination, value: last connection
+	until  time.Time            // Blocked or throttled until
+	bucket *rate.Limiter
+}
+
+type node struct {
+	access   sync.Mutex
+	max      int
+	action   string
+	limit    rate.Limit // Byte/s
+	duration time.Duration
+	ruleID   int
+	users    map[string]*user // Key: email
+	swept    time.Time
+}
+
+// Manager keeps the detection settings and the recent destinations of the
+// users of each node
+type Manager struct {
+	nodes sync.Map // Key: inbound tag, value: *node
+}
+
+func NewManager() *Manager {
+	return &Manager{}
+}
+
+// AddNode turns the detection on for the inbound with tag, replacing its
+// previous settings and forgetting the detected users
+func (m *Manager) AddNode(tag string, config *Config) error {
+	if config.MaxDestinations <= 0 {
+		return fmt.Errorf("port scan detection needs a positive MaxDestinations")
+	}
+	n := &node{
+		max:      config.MaxDestinations,
+		action:   strings.ToLower(config.Action),
+		limit:    rate.Limit(config.Limit * 1000000 / 8),
+		duration: time.Duration(config.Duration) * time.Second,
+		ruleID:   config.RuleID,
+		users:    make(map[string]*user),
+	}
+	switch n.action {
+	case "", ActionBlock:
+		n.action = ActionBlock
+	case ActionThrottle:
+		if n.limit <= 0 {
+			return fmt.Errorf("port scan throttle needs a positive Limit")
+		}
+	default:
+		return fmt.Errorf("unsupported port scan action: %s", config.Action)
+	}
+	if n.duration <= 0 {
+		n.duration = 10 * time.Minute
+	}
+	m.nodes.Store(tag, n)
+	return nil
+}
+
+func (m *Manager) RemoveNode(tag string) {
+	m.nodes.Delete(tag)
+}
+
+// Check counts a connection of the user with email to the destination, given
+// as address and port. It returns the action for the connection, empty if it
+// is allowed as is, and whether the user has just been detected by it.
+func (m *Manager) Check(tag string, email string, destination string) (action string, detected bool) {
+	value, ok := m.nodes.Load(tag)
+	if !ok {
+		return "", false
+	}
+	n := value.(*node)
+	now := time.Now()
+	n.access.Lock()
+	defer n.access.Unlock()
+	n.sweep(now)
+	u, ok := n.users[email]
+	if !ok {
+		u = &user{seen: make(map[string]time.Time)}
+		n.users[email] = u
+	}
+	if now.Before(u.until) {
+		return n.action, false
+	}
+	u.seen[destination] = now
+	if len(u.seen) <= n.max {
+		return "", false
+	}
+	// Drop the destinations out of the window before counting again
+	for d, last := range u.seen {
+		if now.Sub(last) > window {
+			delete(u.seen, d)
+		}
+	}
+	if len(u.seen) <= n.max {
+		return "", false
+	}
+	u.seen = make(map[string]time.Time)
+	u.until = now.Add(n.duration)
+	if n.action == ActionThrottle {
+		u.bucket = rate.NewLimiter(n.limit, int(n.limit))
+	}
+	return n.action, true
+}
+
+// Bucket returns the rate limiter of a throttled user, nil if the user is
+// not throttled
+func (m *Manager) Bucket(tag string, email string) *rate.Limiter {
+	value, ok := m.nodes.Load(tag)
+	if !ok {
+		return nil
+	}
+	n := value.(*node)
+	n.access.Lock()
+	defer n.access.Unlock()
+	if u, ok := n.users[email]; ok && time.Now().Before(u.until) {
+		return u.bucket
+	}
+	return nil
+}
+
+// RuleID returns the audit rule the detections of the node are reported as
+func (m *Manager) RuleID(tag string) int {
+	if value, ok := m.nodes.Load(tag); ok {
+		return value.(*node).ruleID
+	}
+	return -1
+}
+
+// sweep drops the users without recent connections, at most once per window
+func (n *node) sweep(now time.Time) {
+	if now.Sub(n.swept) < window {
+		return
+	}
+	n.swept = now
+	for email, u := range n.users {
+		for d, last := range u.seen {
+			if now.Sub(last) > window {
+				delete(u.seen, d)
+			}
+		}
+		if len(u.seen) == 0 && !now.Before(u.until) {
+			delete(n.users, email)
+		}
+	}
+}
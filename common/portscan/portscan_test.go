@@ -0,0 +1,52 @@
+package portscan_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/portscan"
+)
+
+func TestCheck(t *testing.T) {
+	m := portscan.NewManager()
+	if err := m.AddNode("block", &portscan.Config{Enable: true, MaxDestinations: 3, RuleID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddNode("throttle", &portscan.Config{Enable: true, MaxDestinations: 3, Action: "throttle", Limit: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddNode("invalid", &portscan.Config{Enable: true, MaxDestinations: 3, Action: "throttle"}); err == nil {
+		t.Error("throttle without a limit should fail")
+	}
+
+	// Connecting to the same destinations again is not scanning
+	for i := 0; i < 10; i++ {
+		if action, _ := m.Check("block", "user", fmt.Sprintf("tcp:203.0.113.%d:443", i%3)); action != "" {
+			t.Fatalf("connection %d should be allowed, got %q", i, action)
+		}
+	}
+	action, detected := m.Check("block", "user", "tcp:203.0.113.9:25")
+	if action != portscan.ActionBlock || !detected {
+		t.Errorf("the fourth destination should be detected, got %q, %v", action, detected)
+	}
+	if action, detected := m.Check("block", "user", "tcp:203.0.113.1:443"); action != portscan.ActionBlock || detected {
+		t.Errorf("a detected user should stay blocked and be reported once, got %q, %v", action, detected)
+	}
+	if action, _ := m.Check("block", "other", "tcp:203.0.113.9:25"); action != "" {
+		t.Errorf("the other users should be allowed, got %q", action)
+	}
+	if m.RuleID("block") != 7 || m.RuleID("unknown") != -1 {
+		t.Error("unexpected rule ID")
+	}
+
+	for i := 0; i < 4; i++ {
+		m.Check("throttle", "user", fmt.Sprintf("udp:198.51.100.1:%d", 1000+i))
+	}
+	bucket := m.Bucket("throttle", "user")
+	if bucket == nil || bucket.Limit() != 1000000 {
+		t.Error("a detected user should be throttled to 1MB/s")
+	}
+	if m.Bucket("throttle", "other") != nil || m.Bucket("block", "user") != nil {
+		t.Error("only the throttled users should have a bucket")
+	}
+}
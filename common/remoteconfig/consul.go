@@ -0,0 +1,102 @@
+package remoteconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulWatcher uses the blocking queries of the KV API: a request with the
+// index of the last answer is held by Consul until something changes.
+type consulWatcher struct {
+	client  *http.Client
+	address string
+	prefix  string
+	token   string
+	timeout time.Duration
+	index   uint64
+}
+
+type consulPair struct {
+	Key   string
+	Value []byte // base64 in the JSON, decoded by encoding/json
+}
+
+// consulWait is how long Consul holds a blocking query before answering unchanged
+const consulWait = 5 * time.Minute
+
+func (w *consulWatcher) Next(ctx context.Context) (map[string][]byte, error) {
+	for {
+		query := url.Values{"recurse": {"true"}}
+		timeout := w.timeout
+		if w.index > 0 {
+			query.Set("index", strconv.FormatUint(w.index, 10))
+			query.Set("wait", consulWait.String())
+			// Consul adds up to 1/16 of wait as jitter
+			timeout += consulWait + consulWait/16
+		}
+		pairs, index, err := w.get(ctx, query, timeout)
+		if err != nil {
+			return nil, err
+		}
+		// The index may go backwards after a restore of Consul, start over then
+		changed := w.index == 0 || index != w.index
+		if index < w.index {
+			index = 0
+		}
+		w.index = index
+		if !changed {
+			continue
+		}
+		values := make(map[string][]byte, len(pairs))
+		for _, pair := range pairs {
+			key := strings.TrimPrefix(strings.TrimPrefix(pair.Key, w.prefix), "/")
+			// Folders have no value
+			if key == "" || strings.HasSuffix(key, "/") {
+				continue
+			}
+			values[key] = pair.Value
+		}
+		return values, nil
+	}
+}
+
+func (w *consulWatcher) get(ctx context.Context, query url.Values, timeout time.Duration) ([]consulPair, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.address+"/v1/kv/"+w.prefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if w.token != "" {
+		req.Header.Set("X-Consul-Token", w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	// No key under the prefix
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, index, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul: %s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var pairs []consulPair
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return nil, 0, fmt.Errorf("parse consul response failed: %s", err)
+	}
+	return pairs, index, nil
+}
@@ -0,0 +1,211 @@
+package remoteconfig
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etcdWatcher talks to the JSON gateway of the etcd v3 API. It reads the
+// prefix with a range request, then holds a watch from the next revision
+// until an event comes in and reads the prefix again.
+type etcdWatcher struct {
+	client   *http.Client
+	address  string
+	prefix   string
+	username string
+	password string
+	timeout  time.Duration
+	token    string
+	revision int64
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result *struct {
+		Header   etcdHeader        `json:"header"`
+		Canceled bool              `json:"canceled"`
+		Events   []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (w *etcdWatcher) Next(ctx context.Context) (map[string][]byte, error) {
+	if w.revision > 0 {
+		if err := w.watch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var resp etcdRangeResponse
+	if err := w.call(ctx, "/v3/kv/range", map[string]any{
+		"key":       []byte(w.prefix),
+		"range_end": prefixEnd(w.prefix),
+	}, &resp); err != nil {
+		return nil, err
+	}
+	w.revision, _ = strconv.ParseInt(resp.Header.Revision, 10, 64)
+	values := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(strings.TrimPrefix(string(kv.Key), w.prefix), "/")
+		if key != "" {
+			values[key] = kv.Value
+		}
+	}
+	return values, nil
+}
+
+// etcdWatchTime bounds a watch, so a connection dropped silently is noticed
+const etcdWatchTime = 5 * time.Minute
+
+// watch blocks until a key under the prefix changes after the last range,
+// or etcdWatchTime passes
+func (w *etcdWatcher) watch(parent context.Context) (err error) {
+	ctx, cancel := context.WithTimeout(parent, etcdWatchTime)
+	defer cancel()
+	defer func() {
+		if err != nil && parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = nil
+		}
+	}()
+	body, _ := json.Marshal(map[string]any{
+		"create_request": map[string]any{
+			"key":            []byte(w.prefix),
+			"range_end":      prefixEnd(w.prefix),
+			"start_revision": strconv.FormatInt(w.revision+1, 10),
+		},
+	})
+	resp, err := w.post(ctx, "/v3/watch", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			w.token = ""
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("etcd watch: %s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	// The gateway streams one JSON object per line
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var msg etcdWatchResponse
+			if err := json.Unmarshal(line, &msg); err != nil {
+				return fmt.Errorf("parse etcd watch response failed: %s", err)
+			}
+			if msg.Error != nil {
+				return fmt.Errorf("etcd watch: %s", msg.Error.Message)
+			}
+			if msg.Result != nil {
+				if len(msg.Result.Events) > 0 {
+					return nil
+				}
+				// The revision was compacted, read everything again
+				if msg.Result.Canceled {
+					return nil
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *etcdWatcher) call(ctx context.Context, path string, request any, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	resp, err := w.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The token expired, authenticate again next time
+		if resp.StatusCode == http.StatusUnauthorized {
+			w.token = ""
+		}
+		return fmt.Errorf("etcd %s: %s %s", path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("parse etcd response failed: %s", err)
+	}
+	return nil
+}
+
+func (w *etcdWatcher) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	if w.username != "" && w.token == "" && path != "/v3/auth/authenticate" {
+		if err := w.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.address+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.token != "" {
+		req.Header.Set("Authorization", w.token)
+	}
+	return w.client.Do(req)
+}
+
+func (w *etcdWatcher) authenticate(ctx context.Context) error {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := w.call(ctx, "/v3/auth/authenticate", map[string]string{
+		"name":     w.username,
+		"password": w.password,
+	}, &resp); err != nil {
+		return err
+	}
+	w.token = resp.Token
+	return nil
+}
+
+// prefixEnd is the range end covering every key starting with prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// Every key
+	return []byte{0}
+}
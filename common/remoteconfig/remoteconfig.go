@@ -0,0 +1,68 @@
+// Package remoteconfig reads the values under a key prefix of etcd or Consul
+// and follows their changes, so the node definitions of a fleet can be kept
+// in one place
+package remoteconfig
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultPrefix = "xrayr/nodes/"
+
+type Config struct {
+	Enable   bool   `mapstructure:"Enable"`
+	Type     string `mapstructure:"Type"`    // etcd or consul
+	Address  string `mapstructure:"Address"` // Like http://127.0.0.1:2379 for etcd, http://127.0.0.1:8500 for consul
+	Prefix   string `mapstructure:"Prefix"`  // Every key under it holds a node, defaults to xrayr/nodes/
+	Username string `mapstructure:"Username"`
+	Password string `mapstructure:"Password"`
+	Token    string `mapstructure:"Token"`   // Consul ACL token
+	Timeout  int    `mapstructure:"Timeout"` // second
+}
+
+// Watcher follows the values under the prefix. The first call of Next
+// returns them at once, the later ones block until they change. The keys
+// are relative to the prefix.
+type Watcher interface {
+	Next(ctx context.Context) (map[string][]byte, error)
+}
+
+func New(config *Config) (Watcher, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("remote config address is empty")
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	address := strings.TrimSuffix(config.Address, "/")
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	switch strings.ToLower(config.Type) {
+	case "etcd":
+		return &etcdWatcher{
+			client:   &http.Client{},
+			address:  address,
+			prefix:   prefix,
+			username: config.Username,
+			password: config.Password,
+			timeout:  timeout,
+		}, nil
+	case "consul":
+		return &consulWatcher{
+			client:  &http.Client{},
+			address: address,
+			prefix:  strings.TrimPrefix(prefix, "/"),
+			token:   config.Token,
+			timeout: timeout,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported remote config type: %s", config.Type)
+	}
+}
@@ -0,0 +1,92 @@
+package remoteconfig_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/remoteconfig"
+)
+
+func TestConsulWatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/xrayr/nodes/" || r.Header.Get("X-Consul-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// The second request blocks on index 5 until node 2 shows up
+		pairs := []map[string]any{{"Key": "xrayr/nodes/", "Value": nil}, {"Key": "xrayr/nodes/1", "Value": []byte("NodeID: 1")}}
+		index := "5"
+		if r.URL.Query().Get("index") == "5" {
+			pairs = append(pairs, map[string]any{"Key": "xrayr/nodes/2", "Value": []byte("NodeID: 2")})
+			index = "6"
+		}
+		w.Header().Set("X-Consul-Index", index)
+		json.NewEncoder(w).Encode(pairs)
+	}))
+	defer server.Close()
+
+	watcher, err := remoteconfig.New(&remoteconfig.Config{Type: "consul", Address: server.URL, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := watcher.Next(context.Background())
+	if err != nil || len(values) != 1 || string(values["1"]) != "NodeID: 1" {
+		t.Fatalf("unexpected values: %q, %v", values, err)
+	}
+	values, err = watcher.Next(context.Background())
+	if err != nil || len(values) != 2 || string(values["2"]) != "NodeID: 2" {
+		t.Fatalf("unexpected values: %q, %v", values, err)
+	}
+}
+
+func TestEtcdWatch(t *testing.T) {
+	revision := 10
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			var request struct {
+				Key      []byte `json:"key"`
+				RangeEnd []byte `json:"range_end"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			if string(request.Key) != "nodes/" || string(request.RangeEnd) != "nodes0" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{
+				"header": map[string]string{"revision": "10"},
+				"kvs":    []map[string][]byte{{"key": []byte("nodes/a"), "value": []byte("NodeID: 1")}},
+			})
+		case "/v3/watch":
+			var request struct {
+				CreateRequest struct {
+					StartRevision string `json:"start_revision"`
+				} `json:"create_request"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			if request.CreateRequest.StartRevision == "11" {
+				revision++
+			}
+			w.Write([]byte(`{"result":{"header":{"revision":"10"},"created":true}}` + "\n"))
+			w.Write([]byte(`{"result":{"header":{"revision":"11"},"events":[{"kv":{}}]}}` + "\n"))
+		}
+	}))
+	defer server.Close()
+
+	watcher, err := remoteconfig.New(&remoteconfig.Config{Type: "etcd", Address: server.URL, Prefix: "nodes/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		values, err := watcher.Next(context.Background())
+		if err != nil || len(values) != 1 || string(values["a"]) != "NodeID: 1" {
+			t.Fatalf("unexpected values: %q, %v", values, err)
+		}
+	}
+	if revision != 11 {
+		t.Fatalf("the watch should start after the revision read")
+	}
+}
@@ -15,12 +15,20 @@ import (
 
 type Manager struct {
 	InboundRule         *sync.Map // Key: Tag, Value: []api.DetectRule
+	InboundPortRule     *sync.Map // Key: Tag, Value: *PortRule
 	InboundDetectResult *sync.Map // key: Tag, Value: mapset.NewSet []api.DetectResult
 }
 
+// PortRule rejects the destinations on some ports, reported as the audit rule RuleID
+type PortRule struct {
+	Ports  map[uint16]bool
+	RuleID int
+}
+
 func New() *Manager {
 	return &Manager{
 		InboundRule:         new(sync.Map),
+		InboundPortRule:     new(sync.Map),
 		InboundDetectResult: new(sync.Map),
 	}
 }
@@ -47,6 +55,19 @@ func (r *Manager) GetDetectResult(tag string) (*[]api.DetectResult, error) {
 	return &detectResult, nil
 }
 
+// UpdatePortRule rejects the destinations of the inbound with tag on ports
+func (r *Manager) UpdatePortRule(tag string, ports []uint16, ruleID int) {
+	portRule := &PortRule{Ports: make(map[uint16]bool, len(ports)), RuleID: ruleID}
+	for _, port := range ports {
+		portRule.Ports[port] = true
+	}
+	r.InboundPortRule.Store(tag, portRule)
+}
+
+func (r *Manager) RemovePortRule(tag string) {
+	r.InboundPortRule.Delete(tag)
+}
+
 func (r *Manager) Detect(tag string, destination string, email string) (reject bool) {
 	reject = false
 	var hitRuleID = -1
@@ -60,24 +81,40 @@ func (r *Manager) Detect(tag string, destination string, email string) (reject b
 				break
 			}
 		}
-		// If we hit some rule
-		if reject && hitRuleID != -1 {
-			l := strings.Split(email, "|")
-			uid, err := strconv.Atoi(l[len(l)-1])
-			if err != nil {
-				newError(fmt.Sprintf("Record illegal behavior failed! Cannot find user's uid: %s", email)).AtDebug().WriteToLog()
-				return reject
-			}
-			newSet := mapset.NewSetWith(api.DetectResult{UID: uid, RuleID: hitRuleID})
-			// If there are any hit history
-			if v, ok := r.InboundDetectResult.LoadOrStore(tag, newSet); ok {
-				resultSet := v.(mapset.Set)
-				// If this is a new record
-				if resultSet.Add(api.DetectResult{UID: uid, RuleID: hitRuleID}) {
-					r.InboundDetectResult.Store(tag, resultSet)
-				}
+	}
+	// Or the port of the destination is rejected
+	if value, ok := r.InboundPortRule.Load(tag); ok && !reject {
+		portRule := value.(*PortRule)
+		if i := strings.LastIndexByte(destination, ':'); i >= 0 {
+			if port, err := strconv.ParseUint(destination[i+1:], 10, 16); err == nil && portRule.Ports[uint16(port)] {
+				hitRuleID = portRule.RuleID
+				reject = true
 			}
 		}
 	}
+	// If we hit some rule
+	if reject && hitRuleID != -1 {
+		r.Record(tag, email, hitRuleID)
+	}
 	return reject
 }
+
+// Record keeps a rule broken by the user with email, reported to the panel
+// with the other detections of the inbound
+func (r *Manager) Record(tag string, email string, ruleID int) {
+	l := strings.Split(email, "|")
+	uid, err := strconv.Atoi(l[len(l)-1])
+	if err != nil {
+		newError(fmt.Sprintf("Record illegal behavior failed! Cannot find user's uid: %s", email)).AtDebug().WriteToLog()
+		return
+	}
+	newSet := mapset.NewSetWith(api.DetectResult{UID: uid, RuleID: ruleID})
+	// If there are any hit history
+	if v, ok := r.InboundDetectResult.LoadOrStore(tag, newSet); ok {
+		resultSet := v.(mapset.Set)
+		// If this is a new record
+		if resultSet.Add(api.DetectResult{UID: uid, RuleID: ruleID}) {
+			r.InboundDetectResult.Store(tag, resultSet)
+		}
+	}
+}
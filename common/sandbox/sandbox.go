@@ -0,0 +1,15 @@
+// Package sandbox restricts what the process may do once it is started, so an
+// exploit of the proxy stack can't take the system over
+package sandbox
+
+// Config of the sandbox, applied once the nodes are started
+type Config struct {
+	Seccomp       bool     `mapstructure:"Seccomp"`       // Deny the system calls a proxy never makes, like execve, ptrace, mount and bpf
+	Landlock      bool     `mapstructure:"Landlock"`      // Deny writing outside the writable paths, everything stays readable
+	WritablePaths []string `mapstructure:"WritablePaths"` // More paths written to, beside the state paths of XrayR
+}
+
+// Enabled reports whether the config restricts anything
+func (c *Config) Enabled() bool {
+	return c != nil && (c.Seccomp || c.Landlock)
+}
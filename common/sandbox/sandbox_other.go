@@ -0,0 +1,10 @@
+//go:build !linux
+
+package sandbox
+
+import "errors"
+
+// Apply fails, the sandbox needs Linux
+func Apply(c *Config, writable []string) error {
+	return errors.New("the sandbox is only supported on Linux")
+}
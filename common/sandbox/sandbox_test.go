@@ -0,0 +1,58 @@
+package sandbox_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/sandbox"
+)
+
+// The sandbox can't be undone, so it is applied in a child process running
+// the test named by this variable
+const childEnv = "SANDBOX_TEST_CHILD"
+
+func runChild(t *testing.T, name string, env ...string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^"+name+"$")
+	cmd.Env = append(append(os.Environ(), childEnv+"="+name), env...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s\n%s", err, output)
+	}
+}
+
+func TestSeccomp(t *testing.T) {
+	if os.Getenv(childEnv) != t.Name() {
+		runChild(t, t.Name())
+		return
+	}
+	if err := sandbox.Apply(&sandbox.Config{Seccomp: true}, nil); err != nil {
+		t.Skip(err)
+	}
+	if err := exec.Command(os.Args[0], "-test.run=^$").Run(); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("execve not denied: %v", err)
+	}
+}
+
+func TestLandlock(t *testing.T) {
+	if os.Getenv(childEnv) != t.Name() {
+		runChild(t, t.Name(), "SANDBOX_TEST_DIR="+t.TempDir(), "SANDBOX_TEST_OTHER="+t.TempDir())
+		return
+	}
+	writable, other := os.Getenv("SANDBOX_TEST_DIR"), os.Getenv("SANDBOX_TEST_OTHER")
+	if err := sandbox.Apply(&sandbox.Config{Landlock: true}, []string{writable}); err != nil {
+		t.Skip(err)
+	}
+	if err := os.WriteFile(filepath.Join(writable, "file"), nil, 0o644); err != nil {
+		t.Errorf("write in a writable path: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(other, "file"), nil, 0o644); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("write elsewhere not denied: %v", err)
+	}
+	if _, err := os.ReadFile(os.Args[0]); err != nil {
+		t.Errorf("read denied: %s", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package sandbox
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_X86_64
+
+// x32Bit is set in the numbers of the x32 system calls, which are checked
+// against the same arch and have to be denied as a whole
+const x32Bit = 0x40000000
+
+var archDeniedSyscalls = []uint32{unix.SYS_IOPL, unix.SYS_IOPERM}
@@ -0,0 +1,12 @@
+//go:build linux
+
+package sandbox
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_AARCH64
+
+// No other ABI shares the arch
+const x32Bit = 0
+
+var archDeniedSyscalls []uint32
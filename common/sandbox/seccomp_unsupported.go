@@ -0,0 +1,10 @@
+//go:build linux && !amd64 && !arm64
+
+package sandbox
+
+// No filter is built for the other archs, Seccomp is refused on them
+const auditArch = 0
+
+const x32Bit = 0
+
+var archDeniedSyscalls []uint32
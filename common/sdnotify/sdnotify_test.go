@@ -0,0 +1,52 @@
+package sdnotify_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/common/sdnotify"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := sdnotify.Notify(sdnotify.Ready); sent || err != nil {
+		t.Fatalf("sent %v, %v without a socket", sent, err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+	if sent, err := sdnotify.Notify(sdnotify.Ready); !sent || err != nil {
+		t.Fatalf("sent %v, %v", sent, err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != sdnotify.Ready {
+		t.Errorf("received %q", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval, ok := sdnotify.WatchdogInterval(); !ok || interval != 30*time.Second {
+		t.Errorf("interval %s, %v", interval, ok)
+	}
+	// For another process
+	t.Setenv("WATCHDOG_PID", "1")
+	if _, ok := sdnotify.WatchdogInterval(); ok {
+		t.Error("watchdog on for another process")
+	}
+}
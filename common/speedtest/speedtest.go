@@ -0,0 +1,165 @@
+// Package speedtest detects the connections to speed test services, so a node
+// can throttle or block them instead of letting them saturate the link.
+package speedtest
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Actions taken on a detected speed test
+const (
+	ActionBlock    = "block"
+	ActionThrottle = "throttle"
+)
+
+// DefaultDomains are the domains of the common speed test services, matched
+// along with their subdomains
+var DefaultDomains = []string{
+	"speedtest.net",
+	"ooklaserver.net",
+	"speed.cloudflare.com",
+	"speedtest.googlefiber.net",
+	"fast.com",
+	"librespeed.org",
+	"speedof.me",
+	"testmy.net",
+	"nperf.com",
+	"speedcheck.org",
+	"speedtest.cn",
+}
+
+// DefaultKeywords match the domains of the self hosted Ookla and LibreSpeed
+// servers, which are usually named after them
+var DefaultKeywords = []string{"speedtest"}
+
+type Config struct {
+	Enable  bool     `mapstructure:"Enable"`
+	Action  string   `mapstructure:"Action"`  // block or throttle
+	Limit   int      `mapstructure:"Limit"`   // mbps, shared by all the speed tests of a user
+	Domains []string `mapstructure:"Domains"` // Matched along with their subdomains, besides DefaultDomains
+	IPs     []string `mapstructure:"IPs"`     // IPs or CIDRs
+}
+
+type node struct {
+	action   string
+	limit    rate.Limit // Byte/s
+	domains  []string
+	keywords []string
+	prefixes []netip.Prefix
+	buckets  sync.Map // Key: email, value: *rate.Limiter
+}
+
+// Manager keeps the speed test settings of each node
+type Manager struct {
+	nodes sync.Map // Key: inbound tag, value: *node
+}
+
+func NewManager() *Manager {
+	return &Manager{}
+}
+
+// AddNode turns the detection on for the inbound with tag, replacing its
+// previous settings
+func (m *Manager) AddNode(tag string, config *Config) error {
+	n := &node{
+		action:   strings.ToLower(config.Action),
+		limit:    rate.Limit(config.Limit * 1000000 / 8),
+		keywords: DefaultKeywords,
+	}
+	switch n.action {
+	case "", ActionBlock:
+		n.action = ActionBlock
+	case ActionThrottle:
+		if n.limit <= 0 {
+			return fmt.Errorf("speedtest throttle needs a positive Limit")
+		}
+	default:
+		return fmt.Errorf("unsupported speedtest action: %s", config.Action)
+	}
+	for _, domains := range [][]string{DefaultDomains, config.Domains} {
+		for _, domain := range domains {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				n.domains = append(n.domains, domain)
+			}
+		}
+	}
+	for _, s := range config.IPs {
+		prefix, err := parsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid speedtest IP %s: %s", s, err)
+		}
+		n.prefixes = append(n.prefixes, prefix)
+	}
+	m.nodes.Store(tag, n)
+	return nil
+}
+
+func (m *Manager) RemoveNode(tag string) {
+	m.nodes.Delete(tag)
+}
+
+// Match returns the action for a connection of the inbound with tag to the
+// destination, given as a domain or an address. It is empty if the
+// destination is not a speed test.
+func (m *Manager) Match(tag string, domain string, addr netip.Addr) string {
+	value, ok := m.nodes.Load(tag)
+	if !ok {
+		return ""
+	}
+	n := value.(*node)
+	if domain != "" {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		for _, d := range n.domains {
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				return n.action
+			}
+		}
+		for _, keyword := range n.keywords {
+			if strings.Contains(domain, keyword) {
+				return n.action
+			}
+		}
+	}
+	if addr.IsValid() {
+		addr = addr.Unmap()
+		for _, prefix := range n.prefixes {
+			if prefix.Contains(addr) {
+				return n.action
+			}
+		}
+	}
+	return ""
+}
+
+// Bucket returns the rate limiter shared by the speed tests of a user, nil
+// if the node does not throttle them
+func (m *Manager) Bucket(tag string, email string) *rate.Limiter {
+	value, ok := m.nodes.Load(tag)
+	if !ok {
+		return nil
+	}
+	n := value.(*node)
+	if n.action != ActionThrottle {
+		return nil
+	}
+	bucket, _ := n.buckets.LoadOrStore(email, rate.NewLimiter(n.limit, int(n.limit)))
+	return bucket.(*rate.Limiter)
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,52 @@
+package speedtest_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/speedtest"
+)
+
+func TestMatch(t *testing.T) {
+	m := speedtest.NewManager()
+	if err := m.AddNode("block", &speedtest.Config{Enable: true, IPs: []string{"203.0.113.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddNode("throttle", &speedtest.Config{Enable: true, Action: "throttle", Limit: 8, Domains: []string{"Example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddNode("invalid", &speedtest.Config{Enable: true, Action: "throttle"}); err == nil {
+		t.Error("throttle without a limit should fail")
+	}
+	for _, c := range []struct {
+		tag    string
+		domain string
+		addr   string
+		want   string
+	}{
+		{"block", "www.speedtest.net", "", speedtest.ActionBlock},
+		{"block", "speedtest.isp.example.", "", speedtest.ActionBlock},
+		{"block", "notfast.com", "", ""},
+		{"block", "", "203.0.113.9", speedtest.ActionBlock},
+		{"block", "", "::ffff:203.0.113.9", speedtest.ActionBlock},
+		{"throttle", "cdn.example.com", "", speedtest.ActionThrottle},
+		{"throttle", "", "203.0.113.9", ""},
+		{"other", "www.speedtest.net", "", ""},
+	} {
+		var addr netip.Addr
+		if c.addr != "" {
+			addr = netip.MustParseAddr(c.addr)
+		}
+		if got := m.Match(c.tag, c.domain, addr); got != c.want {
+			t.Errorf("Match(%s, %s, %s) = %q, want %q", c.tag, c.domain, c.addr, got, c.want)
+		}
+	}
+
+	if m.Bucket("block", "user") != nil {
+		t.Error("a blocking node should not have buckets")
+	}
+	bucket := m.Bucket("throttle", "user")
+	if bucket == nil || bucket.Limit() != 1000000 || m.Bucket("throttle", "user") != bucket {
+		t.Error("the speed tests of a user should share a 1MB/s bucket")
+	}
+}
@@ -0,0 +1,57 @@
+package sshtunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// LoadHostKey returns the host key in the OpenSSH private key file, creating
+// the file with a new Ed25519 key if it doesn't exist, so the clients see
+// the same key after a restart
+func LoadHostKey(file string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, newError("invalid host key file ", file).Base(err)
+		}
+		return signer, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, newError("failed to read host key file ", file).Base(err)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return nil, newError("failed to create host key file ", file).Base(err)
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+		return nil, newError("failed to create host key file ", file).Base(err)
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// ParseHostKey returns the Ed25519 host key of the seed in base64, like the
+// server key given by the panel
+func ParseHostKey(seed string) (ssh.Signer, error) {
+	b, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil || len(b) != ed25519.SeedSize {
+		return nil, newError("host key must be an Ed25519 seed of ", ed25519.SeedSize, " bytes in base64")
+	}
+	return ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(b))
+}
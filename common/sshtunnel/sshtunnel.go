@@ -0,0 +1,369 @@
+// Package sshtunnel serves an SSH server for the clients forwarding their
+// connections through it, like with ssh -D. The users log in with their name
+// and password, and may do nothing but open direct-tcpip channels: no shell,
+// command or remote forward.
+package sshtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gonet "net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/http"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"golang.org/x/crypto/ssh"
+)
+
+// Message shown to the clients asking for a shell
+const shellMessage = "This server only forwards connections.\r\n"
+
+type Config struct {
+	Tag      string
+	Listen   string // Address listened on, every one if empty
+	Port     uint32
+	HostKey  ssh.Signer
+	Sniffing session.SniffingRequest
+}
+
+// Handler is the inbound.Handler listening for the SSH clients of a node
+type Handler struct {
+	config     *Config
+	server     *Server
+	dispatcher routing.Dispatcher
+
+	access   sync.Mutex
+	listener gonet.Listener
+}
+
+func NewHandler(config *Config, dispatcher routing.Dispatcher, policyManager policy.Manager) *Handler {
+	return &Handler{
+		config:     config,
+		dispatcher: dispatcher,
+		server: &Server{
+			hostKey:       config.HostKey,
+			sniffing:      config.Sniffing,
+			policyManager: policyManager,
+			users:         make(map[string]*user),
+			names:         make(map[string]string),
+		},
+	}
+}
+
+// Start implements common.Runnable.
+func (h *Handler) Start() error {
+	listener, err := gonet.Listen("tcp", gonet.JoinHostPort(h.config.Listen, strconv.Itoa(int(h.config.Port))))
+	if err != nil {
+		return newError("failed to listen on port ", h.config.Port).Base(err)
+	}
+	h.access.Lock()
+	h.listener = listener
+	h.access.Unlock()
+	go h.serve(listener)
+	return nil
+}
+
+// Close implements common.Closable. The connections accepted so far are
+// left to end by themselves, like the ones of the other inbounds.
+func (h *Handler) Close() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Close()
+}
+
+// Tag implements inbound.Handler.
+func (h *Handler) Tag() string {
+	return h.config.Tag
+}
+
+// GetRandomInboundProxy implements inbound.Handler.
+func (h *Handler) GetRandomInboundProxy() (interface{}, net.Port, int) {
+	return h.server, net.Port(h.config.Port), 9999
+}
+
+// GetInbound implements proxy.GetInbound.
+func (h *Handler) GetInbound() proxy.Inbound {
+	return h.server
+}
+
+func (h *Handler) serve(listener gonet.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, gonet.ErrClosed) {
+				return
+			}
+			newError("failed to accept connection").Base(err).AtWarning().WriteToLog()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go h.handle(conn)
+	}
+}
+
+func (h *Handler) handle(conn gonet.Conn) {
+	defer conn.Close()
+	gateway := net.AnyIP
+	if h.config.Listen != "" {
+		gateway = net.ParseAddress(h.config.Listen)
+	}
+	ctx := session.ContextWithID(context.Background(), session.NewID())
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{
+		Source:  net.DestinationFromAddr(conn.RemoteAddr()),
+		Gateway: net.TCPDestination(gateway, net.Port(h.config.Port)),
+		Tag:     h.config.Tag,
+		Conn:    conn,
+	})
+	if err := h.server.Process(ctx, net.Network_TCP, conn, h.dispatcher); err != nil {
+		newError("connection ends").Base(err).WriteToLog(session.ExportIDToError(ctx))
+	}
+}
+
+type user struct {
+	*protocol.MemoryUser
+	password string
+}
+
+// Server authenticates the clients by the user name and password of the HTTP
+// account of the users, and proxies their direct-tcpip channels
+type Server struct {
+	hostKey       ssh.Signer
+	sniffing      session.SniffingRequest
+	policyManager policy.Manager
+
+	access sync.RWMutex
+	users  map[string]*user  // Key: user name
+	names  map[string]string // Key: lower case email
+}
+
+// AddUser implements proxy.UserManager.AddUser().
+func (s *Server) AddUser(ctx context.Context, u *protocol.MemoryUser) error {
+	account, ok := u.Account.(*http.Account)
+	if !ok {
+		return newError("user ", u.Email, " has no user name and password")
+	}
+	email := strings.ToLower(u.Email)
+	s.access.Lock()
+	defer s.access.Unlock()
+	if _, found := s.names[email]; found {
+		return newError("User ", u.Email, " already exists.")
+	}
+	if _, found := s.users[account.Username]; found {
+		return newError("user name ", account.Username, " of user ", u.Email, " is taken")
+	}
+	s.users[account.Username] = &user{MemoryUser: u, password: account.Password}
+	s.names[email] = account.Username
+	return nil
+}
+
+// RemoveUser implements proxy.UserManager.RemoveUser().
+func (s *Server) RemoveUser(ctx context.Context, e string) error {
+	email := strings.ToLower(e)
+	s.access.Lock()
+	defer s.access.Unlock()
+	name, found := s.names[email]
+	if !found {
+		return newError("User ", e, " not found.")
+	}
+	delete(s.names, email)
+	delete(s.users, name)
+	return nil
+}
+
+// authenticate returns the user of the credentials, nil if they are wrong
+func (s *Server) authenticate(name, password string) *protocol.MemoryUser {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	u := s.users[name]
+	if u == nil || u.password != password {
+		return nil
+	}
+	return u.MemoryUser
+}
+
+// Network implements proxy.Inbound.Network().
+func (s *Server) Network() []net.Network {
+	return []net.Network{net.Network_TCP}
+}
+
+// Process implements proxy.Inbound.Process().
+func (s *Server) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	if err := conn.SetDeadline(time.Now().Add(s.policyManager.ForLevel(0).Timeouts.Handshake)); err != nil {
+		return newError("unable to set deadline").Base(err).AtWarning()
+	}
+	var u *protocol.MemoryUser
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if u = s.authenticate(meta.User(), string(password)); u == nil {
+				return nil, fmt.Errorf("invalid user %s", meta.User())
+			}
+			return nil, nil
+		},
+		MaxAuthTries: 3,
+	}
+	config.AddHostKey(s.hostKey)
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		if u == nil {
+			return s.reject(ctx, newError("SSH handshake failed").Base(err))
+		}
+		return newError("SSH handshake failed").Base(err)
+	}
+	defer serverConn.Close()
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return newError("unable to clear deadline").Base(err)
+	}
+	inbound := session.InboundFromContext(ctx)
+	inbound.Name = "ssh"
+	inbound.User = u
+	inbound.SetCanSpliceCopy(3)
+
+	// Remote forwards and the other global requests are refused
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "direct-tcpip":
+			go s.forward(ctx, u, newChannel, dispatcher)
+		case "session":
+			go s.session(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+	return nil
+}
+
+// reject logs the connection of ctx as rejected
+func (s *Server) reject(ctx context.Context, err error) error {
+	log.Record(&log.AccessMessage{
+		From:   session.InboundFromContext(ctx).Source,
+		To:     "",
+		Status: log.AccessRejected,
+		Reason: err,
+	})
+	return err
+}
+
+// directTCPIP is the payload of a direct-tcpip channel request, RFC 4254
+// section 7.2
+type directTCPIP struct {
+	Host           string
+	Port           uint32
+	OriginatorIP   string
+	OriginatorPort uint32
+}
+
+// forward proxies a direct-tcpip channel to its destination
+func (s *Server) forward(ctx context.Context, u *protocol.MemoryUser, newChannel ssh.NewChannel, dispatcher routing.Dispatcher) {
+	var request directTCPIP
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &request); err != nil || request.Port == 0 || request.Port > 65535 {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid destination")
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	destination := net.TCPDestination(net.ParseAddress(request.Host), net.Port(request.Port))
+	if err := s.proxy(ctx, u, destination, channel, dispatcher); err != nil {
+		newError("channel to ", destination, " ends").Base(err).WriteToLog(session.ExportIDToError(ctx))
+	}
+}
+
+// session serves a session channel, for the clients opening one anyway. A
+// shell only shows a message, the commands and the subsystems like SFTP are
+// refused.
+func (s *Server) session(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for request := range requests {
+		switch request.Type {
+		case "pty-req", "window-change":
+			request.Reply(true, nil)
+		case "shell":
+			request.Reply(true, nil)
+			channel.Write([]byte(shellMessage))
+			// The client may still forward connections until it leaves
+			go func() {
+				buf.Copy(buf.NewReader(channel), buf.Discard)
+				channel.Close()
+			}()
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+func (s *Server) proxy(ctx context.Context, u *protocol.MemoryUser, destination net.Destination, channel ssh.Channel, dispatcher routing.Dispatcher) error {
+	sessionPolicy := s.policyManager.ForLevel(u.Level)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := signal.CancelAfterInactivity(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle)
+	ctx = policy.ContextWithBufferPolicy(ctx, sessionPolicy.Buffer)
+	ctx = log.ContextWithAccessMessage(ctx, &log.AccessMessage{
+		From:   session.InboundFromContext(ctx).Source,
+		To:     destination,
+		Status: log.AccessAccepted,
+		Reason: "",
+		Email:  u.Email,
+	})
+	ctx = session.ContextWithContent(ctx, &session.Content{
+		SniffingRequest: s.sniffing,
+	})
+
+	newError("received request for ", destination).WriteToLog(session.ExportIDToError(ctx))
+	link, err := dispatcher.Dispatch(ctx, destination)
+	if err != nil {
+		return newError("failed to dispatch request to ", destination).Base(err)
+	}
+
+	requestDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.DownlinkOnly)
+		if err := buf.Copy(buf.NewReader(channel), link.Writer, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to transfer request").Base(err)
+		}
+		return nil
+	}
+
+	responseDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.UplinkOnly)
+		if err := buf.Copy(link.Reader, buf.NewWriter(channel), buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to write response").Base(err)
+		}
+		// Tell the client the destination is done sending
+		channel.CloseWrite()
+		return nil
+	}
+
+	requestDonePost := task.OnSuccess(requestDone, task.Close(link.Writer))
+	if err := task.Run(ctx, requestDonePost, responseDone); err != nil {
+		common.Must(common.Interrupt(link.Reader))
+		common.Must(common.Interrupt(link.Writer))
+		return newError("connection ends").Base(err)
+	}
+	return nil
+}
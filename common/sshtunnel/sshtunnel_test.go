@@ -0,0 +1,110 @@
+package sshtunnel_test
+
+import (
+	"context"
+	gonet "net"
+	"path/filepath"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/policy"
+	xhttp "github.com/xtls/xray-core/proxy/http"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/qtai2901/new_xrayr/common/sshtunnel"
+)
+
+// serve runs the server of a node with user alice on a local port, returning
+// its address
+func serve(t *testing.T) string {
+	hostKey, err := sshtunnel.LoadHostKey(filepath.Join(t.TempDir(), "host_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sshtunnel.NewHandler(&sshtunnel.Config{Tag: "ssh", HostKey: hostKey}, nil, policy.DefaultManager{})
+	server := h.GetInbound().(*sshtunnel.Server)
+	user := &protocol.MemoryUser{Email: "ssh|1@node|1", Account: &xhttp.Account{Username: "alice", Password: "secret"}}
+	if err := server.AddUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+				Source:  net.DestinationFromAddr(conn.RemoteAddr()),
+				Gateway: net.DestinationFromAddr(conn.LocalAddr()),
+				Tag:     "ssh",
+			})
+			go func() {
+				server.Process(ctx, net.Network_TCP, conn, nil)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func dial(address, password string) (*ssh.Client, error) {
+	return ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+}
+
+func TestRejectsWrongPassword(t *testing.T) {
+	address := serve(t)
+	if client, err := dial(address, "wrong"); err == nil {
+		client.Close()
+		t.Fatal("logged in with a wrong password")
+	}
+}
+
+func TestOnlyForwards(t *testing.T) {
+	client, err := dial(serve(t), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run("id"); err == nil {
+		t.Error("ran a command")
+	}
+	if listener, err := client.Listen("tcp", "127.0.0.1:0"); err == nil {
+		listener.Close()
+		t.Error("opened a remote forward")
+	}
+}
+
+func TestHostKeyIsKept(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "host_key")
+	first, err := sshtunnel.LoadHostKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sshtunnel.LoadHostKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(first.PublicKey()) != ssh.FingerprintSHA256(second.PublicKey()) {
+		t.Error("host key changed")
+	}
+	if _, err := sshtunnel.ParseHostKey("c2hvcnQ="); err == nil {
+		t.Error("parsed a short seed")
+	}
+}
@@ -0,0 +1,229 @@
+// Package telegram sends the alerts of XrayR to its admins through a Telegram
+// bot, and answers their commands
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAPIHost = "https://api.telegram.org"
+	pollTimeout    = 30 // Second, of the long polling of the updates
+	maxPending     = 64 // Alerts waiting to be sent, the newer ones are dropped
+	maxMessageLen  = 4096
+)
+
+type Config struct {
+	Enable   bool    `mapstructure:"Enable"`
+	BotToken string  `mapstructure:"BotToken"`
+	AdminIDs []int64 `mapstructure:"AdminIDs"` // Users getting the alerts, the only ones the commands are answered for
+	APIHost  string  `mapstructure:"APIHost"`  // Defaults to https://api.telegram.org
+}
+
+// Command answers a command with its arguments
+type Command func(args []string) string
+
+// Bot sends the alerts to the admins and answers their commands
+type Bot struct {
+	config   *Config
+	client   *http.Client
+	access   sync.Mutex
+	commands map[string]Command
+	alerts   chan string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func New(config *Config) (*Bot, error) {
+	if config.BotToken == "" {
+		return nil, errors.New("telegram needs a BotToken")
+	}
+	if len(config.AdminIDs) == 0 {
+		return nil, errors.New("telegram needs the AdminIDs")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Bot{
+		config:   config,
+		client:   &http.Client{Timeout: (pollTimeout + 10) * time.Second},
+		commands: make(map[string]Command),
+		alerts:   make(chan string, maxPending),
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// Handle answers /name with f
+func (b *Bot) Handle(name string, f Command) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	b.commands[name] = f
+}
+
+// Start sends the alerts and polls the commands until Close
+func (b *Bot) Start() {
+	b.wg.Add(2)
+	go b.sendAlerts()
+	go b.pollCommands()
+}
+
+func (b *Bot) Close() {
+	b.cancel()
+	b.wg.Wait()
+}
+
+// Notify sends text to the admins in the background. It never blocks, the
+// alert is dropped when too many are waiting.
+func (b *Bot) Notify(text string) {
+	select {
+	case b.alerts <- text:
+	default:
+		log.Warnf("Telegram alert dropped: %s", text)
+	}
+}
+
+func (b *Bot) sendAlerts() {
+	defer b.wg.Done()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case text := <-b.alerts:
+			for _, id := range b.config.AdminIDs {
+				if err := b.send(id, text); err != nil {
+					log.Errorf("Send telegram alert failed: %s", err)
+				}
+			}
+		}
+	}
+}
+
+type update struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		From *struct {
+			ID int64 `json:"id"`
+		} `json:"from"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+func (b *Bot) pollCommands() {
+	defer b.wg.Done()
+	var offset int64
+	for {
+		var updates []update
+		err := b.call("getUpdates", map[string]any{"offset": offset, "timeout": pollTimeout, "allowed_updates": []string{"message"}}, &updates)
+		if err != nil {
+			if b.ctx.Err() != nil {
+				return
+			}
+			log.Errorf("Get telegram updates failed: %s", err)
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			m := u.Message
+			if m == nil || m.From == nil || !slices.Contains(b.config.AdminIDs, m.From.ID) {
+				continue
+			}
+			if reply := b.answer(m.Text); reply != "" {
+				if err := b.send(m.Chat.ID, reply); err != nil {
+					log.Errorf("Send telegram reply failed: %s", err)
+				}
+			}
+		}
+	}
+}
+
+// answer returns the reply to a message, empty for the ones not a command
+func (b *Bot) answer(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return ""
+	}
+	// Like /status@XrayRBot in a group
+	name, _, _ := strings.Cut(strings.TrimPrefix(fields[0], "/"), "@")
+	b.access.Lock()
+	f, ok := b.commands[name]
+	names := make([]string, 0, len(b.commands))
+	for n := range b.commands {
+		names = append(names, "/"+n)
+	}
+	b.access.Unlock()
+	if !ok {
+		slices.Sort(names)
+		return "Unknown command, try " + strings.Join(names, ", ")
+	}
+	return f(fields[1:])
+}
+
+func (b *Bot) send(chatID int64, text string) error {
+	if len(text) > maxMessageLen {
+		text = text[:maxMessageLen-3] + "..."
+	}
+	return b.call("sendMessage", map[string]any{"chat_id": chatID, "text": text}, nil)
+}
+
+// call calls a method of the Bot API, decoding its result into result
+func (b *Bot) call(method string, params map[string]any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	host := b.config.APIHost
+	if host == "" {
+		host = defaultAPIHost
+	}
+	endpoint := fmt.Sprintf("%s/bot%s/%s", strings.TrimSuffix(host, "/"), b.config.BotToken, method)
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := b.client.Do(req)
+	if err != nil {
+		// The URL holds the token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer res.Body.Close()
+	var response struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%s: %s", method, err)
+	}
+	if !response.OK {
+		return fmt.Errorf("%s: %s", method, response.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package telegram_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/common/telegram"
+)
+
+// fakeAPI serves the updates once, and collects the messages sent
+type fakeAPI struct {
+	access  sync.Mutex
+	updates []map[string]any
+	sent    map[int64][]string
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var params map[string]any
+	json.NewDecoder(r.Body).Decode(&params)
+	f.access.Lock()
+	defer f.access.Unlock()
+	var result any = true
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/getUpdates"):
+		result, f.updates = f.updates, nil
+		if result == nil {
+			result = []any{}
+		}
+	case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+		id := int64(params["chat_id"].(float64))
+		f.sent[id] = append(f.sent[id], params["text"].(string))
+	}
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+}
+
+func (f *fakeAPI) messages(id int64) []string {
+	f.access.Lock()
+	defer f.access.Unlock()
+	return f.sent[id]
+}
+
+func message(updateID, from int64, text string) map[string]any {
+	return map[string]any{
+		"update_id": updateID,
+		"message":   map[string]any{"from": map[string]any{"id": from}, "chat": map[string]any{"id": from}, "text": text},
+	}
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 200 && !f(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !f() {
+		t.Fatal("timed out")
+	}
+}
+
+func TestCommandsFromAdminsOnly(t *testing.T) {
+	api := &fakeAPI{sent: make(map[int64][]string), updates: []map[string]any{
+		message(1, 42, "/status"),
+		message(2, 7, "/status"),
+		message(3, 42, "/online@XrayRBot 3"),
+		message(4, 42, "/nope"),
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	bot, err := telegram.New(&telegram.Config{BotToken: "token", AdminIDs: []int64{42}, APIHost: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.Handle("status", func([]string) string { return "ok" })
+	bot.Handle("online", func(args []string) string { return "online " + strings.Join(args, " ") })
+	bot.Start()
+	defer bot.Close()
+
+	waitFor(t, func() bool { return len(api.messages(42)) == 3 })
+	got := api.messages(42)
+	if got[0] != "ok" || got[1] != "online 3" || !strings.HasPrefix(got[2], "Unknown command") {
+		t.Errorf("replies %q", got)
+	}
+	if len(api.messages(7)) != 0 {
+		t.Error("answered a user not an admin")
+	}
+}
+
+func TestNotifyAdmins(t *testing.T) {
+	api := &fakeAPI{sent: make(map[int64][]string)}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	bot, err := telegram.New(&telegram.Config{BotToken: "token", AdminIDs: []int64{1, 2}, APIHost: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.Start()
+	defer bot.Close()
+	bot.Notify("node down")
+
+	waitFor(t, func() bool { return len(api.messages(1)) == 1 && len(api.messages(2)) == 1 })
+	if _, err := telegram.New(&telegram.Config{BotToken: "token"}); err == nil {
+		t.Error("created a bot without admins")
+	}
+}
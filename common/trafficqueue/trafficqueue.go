@@ -0,0 +1,287 @@
+// Package trafficqueue buffers user traffic that has not been accepted by the panel yet
+package trafficqueue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// Batch is a report handed to the panel. Once formed it is never changed,
+// so a retry after a timeout is sent with the same ID and content.
+type Batch struct {
+	ID      uint64
+	Traffic []api.UserTraffic
+}
+
+// state is what the queue keeps on disk
+type state struct {
+	Epoch    string
+	NextID   uint64
+	Inflight []Batch
+	Pending  []api.UserTraffic
+}
+
+// Queue aggregates unreported traffic by UID. When a path is given, the
+// pending traffic is written to disk on every change, so it survives restarts.
+type Queue struct {
+	path        string
+	access      sync.Mutex
+	epoch       string // Random per queue file, keeps the report keys unique when the file is lost
+	nextID      uint64
+	inflight    []Batch
+	pending     map[int]api.UserTraffic // Key: UID
+	maxUsers    int
+	maxBodySize int
+	flushing    sync.Mutex // Held by a flush, which only locks access between the reports
+}
+
+// New creates a queue backed by the file at path and restores any traffic
+// left from a previous run. An empty path keeps the queue in memory only.
+func New(path string) (*Queue, error) {
+	q := &Queue{
+		path:    path,
+		pending: make(map[int]api.UserTraffic),
+	}
+	if path == "" {
+		return q, q.newEpoch()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return q, q.newEpoch()
+		}
+		return nil, fmt.Errorf("read traffic queue %s failed: %s", path, err)
+	}
+	// Older versions saved the pending traffic only
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var saved []api.UserTraffic
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, fmt.Errorf("parse traffic queue %s failed: %s", path, err)
+		}
+		for _, t := range saved {
+			q.add(t)
+		}
+		return q, q.newEpoch()
+	}
+	var saved state
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse traffic queue %s failed: %s", path, err)
+	}
+	q.epoch, q.nextID, q.inflight = saved.Epoch, saved.NextID, saved.Inflight
+	for _, t := range saved.Pending {
+		q.add(t)
+	}
+	if q.epoch == "" {
+		return q, q.newEpoch()
+	}
+	return q, nil
+}
+
+func (q *Queue) newEpoch() error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	q.epoch = hex.EncodeToString(b)
+	return nil
+}
+
+func (q *Queue) add(t api.UserTraffic) {
+	if p, ok := q.pending[t.UID]; ok {
+		t.Upload += p.Upload
+		t.Download += p.Download
+	}
+	q.pending[t.UID] = t
+}
+
+// Push adds the traffic to the queue, merging it with any pending traffic
+// of the same user, and persists the result. Traffic already handed out in
+// a batch is never merged into.
+func (q *Queue) Push(userTraffic *[]api.UserTraffic) error {
+	q.access.Lock()
+	defer q.access.Unlock()
+
+	for _, t := range *userTraffic {
+		q.add(t)
+	}
+	return q.save()
+}
+
+// Key returns the idempotency key of the batch, unique across restarts
+func (q *Queue) Key(batch *Batch) string {
+	return fmt.Sprintf("%s-%d", q.epoch, batch.ID)
+}
+
+// SetBatchLimit caps every report handed out by Flush to at most maxUsers
+// users and roughly maxBodySize bytes of JSON. Zero disables a limit.
+func (q *Queue) SetBatchLimit(maxUsers, maxBodySize int) {
+	q.access.Lock()
+	defer q.access.Unlock()
+
+	q.maxUsers = maxUsers
+	q.maxBodySize = maxBodySize
+}
+
+// Flush hands the pending traffic to report, one batch at a time. Every
+// batch accepted by report is removed from the queue; on the first failure
+// the rest is kept for the next attempt. It returns the number of users reported.
+func (q *Queue) Flush(report func(userTraffic *[]api.UserTraffic) error) (int, error) {
+	return q.FlushWithKey(func(_ string, userTraffic *[]api.UserTraffic) error {
+		return report(userTraffic)
+	})
+}
+
+// FlushWithKey is Flush with the idempotency key of every batch passed to
+// report. The batches left from a failed attempt are sent first, unchanged
+// and under their old keys, so the panel can tell a retry from a new report.
+func (q *Queue) FlushWithKey(report func(key string, userTraffic *[]api.UserTraffic) error) (int, error) {
+	q.flushing.Lock()
+	defer q.flushing.Unlock()
+
+	// The batch IDs are persisted before anything is sent
+	q.access.Lock()
+	if len(q.pending) > 0 {
+		for _, traffic := range q.batches() {
+			q.nextID++
+			q.inflight = append(q.inflight, Batch{ID: q.nextID, Traffic: traffic})
+		}
+		q.pending = make(map[int]api.UserTraffic)
+		if err := q.save(); err != nil {
+			q.access.Unlock()
+			return 0, err
+		}
+	}
+	q.access.Unlock()
+
+	// A slow panel must not hold up Push and Traffic, the queue is not locked
+	// during a report. Only a flush removes the batches, the head is still
+	// the one reported when it is removed.
+	reported := 0
+	for {
+		q.access.Lock()
+		if len(q.inflight) == 0 {
+			q.access.Unlock()
+			return reported, nil
+		}
+		batch := q.inflight[0]
+		q.access.Unlock()
+		if err := report(q.Key(&batch), &batch.Traffic); err != nil {
+			return reported, err
+		}
+		q.access.Lock()
+		q.inflight = q.inflight[1:]
+		reported += len(batch.Traffic)
+		err := q.save()
+		q.access.Unlock()
+		if err != nil {
+			return reported, err
+		}
+	}
+}
+
+// batches splits the pending traffic by the batch limits. The body size of
+// a batch is estimated from the JSON encoding of api.UserTraffic, which is
+// larger than what any panel client sends, so the estimate stays on the safe side.
+func (q *Queue) batches() [][]api.UserTraffic {
+	var (
+		batches [][]api.UserTraffic
+		batch   []api.UserTraffic
+		size    int
+	)
+	for _, t := range q.list() {
+		entrySize := 0
+		if q.maxBodySize > 0 {
+			b, _ := json.Marshal(t)
+			entrySize = len(b) + 1
+		}
+		if len(batch) > 0 && ((q.maxUsers > 0 && len(batch) >= q.maxUsers) ||
+			(q.maxBodySize > 0 && size+entrySize > q.maxBodySize)) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, t)
+		size += entrySize
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// Len returns the number of unreported traffic entries, a user may have
+// one in a batch waiting for a retry and another one pending
+func (q *Queue) Len() int {
+	q.access.Lock()
+	defer q.access.Unlock()
+
+	n := len(q.pending)
+	for _, batch := range q.inflight {
+		n += len(batch.Traffic)
+	}
+	return n
+}
+
+// Traffic returns the unreported traffic by UID, upload and download added,
+// the batches waiting for a retry included
+func (q *Queue) Traffic() map[int]int64 {
+	q.access.Lock()
+	defer q.access.Unlock()
+
+	traffic := make(map[int]int64, len(q.pending))
+	for uid, t := range q.pending {
+		traffic[uid] += t.Upload + t.Download
+	}
+	for _, batch := range q.inflight {
+		for _, t := range batch.Traffic {
+			traffic[t.UID] += t.Upload + t.Download
+		}
+	}
+	return traffic
+}
+
+func (q *Queue) list() []api.UserTraffic {
+	userTraffic := make([]api.UserTraffic, 0, len(q.pending))
+	for _, t := range q.pending {
+		userTraffic = append(userTraffic, t)
+	}
+	sort.Slice(userTraffic, func(i, j int) bool { return userTraffic[i].UID < userTraffic[j].UID })
+	return userTraffic
+}
+
+// save writes the queue to a temp file and renames it over the old one, so
+// a crash never leaves a half written queue behind. The file is kept even
+// when empty, the next report ID must not start over.
+func (q *Queue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(&state{
+		Epoch:    q.epoch,
+		NextID:   q.nextID,
+		Inflight: q.inflight,
+		Pending:  q.list(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o755); err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
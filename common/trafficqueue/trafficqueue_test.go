@@ -0,0 +1,188 @@
+package trafficqueue_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/trafficqueue"
+)
+
+func TestQueueAggregateAndRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	q, err := trafficqueue.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(&[]api.UserTraffic{{UID: 1, Upload: 10, Download: 20}, {UID: 2, Upload: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(&[]api.UserTraffic{{UID: 1, Upload: 5, Download: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Panel is down, nothing must be lost
+	if _, err := q.Flush(func(*[]api.UserTraffic) error { return errors.New("panel down") }); err == nil {
+		t.Fatal("expected flush error")
+	}
+
+	// Simulate a restart
+	q, err = trafficqueue.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported []api.UserTraffic
+	n, err := q.Flush(func(userTraffic *[]api.UserTraffic) error {
+		reported = *userTraffic
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || reported[0].UID != 1 || reported[0].Upload != 15 || reported[0].Download != 25 {
+		t.Fatalf("unexpected report: %v", reported)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("queue should be empty, got %d", q.Len())
+	}
+}
+
+func TestQueueFlushInBatches(t *testing.T) {
+	q, err := trafficqueue.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.SetBatchLimit(2, 0)
+	if err := q.Push(&[]api.UserTraffic{{UID: 1}, {UID: 2}, {UID: 3}, {UID: 4}, {UID: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second batch fails, only the first one is removed from the queue
+	calls := 0
+	n, err := q.Flush(func(userTraffic *[]api.UserTraffic) error {
+		calls++
+		if len(*userTraffic) > 2 {
+			t.Fatalf("batch too large: %d", len(*userTraffic))
+		}
+		if calls == 2 {
+			return errors.New("timeout")
+		}
+		return nil
+	})
+	if err == nil || n != 2 || q.Len() != 3 {
+		t.Fatalf("unexpected flush result: n=%d len=%d err=%v", n, q.Len(), err)
+	}
+
+	n, err = q.Flush(func(*[]api.UserTraffic) error { return nil })
+	if err != nil || n != 3 || q.Len() != 0 {
+		t.Fatalf("unexpected flush result: n=%d len=%d err=%v", n, q.Len(), err)
+	}
+}
+
+func TestQueueRetryKeepsKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	q, err := trafficqueue.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(&[]api.UserTraffic{{UID: 1, Upload: 10}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The panel may have counted the report before the timeout
+	var firstKey string
+	if _, err := q.FlushWithKey(func(key string, _ *[]api.UserTraffic) error {
+		firstKey = key
+		return errors.New("timeout")
+	}); err == nil {
+		t.Fatal("expected flush error")
+	}
+
+	// Traffic pushed meanwhile must not change the batch being retried
+	if err := q.Push(&[]api.UserTraffic{{UID: 1, Upload: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	q, err = trafficqueue.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	var uploads []int64
+	if _, err := q.FlushWithKey(func(key string, userTraffic *[]api.UserTraffic) error {
+		keys = append(keys, key)
+		uploads = append(uploads, (*userTraffic)[0].Upload)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != firstKey || keys[1] == firstKey {
+		t.Fatalf("unexpected keys: first %s, retried %v", firstKey, keys)
+	}
+	if uploads[0] != 10 || uploads[1] != 5 {
+		t.Fatalf("unexpected uploads: %v", uploads)
+	}
+}
+
+func TestQueueTraffic(t *testing.T) {
+	q, err := trafficqueue.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(&[]api.UserTraffic{{UID: 1, Upload: 10, Download: 20}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.FlushWithKey(func(string, *[]api.UserTraffic) error { return errors.New("timeout") }); err == nil {
+		t.Fatal("expected flush error")
+	}
+	if err := q.Push(&[]api.UserTraffic{{UID: 1, Upload: 5}, {UID: 2, Download: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	// The batch waiting for a retry is not reported either
+	if traffic := q.Traffic(); len(traffic) != 2 || traffic[1] != 35 || traffic[2] != 7 {
+		t.Fatalf("unexpected traffic: %v", traffic)
+	}
+}
+
+func TestQueueNotLockedDuringReport(t *testing.T) {
+	q, err := trafficqueue.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(&[]api.UserTraffic{{UID: 1, Upload: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	reporting, release := make(chan struct{}), make(chan struct{})
+	flushed := make(chan error)
+	go func() {
+		_, err := q.FlushWithKey(func(string, *[]api.UserTraffic) error {
+			close(reporting)
+			<-release
+			return nil
+		})
+		flushed <- err
+	}()
+	<-reporting
+	// A stuck report must not block the queue
+	done := make(chan struct{})
+	go func() {
+		q.Push(&[]api.UserTraffic{{UID: 2, Download: 5}})
+		if traffic := q.Traffic(); traffic[1] != 10 || traffic[2] != 5 {
+			t.Errorf("unexpected traffic during a report: %v", traffic)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the queue is locked during a report")
+	}
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	if traffic := q.Traffic(); len(traffic) != 1 || traffic[2] != 5 {
+		t.Errorf("unexpected traffic after the report: %v", traffic)
+	}
+}
@@ -0,0 +1,200 @@
+// Package trafficsink appends the traffic of every report interval to local
+// files, for operators running their own billing or analytics
+package trafficsink
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+type Config struct {
+	Enable     bool   `mapstructure:"Enable"`
+	Format     string `mapstructure:"Format"`     // csv or jsonl
+	Path       string `mapstructure:"Path"`       // Directory of the files
+	MaxSize    int    `mapstructure:"MaxSize"`    // MB
+	MaxBackups int    `mapstructure:"MaxBackups"` // Rotated files kept, 0 keeps all
+}
+
+// Record is a line of the jsonl format, the csv columns follow the same order
+type Record struct {
+	Time     time.Time `json:"time"`
+	NodeType string    `json:"node_type"`
+	NodeID   int       `json:"node_id"`
+	UID      int       `json:"uid"`
+	Email    string    `json:"email"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+}
+
+var csvHeader = []string{"time", "node_type", "node_id", "uid", "email", "upload", "download"}
+
+// Sink is the usage file of a node. The file is renamed with a timestamp
+// suffix once it grows past MaxSize, and a new one is started.
+type Sink struct {
+	access   sync.Mutex
+	format   string
+	path     string
+	maxSize  int64
+	backups  int
+	nodeType string
+	nodeID   int
+	file     *os.File
+	size     int64
+}
+
+// New creates the sink of the node, the file is opened on the first write
+func New(config *Config, nodeType string, nodeID int) (*Sink, error) {
+	format := strings.ToLower(config.Format)
+	switch format {
+	case "":
+		format = "csv"
+	case "csv", "jsonl":
+	default:
+		return nil, fmt.Errorf("unsupported traffic sink format: %s", config.Format)
+	}
+	if config.Path == "" {
+		return nil, fmt.Errorf("traffic sink path is empty")
+	}
+	return &Sink{
+		format:   format,
+		path:     filepath.Join(config.Path, fmt.Sprintf("usage_%s_%d.%s", nodeType, nodeID, format)),
+		maxSize:  int64(config.MaxSize) * 1024 * 1024,
+		backups:  config.MaxBackups,
+		nodeType: nodeType,
+		nodeID:   nodeID,
+	}, nil
+}
+
+// Write appends a record for every user of userTraffic
+func (s *Sink) Write(at time.Time, userTraffic []api.UserTraffic) error {
+	if len(userTraffic) == 0 {
+		return nil
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+	var builder strings.Builder
+	if s.format == "csv" {
+		w := csv.NewWriter(&builder)
+		if s.size == 0 {
+			w.Write(csvHeader)
+		}
+		for _, t := range userTraffic {
+			w.Write([]string{
+				at.UTC().Format(time.RFC3339),
+				s.nodeType,
+				strconv.Itoa(s.nodeID),
+				strconv.Itoa(t.UID),
+				t.Email,
+				strconv.FormatInt(t.Upload, 10),
+				strconv.FormatInt(t.Download, 10),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	} else {
+		encoder := json.NewEncoder(&builder)
+		for _, t := range userTraffic {
+			if err := encoder.Encode(&Record{
+				Time:     at.UTC(),
+				NodeType: s.nodeType,
+				NodeID:   s.nodeID,
+				UID:      t.UID,
+				Email:    t.Email,
+				Upload:   t.Upload,
+				Download: t.Download,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	n, err := s.file.WriteString(builder.String())
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write traffic sink %s failed: %s", s.path, err)
+	}
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		return s.rotate(at)
+	}
+	return nil
+}
+
+func (s *Sink) open() error {
+	if s.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open traffic sink %s failed: %s", s.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the full file aside and removes the oldest rotated files
+// over MaxBackups
+func (s *Sink) rotate(at time.Time) error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file, s.size = nil, 0
+
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	if err := os.Rename(s.path, base+"-"+at.UTC().Format("20060102T150405")+ext); err != nil {
+		return fmt.Errorf("rotate traffic sink %s failed: %s", s.path, err)
+	}
+	if s.backups <= 0 {
+		return nil
+	}
+	rotated, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return err
+	}
+	// The timestamps sort by name
+	sort.Strings(rotated)
+	for len(rotated) > s.backups {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// Close closes the file, a later Write opens it again
+func (s *Sink) Close() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file, s.size = nil, 0
+	return err
+}
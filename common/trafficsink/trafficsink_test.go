@@ -0,0 +1,58 @@
+package trafficsink_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/trafficsink"
+)
+
+func TestSinkWriteAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := trafficsink.New(&trafficsink.Config{Path: dir, MaxBackups: 1}, "V2ray", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := sink.Write(at, []api.UserTraffic{{UID: 1, Email: "a@test", Upload: 10, Download: 20}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopened files are appended to, without a second header
+	if err := sink.Write(at, []api.UserTraffic{{UID: 2, Email: "b@test", Upload: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "usage_V2ray_1.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "time,node_type,node_id,uid,email,upload,download\n" +
+		"2024-01-02T03:04:05Z,V2ray,1,1,a@test,10,20\n" +
+		"2024-01-02T03:04:05Z,V2ray,1,2,b@test,1,0\n"
+	if string(data) != want {
+		t.Fatalf("unexpected file:\n%s", data)
+	}
+	sink.Close()
+
+	// Every write fills a file, only the newest rotated one is kept
+	sink, err = trafficsink.New(&trafficsink.Config{Format: "jsonl", Path: dir, MaxSize: 1, MaxBackups: 1}, "Trojan", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := strings.Repeat("a", 1024*1024)
+	for i := 0; i < 3; i++ {
+		if err := sink.Write(at.Add(time.Duration(i)*time.Second), []api.UserTraffic{{UID: i, Email: email}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, "usage_Trojan_2-*.jsonl"))
+	if len(rotated) != 1 || !strings.HasSuffix(rotated[0], "-20240102T030407.jsonl") {
+		t.Fatalf("unexpected rotated files: %v", rotated)
+	}
+}
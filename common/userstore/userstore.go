@@ -0,0 +1,163 @@
+// Package userstore keeps values of the users by UID, in shards with a lock
+// each. The links of the users look them up on every dispatch, and a shard
+// only blocks the users it holds, so they don't wait on each other nor on the
+// syncs writing the whole user list.
+package userstore
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of shards, a power of two
+const shardCount = 64
+
+type shard[V any] struct {
+	access sync.RWMutex
+	users  map[int]V
+}
+
+// Store is a map of the users by UID, safe for concurrent use. The zero value
+// is not usable, see New.
+type Store[V any] struct {
+	shards [shardCount]shard[V]
+}
+
+func New[V any]() *Store[V] {
+	s := new(Store[V])
+	for i := range s.shards {
+		s.shards[i].users = make(map[int]V)
+	}
+	return s
+}
+
+func (s *Store[V]) shard(uid int) *shard[V] {
+	return &s.shards[uint(uid)%shardCount]
+}
+
+// Load returns the value of the user, and whether there is one
+func (s *Store[V]) Load(uid int) (value V, ok bool) {
+	sh := s.shard(uid)
+	sh.access.RLock()
+	defer sh.access.RUnlock()
+	value, ok = sh.users[uid]
+	return value, ok
+}
+
+// Store sets the value of the user
+func (s *Store[V]) Store(uid int, value V) {
+	sh := s.shard(uid)
+	sh.access.Lock()
+	defer sh.access.Unlock()
+	sh.users[uid] = value
+}
+
+// LoadOrStore returns the value of the user if there is one, and sets it to
+// value otherwise. loaded reports whether it was there.
+func (s *Store[V]) LoadOrStore(uid int, value V) (actual V, loaded bool) {
+	sh := s.shard(uid)
+	sh.access.RLock()
+	actual, loaded = sh.users[uid]
+	sh.access.RUnlock()
+	if loaded {
+		return actual, true
+	}
+	sh.access.Lock()
+	defer sh.access.Unlock()
+	if actual, loaded = sh.users[uid]; loaded {
+		return actual, true
+	}
+	sh.users[uid] = value
+	return value, false
+}
+
+// Compute sets the value of the user to the one f returns for the current
+// one, ok reporting whether there is one, and returns it. The user is removed
+// if f returns false for keep. f runs under the lock of the shard, so it may
+// change the value it gets safely.
+func (s *Store[V]) Compute(uid int, f func(value V, ok bool) (newValue V, keep bool)) V {
+	sh := s.shard(uid)
+	sh.access.Lock()
+	defer sh.access.Unlock()
+	value, ok := sh.users[uid]
+	value, keep := f(value, ok)
+	if keep {
+		sh.users[uid] = value
+	} else {
+		delete(sh.users, uid)
+	}
+	return value
+}
+
+// LoadAndDelete removes the user, returning its value if there was one
+func (s *Store[V]) LoadAndDelete(uid int) (value V, loaded bool) {
+	sh := s.shard(uid)
+	sh.access.Lock()
+	defer sh.access.Unlock()
+	value, loaded = sh.users[uid]
+	delete(sh.users, uid)
+	return value, loaded
+}
+
+// Delete removes the user
+func (s *Store[V]) Delete(uid int) {
+	s.LoadAndDelete(uid)
+}
+
+// Range calls f for the users until it returns false, one shard at a time.
+// f runs under the lock of the shard, so it must not change the store, see
+// DeleteFunc, and has to be quick.
+func (s *Store[V]) Range(f func(uid int, value V) bool) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.access.RLock()
+		for uid, value := range sh.users {
+			if !f(uid, value) {
+				sh.access.RUnlock()
+				return
+			}
+		}
+		sh.access.RUnlock()
+	}
+}
+
+// DeleteFunc removes the users f returns true for
+func (s *Store[V]) DeleteFunc(f func(uid int, value V) bool) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.access.Lock()
+		for uid, value := range sh.users {
+			if f(uid, value) {
+				delete(sh.users, uid)
+			}
+		}
+		sh.access.Unlock()
+	}
+}
+
+// Len returns the number of users
+func (s *Store[V]) Len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.access.RLock()
+		n += len(sh.users)
+		sh.access.RUnlock()
+	}
+	return n
+}
+
+// UID returns the UID of the user known by email in the core, the number after
+// its last |, like in InboundTag|uid@node|uid
+func UID(email string) (int, bool) {
+	i := strings.LastIndexByte(email, '|')
+	if i < 0 {
+		return 0, false
+	}
+	uid, err := strconv.Atoi(email[i+1:])
+	if err != nil {
+		return 0, false
+	}
+	return uid, true
+}
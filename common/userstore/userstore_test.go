@@ -0,0 +1,62 @@
+package userstore_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/userstore"
+)
+
+func TestStore(t *testing.T) {
+	s := userstore.New[string]()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for uid := i; uid < 1000; uid += 8 {
+				s.Store(uid, "user")
+				if _, ok := s.Load(uid); !ok {
+					t.Errorf("user %d not stored", uid)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := s.Len(); n != 1000 {
+		t.Fatalf("%d users, want 1000", n)
+	}
+	if v, loaded := s.LoadOrStore(1, "other"); !loaded || v != "user" {
+		t.Errorf("LoadOrStore of a user gave %q, %v", v, loaded)
+	}
+	s.DeleteFunc(func(uid int, _ string) bool { return uid >= 10 })
+	if n := s.Len(); n != 10 {
+		t.Fatalf("%d users after DeleteFunc, want 10", n)
+	}
+	if v := s.Compute(2, func(v string, ok bool) (string, bool) { return v + "s", ok }); v != "users" {
+		t.Errorf("Compute gave %q", v)
+	}
+	s.Compute(3, func(v string, ok bool) (string, bool) { return v, false })
+	if _, ok := s.Load(3); ok {
+		t.Error("user 3 not removed by Compute")
+	}
+	if _, loaded := s.LoadAndDelete(5); !loaded {
+		t.Error("user 5 not deleted")
+	}
+	if _, ok := s.Load(5); ok {
+		t.Error("user 5 still there")
+	}
+}
+
+func TestUID(t *testing.T) {
+	for email, want := range map[string]int{
+		"V2ray_443|12@node|12": 12,
+		"tag|uid@node|x":       -1,
+		"no separator":         -1,
+	} {
+		uid, ok := userstore.UID(email)
+		if (want < 0 && ok) || (want >= 0 && (!ok || uid != want)) {
+			t.Errorf("UID(%q) = %d, %v, want %d", email, uid, ok, want)
+		}
+	}
+}
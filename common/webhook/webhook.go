@@ -0,0 +1,368 @@
+// Package webhook posts the lifecycle events and the alerts of XrayR to a URL,
+// as signed JSON so the operators can wire their own alerting, or as the
+// messages of a Discord or Slack incoming webhook
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The events posted
+const (
+	NodeStarted     = "node_started"
+	NodeStopped     = "node_stopped"
+	NodeStartFailed = "node_start_failed" // The first failed start of a node, it is retried
+	NodeRecovered   = "node_recovered"    // A node started after failing
+	NodeMaintenance = "node_maintenance"  // A node drained for a maintenance, stopped once its connections are closed
+	SyncFailed      = "sync_failed"       // The panel failed the node info or user list fetches in a row
+	SyncRecovered   = "sync_recovered"    // The panel answered again after a sync_failed
+	CertRenewed     = "cert_renewed"      // A certificate was obtained again from the CA
+	CertRenewFailed = "cert_renew_failed"
+	CertExpiring    = "cert_expiring" // A certificate expires in less than a week
+	DeviceLimit     = "device_limit"  // Connections of a user were rejected by its device limit
+	DiskFull        = "disk_full"     // A disk XrayR writes to is nearly full
+	DiskRecovered   = "disk_recovered"
+)
+
+// The formats of the body
+const (
+	FormatJSON    = "json"    // The Event, signed
+	FormatDiscord = "discord" // The message of a Discord incoming webhook
+	FormatSlack   = "slack"   // The message of a Slack incoming webhook
+)
+
+// Default Template of the messages, by format
+var defaultTemplates = map[string]string{
+	FormatDiscord: "{{.Severity.Icon}} **{{.Event}}**{{with .Node}} {{.}}{{end}}: {{.Text}}",
+	FormatSlack:   "{{.Severity.Icon}} *{{.Event}}*{{with .Node}} {{.}}{{end}}: {{.Text}}",
+}
+
+// Max length of a Discord message, in characters
+const discordMaxContent = 2000
+
+const (
+	maxPending = 256 // Events waiting to be posted, the newer ones are dropped
+	maxRetries = 3
+	// Time Close waits for the pending events to be posted
+	closeTimeout = 5 * time.Second
+)
+
+// Severity of an event. The posts of a webhook can be limited to the events
+// of a severity and above.
+type Severity int
+
+const (
+	Info Severity = iota
+	Warning
+	Error
+)
+
+// Default severity of the events, Info for the ones not listed
+var defaultSeverities = map[string]Severity{
+	NodeStartFailed: Error,
+	SyncFailed:      Error,
+	CertRenewFailed: Error,
+	CertExpiring:    Warning,
+	DiskFull:        Warning,
+}
+
+var severityNames = [...]string{Info: "info", Warning: "warning", Error: "error"}
+
+func ParseSeverity(s string) (Severity, error) {
+	for i, name := range severityNames {
+		if strings.EqualFold(s, name) {
+			return Severity(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown severity %q", s)
+}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return strconv.Itoa(int(s))
+	}
+	return severityNames[s]
+}
+
+// Icon returns an emoji of the severity, for the messages
+func (s Severity) Icon() string {
+	switch s {
+	case Error:
+		return "\U0001F6A8"
+	case Warning:
+		return "\u26A0\uFE0F"
+	default:
+		return "\u2139\uFE0F"
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(text []byte) error {
+	severity, err := ParseSeverity(string(text))
+	if err != nil {
+		return err
+	}
+	*s = severity
+	return nil
+}
+
+type Config struct {
+	Enable     bool              `mapstructure:"Enable"`
+	URL        string            `mapstructure:"URL"`
+	Format     string            `mapstructure:"Format"`     // json, discord or slack, json if empty
+	Template   string            `mapstructure:"Template"`   // Go template of the discord and slack messages, executed on the Event
+	Secret     string            `mapstructure:"Secret"`     // Key of the HMAC-SHA256 signature of the body, in the X-XrayR-Signature header
+	Events     []string          `mapstructure:"Events"`     // Events posted, all of them if empty
+	Severity   string            `mapstructure:"Severity"`   // Lowest severity posted, info if empty
+	Severities map[string]string `mapstructure:"Severities"` // Severity of the events by name, over the defaults
+	Timeout    int               `mapstructure:"Timeout"`    // Second
+}
+
+// Node is the node an event is about
+type Node struct {
+	APIHost  string `json:"api_host"`
+	NodeID   int    `json:"node_id"`
+	NodeType string `json:"node_type"`
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("%s(ID=%d) of %s", n.NodeType, n.NodeID, n.APIHost)
+}
+
+// Event is the body of a post in the json format
+type Event struct {
+	Event    string    `json:"event"`
+	Severity Severity  `json:"severity"`
+	Time     time.Time `json:"time"`
+	Node     *Node     `json:"node,omitempty"`
+	Text     string    `json:"text,omitempty"` // What happened, for humans
+	Data     any       `json:"data,omitempty"`
+}
+
+// Sender posts the events in the order they are sent, retrying the failed
+// posts a few times
+type Sender struct {
+	config     *Config
+	template   *template.Template // nil for the json format
+	severity   Severity
+	severities map[string]Severity
+	client     *http.Client
+	events     chan Event
+	closing    chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+func New(config *Config) (*Sender, error) {
+	if config.URL == "" {
+		return nil, errors.New("webhook URL is empty")
+	}
+	var tmpl *template.Template
+	switch config.Format {
+	case "", FormatJSON:
+	case FormatDiscord, FormatSlack:
+		text := config.Template
+		if text == "" {
+			text = defaultTemplates[config.Format]
+		}
+		var err error
+		if tmpl, err = template.New(config.Format).Parse(text); err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q", config.Format)
+	}
+	var severity Severity
+	if config.Severity != "" {
+		var err error
+		if severity, err = ParseSeverity(config.Severity); err != nil {
+			return nil, err
+		}
+	}
+	severities := make(map[string]Severity, len(config.Severities))
+	for event, name := range config.Severities {
+		s, err := ParseSeverity(name)
+		if err != nil {
+			return nil, fmt.Errorf("severity of %s: %w", event, err)
+		}
+		severities[event] = s
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Sender{
+		config:     config,
+		template:   tmpl,
+		severity:   severity,
+		severities: severities,
+		client:     &http.Client{Timeout: timeout},
+		events:     make(chan Event, maxPending),
+		closing:    make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// Close posts the pending events, dropping the ones left after a few
+// seconds, and stops
+func (s *Sender) Close() {
+	close(s.closing)
+	timer := time.AfterFunc(closeTimeout, s.cancel)
+	s.wg.Wait()
+	timer.Stop()
+	s.cancel()
+}
+
+// Send posts the event in the background, if it is in Events and of Severity
+// at least. It never blocks, the event is dropped when too many are waiting.
+func (s *Sender) Send(event string, node *Node, text string, data any) {
+	if len(s.config.Events) > 0 && !slices.Contains(s.config.Events, event) {
+		return
+	}
+	severity := s.severityOf(event)
+	if severity < s.severity {
+		return
+	}
+	select {
+	case s.events <- Event{Event: event, Severity: severity, Time: time.Now(), Node: node, Text: text, Data: data}:
+	default:
+		log.Warnf("Webhook event %s dropped", event)
+	}
+}
+
+func (s *Sender) severityOf(event string) Severity {
+	if severity, ok := s.severities[event]; ok {
+		return severity
+	}
+	return defaultSeverities[event]
+}
+
+func (s *Sender) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.closing:
+			for {
+				select {
+				case e := <-s.events:
+					s.post(e)
+				default:
+					return
+				}
+			}
+		case e := <-s.events:
+			s.post(e)
+		}
+	}
+}
+
+func (s *Sender) post(e Event) {
+	if err := s.postWithRetry(e); err != nil {
+		log.Errorf("Post webhook event %s failed: %s", e.Event, err)
+	}
+}
+
+func (s *Sender) postWithRetry(e Event) error {
+	body, err := s.body(e)
+	if err != nil {
+		return err
+	}
+	delay := time.Second
+	for i := 0; ; i++ {
+		err = s.postOnce(e, body)
+		if err == nil || i == maxRetries-1 {
+			return err
+		}
+		select {
+		case <-s.ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (s *Sender) postOnce(e Event, body []byte) error {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-XrayR-Event", e.Event)
+	req.Header.Set("X-XrayR-Timestamp", strconv.FormatInt(e.Time.Unix(), 10))
+	if s.config.Secret != "" {
+		req.Header.Set("X-XrayR-Signature", Sign(s.config.Secret, body))
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
+
+// body returns the body of the post of the event in the format of the webhook
+func (s *Sender) body(e Event) ([]byte, error) {
+	if s.template == nil {
+		return json.Marshal(e)
+	}
+	var b strings.Builder
+	if err := s.template.Execute(&b, e); err != nil {
+		log.Errorf("Webhook template failed on %s: %s", e.Event, err)
+		b.Reset()
+		b.WriteString(e.Event + ": " + e.Text)
+	}
+	message := b.String()
+	if s.config.Format == FormatDiscord {
+		return json.Marshal(map[string]string{"content": truncate(message, discordMaxContent)})
+	}
+	return json.Marshal(map[string]string{"text": message})
+}
+
+// truncate cuts s to at most n characters, ending it with an ellipsis if cut
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:n-1]) + "\u2026"
+}
+
+// Sign returns the signature of the body with secret, as sent in the
+// X-XrayR-Signature header: sha256= followed by the HMAC-SHA256 in hex
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
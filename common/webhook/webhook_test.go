@@ -0,0 +1,127 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/common/webhook"
+)
+
+func TestSignedPost(t *testing.T) {
+	received := make(chan webhook.Event, 2)
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got := r.Header.Get("X-XrayR-Signature"); got != webhook.Sign("secret", body) {
+			t.Errorf("signature %q", got)
+		}
+		// The first post fails and is retried
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var e webhook.Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer server.Close()
+
+	s, err := webhook.New(&webhook.Config{URL: server.URL, Secret: "secret", Events: []string{webhook.NodeStarted}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Send(webhook.SyncFailed, nil, "", nil)
+	s.Send(webhook.NodeStarted, &webhook.Node{NodeID: 1, NodeType: "V2ray"}, "Started", map[string]string{"tag": "V2ray_1"})
+
+	select {
+	case e := <-received:
+		if e.Event != webhook.NodeStarted || e.Node == nil || e.Node.NodeID != 1 {
+			t.Errorf("event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event posted")
+	}
+	select {
+	case e := <-received:
+		t.Errorf("posted %s, not in Events", e.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClosePostsPending(t *testing.T) {
+	received := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-XrayR-Event")
+	}))
+	defer server.Close()
+
+	s, err := webhook.New(&webhook.Config{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(webhook.NodeStopped, nil, "", nil)
+	s.Send(webhook.NodeStopped, nil, "", nil)
+	s.Close()
+	if len(received) != 2 {
+		t.Errorf("posted %d events before closing, want 2", len(received))
+	}
+}
+
+func TestDiscordSeverity(t *testing.T) {
+	received := make(chan map[string]string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			t.Error(err)
+		}
+		received <- message
+	}))
+	defer server.Close()
+
+	s, err := webhook.New(&webhook.Config{
+		URL:        server.URL,
+		Format:     webhook.FormatDiscord,
+		Severity:   "warning",
+		Severities: map[string]string{webhook.DeviceLimit: "error"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &webhook.Node{APIHost: "https://panel", NodeID: 1, NodeType: "V2ray"}
+	s.Send(webhook.NodeStarted, node, "Started", nil)
+	s.Send(webhook.SyncFailed, node, "Panel unreachable", nil)
+	s.Send(webhook.DeviceLimit, nil, "User 2 rejected", nil)
+	s.Close()
+
+	if len(received) != 2 {
+		t.Fatalf("posted %d messages, want 2", len(received))
+	}
+	want := "\U0001F6A8 **sync_failed** V2ray(ID=1) of https://panel: Panel unreachable"
+	if got := (<-received)["content"]; got != want {
+		t.Errorf("content %q, want %q", got, want)
+	}
+	if got := (<-received)["content"]; got != "\U0001F6A8 **device_limit**: User 2 rejected" {
+		t.Errorf("content %q", got)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, c := range []*webhook.Config{
+		{URL: "http://localhost", Format: "teams"},
+		{URL: "http://localhost", Format: webhook.FormatSlack, Template: "{{.Event"},
+		{URL: "http://localhost", Severity: "fatal"},
+	} {
+		if s, err := webhook.New(c); err == nil {
+			s.Close()
+			t.Errorf("accepted %+v", c)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package wireguard
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/netip"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// DefaultNetwork is the network the tunnel addresses are taken from, the
+// first one for the node and the next ones for the users by their UID
+const DefaultNetwork = "10.0.0.0/8"
+
+// Key is a Curve25519 key, written in base64 like by the wg tool
+type Key [32]byte
+
+func ParseKey(s string) (Key, error) {
+	var k Key
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != len(k) {
+		return k, newError("invalid key: ", s)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// DerivePrivateKey returns the private key of a user the panel gives no
+// public key of: the SHA-256 of its UUID, clamped. Subscriptions can derive
+// the same one for the configs of the clients.
+func DerivePrivateKey(uuid string) Key {
+	k := Key(sha256.Sum256([]byte(uuid)))
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+	return k
+}
+
+// PublicKey returns the public key of the private key
+func (k Key) PublicKey() Key {
+	var public Key
+	b, _ := curve25519.X25519(k[:], curve25519.Basepoint)
+	copy(public[:], b)
+	return public
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// hex returns the key the way the configuration protocol of wireguard-go
+// writes it
+func (k Key) hex() string {
+	return hex.EncodeToString(k[:])
+}
+
+// ParseNetwork parses the network of the tunnel addresses, DefaultNetwork if
+// empty
+func ParseNetwork(s string) (netip.Prefix, error) {
+	if s == "" {
+		s = DefaultNetwork
+	}
+	network, err := netip.ParsePrefix(s)
+	if err != nil {
+		return network, newError("invalid network: ", s).Base(err)
+	}
+	return network.Masked(), nil
+}
+
+// ServerAddress returns the tunnel address of the node in the network
+func ServerAddress(network netip.Prefix) (netip.Addr, error) {
+	return nthAddress(network, 1)
+}
+
+// PeerAddress returns the tunnel address of the user of the UID in the
+// network, so a client config keeps working as long as its user exists
+func PeerAddress(network netip.Prefix, uid int) (netip.Addr, error) {
+	if uid < 1 {
+		return netip.Addr{}, newError("invalid UID ", uid)
+	}
+	return nthAddress(network, uint64(uid)+1)
+}
+
+// nthAddress returns the nth address of the network, neither the network
+// address nor the IPv4 broadcast one
+func nthAddress(network netip.Prefix, n uint64) (netip.Addr, error) {
+	b := network.Addr().AsSlice()
+	carry := n
+	for i := len(b) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(b[i]) + carry&0xff
+		b[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	if carry > 0 || !network.Contains(addr) || (addr.Is4() && !network.Contains(addr.Next())) {
+		return netip.Addr{}, newError("network ", network, " has no address ", n)
+	}
+	return addr, nil
+}
@@ -0,0 +1,61 @@
+package wireguard_test
+
+import (
+	"testing"
+
+	"github.com/qtai2901/new_xrayr/common/wireguard"
+)
+
+func TestDeriveKeys(t *testing.T) {
+	privateKey := wireguard.DerivePrivateKey("b831381d-6324-4d53-ad4f-8cda48b30811")
+	if privateKey != wireguard.DerivePrivateKey("b831381d-6324-4d53-ad4f-8cda48b30811") {
+		t.Error("the derived keys should not change")
+	}
+	if privateKey[0]&7 != 0 || privateKey[31]&192 != 64 {
+		t.Error("the derived key should be clamped")
+	}
+	publicKey, err := wireguard.ParseKey(privateKey.PublicKey().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicKey != privateKey.PublicKey() {
+		t.Error("the public key should parse back")
+	}
+	if _, err := wireguard.ParseKey("c2hvcnQ="); err == nil {
+		t.Error("a short key should fail")
+	}
+}
+
+func TestPeerAddress(t *testing.T) {
+	network, err := wireguard.ParseNetwork("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server, _ := wireguard.ServerAddress(network); server.String() != "10.0.0.1" {
+		t.Errorf("server address %s, want 10.0.0.1", server)
+	}
+	for uid, want := range map[int]string{1: "10.0.0.2", 254: "10.0.0.255", 255: "10.0.1.0", 70000: "10.1.17.113"} {
+		if addr, err := wireguard.PeerAddress(network, uid); err != nil || addr.String() != want {
+			t.Errorf("address of UID %d: %s %v, want %s", uid, addr, err, want)
+		}
+	}
+
+	small, err := wireguard.ParseNetwork("192.168.7.9/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, err := wireguard.PeerAddress(small, 5); err != nil || addr.String() != "192.168.7.14" {
+		t.Errorf("address of UID 5: %s %v, want 192.168.7.14", addr, err)
+	}
+	if _, err := wireguard.PeerAddress(small, 6); err == nil {
+		t.Error("the broadcast address should not be given")
+	}
+
+	v6, err := wireguard.ParseNetwork("fd00::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, err := wireguard.PeerAddress(v6, 65535); err != nil || addr.String() != "fd00::1:0" {
+		t.Errorf("address of UID 65535: %s %v, want fd00::1:0", addr, err)
+	}
+}
@@ -0,0 +1,336 @@
+// Package wireguard serves the users of a node as the peers of a WireGuard
+// interface. Each user has its own tunnel address, the only one its peer is
+// allowed to send from, so the connections coming out of the tunnel are
+// dispatched as the ones of their user.
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/http"
+	"github.com/xtls/xray-core/proxy/wireguard/gvisortun"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const DefaultMTU = 1420
+
+type Config struct {
+	Tag        string
+	Port       uint32 // UDP port, listened on every address
+	PrivateKey string // Of the node, in base64
+	Network    string // Of the tunnel addresses, DefaultNetwork if empty
+	MTU        int    // DefaultMTU if 0
+	Sniffing   session.SniffingRequest
+}
+
+// Handler is the inbound.Handler of the WireGuard interface of a node
+type Handler struct {
+	config *Config
+	server *Server
+	device *device.Device
+}
+
+func NewHandler(config *Config, dispatcher routing.Dispatcher, policyManager policy.Manager) (*Handler, error) {
+	privateKey, err := ParseKey(config.PrivateKey)
+	if err != nil {
+		return nil, newError("invalid private key of the node").Base(err)
+	}
+	network, err := ParseNetwork(config.Network)
+	if err != nil {
+		return nil, err
+	}
+	address, err := ServerAddress(network)
+	if err != nil {
+		return nil, err
+	}
+	mtu := config.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	tun, _, st, err := gvisortun.CreateNetTUN([]netip.Addr{address}, mtu, true)
+	if err != nil {
+		return nil, newError("failed to create the tunnel").Base(err)
+	}
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			newError(fmt.Sprintf(format, args...)).AtDebug().WriteToLog()
+		},
+		Errorf: func(format string, args ...any) {
+			newError(fmt.Sprintf(format, args...)).AtError().WriteToLog()
+		},
+	})
+	if err := dev.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%d\n", privateKey.hex(), config.Port)); err != nil {
+		dev.Close()
+		return nil, newError("failed to configure the device").Base(err)
+	}
+	server := &Server{
+		tag:           config.Tag,
+		gateway:       net.UDPDestination(net.AnyIP, net.Port(config.Port)),
+		sniffing:      config.Sniffing,
+		network:       network,
+		device:        dev,
+		dispatcher:    dispatcher,
+		policyManager: policyManager,
+		users:         make(map[netip.Addr]*protocol.MemoryUser),
+		peers:         make(map[string]peer),
+	}
+	server.forward(st)
+	return &Handler{config: config, server: server, device: dev}, nil
+}
+
+// Start implements common.Runnable.
+func (h *Handler) Start() error {
+	if err := h.device.Up(); err != nil {
+		return newError("failed to listen on port ", h.config.Port).Base(err)
+	}
+	return nil
+}
+
+// Close implements common.Closable. The tunnel and its connections are
+// closed too.
+func (h *Handler) Close() error {
+	h.device.Close()
+	return nil
+}
+
+// Tag implements inbound.Handler.
+func (h *Handler) Tag() string {
+	return h.config.Tag
+}
+
+// GetRandomInboundProxy implements inbound.Handler.
+func (h *Handler) GetRandomInboundProxy() (interface{}, net.Port, int) {
+	return h.server, net.Port(h.config.Port), 9999
+}
+
+// GetInbound implements proxy.GetInbound.
+func (h *Handler) GetInbound() proxy.Inbound {
+	return h.server
+}
+
+type peer struct {
+	publicKey Key
+	address   netip.Addr
+}
+
+// Server keeps a peer of the interface for each user, with the public key and
+// the tunnel address of its HTTP account as user name and password, and
+// dispatches the connections of the peers
+type Server struct {
+	tag           string
+	gateway       net.Destination
+	sniffing      session.SniffingRequest
+	network       netip.Prefix
+	device        *device.Device
+	dispatcher    routing.Dispatcher
+	policyManager policy.Manager
+
+	access sync.RWMutex
+	users  map[netip.Addr]*protocol.MemoryUser
+	peers  map[string]peer // Key: lower case email
+}
+
+// AddUser implements proxy.UserManager.AddUser().
+func (s *Server) AddUser(ctx context.Context, u *protocol.MemoryUser) error {
+	account, ok := u.Account.(*http.Account)
+	if !ok {
+		return newError("user ", u.Email, " has no public key and address")
+	}
+	publicKey, err := ParseKey(account.Username)
+	if err != nil {
+		return newError("invalid public key of user ", u.Email).Base(err)
+	}
+	address, err := netip.ParseAddr(account.Password)
+	if err != nil || !s.network.Contains(address) {
+		return newError("address ", account.Password, " of user ", u.Email, " is not in network ", s.network)
+	}
+	email := strings.ToLower(u.Email)
+	s.access.Lock()
+	defer s.access.Unlock()
+	if _, found := s.peers[email]; found {
+		return newError("User ", u.Email, " already exists.")
+	}
+	if _, found := s.users[address]; found {
+		return newError("address ", address, " of user ", u.Email, " is taken")
+	}
+	if err := s.device.IpcSet(fmt.Sprintf("public_key=%s\nreplace_allowed_ips=true\nallowed_ip=%s\n",
+		publicKey.hex(), netip.PrefixFrom(address, address.BitLen()))); err != nil {
+		return newError("failed to add the peer of user ", u.Email).Base(err)
+	}
+	s.users[address] = u
+	s.peers[email] = peer{publicKey: publicKey, address: address}
+	return nil
+}
+
+// RemoveUser implements proxy.UserManager.RemoveUser().
+func (s *Server) RemoveUser(ctx context.Context, e string) error {
+	email := strings.ToLower(e)
+	s.access.Lock()
+	defer s.access.Unlock()
+	p, found := s.peers[email]
+	if !found {
+		return newError("User ", e, " not found.")
+	}
+	if err := s.device.IpcSet(fmt.Sprintf("public_key=%s\nremove=true\n", p.publicKey.hex())); err != nil {
+		return newError("failed to remove the peer of user ", e).Base(err)
+	}
+	delete(s.peers, email)
+	delete(s.users, p.address)
+	return nil
+}
+
+func (s *Server) getUser(address tcpip.Address) *protocol.MemoryUser {
+	addr, _ := netip.AddrFromSlice(address.AsSlice())
+	s.access.RLock()
+	defer s.access.RUnlock()
+	return s.users[addr]
+}
+
+// Network implements proxy.Inbound.Network().
+func (s *Server) Network() []net.Network {
+	return []net.Network{net.Network_UDP}
+}
+
+// Process implements proxy.Inbound.Process(). The packets are received by
+// the device of the Handler, not by Xray.
+func (s *Server) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	return newError("wireguard packets are received by its own handler")
+}
+
+// forward makes the stack of the tunnel accept the connections to every
+// destination, serving them as the ones of the user of their source
+func (s *Server) forward(st *stack.Stack) {
+	tcpForwarder := tcp.NewForwarder(st, 0, 65535, func(r *tcp.ForwarderRequest) {
+		go func() {
+			id := r.ID()
+			user := s.getUser(id.RemoteAddress)
+			if user == nil {
+				r.Complete(true)
+				return
+			}
+			var wq waiter.Queue
+			ep, err := r.CreateEndpoint(&wq)
+			if err != nil {
+				newError(err.String()).AtWarning().WriteToLog()
+				r.Complete(true)
+				return
+			}
+			r.Complete(false)
+			ep.SocketOptions().SetKeepAlive(true)
+			conn := gonet.NewTCPConn(&wq, ep)
+			defer conn.Close()
+			s.serve(user,
+				net.TCPDestination(net.IPAddress(id.RemoteAddress.AsSlice()), net.Port(id.RemotePort)),
+				net.TCPDestination(net.IPAddress(id.LocalAddress.AsSlice()), net.Port(id.LocalPort)),
+				buf.NewReader(conn), buf.NewWriter(conn))
+		}()
+	})
+	st.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(st, func(r *udp.ForwarderRequest) {
+		go func() {
+			id := r.ID()
+			user := s.getUser(id.RemoteAddress)
+			if user == nil {
+				return
+			}
+			var wq waiter.Queue
+			ep, err := r.CreateEndpoint(&wq)
+			if err != nil {
+				newError(err.String()).AtWarning().WriteToLog()
+				return
+			}
+			conn := gonet.NewUDPConn(st, &wq, ep)
+			defer conn.Close()
+			s.serve(user,
+				net.UDPDestination(net.IPAddress(id.RemoteAddress.AsSlice()), net.Port(id.RemotePort)),
+				net.UDPDestination(net.IPAddress(id.LocalAddress.AsSlice()), net.Port(id.LocalPort)),
+				buf.NewReader(conn), buf.NewWriter(conn))
+		}()
+	})
+	st.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+}
+
+func (s *Server) serve(user *protocol.MemoryUser, source, destination net.Destination, clientReader buf.Reader, clientWriter buf.Writer) {
+	ctx := session.ContextWithID(context.Background(), session.NewID())
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{
+		Source:  source,
+		Gateway: s.gateway,
+		Tag:     s.tag,
+		Name:    "wireguard",
+		User:    user,
+	})
+	ctx = session.ContextWithContent(ctx, &session.Content{
+		SniffingRequest: s.sniffing,
+	})
+	if err := s.proxy(ctx, user, destination, clientReader, clientWriter); err != nil {
+		newError("connection ends").Base(err).WriteToLog(session.ExportIDToError(ctx))
+	}
+}
+
+func (s *Server) proxy(ctx context.Context, user *protocol.MemoryUser, destination net.Destination, clientReader buf.Reader, clientWriter buf.Writer) error {
+	sessionPolicy := s.policyManager.ForLevel(user.Level)
+	ctx, cancel := context.WithCancel(ctx)
+	timer := signal.CancelAfterInactivity(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle)
+	ctx = policy.ContextWithBufferPolicy(ctx, sessionPolicy.Buffer)
+	ctx = log.ContextWithAccessMessage(ctx, &log.AccessMessage{
+		From:   session.InboundFromContext(ctx).Source,
+		To:     destination,
+		Status: log.AccessAccepted,
+		Reason: "",
+		Email:  user.Email,
+	})
+
+	newError("received request for ", destination).WriteToLog(session.ExportIDToError(ctx))
+	link, err := s.dispatcher.Dispatch(ctx, destination)
+	if err != nil {
+		return newError("failed to dispatch request to ", destination).Base(err)
+	}
+
+	requestDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.DownlinkOnly)
+		if err := buf.Copy(clientReader, link.Writer, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to transfer request").Base(err)
+		}
+		return nil
+	}
+
+	responseDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.UplinkOnly)
+		if err := buf.Copy(link.Reader, clientWriter, buf.UpdateActivity(timer)); err != nil {
+			return newError("failed to write response").Base(err)
+		}
+		return nil
+	}
+
+	requestDonePost := task.OnSuccess(requestDone, task.Close(link.Writer))
+	if err := task.Run(ctx, requestDonePost, responseDone); err != nil {
+		common.Must(common.Interrupt(link.Reader))
+		common.Must(common.Interrupt(link.Writer))
+		return newError("connection ends").Base(err)
+	}
+	return nil
+}
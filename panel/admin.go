@@ -0,0 +1,319 @@
+package panel
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/service/controller"
+)
+
+type AdminAPIConfig struct {
+	Listen    string `mapstructure:"Listen"` // Like 127.0.0.1:10087, empty for disable
+	Token     string `mapstructure:"Token"`  // Sent as Authorization: Bearer <Token>, or as the password of basic auth
+	Dashboard bool   `mapstructure:"Dashboard"`
+}
+
+// startAdminAPI serves the control API over HTTP on the address set by
+// AdminAPIConfig, for the tools that can't reach the control socket. Every
+// request must carry the token.
+func (p *Panel) startAdminAPI() error {
+	c := p.panelConfig.AdminAPIConfig
+	if c == nil || c.Listen == "" || p.admin != nil {
+		return nil
+	}
+	if c.Token == "" {
+		return errors.New("AdminAPIConfig has no Token")
+	}
+	listener, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return err
+	}
+	mux := p.controlMux()
+	mux.HandleFunc("GET /logs", p.handleLogs)
+	if c.Dashboard {
+		if dashboard := dashboardHandler(); dashboard != nil {
+			mux.Handle("GET /dashboard/", dashboard)
+		} else {
+			log.Warn("The dashboard is not built in, left out of the admin API")
+		}
+	}
+	// Shutdown doesn't wait for the log streams, they end with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	p.admin = &http.Server{
+		Handler:           requireToken(c.Token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	p.admin.RegisterOnShutdown(cancel)
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Admin API stopped: %s", err)
+		}
+	}(p.admin)
+	log.Printf("Admin API listening on %s", listener.Addr())
+	return nil
+}
+
+func (p *Panel) stopAdminAPI() {
+	if p.admin == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.admin.Shutdown(ctx); err != nil {
+		log.Errorf("Admin API close failed: %s", err)
+	}
+	p.admin = nil
+}
+
+// requireToken rejects the requests without the token, as a bearer token or
+// as the password of basic auth, the one a browser asks for
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, given, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="XrayR", charset="UTF-8"`)
+			writeControlError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetReload sets how the admin API reloads the config, a reload is refused
+// until it is set
+func (p *Panel) SetReload(reload func() error) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.reload = reload
+}
+
+// controllerOf returns the controller of the node, nil if there is none
+func (p *Panel) controllerOf(key NodeKey) *controller.Controller {
+	p.access.Lock()
+	defer p.access.Unlock()
+	for _, n := range p.nodes {
+		if newNodeKey(n.config) == key {
+			c, _ := n.service.(*controller.Controller)
+			return c
+		}
+	}
+	return nil
+}
+
+// queryController returns the controller of the node given by the ApiHost,
+// NodeID and NodeType query parameters, answering the error if there is none
+func (p *Panel) queryController(w http.ResponseWriter, r *http.Request) *controller.Controller {
+	query := r.URL.Query()
+	nodeID, err := strconv.Atoi(query.Get("NodeID"))
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, fmt.Errorf("invalid NodeID: %s", err))
+		return nil
+	}
+	key := NodeKey{APIHost: query.Get("ApiHost"), NodeID: nodeID, NodeType: query.Get("NodeType")}
+	c := p.controllerOf(key)
+	if c == nil {
+		writeControlError(w, http.StatusNotFound, fmt.Errorf("node %s not found", key))
+	}
+	return c
+}
+
+func (p *Panel) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	if c := p.queryController(w, r); c != nil {
+		writeControlResponse(w, http.StatusOK, c.Users())
+	}
+}
+
+func (p *Panel) handleListOnline(w http.ResponseWriter, r *http.Request) {
+	if c := p.queryController(w, r); c != nil {
+		writeControlResponse(w, http.StatusOK, c.Online())
+	}
+}
+
+type nodeAudit struct {
+	NodeKey
+	controller.AuditHit
+}
+
+// handleListAudits lists the last audit hits of every node, newest first
+func (p *Panel) handleListAudits(w http.ResponseWriter, r *http.Request) {
+	audits := []nodeAudit{}
+	p.access.Lock()
+	for _, n := range p.nodes {
+		if c, ok := n.service.(*controller.Controller); ok {
+			key := newNodeKey(n.config)
+			for _, a := range c.Audits() {
+				audits = append(audits, nodeAudit{NodeKey: key, AuditHit: a})
+			}
+		}
+	}
+	p.access.Unlock()
+	sort.SliceStable(audits, func(i, j int) bool { return audits[i].Time > audits[j].Time })
+	writeControlResponse(w, http.StatusOK, audits)
+}
+
+// handleKickUser closes the connections of the user given as
+// {"ApiHost": ..., "NodeID": ..., "NodeType": ..., "UID": ...}
+func (p *Panel) handleKickUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		NodeKey
+		UID int `json:"UID"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	c := p.controllerOf(req.NodeKey)
+	if c == nil {
+		writeControlError(w, http.StatusNotFound, fmt.Errorf("node %s not found", req.NodeKey))
+		return
+	}
+	if !c.KickUser(req.UID) {
+		writeControlError(w, http.StatusNotFound, fmt.Errorf("user %d has no connection on node %s", req.UID, req.NodeKey))
+		return
+	}
+	writeControlResponse(w, http.StatusOK, req)
+}
+
+type nodeStats struct {
+	NodeKey
+	controller.Stats
+}
+
+type panelStats struct {
+	Uptime     int64       `json:"Uptime"` // Second, since the last start or reload
+	Goroutines int         `json:"Goroutines"`
+	HeapAlloc  uint64      `json:"HeapAlloc"` // Byte
+	Sys        uint64      `json:"Sys"`       // Byte, memory obtained from the system
+	Nodes      []nodeStats `json:"Nodes"`
+}
+
+func (p *Panel) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeControlResponse(w, http.StatusOK, p.stats())
+}
+
+func (p *Panel) stats() panelStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := panelStats{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		Sys:        mem.Sys,
+		Nodes:      []nodeStats{},
+	}
+	p.access.Lock()
+	if p.Running {
+		stats.Uptime = int64(time.Since(p.startAt) / time.Second)
+	}
+	for _, n := range p.nodes {
+		s := nodeStats{NodeKey: newNodeKey(n.config)}
+		if c, ok := n.service.(*controller.Controller); ok {
+			s.Stats = c.Stats()
+		}
+		stats.Nodes = append(stats.Nodes, s)
+	}
+	p.access.Unlock()
+	return stats
+}
+
+type nodeHealth struct {
+	NodeKey
+	Healthy bool   `json:"Healthy"`
+	Error   string `json:"Error,omitempty"`
+}
+
+type panelHealth struct {
+	Healthy bool         `json:"Healthy"` // Running, with all its nodes healthy
+	Nodes   []nodeHealth `json:"Nodes"`
+}
+
+// handleHealth answers 200 when the panel and all its nodes are healthy, 503
+// otherwise, for the probes of the containers and load balancers
+func (p *Panel) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := p.health()
+	status := http.StatusOK
+	if !health.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeControlResponse(w, status, health)
+}
+
+func (p *Panel) health() panelHealth {
+	p.access.Lock()
+	defer p.access.Unlock()
+	health := panelHealth{Healthy: p.Running, Nodes: []nodeHealth{}}
+	for _, n := range p.nodes {
+		h := nodeHealth{NodeKey: newNodeKey(n.config), Healthy: true}
+		err := errors.New("not a node controller")
+		if c, ok := n.service.(*controller.Controller); ok {
+			err = c.Health()
+		}
+		if err != nil {
+			h.Healthy, h.Error = false, err.Error()
+			health.Healthy = false
+		}
+		health.Nodes = append(health.Nodes, h)
+	}
+	return health
+}
+
+// Stalled returns an error when the user sync of a node hangs, for the
+// watchdog of systemd. A panel busy starting or closing its nodes is not
+// stalled, its lock is not waited for.
+func (p *Panel) Stalled() error {
+	if !p.access.TryLock() {
+		return nil
+	}
+	defer p.access.Unlock()
+	for _, n := range p.nodes {
+		if c, ok := n.service.(*controller.Controller); ok {
+			if err := c.Stalled(); err != nil {
+				return fmt.Errorf("node %s: %w", newNodeKey(n.config), err)
+			}
+		}
+	}
+	return nil
+}
+
+// handleReload reloads the config file, the same as when it changes. The
+// panel restarts after the response, along with the API itself.
+func (p *Panel) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := p.startReload(); err != nil {
+		writeControlError(w, http.StatusNotImplemented, err)
+		return
+	}
+	writeControlResponse(w, http.StatusAccepted, map[string]string{"status": "reloading"})
+}
+
+// startReload reloads the config in the background, as the APIs asking for
+// it are restarted by the reload
+func (p *Panel) startReload() error {
+	p.access.Lock()
+	reload := p.reload
+	p.access.Unlock()
+	if reload == nil {
+		return errors.New("reload is not supported")
+	}
+	go func() {
+		if err := reload(); err != nil {
+			log.Errorf("Reload failed: %s", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,53 @@
+package panel
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/common/mailer"
+)
+
+// notify sends an alert to the admins, by Telegram and mail for the ones on,
+// and posts it to the webhooks as the event, see package webhook. key is the
+// node it is about, nil for the panel itself. It doesn't take the lock of the
+// panel, the supervisors and the nodes call it.
+func (p *Panel) notify(event string, key *NodeKey, text string, data any) {
+	p.sendEvent(event, key, text, data)
+	if key != nil {
+		text = fmt.Sprintf("[%s %d] %s", key.NodeType, key.NodeID, text)
+	}
+	if bot := p.bot.Load(); bot != nil {
+		bot.Notify(text)
+	}
+	if m := p.mailer.Load(); m != nil {
+		m.Notify(text)
+	}
+}
+
+// startMailer starts sending the alerts by mail as set by MailConfig
+func (p *Panel) startMailer() error {
+	c := p.panelConfig.MailConfig
+	if c == nil || !c.Enable || p.mailer.Load() != nil {
+		return nil
+	}
+	m, err := mailer.New(c)
+	if err != nil {
+		return err
+	}
+	p.mailer.Store(m)
+	log.Printf("Alerts are mailed to %v", c.To)
+	return nil
+}
+
+// stopMailer sends the alerts pending
+func (p *Panel) stopMailer() {
+	if m := p.mailer.Swap(nil); m != nil {
+		m.Close()
+	}
+}
+
+// alerting reports whether the alerts go anywhere
+func (p *Panel) alerting() bool {
+	return p.bot.Load() != nil || p.mailer.Load() != nil || p.webhooks.Load() != nil
+}
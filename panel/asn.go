@@ -0,0 +1,60 @@
+package panel
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/common/asn"
+)
+
+// loadASNDatabase loads the database used by the ASN routes of the nodes,
+// downloading it when there is no local copy yet
+func (p *Panel) loadASNDatabase() {
+	c := p.panelConfig.ASNConfig
+	if c == nil || c.DatabasePath == "" {
+		return
+	}
+	db, err := asn.Load(c.DatabasePath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Downloading ASN database from %s", asnUpdateURL(c))
+		db, err = asn.Download(asnUpdateURL(c), c.DatabasePath)
+	}
+	if err != nil {
+		log.Errorf("Load ASN database failed: %s", err)
+		return
+	}
+	asn.SetCurrent(db)
+}
+
+// updateASNDatabase downloads the ASN database every UpdatePeriodic hours.
+// The nodes pick up the new one on their next user sync.
+func (p *Panel) updateASNDatabase() {
+	defer p.wg.Done()
+	c := p.panelConfig.ASNConfig
+	ticker := time.NewTicker(time.Duration(c.UpdatePeriodic) * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		db, err := asn.Download(asnUpdateURL(c), c.DatabasePath)
+		if err != nil {
+			log.Errorf("Update ASN database failed: %s", err)
+			continue
+		}
+		asn.SetCurrent(db)
+		log.Printf("ASN database updated")
+	}
+}
+
+func asnUpdateURL(c *ASNConfig) string {
+	if c.UpdateURL != "" {
+		return c.UpdateURL
+	}
+	return asn.DefaultUpdateURL
+}
@@ -0,0 +1,111 @@
+package panel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+
+	log "github.com/sirupsen/logrus"
+	applog "github.com/xtls/xray-core/app/log"
+	xlog "github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/core"
+
+	"github.com/qtai2901/new_xrayr/common/ban"
+	"github.com/qtai2901/new_xrayr/common/logstream"
+)
+
+// banLogHandler counts the connections rejected by the inbounds, which the
+// core only reports to its access log, before passing them on to the logger
+type banLogHandler struct {
+	next xlog.Handler
+	ban  *ban.Manager
+}
+
+func (h *banLogHandler) Handle(msg xlog.Message) {
+	if m, ok := msg.(*xlog.AccessMessage); ok && m.Status == xlog.AccessRejected {
+		if addr, ok := ban.ParseSource(fmt.Sprint(m.From)); ok && h.ban.AuthFailed(addr) {
+			log.Warnf("Banned %s for failing to authenticate", addr)
+		}
+	}
+	h.next.Handle(msg)
+}
+
+// startBan turns the ban on in the dispatcher of the core, reporting whether
+// it is on
+func (p *Panel) startBan(server *core.Instance) (bool, error) {
+	c := p.panelConfig.BanConfig
+	if c == nil || !c.Enable {
+		return false, nil
+	}
+	dispatcher := dispatcherOf(server)
+	if dispatcher == nil {
+		return false, errors.New("the dispatcher of the core is not found")
+	}
+	if err := dispatcher.Ban.SetConfig(c); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hookCoreLog puts the handlers of the panel in front of the logger of the
+// core: the ban counting the failed authentications of the inbounds if it is
+// on, and the live log stream
+func (p *Panel) hookCoreLog(server *core.Instance, banned bool) error {
+	logger, ok := server.GetFeature((*applog.Instance)(nil)).(*applog.Instance)
+	if !ok {
+		return errors.New("the logger of the core is not found")
+	}
+	var handler xlog.Handler = logger
+	if banned {
+		handler = &banLogHandler{next: handler, ban: dispatcherOf(server).Ban}
+	}
+	xlog.RegisterHandler(&logstream.CoreHandler{Hub: p.logs, Next: handler})
+	return nil
+}
+
+func (p *Panel) banManager() *ban.Manager {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if dispatcher := dispatcherOf(p.Server); dispatcher != nil {
+		return dispatcher.Ban
+	}
+	return nil
+}
+
+func (p *Panel) handleListBans(w http.ResponseWriter, r *http.Request) {
+	manager := p.banManager()
+	if manager == nil {
+		writeControlError(w, http.StatusServiceUnavailable, errors.New("XrayR is not running"))
+		return
+	}
+	writeControlResponse(w, http.StatusOK, manager.List())
+}
+
+// handleUnban lifts the ban of the IP given as {"IP": "1.2.3.4"}
+func (p *Panel) handleUnban(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IP string `json:"IP"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	addr, err := netip.ParseAddr(req.IP)
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	manager := p.banManager()
+	if manager == nil {
+		writeControlError(w, http.StatusServiceUnavailable, errors.New("XrayR is not running"))
+		return
+	}
+	if !manager.Unban(addr) {
+		writeControlError(w, http.StatusNotFound, fmt.Errorf("%s is not banned", addr))
+		return
+	}
+	writeControlResponse(w, http.StatusOK, req)
+}
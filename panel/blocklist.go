@@ -0,0 +1,106 @@
+package panel
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xtls/xray-core/core"
+
+	"github.com/qtai2901/new_xrayr/common/blocklist"
+)
+
+// BlocklistStats is the state of the blocklist served by the control API
+type BlocklistStats struct {
+	Ranges int               `json:"Ranges"`
+	Hits   map[string]uint64 `json:"Hits"` // Key: inbound tag
+}
+
+// loadBlocklist loads the blocklist checked by the nodes, downloading it
+// when there is no cached copy yet
+func (p *Panel) loadBlocklist() {
+	c := p.panelConfig.BlocklistConfig
+	if c == nil || !c.Enable {
+		return
+	}
+	var (
+		list *blocklist.List
+		err  = os.ErrNotExist
+	)
+	if c.CachePath != "" {
+		list, err = blocklist.Load(c.CachePath)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Downloading blocklist from %v", blocklistURLs(c))
+		list, err = blocklist.Download(blocklistURLs(c), c.CachePath)
+	}
+	if err != nil {
+		log.Errorf("Load blocklist failed: %s", err)
+		return
+	}
+	blocklist.SetCurrent(list)
+	log.Printf("Blocklist loaded with %d ranges", list.Len())
+}
+
+// updateBlocklist downloads the blocklist every UpdatePeriodic hours, logging
+// the connections blocked so far by each node
+func (p *Panel) updateBlocklist() {
+	defer p.wg.Done()
+	c := p.panelConfig.BlocklistConfig
+	// Started by Start after the core, reading it without the lock held by Close
+	server := p.Server
+	ticker := time.NewTicker(time.Duration(c.UpdatePeriodic) * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		if stats := blocklistStats(server); stats != nil {
+			for tag, hits := range stats.Hits {
+				log.Printf("Blocklist blocked %d connections of %s", hits, tag)
+			}
+		}
+		list, err := blocklist.Download(blocklistURLs(c), c.CachePath)
+		if err != nil {
+			log.Errorf("Update blocklist failed: %s", err)
+			continue
+		}
+		blocklist.SetCurrent(list)
+		log.Printf("Blocklist updated with %d ranges", list.Len())
+	}
+}
+
+// blocklistStats returns nil when the core is not running
+func blocklistStats(server *core.Instance) *BlocklistStats {
+	dispatcher := dispatcherOf(server)
+	if dispatcher == nil {
+		return nil
+	}
+	stats := &BlocklistStats{Hits: dispatcher.Blocklist.Hits()}
+	if list := blocklist.Current(); list != nil {
+		stats.Ranges = list.Len()
+	}
+	return stats
+}
+
+func (p *Panel) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	p.access.Lock()
+	stats := blocklistStats(p.Server)
+	p.access.Unlock()
+	if stats == nil {
+		writeControlError(w, http.StatusServiceUnavailable, errors.New("XrayR is not running"))
+		return
+	}
+	writeControlResponse(w, http.StatusOK, stats)
+}
+
+func blocklistURLs(c *BlocklistConfig) []string {
+	if len(c.URLs) > 0 {
+		return c.URLs
+	}
+	return blocklist.DefaultURLs
+}
@@ -0,0 +1,12 @@
+//go:build !no_bunpanel
+
+package panel
+
+import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/bunpanel"
+)
+
+func init() {
+	panelClients["BunPanel"] = func(c *api.Config) api.API { return bunpanel.New(c) }
+}
@@ -0,0 +1,12 @@
+//go:build !no_gov2panel
+
+package panel
+
+import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/gov2panel"
+)
+
+func init() {
+	panelClients["GoV2Panel"] = func(c *api.Config) api.API { return gov2panel.New(c) }
+}
@@ -0,0 +1,12 @@
+//go:build !no_newv2board
+
+package panel
+
+import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/newV2board"
+)
+
+func init() {
+	panelClients["NewV2board"] = func(c *api.Config) api.API { return newV2board.New(c) }
+}
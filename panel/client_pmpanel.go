@@ -0,0 +1,12 @@
+//go:build !no_pmpanel
+
+package panel
+
+import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/pmpanel"
+)
+
+func init() {
+	panelClients["PMpanel"] = func(c *api.Config) api.API { return pmpanel.New(c) }
+}
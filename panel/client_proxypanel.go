@@ -0,0 +1,12 @@
+//go:build !no_proxypanel
+
+package panel
+
+import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/proxypanel"
+)
+
+func init() {
+	panelClients["Proxypanel"] = func(c *api.Config) api.API { return proxypanel.New(c) }
+}
@@ -0,0 +1,12 @@
+//go:build !no_sspanel
+
+package panel
+
+import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/sspanel"
+)
+
+func init() {
+	panelClients["SSpanel"] = func(c *api.Config) api.API { return sspanel.New(c) }
+}
@@ -0,0 +1,12 @@
+//go:build !no_v2board
+
+package panel
+
+import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/v2board"
+)
+
+func init() {
+	panelClients["V2board"] = func(c *api.Config) api.API { return v2board.New(c) }
+}
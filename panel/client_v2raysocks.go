@@ -0,0 +1,12 @@
+//go:build !no_v2raysocks
+
+package panel
+
+import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/api/v2raysocks"
+)
+
+func init() {
+	panelClients["V2RaySocks"] = func(c *api.Config) api.API { return v2raysocks.New(c) }
+}
@@ -0,0 +1,8 @@
+package panel
+
+import "github.com/qtai2901/new_xrayr/api"
+
+// panelClients are the clients of the panel types built in, by PanelType.
+// Their files register them, unless excluded by the build tag no_<panel type
+// in lower case>, like no_sspanel, for a smaller binary.
+var panelClients = map[string]func(*api.Config) api.API{}
@@ -2,17 +2,47 @@ package panel
 
 import (
 	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/ban"
+	"github.com/qtai2901/new_xrayr/common/logarchive"
+	"github.com/qtai2901/new_xrayr/common/mailer"
+	"github.com/qtai2901/new_xrayr/common/remoteconfig"
+	"github.com/qtai2901/new_xrayr/common/sandbox"
+	"github.com/qtai2901/new_xrayr/common/telegram"
+	"github.com/qtai2901/new_xrayr/common/webhook"
 	"github.com/qtai2901/new_xrayr/service/controller"
 )
 
 type Config struct {
-	LogConfig          *LogConfig        `mapstructure:"Log"`
-	DnsConfigPath      string            `mapstructure:"DnsConfigPath"`
-	InboundConfigPath  string            `mapstructure:"InboundConfigPath"`
-	OutboundConfigPath string            `mapstructure:"OutboundConfigPath"`
-	RouteConfigPath    string            `mapstructure:"RouteConfigPath"`
-	ConnectionConfig   *ConnectionConfig `mapstructure:"ConnectionConfig"`
-	NodesConfig        []*NodesConfig    `mapstructure:"Nodes"`
+	LogConfig          *LogConfig           `mapstructure:"Log"`
+	DnsConfigPath      string               `mapstructure:"DnsConfigPath"`
+	InboundConfigPath  string               `mapstructure:"InboundConfigPath"`
+	OutboundConfigPath string               `mapstructure:"OutboundConfigPath"`
+	RouteConfigPath    string               `mapstructure:"RouteConfigPath"`
+	CustomConfigDir    string               `mapstructure:"CustomConfigDir"`
+	ConnectionConfig   *ConnectionConfig    `mapstructure:"ConnectionConfig"`
+	NodesConfig        []*NodesConfig       `mapstructure:"Nodes"`
+	ShutdownDrainTime  int                  `mapstructure:"ShutdownDrainTime"` // Second
+	User               string               `mapstructure:"User"`              // Switched to once the nodes are started, see the setup command
+	SandboxConfig      *sandbox.Config      `mapstructure:"SandboxConfig"`
+	StartConcurrency   int                  `mapstructure:"StartConcurrency"`
+	ControlSocket      string               `mapstructure:"ControlSocket"`
+	AdminAPIConfig     *AdminAPIConfig      `mapstructure:"AdminAPIConfig"`
+	GRPCConfig         *GRPCConfig          `mapstructure:"GRPCConfig"`
+	TelegramConfig     *telegram.Config     `mapstructure:"TelegramConfig"`
+	MailConfig         *mailer.Config       `mapstructure:"MailConfig"`
+	DiskAlertPercent   int                  `mapstructure:"DiskAlertPercent"` // 0 for 10, -1 for disable
+	WebhookConfig      *webhook.Config      `mapstructure:"WebhookConfig"`
+	WebhookConfigs     []*webhook.Config    `mapstructure:"WebhookConfigs"` // More webhooks, like a chat of the errors only
+	ObservatoryConfig  *ObservatoryConfig   `mapstructure:"ObservatoryConfig"`
+	ASNConfig          *ASNConfig           `mapstructure:"ASNConfig"`
+	GeoIPConfig        *GeoIPConfig         `mapstructure:"GeoIPConfig"`
+	GeoDataConfig      *GeoDataConfig       `mapstructure:"GeoDataConfig"`
+	LogArchiveConfig   *logarchive.Config   `mapstructure:"LogArchiveConfig"`
+	RemoteNodesConfig  *remoteconfig.Config `mapstructure:"RemoteNodesConfig"`
+	BlocklistConfig    *BlocklistConfig     `mapstructure:"BlocklistConfig"`
+	BanConfig          *ban.Config          `mapstructure:"BanConfig"`
+	MemoryConfig       *MemoryConfig        `mapstructure:"MemoryConfig"`
+	CPUConfig          *CPUConfig           `mapstructure:"CPUConfig"`
 }
 
 type NodesConfig struct {
@@ -34,3 +64,35 @@ type ConnectionConfig struct {
 	DownlinkOnly uint32 `mapstructure:"downlinkOnly"`
 	BufferSize   int32  `mapstructure:"bufferSize"`
 }
+
+type ObservatoryConfig struct {
+	ProbeURL      string `mapstructure:"ProbeURL"`
+	ProbeInterval int    `mapstructure:"ProbeInterval"` // Second
+}
+
+type ASNConfig struct {
+	DatabasePath   string `mapstructure:"DatabasePath"`
+	UpdateURL      string `mapstructure:"UpdateURL"`
+	UpdatePeriodic int    `mapstructure:"UpdatePeriodic"` // Hour
+}
+
+type GeoIPConfig struct {
+	DatabasePath   string   `mapstructure:"DatabasePath"`
+	UpdateURLs     []string `mapstructure:"UpdateURLs"`
+	UpdatePeriodic int      `mapstructure:"UpdatePeriodic"` // Hour
+}
+
+type GeoDataConfig struct {
+	Enable         bool   `mapstructure:"Enable"`
+	GeoIPURL       string `mapstructure:"GeoIPURL"`
+	GeoSiteURL     string `mapstructure:"GeoSiteURL"`
+	VerifyChecksum bool   `mapstructure:"VerifyChecksum"`
+	UpdatePeriodic int    `mapstructure:"UpdatePeriodic"` // Hour
+}
+
+type BlocklistConfig struct {
+	Enable         bool     `mapstructure:"Enable"`
+	URLs           []string `mapstructure:"URLs"` // Defaults to the Spamhaus DROP lists
+	CachePath      string   `mapstructure:"CachePath"`
+	UpdatePeriodic int      `mapstructure:"UpdatePeriodic"` // Hour
+}
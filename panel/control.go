@@ -0,0 +1,159 @@
+package panel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// NodeKey identifies a node of the panel
+type NodeKey struct {
+	APIHost  string `json:"ApiHost"`
+	NodeID   int    `json:"NodeID"`
+	NodeType string `json:"NodeType"`
+}
+
+func newNodeKey(nodeConfig *NodesConfig) NodeKey {
+	return NodeKey{
+		APIHost:  nodeConfig.ApiConfig.APIHost,
+		NodeID:   nodeConfig.ApiConfig.NodeID,
+		NodeType: nodeConfig.ApiConfig.NodeType,
+	}
+}
+
+func (k NodeKey) String() string {
+	return fmt.Sprintf("%s(ID=%d) of %s", k.NodeType, k.NodeID, k.APIHost)
+}
+
+// startControl serves the control API on the unix socket set by ControlSocket.
+// Nodes added or removed through it are not written back to the config file.
+func (p *Panel) startControl() error {
+	path := p.panelConfig.ControlSocket
+	if path == "" || p.control != nil {
+		return nil
+	}
+	// Remove the socket left by an unclean exit
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	p.control = &http.Server{Handler: p.controlMux(), ReadHeaderTimeout: 10 * time.Second}
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Control socket stopped: %s", err)
+		}
+	}(p.control)
+	log.Printf("Control socket listening on %s", path)
+	return nil
+}
+
+// controlMux routes the control API, served on the control socket and by the
+// admin API
+func (p *Panel) controlMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /nodes", p.handleListNodes)
+	mux.HandleFunc("POST /nodes", p.handleAddNode)
+	mux.HandleFunc("DELETE /nodes", p.handleRemoveNode)
+	mux.HandleFunc("POST /drain", p.handleDrain)
+	mux.HandleFunc("GET /blocklist", p.handleBlocklist)
+	mux.HandleFunc("GET /bans", p.handleListBans)
+	mux.HandleFunc("DELETE /bans", p.handleUnban)
+	mux.HandleFunc("GET /users", p.handleListUsers)
+	mux.HandleFunc("GET /online", p.handleListOnline)
+	mux.HandleFunc("GET /audits", p.handleListAudits)
+	mux.HandleFunc("POST /users/kick", p.handleKickUser)
+	mux.HandleFunc("GET /stats", p.handleStats)
+	mux.HandleFunc("GET /health", p.handleHealth)
+	mux.HandleFunc("POST /reload", p.handleReload)
+	return mux
+}
+
+func (p *Panel) stopControl() {
+	if p.control == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.control.Shutdown(ctx); err != nil {
+		log.Errorf("Control socket close failed: %s", err)
+	}
+	p.control = nil
+}
+
+func (p *Panel) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	writeControlResponse(w, http.StatusOK, p.Nodes())
+}
+
+// handleAddNode accepts a single entry of Nodes, in YAML or JSON
+func (p *Panel) handleAddNode(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	nodeConfig, err := parseNodeConfig(body)
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := p.AddNode(nodeConfig); err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeControlResponse(w, http.StatusCreated, newNodeKey(nodeConfig))
+}
+
+func (p *Panel) handleRemoveNode(w http.ResponseWriter, r *http.Request) {
+	var key NodeKey
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&key); err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := p.RemoveNode(key); err != nil {
+		writeControlError(w, http.StatusNotFound, err)
+		return
+	}
+	writeControlResponse(w, http.StatusOK, key)
+}
+
+// parseNodeConfig reads a single entry of Nodes, in YAML or JSON
+func parseNodeConfig(data []byte) (*NodesConfig, error) {
+	config := viper.New()
+	config.SetConfigType("yaml")
+	if err := config.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("parse node config failed: %s", err)
+	}
+	nodeConfig := &NodesConfig{}
+	if err := config.Unmarshal(nodeConfig); err != nil {
+		return nil, fmt.Errorf("parse node config failed: %s", err)
+	}
+	return nodeConfig, nil
+}
+
+func writeControlResponse(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	writeControlResponse(w, status, map[string]string{"error": err.Error()})
+}
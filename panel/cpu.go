@@ -0,0 +1,58 @@
+package panel
+
+import (
+	"os"
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type CPUConfig struct {
+	MaxProcs int   `mapstructure:"MaxProcs"` // 0 to follow the CPU quota of the container
+	Affinity []int `mapstructure:"Affinity"` // CPUs to run on, all of them if empty
+}
+
+// applyCPUConfig pins the process to the CPUs of the affinity and sets the
+// number of CPUs running goroutines at once. Unless set, it is the CPU quota
+// of the cgroup, so a container limited to 2 CPUs on a 64 CPU host doesn't
+// run 64 threads throttled by the quota. The GOMAXPROCS environment variable
+// takes precedence, the runtime applied it already.
+func applyCPUConfig(c *CPUConfig) {
+	if c == nil {
+		c = &CPUConfig{}
+	}
+	cpus := runtime.NumCPU()
+	if len(c.Affinity) > 0 {
+		if err := setAffinity(c.Affinity); err != nil {
+			log.Errorf("Set CPU affinity failed: %s", err)
+		} else {
+			cpus = len(c.Affinity)
+			log.Printf("CPU affinity: %v", c.Affinity)
+		}
+	}
+	if _, ok := os.LookupEnv("GOMAXPROCS"); ok {
+		return
+	}
+	procs := c.MaxProcs
+	if procs <= 0 {
+		procs = cpus
+		if quota, ok := cgroupCPUQuota(); ok && quota < procs {
+			procs = quota
+		}
+	}
+	if runtime.GOMAXPROCS(procs) != procs {
+		log.Printf("GOMAXPROCS: %d", procs)
+	}
+}
+
+// cpuQuota returns the CPUs a quota of the period allows, rounded down but
+// at least one. ok is false for no quota.
+func cpuQuota(quota, period int64) (int, bool) {
+	if quota <= 0 || period <= 0 {
+		return 0, false
+	}
+	if n := int(quota / period); n > 1 {
+		return n, true
+	}
+	return 1, true
+}
@@ -0,0 +1,83 @@
+package panel
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// setAffinity pins every thread of the process to the CPUs. The threads the
+// runtime starts later inherit it from the one starting them.
+func setAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		// The thread may have exited meanwhile
+		if err := unix.SchedSetaffinity(tid, &set); err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
+
+// cgroupCPUQuota returns the CPUs the cgroup of the process may use, from
+// cpu.max of cgroup v2 or the CFS quota of cgroup v1
+func cgroupCPUQuota() (int, bool) {
+	if data, err := os.ReadFile(filepath.Join("/sys/fs/cgroup", cgroupPath(), "cpu.max")); err == nil {
+		// Like "200000 100000", or "max 100000" for no quota
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		quota, _ := strconv.ParseInt(fields[0], 10, 64)
+		period, _ := strconv.ParseInt(fields[1], 10, 64)
+		return cpuQuota(quota, period)
+	}
+	quota, err := readInt("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0, false
+	}
+	period, err := readInt("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0, false
+	}
+	return cpuQuota(quota, period)
+}
+
+// cgroupPath returns the cgroup v2 of the process, / inside most containers
+func cgroupPath() string {
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "/"
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path
+		}
+	}
+	return "/"
+}
+
+func readInt(file string) (int64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
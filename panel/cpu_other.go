@@ -0,0 +1,13 @@
+//go:build !linux
+
+package panel
+
+import "errors"
+
+func setAffinity([]int) error {
+	return errors.New("CPU affinity is only supported on Linux")
+}
+
+func cgroupCPUQuota() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,47 @@
+package panel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+// customConfig is a fragment of a xray config dropped into CustomConfigDir
+type customConfig struct {
+	Outbounds []conf.OutboundDetourConfig `json:"outbounds"`
+	Routing   *conf.RouterConfig          `json:"routing"`
+}
+
+// loadCustomConfigs merges the outbounds and routing of every *.json file in
+// dir, in the order of the file names, into outbounds and routerConfig.
+// Rules and balancers are appended, a domainStrategy replaces the former one.
+func loadCustomConfigs(dir string, outbounds []conf.OutboundDetourConfig, routerConfig *conf.RouterConfig) ([]conf.OutboundDetourConfig, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read custom config %s failed: %s", file, err)
+		}
+		custom := &customConfig{}
+		if err := json.Unmarshal(data, custom); err != nil {
+			return nil, fmt.Errorf("unmarshal custom config %s failed: %s", file, err)
+		}
+		outbounds = append(outbounds, custom.Outbounds...)
+		if custom.Routing != nil {
+			routerConfig.RuleList = append(routerConfig.RuleList, custom.Routing.RuleList...)
+			routerConfig.Balancers = append(routerConfig.Balancers, custom.Routing.Balancers...)
+			if custom.Routing.DomainStrategy != nil {
+				routerConfig.DomainStrategy = custom.Routing.DomainStrategy
+			}
+		}
+	}
+	return outbounds, nil
+}
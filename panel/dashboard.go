@@ -0,0 +1,19 @@
+//go:build !no_dashboard
+
+package panel
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardHandler serves the web dashboard at /dashboard/. It only reads the
+// admin API, with the credentials the browser asked for.
+func dashboardHandler() http.Handler {
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+}
@@ -0,0 +1,11 @@
+//go:build no_dashboard
+
+package panel
+
+import "net/http"
+
+// dashboardHandler returns nil, the dashboard is left out by the no_dashboard
+// build tag
+func dashboardHandler() http.Handler {
+	return nil
+}
@@ -28,3 +28,10 @@ func getDefaultControllerConfig() *controller.Config {
 		DNSType:        "AsIs",
 	}
 }
+
+func getDefaultObservatoryConfig() *ObservatoryConfig {
+	return &ObservatoryConfig{
+		ProbeURL:      "https://www.google.com/generate_204",
+		ProbeInterval: 60,
+	}
+}
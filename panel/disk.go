@@ -0,0 +1,89 @@
+package panel
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/common/webhook"
+)
+
+const (
+	defaultDiskAlertPercent = 10
+	diskCheckInterval       = 5 * time.Minute
+)
+
+type diskStatus struct {
+	Path        string  `json:"path"`
+	FreePercent float64 `json:"free_percent"`
+	Free        uint64  `json:"free"` // Byte
+}
+
+// diskPaths returns the directories the logs and the local state of the nodes
+// are written to
+func (p *Panel) diskPaths() []string {
+	var paths []string
+	if c := p.panelConfig.LogConfig; c != nil {
+		for _, file := range []string{c.AccessPath, c.ErrorPath} {
+			if file != "" && file != "none" {
+				paths = append(paths, filepath.Dir(file))
+			}
+		}
+	}
+	for _, nodeConfig := range p.panelConfig.NodesConfig {
+		if c := nodeConfig.ControllerConfig; c != nil && c.DataDir != "" {
+			paths = append(paths, c.DataDir)
+		}
+	}
+	return paths
+}
+
+// monitorDisks alerts when a disk of the logs or of the traffic queues gets
+// nearly full, and once it has room again
+func (p *Panel) monitorDisks() {
+	defer p.wg.Done()
+	percent := p.panelConfig.DiskAlertPercent
+	if percent == 0 {
+		percent = defaultDiskAlertPercent
+	}
+	paths := p.diskPaths()
+	full := make(map[uint64]bool) // By device
+	check := func() {
+		checked := make(map[uint64]bool)
+		for _, path := range paths {
+			device, free, total, err := diskUsage(path)
+			if err != nil {
+				log.Debugf("Check disk of %s failed: %s", path, err)
+				continue
+			}
+			if checked[device] || total == 0 {
+				continue
+			}
+			checked[device] = true
+			freePercent := float64(free) * 100 / float64(total)
+			switch {
+			case freePercent < float64(percent) && !full[device]:
+				full[device] = true
+				p.notify(webhook.DiskFull, nil, fmt.Sprintf("Disk of %s nearly full, %.1f%% free (%d MB)", path, freePercent, free>>20),
+					diskStatus{Path: path, FreePercent: freePercent, Free: free})
+			case freePercent >= float64(percent) && full[device]:
+				full[device] = false
+				p.notify(webhook.DiskRecovered, nil, fmt.Sprintf("Disk of %s has room again, %.1f%% free", path, freePercent),
+					diskStatus{Path: path, FreePercent: freePercent, Free: free})
+			}
+		}
+	}
+	check()
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package panel
+
+import "golang.org/x/sys/unix"
+
+// diskUsage returns the device of the file system path is on, with its space
+// free for unprivileged users and its size, Byte
+func diskUsage(path string) (device, free, total uint64, err error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, 0, 0, err
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return 0, 0, 0, err
+	}
+	return stat.Dev, fs.Bavail * uint64(fs.Bsize), fs.Blocks * uint64(fs.Bsize), nil
+}
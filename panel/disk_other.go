@@ -0,0 +1,9 @@
+//go:build !linux
+
+package panel
+
+import "errors"
+
+func diskUsage(string) (device, free, total uint64, err error) {
+	return 0, 0, 0, errors.New("disk usage is only supported on Linux")
+}
@@ -0,0 +1,77 @@
+package panel
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xtls/xray-core/common/platform"
+
+	"github.com/qtai2901/new_xrayr/common/geodata"
+)
+
+// loadGeoData downloads the geo files missing from the asset directory, before
+// the core compiles its routing from them
+func (p *Panel) loadGeoData() {
+	c := p.panelConfig.GeoDataConfig
+	if c == nil || !c.Enable {
+		return
+	}
+	for name, url := range geoDataURLs(c) {
+		path := platform.GetAssetLocation(name)
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		log.Printf("Downloading %s from %s", name, url)
+		if _, err := geodata.Update(name, url, path, c.VerifyChecksum); err != nil {
+			log.Errorf("Download %s failed: %s", name, err)
+		}
+	}
+}
+
+// updateGeoData downloads the geo files every UpdatePeriodic hours. The routes
+// of the nodes are compiled again from the new ones on their next user sync,
+// the routing of RouteConfigPath on the next reload.
+func (p *Panel) updateGeoData() {
+	defer p.wg.Done()
+	c := p.panelConfig.GeoDataConfig
+	ticker := time.NewTicker(time.Duration(c.UpdatePeriodic) * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		updated := false
+		for name, url := range geoDataURLs(c) {
+			changed, err := geodata.Update(name, url, platform.GetAssetLocation(name), c.VerifyChecksum)
+			if err != nil {
+				log.Errorf("Update %s failed: %s", name, err)
+				continue
+			}
+			if changed {
+				log.Printf("%s updated", name)
+				updated = true
+			}
+		}
+		if updated {
+			geodata.Reload()
+		}
+	}
+}
+
+func geoDataURLs(c *GeoDataConfig) map[string]string {
+	urls := map[string]string{
+		geodata.GeoIP:   geodata.DefaultURLs[geodata.GeoIP],
+		geodata.GeoSite: geodata.DefaultURLs[geodata.GeoSite],
+	}
+	if c.GeoIPURL != "" {
+		urls[geodata.GeoIP] = c.GeoIPURL
+	}
+	if c.GeoSiteURL != "" {
+		urls[geodata.GeoSite] = c.GeoSiteURL
+	}
+	return urls
+}
@@ -0,0 +1,60 @@
+package panel
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/common/geoip"
+)
+
+// loadGeoIPDatabase loads the database used by the country routes of the
+// nodes, downloading it when there is no local copy yet
+func (p *Panel) loadGeoIPDatabase() {
+	c := p.panelConfig.GeoIPConfig
+	if c == nil || c.DatabasePath == "" {
+		return
+	}
+	db, err := geoip.Load(c.DatabasePath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Downloading GeoIP database from %v", geoIPUpdateURLs(c))
+		db, err = geoip.Download(geoIPUpdateURLs(c), c.DatabasePath)
+	}
+	if err != nil {
+		log.Errorf("Load GeoIP database failed: %s", err)
+		return
+	}
+	geoip.SetCurrent(db)
+}
+
+// updateGeoIPDatabase downloads the GeoIP database every UpdatePeriodic hours.
+// The nodes pick up the new one on their next user sync.
+func (p *Panel) updateGeoIPDatabase() {
+	defer p.wg.Done()
+	c := p.panelConfig.GeoIPConfig
+	ticker := time.NewTicker(time.Duration(c.UpdatePeriodic) * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		db, err := geoip.Download(geoIPUpdateURLs(c), c.DatabasePath)
+		if err != nil {
+			log.Errorf("Update GeoIP database failed: %s", err)
+			continue
+		}
+		geoip.SetCurrent(db)
+		log.Printf("GeoIP database updated")
+	}
+}
+
+func geoIPUpdateURLs(c *GeoIPConfig) []string {
+	if len(c.UpdateURLs) > 0 {
+		return c.UpdateURLs
+	}
+	return geoip.DefaultUpdateURLs
+}
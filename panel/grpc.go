@@ -0,0 +1,215 @@
+package panel
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/qtai2901/new_xrayr/common/controlrpc"
+)
+
+type GRPCConfig struct {
+	Listen       string `mapstructure:"Listen"`       // Like 127.0.0.1:10088, empty for disable
+	Token        string `mapstructure:"Token"`        // Sent as the metadata authorization: Bearer <Token>
+	CertFile     string `mapstructure:"CertFile"`     // TLS certificate of the server
+	KeyFile      string `mapstructure:"KeyFile"`      // TLS key of the server
+	ClientCAFile string `mapstructure:"ClientCAFile"` // CA the clients must have a certificate of, for mTLS
+}
+
+// startGRPC serves the control operations over gRPC, for a controller managing
+// a fleet of instances. A client needs the token, a certificate of the client
+// CA, or both when both are set.
+func (p *Panel) startGRPC() error {
+	c := p.panelConfig.GRPCConfig
+	if c == nil || c.Listen == "" || p.grpcServer != nil {
+		return nil
+	}
+	if c.Token == "" && c.ClientCAFile == "" {
+		return errors.New("GRPCConfig needs a Token or a ClientCAFile")
+	}
+	if c.CertFile == "" && !isLoopback(c.Listen) {
+		// The token would cross the network in plaintext
+		return fmt.Errorf("GRPCConfig needs a CertFile and a KeyFile to listen on %s, or a loopback Listen", c.Listen)
+	}
+	var opts []grpc.ServerOption
+	if c.CertFile != "" || c.ClientCAFile != "" {
+		tlsConfig, err := grpcTLSConfig(c)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if c.Token != "" {
+		opts = append(opts, grpc.UnaryInterceptor(requireGRPCToken(c.Token)))
+	}
+	listener, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return err
+	}
+	p.grpcServer = grpc.NewServer(opts...)
+	controlrpc.RegisterControlServer(p.grpcServer, &controlServer{panel: p})
+	go func(server *grpc.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			log.Errorf("gRPC control stopped: %s", err)
+		}
+	}(p.grpcServer)
+	log.Printf("gRPC control listening on %s", listener.Addr())
+	return nil
+}
+
+func (p *Panel) stopGRPC() {
+	if p.grpcServer == nil {
+		return
+	}
+	p.grpcServer.GracefulStop()
+	p.grpcServer = nil
+}
+
+// isLoopback reports whether listen only accepts the connections of the host
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func grpcTLSConfig(c *GRPCConfig) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("GRPCConfig needs a CertFile and a KeyFile for TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load gRPC certificate failed: %s", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read gRPC client CA failed: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// requireGRPCToken rejects the calls without the bearer token
+func requireGRPCToken(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			given, ok := strings.CutPrefix(value, "Bearer ")
+			if ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+}
+
+// controlServer implements the gRPC control service over the panel
+type controlServer struct {
+	controlrpc.UnimplementedControlServer
+	panel *Panel
+}
+
+func toProtoKey(key NodeKey) *controlrpc.NodeKey {
+	return &controlrpc.NodeKey{ApiHost: key.APIHost, NodeId: int32(key.NodeID), NodeType: key.NodeType}
+}
+
+func fromProtoKey(key *controlrpc.NodeKey) NodeKey {
+	return NodeKey{APIHost: key.GetApiHost(), NodeID: int(key.GetNodeId()), NodeType: key.GetNodeType()}
+}
+
+func toProtoKeys(keys []NodeKey) []*controlrpc.NodeKey {
+	nodes := make([]*controlrpc.NodeKey, len(keys))
+	for i, key := range keys {
+		nodes[i] = toProtoKey(key)
+	}
+	return nodes
+}
+
+func (s *controlServer) Status(context.Context, *controlrpc.StatusRequest) (*controlrpc.StatusResponse, error) {
+	stats := s.panel.stats()
+	resp := &controlrpc.StatusResponse{
+		Uptime:     stats.Uptime,
+		Goroutines: int32(stats.Goroutines),
+		HeapAlloc:  stats.HeapAlloc,
+		Sys:        stats.Sys,
+		Nodes:      make([]*controlrpc.NodeStatus, len(stats.Nodes)),
+	}
+	for i, n := range stats.Nodes {
+		resp.Nodes[i] = &controlrpc.NodeStatus{
+			Key:            toProtoKey(n.NodeKey),
+			Tag:            n.Tag,
+			Users:          int32(n.Users),
+			PendingTraffic: int32(n.PendingTraffic),
+			Uptime:         n.Uptime,
+		}
+	}
+	return resp, nil
+}
+
+func (s *controlServer) ListNodes(context.Context, *controlrpc.ListNodesRequest) (*controlrpc.ListNodesResponse, error) {
+	return &controlrpc.ListNodesResponse{Nodes: toProtoKeys(s.panel.Nodes())}, nil
+}
+
+func (s *controlServer) AddNode(_ context.Context, req *controlrpc.AddNodeRequest) (*controlrpc.AddNodeResponse, error) {
+	nodeConfig, err := parseNodeConfig(req.GetConfig())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.panel.AddNode(nodeConfig); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &controlrpc.AddNodeResponse{Key: toProtoKey(newNodeKey(nodeConfig))}, nil
+}
+
+func (s *controlServer) RemoveNode(_ context.Context, req *controlrpc.RemoveNodeRequest) (*controlrpc.RemoveNodeResponse, error) {
+	if err := s.panel.RemoveNode(fromProtoKey(req.GetKey())); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &controlrpc.RemoveNodeResponse{}, nil
+}
+
+func (s *controlServer) Reload(context.Context, *controlrpc.ReloadRequest) (*controlrpc.ReloadResponse, error) {
+	if err := s.panel.startReload(); err != nil {
+		return nil, status.Error(codes.Unimplemented, err.Error())
+	}
+	return &controlrpc.ReloadResponse{}, nil
+}
+
+func (s *controlServer) Drain(_ context.Context, req *controlrpc.DrainRequest) (*controlrpc.DrainResponse, error) {
+	var key *NodeKey
+	if req.GetKey() != nil {
+		k := fromProtoKey(req.GetKey())
+		key = &k
+	}
+	drained, err := s.panel.Drain(key)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &controlrpc.DrainResponse{Nodes: toProtoKeys(drained)}, nil
+}
@@ -0,0 +1,48 @@
+package panel
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/common/logarchive"
+)
+
+// archiveLogs ships the logs to the bucket every Periodic hours. The access
+// and error logs of the core are archived unless Files lists others.
+func (p *Panel) archiveLogs() {
+	defer p.wg.Done()
+	config := *p.panelConfig.LogArchiveConfig
+	if len(config.Files) == 0 && p.panelConfig.LogConfig != nil {
+		for _, file := range []string{p.panelConfig.LogConfig.AccessPath, p.panelConfig.LogConfig.ErrorPath} {
+			if file != "" && file != "none" {
+				config.Files = append(config.Files, file)
+			}
+		}
+	}
+	archive, err := logarchive.New(&config)
+	if err != nil {
+		log.Errorf("Start log archive failed: %s", err)
+		return
+	}
+	periodic := time.Duration(config.Periodic) * time.Hour
+	if periodic <= 0 {
+		periodic = 24 * time.Hour
+	}
+	ticker := time.NewTicker(periodic)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		n, err := archive.Run()
+		if err != nil {
+			log.Errorf("Archive logs failed: %s", err)
+		}
+		if n > 0 {
+			log.Printf("Archived %d log files", n)
+		}
+	}
+}
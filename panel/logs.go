@@ -0,0 +1,73 @@
+package panel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/common/logstream"
+)
+
+const (
+	logStreamBuffer    = 256 // Entries buffered for a slow client before they are dropped
+	logStreamKeepAlive = 30 * time.Second
+)
+
+// handleLogs streams the log as server-sent events, an entry in JSON per
+// event, from the level given by the level query parameter and of the module
+// prefixes given by the comma separated module one. The client is told of the
+// entries it was too slow for by a dropped event with their number.
+func (p *Panel) handleLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	level, err := logstream.ParseLevel(query.Get("level"))
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	filter := logstream.Filter{Level: level}
+	for _, m := range strings.Split(query.Get("module"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			filter.Modules = append(filter.Modules, m)
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeControlError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	sub := p.logs.Subscribe(filter, logStreamBuffer)
+	defer sub.Close()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Not buffered by nginx in front
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(logStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e := <-sub.Entries():
+			if dropped := sub.Dropped(); dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped)
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,145 @@
+package panel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/service/controller"
+)
+
+const (
+	defaultMaintenanceTimeout = 10 * time.Minute
+	// How often the connections of the nodes in maintenance are counted
+	maintenanceCheckInterval = time.Second
+)
+
+// drainRequest is the body of POST /drain, every node is drained if NodeID is 0
+type drainRequest struct {
+	NodeKey
+	Timeout int `json:"Timeout"` // Second, the node is stopped after it even with connections open
+}
+
+// Maintain drains the node with the key, or every node if key is nil, and puts
+// it in maintenance, see controller.Maintain. A node is removed once its
+// connections are closed, or after timeout. When every node is drained,
+// Maintained is closed instead, for XrayR to exit. It returns the nodes
+// drained.
+func (p *Panel) Maintain(key *NodeKey, timeout time.Duration) ([]NodeKey, error) {
+	if key == nil {
+		// No node may be added behind the maintenance
+		p.stopRemoteNodes()
+	}
+	p.access.Lock()
+	defer p.access.Unlock()
+	if !p.Running {
+		return nil, errors.New("panel is not running")
+	}
+	if timeout <= 0 {
+		timeout = defaultMaintenanceTimeout
+	}
+	maintained := make(map[NodeKey]*controller.Controller)
+	keys := make([]NodeKey, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		k := newNodeKey(n.config)
+		if key != nil && k != *key {
+			continue
+		}
+		c, ok := n.service.(*controller.Controller)
+		if !ok {
+			continue
+		}
+		if !n.drained {
+			// A failed node must not be started again behind the drain
+			n.stopSupervisor()
+			if err := c.Drain(); err != nil {
+				return keys, fmt.Errorf("drain node %s failed: %s", k, err)
+			}
+			n.drained = true
+		}
+		if err := c.Maintain(); err != nil {
+			log.Errorf("Node %s maintenance: %s", k, err)
+		}
+		log.Printf("Node %s in maintenance, stopped once its connections are closed or in %s", k, timeout)
+		maintained[k] = c
+		keys = append(keys, k)
+	}
+	if key != nil && len(keys) == 0 {
+		return nil, fmt.Errorf("node %s not found", *key)
+	}
+	go p.finishMaintenance(maintained, timeout, key == nil, p.done)
+	return keys, nil
+}
+
+// Maintained is closed once every node is done with the maintenance asked for
+// all of them
+func (p *Panel) Maintained() <-chan struct{} {
+	return p.maintained
+}
+
+// finishMaintenance stops the nodes once their connections are closed, or
+// after timeout. It gives up when the panel is closed first.
+func (p *Panel) finishMaintenance(nodes map[NodeKey]*controller.Controller, timeout time.Duration, all bool, done <-chan struct{}) {
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for len(nodes) > 0 {
+		select {
+		case <-done:
+			return
+		case <-deadline.C:
+			for k, c := range nodes {
+				log.Warnf("Node %s still has %d connections after %s, stopping it", k, c.Connections(), timeout)
+				p.endMaintenance(k, all)
+				delete(nodes, k)
+			}
+		case <-ticker.C:
+			for k, c := range nodes {
+				if c.Connections() == 0 {
+					log.Printf("Node %s has no connection left", k)
+					p.endMaintenance(k, all)
+					delete(nodes, k)
+				}
+			}
+		}
+	}
+	if all {
+		p.maintainedOnce.Do(func() { close(p.maintained) })
+	}
+}
+
+// endMaintenance removes the node, unless every node is in maintenance and
+// the panel is closed at once
+func (p *Panel) endMaintenance(key NodeKey, all bool) {
+	if all {
+		return
+	}
+	if err := p.RemoveNode(key); err != nil {
+		log.Errorf("Remove node %s failed: %s", key, err)
+	}
+}
+
+// handleDrain puts a node, or every node if the body is empty, in maintenance
+func (p *Panel) handleDrain(w http.ResponseWriter, r *http.Request) {
+	var req drainRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	var key *NodeKey
+	if req.NodeID != 0 {
+		key = &req.NodeKey
+	}
+	drained, err := p.Maintain(key, time.Duration(req.Timeout)*time.Second)
+	if err != nil {
+		writeControlError(w, http.StatusConflict, err)
+		return
+	}
+	writeControlResponse(w, http.StatusOK, drained)
+}
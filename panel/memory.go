@@ -0,0 +1,53 @@
+package panel
+
+import (
+	"math"
+	"os"
+	"runtime/debug"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lowMemoryBufferSize = 4  // kB
+	lowMemoryGCPercent  = 50 // When GCPercent is not set
+)
+
+type MemoryConfig struct {
+	Limit     int  `mapstructure:"Limit"`     // MB, 0 for no limit
+	GCPercent int  `mapstructure:"GCPercent"` // 0 for the default of Go, -1 to collect at the limit only
+	LowMemory bool `mapstructure:"LowMemory"`
+}
+
+// lowMemory reports whether the panel should save memory over throughput
+func lowMemory(c *MemoryConfig) bool {
+	return c != nil && c.LowMemory
+}
+
+// applyMemoryConfig sets the soft memory limit of the process and the GC
+// target, back to the defaults of Go for the ones not set so a reload drops
+// them. The GOMEMLIMIT and GOGC environment variables take precedence, the
+// runtime applied them already.
+func applyMemoryConfig(c *MemoryConfig) {
+	if c == nil {
+		c = &MemoryConfig{}
+	}
+	if _, ok := os.LookupEnv("GOMEMLIMIT"); !ok {
+		if c.Limit > 0 {
+			debug.SetMemoryLimit(int64(c.Limit) * 1024 * 1024)
+			log.Printf("Memory limit: %d MB", c.Limit)
+		} else {
+			debug.SetMemoryLimit(math.MaxInt64)
+		}
+	}
+	if _, ok := os.LookupEnv("GOGC"); !ok {
+		gcPercent := c.GCPercent
+		if gcPercent == 0 && c.LowMemory {
+			gcPercent = lowMemoryGCPercent
+		}
+		if gcPercent == 0 {
+			gcPercent = 100
+		}
+		debug.SetGCPercent(gcPercent)
+	}
+}
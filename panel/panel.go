@@ -1,30 +1,35 @@
 package panel
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"dario.cat/mergo"
 	"github.com/r3labs/diff/v2"
 	log "github.com/sirupsen/logrus"
+	"github.com/xtls/xray-core/app/observatory"
 	"github.com/xtls/xray-core/app/proxyman"
 	"github.com/xtls/xray-core/app/stats"
 	"github.com/xtls/xray-core/common/serial"
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/routing"
 	"github.com/xtls/xray-core/infra/conf"
+	"google.golang.org/grpc"
 
-	"github.com/qtai2901/new_xrayr/api"
-	"github.com/qtai2901/new_xrayr/api/bunpanel"
-	"github.com/qtai2901/new_xrayr/api/gov2panel"
-	"github.com/qtai2901/new_xrayr/api/newV2board"
-	"github.com/qtai2901/new_xrayr/api/v2board"
-	"github.com/qtai2901/new_xrayr/api/pmpanel"
-	"github.com/qtai2901/new_xrayr/api/proxypanel"
-	"github.com/qtai2901/new_xrayr/api/sspanel"
-	"github.com/qtai2901/new_xrayr/api/v2raysocks"
 	"github.com/qtai2901/new_xrayr/app/mydispatcher"
 	_ "github.com/qtai2901/new_xrayr/cmd/distro/all"
+	"github.com/qtai2901/new_xrayr/common/logstream"
+	"github.com/qtai2901/new_xrayr/common/mailer"
+	"github.com/qtai2901/new_xrayr/common/telegram"
+	"github.com/qtai2901/new_xrayr/common/webhook"
 	"github.com/qtai2901/new_xrayr/service"
 	"github.com/qtai2901/new_xrayr/service/controller"
 )
@@ -34,12 +39,55 @@ type Panel struct {
 	access      sync.Mutex
 	panelConfig *Config
 	Server      *core.Instance
-	Service     []service.Service
+	nodes       []*node
 	Running     bool
+	done        chan struct{}
+	wg          sync.WaitGroup
+	attempted   sync.WaitGroup
+	starting    chan struct{} // bounds the nodes starting at once
+	control     *http.Server
+	admin       *http.Server
+	grpcServer  *grpc.Server
+	reload      func() error // Set by SetReload
+	startAt     time.Time
+	bot         atomic.Pointer[telegram.Bot]      // nil unless the Telegram bot is on
+	mailer      atomic.Pointer[mailer.Mailer]     // nil unless the alerts are mailed
+	webhooks    atomic.Pointer[[]*webhook.Sender] // nil unless a webhook is on
+	logs        *logstream.Hub                    // Subscribed to by the log stream of the admin API
+	// Set while the nodes of the remote config are followed
+	remoteCancel context.CancelFunc
+	remoteExited chan struct{}
+	// Closed once every node is done with its maintenance, see Maintain
+	maintained     chan struct{}
+	maintainedOnce sync.Once
 }
 
+// node is a running node service along with the config it was created from
+type node struct {
+	config  *NodesConfig
+	service service.Service
+	stop    chan struct{} // closed to stop the supervisor of this node only
+	exited  chan struct{} // closed when the supervisor returns
+	closing sync.Once
+	drained bool // Set by Drain, no longer accepting new connections
+}
+
+// stopSupervisor stops restarting the node and waits for its supervisor to
+// return, it is safe to call more than once
+func (n *node) stopSupervisor() {
+	n.closing.Do(func() { close(n.stop) })
+	<-n.exited
+}
+
+const (
+	nodeRetryInitialDelay   = 5 * time.Second
+	nodeRetryMaxDelay       = 5 * time.Minute
+	defaultStartConcurrency = 16
+)
+
 func New(panelConfig *Config) *Panel {
-	p := &Panel{panelConfig: panelConfig}
+	p := &Panel{panelConfig: panelConfig, logs: logstream.NewHub(), maintained: make(chan struct{})}
+	log.AddHook(logstream.LogrusHook{Hub: p.logs})
 	return p
 }
 
@@ -68,6 +116,11 @@ func (p *Panel) loadCore(panelConfig *Config) *core.Instance {
 		}
 	}
 
+	// Every answer is cached until it expires otherwise
+	if lowMemory(panelConfig.MemoryConfig) {
+		coreDnsConfig.DisableCache = true
+	}
+
 	// init controller's DNS config
 	// for _, config := range p.panelConfig.NodesConfig {
 	// 	config.ControllerConfig.DNSConfig = coreDnsConfig
@@ -89,10 +142,6 @@ func (p *Panel) loadCore(panelConfig *Config) *core.Instance {
 			}
 		}
 	}
-	routeConfig, err := coreRouterConfig.Build()
-	if err != nil {
-		log.Panicf("Failed to understand Routing config  Please check: https://xtls.github.io/config/routing.html for help: %s", err)
-	}
 	// Custom Inbound config
 	var coreCustomInboundConfig []conf.InboundDetourConfig
 	if panelConfig.InboundConfigPath != "" {
@@ -123,6 +172,16 @@ func (p *Panel) loadCore(panelConfig *Config) *core.Instance {
 			}
 		}
 	}
+	// Custom config fragments, merged into the outbounds and routing above
+	if panelConfig.CustomConfigDir != "" {
+		if coreCustomOutboundConfig, err = loadCustomConfigs(panelConfig.CustomConfigDir, coreCustomOutboundConfig, coreRouterConfig); err != nil {
+			log.Panicf("Failed to load custom config: %s", err)
+		}
+	}
+	routeConfig, err := coreRouterConfig.Build()
+	if err != nil {
+		log.Panicf("Failed to understand Routing config  Please check: https://xtls.github.io/config/routing.html for help: %s", err)
+	}
 	var outBoundConfig []*core.OutboundHandlerConfig
 	for _, config := range coreCustomOutboundConfig {
 		oc, err := config.Build()
@@ -132,9 +191,18 @@ func (p *Panel) loadCore(panelConfig *Config) *core.Instance {
 		outBoundConfig = append(outBoundConfig, oc)
 	}
 	// Policy config
-	levelPolicyConfig := parseConnectionConfig(panelConfig.ConnectionConfig)
+	levelPolicyConfig := parseConnectionConfig(panelConfig.ConnectionConfig, lowMemory(panelConfig.MemoryConfig))
 	corePolicyConfig := &conf.PolicyConfig{}
 	corePolicyConfig.Levels = map[uint32]*conf.Policy{0: levelPolicyConfig}
+	// Every node with its own timeouts gets a level of its own
+	level := uint32(0)
+	for _, nodeConfig := range panelConfig.NodesConfig {
+		if c := nodeConfig.ControllerConfig; c != nil && c.ConnectionConfig != nil {
+			level++
+			c.ConnectionConfig.Level = level
+			corePolicyConfig.Levels[level] = nodePolicy(levelPolicyConfig, c.ConnectionConfig)
+		}
+	}
 	policyConfig, _ := corePolicyConfig.Build()
 	// Build Core Config
 	config := &core.Config{
@@ -151,6 +219,10 @@ func (p *Panel) loadCore(panelConfig *Config) *core.Instance {
 		Inbound:  inBoundConfig,
 		Outbound: outBoundConfig,
 	}
+	// Observatory for the leastPing balancers of the nodes
+	if needObservatory(panelConfig.NodesConfig) {
+		config.App = append(config.App, serial.ToTypedMessage(buildObservatoryConfig(panelConfig.ObservatoryConfig)))
+	}
 	server, err := core.New(config)
 	if err != nil {
 		log.Panicf("failed to create instance: %s", err)
@@ -159,88 +231,480 @@ func (p *Panel) loadCore(panelConfig *Config) *core.Instance {
 	return server
 }
 
+// dispatcherOf returns the dispatcher of the core, nil when it is not running
+func dispatcherOf(server *core.Instance) *mydispatcher.DefaultDispatcher {
+	if server == nil {
+		return nil
+	}
+	dispatcher, _ := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispatcher
+}
+
 // Start the panel
 func (p *Panel) Start() {
 	p.access.Lock()
 	defer p.access.Unlock()
 	log.Print("Start the panel..")
+	applyMemoryConfig(p.panelConfig.MemoryConfig)
+	applyCPUConfig(p.panelConfig.CPUConfig)
+	p.loadGeoData()
 	// Load Core
 	server := p.loadCore(p.panelConfig)
 	if err := server.Start(); err != nil {
 		log.Panicf("Failed to start instance: %s", err)
 	}
 	p.Server = server
+	p.done = make(chan struct{})
+	startConcurrency := p.panelConfig.StartConcurrency
+	if startConcurrency <= 0 {
+		startConcurrency = defaultStartConcurrency
+	}
+	p.starting = make(chan struct{}, startConcurrency)
+	banned, err := p.startBan(server)
+	if err != nil {
+		log.Errorf("Start ban failed: %s", err)
+	}
+	if err := p.hookCoreLog(server, banned); err != nil {
+		log.Errorf("Hook the log of the core failed: %s", err)
+	}
+
+	if err := p.startTelegram(); err != nil {
+		log.Errorf("Start telegram bot failed: %s", err)
+	}
+	if err := p.startMailer(); err != nil {
+		log.Errorf("Start mailer failed: %s", err)
+	}
+	if err := p.startWebhooks(); err != nil {
+		log.Errorf("Start webhook failed: %s", err)
+	}
+	if p.alerting() && p.panelConfig.DiskAlertPercent >= 0 {
+		p.wg.Add(1)
+		go p.monitorDisks()
+	}
+
+	p.loadASNDatabase()
+	if c := p.panelConfig.ASNConfig; c != nil && c.DatabasePath != "" && c.UpdatePeriodic > 0 {
+		p.wg.Add(1)
+		go p.updateASNDatabase()
+	}
+	p.loadGeoIPDatabase()
+	if c := p.panelConfig.GeoIPConfig; c != nil && c.DatabasePath != "" && c.UpdatePeriodic > 0 {
+		p.wg.Add(1)
+		go p.updateGeoIPDatabase()
+	}
+	if c := p.panelConfig.GeoDataConfig; c != nil && c.Enable && c.UpdatePeriodic > 0 {
+		p.wg.Add(1)
+		go p.updateGeoData()
+	}
+	if c := p.panelConfig.LogArchiveConfig; c != nil && c.Enable {
+		p.wg.Add(1)
+		go p.archiveLogs()
+	}
+	p.loadBlocklist()
+	if c := p.panelConfig.BlocklistConfig; c != nil && c.Enable && c.UpdatePeriodic > 0 {
+		p.wg.Add(1)
+		go p.updateBlocklist()
+	}
 
 	// Load Nodes config
 	for _, nodeConfig := range p.panelConfig.NodesConfig {
-		var apiClient api.API
-		switch nodeConfig.PanelType {
-		case "SSpanel":
-			apiClient = sspanel.New(nodeConfig.ApiConfig)
-		case "NewV2board":
-			apiClient = newV2board.New(nodeConfig.ApiConfig)
-		case "V2board":
-			apiClient = v2board.New(nodeConfig.ApiConfig)
-		case "PMpanel":
-			apiClient = pmpanel.New(nodeConfig.ApiConfig)
-		case "Proxypanel":
-			apiClient = proxypanel.New(nodeConfig.ApiConfig)
-		case "V2RaySocks":
-			apiClient = v2raysocks.New(nodeConfig.ApiConfig)
-		case "GoV2Panel":
-			apiClient = gov2panel.New(nodeConfig.ApiConfig)
-		case "BunPanel":
-			apiClient = bunpanel.New(nodeConfig.ApiConfig)
-		default:
-			log.Panicf("Unsupport panel type: %s", nodeConfig.PanelType)
-		}
-		var controllerService service.Service
-		// Register controller service
-		controllerConfig := getDefaultControllerConfig()
-		if nodeConfig.ControllerConfig != nil {
-			if err := mergo.Merge(controllerConfig, nodeConfig.ControllerConfig, mergo.WithOverride); err != nil {
-				log.Panicf("Read Controller Config Failed")
-			}
+		if err := p.addNode(nodeConfig); err != nil {
+			log.Errorf("Skip node: %s", err)
 		}
-		controllerService = controller.New(server, apiClient, controllerConfig, nodeConfig.PanelType)
-		p.Service = append(p.Service, controllerService)
+	}
+	if err := p.startControl(); err != nil {
+		log.Errorf("Start control socket failed: %s", err)
+	}
+	if err := p.startAdminAPI(); err != nil {
+		log.Errorf("Start admin API failed: %s", err)
+	}
+	if err := p.startGRPC(); err != nil {
+		log.Errorf("Start gRPC control failed: %s", err)
+	}
+	if err := p.startRemoteNodes(); err != nil {
+		log.Errorf("Start remote nodes failed: %s", err)
+	}
+	p.startAt = time.Now()
+	p.Running = true
+	return
+}
+
+// addNode creates the service of a node and starts it in its own supervised goroutine
+func (p *Panel) addNode(nodeConfig *NodesConfig) error {
+	if nodeConfig.ApiConfig == nil {
+		return fmt.Errorf("%s node has no ApiConfig", nodeConfig.PanelType)
+	}
+	key := newNodeKey(nodeConfig)
+	for _, n := range p.nodes {
+		if newNodeKey(n.config) == key {
+			return fmt.Errorf("node %s already exists", key)
+		}
+	}
+	controllerService, err := p.newNodeService(p.Server, nodeConfig)
+	if err != nil {
+		return err
+	}
+	n := &node{
+		config:  nodeConfig,
+		service: controllerService,
+		stop:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	p.nodes = append(p.nodes, n)
+	p.wg.Add(1)
+	p.attempted.Add(1)
+	go p.superviseService(n)
+	return nil
+}
+
+// AddNode attaches a new node to the running panel
+func (p *Panel) AddNode(nodeConfig *NodesConfig) error {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if !p.Running {
+		return errors.New("panel is not running")
+	}
+	if err := p.addNode(nodeConfig); err != nil {
+		return err
+	}
+	// The policy levels of the core are only built on start
+	if c := nodeConfig.ControllerConfig; c != nil && c.ConnectionConfig != nil {
+		log.Warnf("Node %s uses the global connection timeouts until XrayR restarts", newNodeKey(nodeConfig))
+	}
+	log.Printf("Node %s added", newNodeKey(nodeConfig))
+	return nil
+}
 
+// RemoveNode stops the node with the given key and detaches it from the panel
+func (p *Panel) RemoveNode(key NodeKey) error {
+	p.access.Lock()
+	defer p.access.Unlock()
+	for i, n := range p.nodes {
+		if newNodeKey(n.config) != key {
+			continue
+		}
+		n.stopSupervisor()
+		if err := safeClose(n.service); err != nil {
+			log.Errorf("Node %s close failed: %s", key, err)
+		}
+		p.nodes = append(p.nodes[:i], p.nodes[i+1:]...)
+		log.Printf("Node %s removed", key)
+		return nil
 	}
+	return fmt.Errorf("node %s not found", key)
+}
 
-	// Start all the service
-	for _, s := range p.Service {
-		err := s.Start()
+// restartNode closes the node with the given key and starts it again from its
+// config, fetching everything from the panel anew
+func (p *Panel) restartNode(key NodeKey) error {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if !p.Running {
+		return errors.New("panel is not running")
+	}
+	for i, n := range p.nodes {
+		if newNodeKey(n.config) != key {
+			continue
+		}
+		n.stopSupervisor()
+		if err := safeClose(n.service); err != nil {
+			log.Errorf("Node %s close failed: %s", key, err)
+		}
+		controllerService, err := p.newNodeService(p.Server, n.config)
 		if err != nil {
-			log.Panicf("Panel Start fialed: %s", err)
+			p.nodes = append(p.nodes[:i], p.nodes[i+1:]...)
+			return err
+		}
+		restarted := &node{
+			config:  n.config,
+			service: controllerService,
+			stop:    make(chan struct{}),
+			exited:  make(chan struct{}),
 		}
+		p.nodes[i] = restarted
+		p.wg.Add(1)
+		p.attempted.Add(1)
+		go p.superviseService(restarted)
+		log.Printf("Node %s restarted", key)
+		return nil
 	}
-	p.Running = true
-	return
+	return fmt.Errorf("node %s not found", key)
+}
+
+// Nodes returns the keys of all nodes of the panel
+func (p *Panel) Nodes() []NodeKey {
+	p.access.Lock()
+	defer p.access.Unlock()
+	keys := make([]NodeKey, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		keys = append(keys, newNodeKey(n.config))
+	}
+	return keys
+}
+
+// WaitStarted blocks until every node has made its first start attempt,
+// so the listeners of the healthy nodes are up when it returns.
+func (p *Panel) WaitStarted() {
+	p.attempted.Wait()
+}
+
+// newNodeService builds the controller service of a single node.
+func (p *Panel) newNodeService(server *core.Instance, nodeConfig *NodesConfig) (s service.Service, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while creating node: %v", r)
+		}
+	}()
+
+	controllerConfig := getDefaultControllerConfig()
+	if nodeConfig.ControllerConfig != nil {
+		if err := mergo.Merge(controllerConfig, nodeConfig.ControllerConfig, mergo.WithOverride); err != nil {
+			return nil, fmt.Errorf("read controller config failed: %s", err)
+		}
+	}
+	// The api clients keep their state next to the one of the controller
+	apiConfig := *nodeConfig.ApiConfig
+	apiConfig.DataDir = controllerConfig.DataDir
+	if err := apiConfig.Resolver.Check(); err != nil {
+		return nil, err
+	}
+	if err := apiConfig.Connection.Check(); err != nil {
+		return nil, err
+	}
+	if err := apiConfig.Retry.Check(); err != nil {
+		return nil, err
+	}
+
+	newClient, ok := panelClients[nodeConfig.PanelType]
+	if !ok {
+		return nil, fmt.Errorf("unsupport panel type: %s", nodeConfig.PanelType)
+	}
+	apiClient := newClient(&apiConfig)
+	// Register controller service
+	c := controller.New(server, apiClient, controllerConfig, nodeConfig.PanelType)
+	key := newNodeKey(nodeConfig)
+	c.SetNotify(func(event, text string, data any) { p.notify(event, &key, text, data) })
+	c.SetEvents(func(event, text string, data any) { p.sendEvent(event, &key, text, data) })
+	c.SetRestart(func() {
+		// The node is closed by the restart, not from its own task
+		go func() {
+			if err := p.restartNode(key); err != nil {
+				log.Errorf("Restart node %s failed: %s", key, err)
+			}
+		}()
+	})
+	return c, nil
+}
+
+// superviseService keeps trying to start a node until it succeeds or the
+// panel is closed. Errors and panics are contained to the failing node.
+func (p *Panel) superviseService(n *node) {
+	defer p.wg.Done()
+	defer close(n.exited)
+	s := n.service
+	name := fmt.Sprintf("%s(ID=%d)", n.config.PanelType, n.config.ApiConfig.NodeID)
+	key := newNodeKey(n.config)
+	delay := nodeRetryInitialDelay
+	attempted, failed := false, false
+	defer func() {
+		// Stopped while waiting for its turn
+		if !attempted {
+			p.attempted.Done()
+		}
+	}()
+	for {
+		// Starting fetches the node from the panel and builds its inbounds,
+		// only so many nodes do it at once
+		select {
+		case p.starting <- struct{}{}:
+		case <-p.done:
+			return
+		case <-n.stop:
+			return
+		}
+		err := safeStart(s)
+		<-p.starting
+		if !attempted {
+			attempted = true
+			p.attempted.Done()
+		}
+		if err == nil {
+			if failed {
+				p.notify(webhook.NodeRecovered, &key, "Started after failing", nil)
+			}
+			return
+		}
+		log.Errorf("Node %s start failed, retry in %s: %s", name, delay, err)
+		if !failed {
+			failed = true
+			p.notify(webhook.NodeStartFailed, &key, "Start failed, retrying: "+err.Error(), nil)
+		}
+		if err := safeClose(s); err != nil {
+			log.Errorf("Node %s close failed: %s", name, err)
+		}
+		select {
+		case <-p.done:
+			return
+		case <-n.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > nodeRetryMaxDelay {
+			delay = nodeRetryMaxDelay
+		}
+	}
+}
+
+func safeStart(s service.Service) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.Start()
+}
+
+func safeClose(s service.Service) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.Close()
 }
 
 // Close the panel
 func (p *Panel) Close() {
+	p.stopRemoteNodes()
 	p.access.Lock()
 	defer p.access.Unlock()
-	for _, s := range p.Service {
-		err := s.Close()
-		if err != nil {
-			log.Panicf("Panel Close fialed: %s", err)
+	p.stopSupervisors()
+	p.stopControl()
+	p.stopAdminAPI()
+	p.stopGRPC()
+	p.stopTelegram()
+	for _, n := range p.nodes {
+		if err := safeClose(n.service); err != nil {
+			log.Errorf("Panel Close fialed: %s", err)
 		}
 	}
-	p.Service = nil
+	// After the nodes, for their stopped events and last alerts
+	p.stopWebhooks()
+	p.stopMailer()
+	p.nodes = nil
 	p.Server.Close()
 	p.Running = false
 	return
 }
 
-func parseConnectionConfig(c *ConnectionConfig) (policy *conf.Policy) {
+// Shutdown stops every node from accepting new connections, gives the
+// established ones the drain window to finish, then closes the panel so
+// the nodes flush their pending reports.
+func (p *Panel) Shutdown(drain time.Duration) {
+	p.stopRemoteNodes()
+	p.access.Lock()
+	p.stopSupervisors()
+	for _, n := range p.nodes {
+		if n.drained {
+			continue
+		}
+		if d, ok := n.service.(service.Drain); ok {
+			if err := d.Drain(); err != nil {
+				log.Errorf("Panel Drain failed: %s", err)
+			}
+		}
+	}
+	p.access.Unlock()
+
+	if drain > 0 {
+		log.Printf("Waiting %s for the established connections", drain)
+		time.Sleep(drain)
+	}
+	p.Close()
+}
+
+// Drain stops the node with the key, or every node if key is nil, from
+// accepting new connections. The established ones keep running until the
+// node is removed or the panel closed. It returns the nodes drained.
+func (p *Panel) Drain(key *NodeKey) ([]NodeKey, error) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	drained := make([]NodeKey, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		k := newNodeKey(n.config)
+		if key != nil && k != *key {
+			continue
+		}
+		d, ok := n.service.(service.Drain)
+		if !ok {
+			continue
+		}
+		if !n.drained {
+			// A failed node must not be started again behind the drain
+			n.stopSupervisor()
+			if err := d.Drain(); err != nil {
+				return drained, fmt.Errorf("drain node %s failed: %s", k, err)
+			}
+			n.drained = true
+			log.Printf("Node %s drained", k)
+		}
+		drained = append(drained, k)
+	}
+	if key != nil && len(drained) == 0 {
+		return nil, fmt.Errorf("node %s not found", *key)
+	}
+	return drained, nil
+}
+
+// stopSupervisors stops restarting the failed nodes, it is safe to call more than once
+func (p *Panel) stopSupervisors() {
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	p.wg.Wait()
+}
+
+func needObservatory(nodesConfig []*NodesConfig) bool {
+	for _, nodeConfig := range nodesConfig {
+		if nodeConfig.ControllerConfig == nil {
+			continue
+		}
+		if b := nodeConfig.ControllerConfig.BalancerConfig; b != nil && b.Enable && strings.EqualFold(b.Strategy, "leastPing") {
+			return true
+		}
+	}
+	return false
+}
+
+func buildObservatoryConfig(c *ObservatoryConfig) *observatory.Config {
+	observatoryConfig := getDefaultObservatoryConfig()
+	if c != nil && c.ProbeURL != "" {
+		observatoryConfig.ProbeURL = c.ProbeURL
+	}
+	if c != nil && c.ProbeInterval > 0 {
+		observatoryConfig.ProbeInterval = c.ProbeInterval
+	}
+	return &observatory.Config{
+		SubjectSelector: []string{"balancer_"},
+		ProbeUrl:        observatoryConfig.ProbeURL,
+		ProbeInterval:   int64(time.Duration(observatoryConfig.ProbeInterval) * time.Second),
+		// Probing concurrently also keeps it from spinning when no member exists
+		EnableConcurrency: true,
+	}
+}
+
+func parseConnectionConfig(c *ConnectionConfig, lowMemory bool) (policy *conf.Policy) {
 	connectionConfig := getDefaultConnectionConfig()
 	if c != nil {
 		if _, err := diff.Merge(connectionConfig, c, connectionConfig); err != nil {
 			log.Panicf("Read ConnectionConfig failed: %s", err)
 		}
 	}
+	if lowMemory && connectionConfig.BufferSize > lowMemoryBufferSize {
+		connectionConfig.BufferSize = lowMemoryBufferSize
+	}
 	policy = &conf.Policy{
 		StatsUserUplink:   true,
 		StatsUserDownlink: true,
@@ -253,3 +717,18 @@ func parseConnectionConfig(c *ConnectionConfig) (policy *conf.Policy) {
 
 	return
 }
+
+// nodePolicy returns the policy with the timeouts set by the node replaced
+func nodePolicy(policy *conf.Policy, c *controller.ConnectionConfig) *conf.Policy {
+	nodePolicy := *policy
+	if c.ConnIdle > 0 {
+		nodePolicy.ConnectionIdle = &c.ConnIdle
+	}
+	if c.UplinkOnly > 0 {
+		nodePolicy.UplinkOnly = &c.UplinkOnly
+	}
+	if c.DownlinkOnly > 0 {
+		nodePolicy.DownlinkOnly = &c.DownlinkOnly
+	}
+	return &nodePolicy
+}
@@ -0,0 +1,105 @@
+package panel
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/common/remoteconfig"
+)
+
+// remoteNode is a node added from the remote config, along with the value it was parsed from
+type remoteNode struct {
+	key  NodeKey
+	data []byte
+}
+
+// startRemoteNodes follows the nodes defined in etcd or Consul. They are
+// added next to the nodes of the config file, and replaced or removed as
+// their keys change.
+func (p *Panel) startRemoteNodes() error {
+	c := p.panelConfig.RemoteNodesConfig
+	if c == nil || !c.Enable || p.remoteCancel != nil {
+		return nil
+	}
+	watcher, err := remoteconfig.New(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan struct{})
+	p.remoteCancel, p.remoteExited = cancel, exited
+	go func() {
+		defer close(exited)
+		p.watchRemoteNodes(ctx, watcher)
+	}()
+	return nil
+}
+
+// stopRemoteNodes stops following the remote config. It must be called
+// without holding the panel lock, the watcher may be waiting for it.
+func (p *Panel) stopRemoteNodes() {
+	p.access.Lock()
+	cancel, exited := p.remoteCancel, p.remoteExited
+	p.remoteCancel, p.remoteExited = nil, nil
+	p.access.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-exited
+}
+
+func (p *Panel) watchRemoteNodes(ctx context.Context, watcher remoteconfig.Watcher) {
+	applied := make(map[string]*remoteNode) // Key: key under the prefix
+	delay := nodeRetryInitialDelay
+	for {
+		values, err := watcher.Next(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("Watch remote nodes failed, retry in %s: %s", delay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, nodeRetryMaxDelay)
+			continue
+		}
+		delay = nodeRetryInitialDelay
+		p.applyRemoteNodes(ctx, applied, values)
+	}
+}
+
+// applyRemoteNodes removes the nodes whose keys are gone or changed, then
+// adds the new ones
+func (p *Panel) applyRemoteNodes(ctx context.Context, applied map[string]*remoteNode, values map[string][]byte) {
+	for name, n := range applied {
+		if data, ok := values[name]; ok && bytes.Equal(data, n.data) {
+			continue
+		}
+		if err := p.RemoveNode(n.key); err != nil {
+			log.Errorf("Remove remote node %s failed: %s", name, err)
+		}
+		delete(applied, name)
+	}
+	for name, data := range values {
+		if _, ok := applied[name]; ok || ctx.Err() != nil {
+			continue
+		}
+		nodeConfig, err := parseNodeConfig(data)
+		if err != nil {
+			log.Errorf("Skip remote node %s: %s", name, err)
+			continue
+		}
+		if err := p.AddNode(nodeConfig); err != nil {
+			log.Errorf("Skip remote node %s: %s", name, err)
+			continue
+		}
+		applied[name] = &remoteNode{key: newNodeKey(nodeConfig), data: data}
+	}
+}
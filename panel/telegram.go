@@ -0,0 +1,123 @@
+package panel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/common/telegram"
+	"github.com/qtai2901/new_xrayr/service/controller"
+)
+
+// startTelegram starts the bot of TelegramConfig, sending the alerts of the
+// panel and its nodes and answering the commands of the admins
+func (p *Panel) startTelegram() error {
+	c := p.panelConfig.TelegramConfig
+	if c == nil || !c.Enable || p.bot.Load() != nil {
+		return nil
+	}
+	bot, err := telegram.New(c)
+	if err != nil {
+		return err
+	}
+	bot.Handle("status", p.telegramStatus)
+	bot.Handle("nodes", p.telegramNodes)
+	bot.Handle("online", p.telegramOnline)
+	bot.Start()
+	p.bot.Store(bot)
+	log.Print("Telegram bot started")
+	return nil
+}
+
+func (p *Panel) stopTelegram() {
+	if bot := p.bot.Swap(nil); bot != nil {
+		bot.Close()
+	}
+}
+
+func (p *Panel) telegramStatus([]string) string {
+	stats := p.stats()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Uptime %s, %d nodes, %d goroutines, %s heap\n",
+		time.Duration(stats.Uptime)*time.Second, len(stats.Nodes), stats.Goroutines, formatBytes(stats.HeapAlloc))
+	for _, n := range stats.Nodes {
+		fmt.Fprintf(&b, "%s %d: %d users, %d online, %s up, %s down\n",
+			n.NodeType, n.NodeID, n.Users, n.OnlineUsers, formatBytes(n.Upload), formatBytes(n.Download))
+		for _, e := range n.Endpoints {
+			if e.Failures > 0 {
+				fmt.Fprintf(&b, "  %s failed %d times, last success %s: %s\n",
+					e.Endpoint, e.Failures, formatSince(e.LastSuccess), e.LastError)
+			}
+		}
+	}
+	return b.String()
+}
+
+func (p *Panel) telegramNodes([]string) string {
+	var b strings.Builder
+	for _, key := range p.Nodes() {
+		fmt.Fprintln(&b, key)
+	}
+	if b.Len() == 0 {
+		return "No nodes"
+	}
+	return b.String()
+}
+
+// telegramOnline answers /online <NodeID> [NodeType] with the users online
+// at the last online report of the node
+func (p *Panel) telegramOnline(args []string) string {
+	if len(args) == 0 {
+		return "Usage: /online <NodeID> [NodeType]"
+	}
+	nodeID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "Invalid NodeID: " + args[0]
+	}
+	var c *controller.Controller
+	for _, key := range p.Nodes() {
+		if key.NodeID == nodeID && (len(args) < 2 || strings.EqualFold(key.NodeType, args[1])) {
+			if c != nil {
+				return "More than one node has this ID, give the NodeType too"
+			}
+			c = p.controllerOf(key)
+		}
+	}
+	if c == nil {
+		return fmt.Sprintf("Node %d not found", nodeID)
+	}
+	online := c.Online()
+	if len(online) == 0 {
+		return "No users online"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d users online\n", len(online))
+	for _, u := range online {
+		fmt.Fprintf(&b, "%d: %s\n", u.UID, strings.Join(u.IPs, ", "))
+	}
+	return b.String()
+}
+
+// formatSince returns how long ago the Unix time t was, never if it is 0
+func formatSince(t int64) string {
+	if t == 0 {
+		return "never"
+	}
+	return time.Since(time.Unix(t, 0)).Round(time.Second).String() + " ago"
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,74 @@
+package panel
+
+import (
+	"errors"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qtai2901/new_xrayr/common/webhook"
+)
+
+// startWebhooks starts posting the events of the nodes to the webhooks of
+// WebhookConfig and WebhookConfigs. The ones failing to start are left out.
+func (p *Panel) startWebhooks() error {
+	if p.webhooks.Load() != nil {
+		return nil
+	}
+	configs := p.panelConfig.WebhookConfigs
+	if c := p.panelConfig.WebhookConfig; c != nil {
+		configs = append([]*webhook.Config{c}, configs...)
+	}
+	var senders []*webhook.Sender
+	var errs []error
+	for _, c := range configs {
+		if c == nil || !c.Enable {
+			continue
+		}
+		sender, err := webhook.New(c)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		senders = append(senders, sender)
+		// The path of a Discord or Slack webhook is its secret
+		host := c.URL
+		if u, err := url.Parse(c.URL); err == nil {
+			host = u.Host
+		}
+		format := c.Format
+		if format == "" {
+			format = webhook.FormatJSON
+		}
+		log.Printf("Webhook events go to %s in %s", host, format)
+	}
+	if len(senders) > 0 {
+		p.webhooks.Store(&senders)
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Panel) stopWebhooks() {
+	if senders := p.webhooks.Swap(nil); senders != nil {
+		for _, sender := range *senders {
+			sender.Close()
+		}
+	}
+}
+
+// sendEvent posts the event to the webhooks on. key is the node it is about,
+// nil for the panel itself. It doesn't take the lock of the panel, the nodes
+// call it.
+func (p *Panel) sendEvent(event string, key *NodeKey, text string, data any) {
+	senders := p.webhooks.Load()
+	if senders == nil {
+		return
+	}
+	var node *webhook.Node
+	if key != nil {
+		node = &webhook.Node{APIHost: key.APIHost, NodeID: key.NodeID, NodeType: key.NodeType}
+	}
+	for _, sender := range *senders {
+		sender.Send(event, node, text, data)
+	}
+}
@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+const (
+	// Audit hits kept for the admin API, per node
+	maxRecentAudits = 100
+	// Time over its interval a user sync may take, for the timeouts of the
+	// requests to the panel
+	syncStallGrace = 2 * time.Minute
+)
+
+// UserEntry is a user of the node as shown by the admin API, without its
+// credentials
+type UserEntry struct {
+	UID         int    `json:"UID"`
+	SpeedLimit  uint64 `json:"SpeedLimit"` // Bps
+	DeviceLimit int    `json:"DeviceLimit"`
+	ExpiredAt   int64  `json:"ExpiredAt,omitempty"`
+	Tag         string `json:"Tag,omitempty"`
+}
+
+// Stats is the state of the node as shown by the admin API
+type Stats struct {
+	Tag            string               `json:"Tag"`
+	Users          int                  `json:"Users"`
+	PendingTraffic int                  `json:"PendingTraffic"`      // Users whose traffic waits for the panel to accept it
+	Uptime         int64                `json:"Uptime"`              // Second
+	Upload         uint64               `json:"Upload"`              // Byte, since the node started
+	Download       uint64               `json:"Download"`            // Byte, since the node started
+	OnlineUsers    int                  `json:"OnlineUsers"`         // At the last online report
+	OnlineIPs      int                  `json:"OnlineIPs"`           // At the last online report
+	Breaker        string               `json:"Breaker,omitempty"`   // State of the circuit breaker of the panel calls, if enabled
+	Endpoints      []api.EndpointHealth `json:"Endpoints,omitempty"` // Health of the endpoints of the panel called so far
+}
+
+// OnlineEntry is a user online at the last online report
+type OnlineEntry struct {
+	UID int      `json:"UID"`
+	IPs []string `json:"IPs"`
+}
+
+// AuditHit is a connection of a user matching an audit rule
+type AuditHit struct {
+	UID    int   `json:"UID"`
+	RuleID int   `json:"RuleID"`
+	Time   int64 `json:"Time"` // Unix time it was reported at
+}
+
+// recentActivity keeps what the reports took out of the limiter and the rule
+// manager, for the admin API to show
+type recentActivity struct {
+	access sync.Mutex
+	online []api.OnlineUser
+	audits []AuditHit // Oldest first
+}
+
+func (r *recentActivity) setOnline(onlineUser []api.OnlineUser) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	r.online = onlineUser
+}
+
+func (r *recentActivity) addAudits(detectResult []api.DetectResult) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	now := time.Now().Unix()
+	for _, d := range detectResult {
+		r.audits = append(r.audits, AuditHit{UID: d.UID, RuleID: d.RuleID, Time: now})
+	}
+	if n := len(r.audits) - maxRecentAudits; n > 0 {
+		r.audits = append(r.audits[:0], r.audits[n:]...)
+	}
+}
+
+// Users returns the users the node serves
+func (c *Controller) Users() []UserEntry {
+	c.access.Lock()
+	userList := c.userList
+	c.access.Unlock()
+	if userList == nil {
+		return []UserEntry{}
+	}
+	users := make([]UserEntry, len(*userList))
+	for i, u := range *userList {
+		users[i] = UserEntry{
+			UID:         u.UID,
+			SpeedLimit:  u.SpeedLimit,
+			DeviceLimit: u.DeviceLimit,
+			ExpiredAt:   u.ExpiredAt,
+			Tag:         u.Tag,
+		}
+	}
+	return users
+}
+
+// KickUser closes the connections the user has open on the node, and
+// reports whether the node serves the user and there were any
+func (c *Controller) KickUser(uid int) bool {
+	c.access.Lock()
+	tag, userList := c.Tag, c.userList
+	c.access.Unlock()
+	if userList == nil {
+		return false
+	}
+	for _, u := range *userList {
+		if u.UID == uid {
+			return c.dispatcher.Limiter.Kick(tag, userEmail(tag, &u))
+		}
+	}
+	return false
+}
+
+// Stats returns the state of the node
+func (c *Controller) Stats() Stats {
+	c.access.Lock()
+	tag, userList, trafficQueue := c.Tag, c.userList, c.trafficQueue
+	c.access.Unlock()
+	stats := Stats{
+		Tag:    tag,
+		Uptime: int64(time.Since(c.startAt) / time.Second),
+	}
+	if userList != nil {
+		stats.Users = len(*userList)
+	}
+	if trafficQueue != nil {
+		stats.PendingTraffic = trafficQueue.Len()
+	}
+	stats.Upload, stats.Download = c.dispatcher.Limiter.TotalTraffic(tag)
+	online := c.Online()
+	stats.OnlineUsers = len(online)
+	for _, o := range online {
+		stats.OnlineIPs += len(o.IPs)
+	}
+	if b, ok := c.apiClient.(api.Breakable); ok && b.Breaker() != nil {
+		stats.Breaker = b.Breaker().State()
+	}
+	if h, ok := c.apiClient.(api.HealthReporter); ok {
+		stats.Endpoints = h.Health()
+	}
+	return stats
+}
+
+// Health returns why the node is unhealthy, nil if it is started and the
+// panel answers its syncs
+func (c *Controller) Health() error {
+	if c.maintenance.Load() {
+		return errors.New("in maintenance")
+	}
+	if !c.started.Load() {
+		return errors.New("not started")
+	}
+	if c.syncsFailing.Load() > 0 {
+		return fmt.Errorf("panel %s unreachable", c.apiClient.Describe().APIHost)
+	}
+	return nil
+}
+
+// Stalled returns an error when the user sync has not run for much longer
+// than its interval, like when it hangs. A sync failing on an unreachable
+// panel still runs.
+func (c *Controller) Stalled() error {
+	if !c.started.Load() {
+		return nil
+	}
+	// The first run waits up to twice the interval, for the jitter
+	limit := 3*c.interval(c.config.UserSyncPeriodic) + syncStallGrace
+	if since := time.Since(time.Unix(0, c.userSyncAt.Load())); since > limit {
+		return fmt.Errorf("user sync has not run for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// Online returns the users online at the last online report, by UID
+func (c *Controller) Online() []OnlineEntry {
+	c.recent.access.Lock()
+	online := c.recent.online
+	c.recent.access.Unlock()
+	ips := make(map[int][]string)
+	for _, o := range online {
+		ips[o.UID] = append(ips[o.UID], o.IP)
+	}
+	entries := make([]OnlineEntry, 0, len(ips))
+	for uid, userIPs := range ips {
+		entries = append(entries, OnlineEntry{UID: uid, IPs: userIPs})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].UID < entries[j].UID })
+	return entries
+}
+
+// Audits returns the last audit hits of the node, newest first
+func (c *Controller) Audits() []AuditHit {
+	c.recent.access.Lock()
+	defer c.recent.access.Unlock()
+	audits := make([]AuditHit, len(c.recent.audits))
+	for i, a := range c.recent.audits {
+		audits[len(audits)-1-i] = a
+	}
+	return audits
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// Version of XrayR, sent in the alive reports. Set by the command starting it.
+var Version string
+
+const defaultAliveInterval = 60 * time.Second
+
+// AliveFields are the fields an alive report may hold
+var AliveFields = []string{"version", "uptime", "online_users", "online_ips", "users", "node_id", "node_type", "maintenance"}
+
+// aliveInterval returns the interval of the alive reports of config
+func aliveInterval(config *AliveConfig) time.Duration {
+	if config.Interval <= 0 {
+		return defaultAliveInterval
+	}
+	return time.Duration(config.Interval) * time.Second
+}
+
+// aliveMonitor posts the alive report of the node to the panel
+func (c *Controller) aliveMonitor() error {
+	config := c.config.AliveConfig
+	alive, err := c.aliveReport(config)
+	if err != nil {
+		c.logger.Print(err)
+		return nil
+	}
+	if err := c.apiClient.(api.AliveReporter).ReportAlive(config.Path, alive); err != nil {
+		c.logger.Printf("Report alive failed: %s", err)
+	}
+	return nil
+}
+
+// aliveReport builds the alive report holding the fields of config, with its
+// extra fields
+func (c *Controller) aliveReport(config *AliveConfig) (map[string]any, error) {
+	fields := config.Fields
+	if len(fields) == 0 {
+		fields = AliveFields
+	}
+	stats := c.Stats()
+	info := c.apiClient.Describe()
+	alive := make(map[string]any, len(fields)+len(config.Extra))
+	for key, value := range config.Extra {
+		alive[key] = value
+	}
+	for _, field := range fields {
+		switch field {
+		case "version":
+			alive[field] = Version
+		case "uptime":
+			alive[field] = stats.Uptime
+		case "online_users":
+			alive[field] = stats.OnlineUsers
+		case "online_ips":
+			alive[field] = stats.OnlineIPs
+		case "users":
+			alive[field] = stats.Users
+		case "node_id":
+			alive[field] = info.NodeID
+		case "node_type":
+			alive[field] = info.NodeType
+		case "maintenance":
+			alive[field] = c.maintenance.Load()
+		default:
+			return nil, fmt.Errorf("unknown alive field %s, use some of %v", field, AliveFields)
+		}
+	}
+	return alive, nil
+}
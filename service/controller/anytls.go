@@ -0,0 +1,57 @@
+//go:build !no_anytls
+
+package controller
+
+import (
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/policy"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/anytls"
+)
+
+func init() {
+	servedProtocols["AnyTLS"] = servedProtocol{
+		newHandler: func(c *Controller, nodeInfo *api.NodeInfo, pm policy.Manager) (inbound.Handler, error) {
+			anyTLSConfig, err := buildAnyTLSConfig(c.config, nodeInfo, c.Tag)
+			if err != nil {
+				return nil, err
+			}
+			return anytls.NewHandler(anyTLSConfig, c.dispatcher, pm), nil
+		},
+	}
+}
+
+// anyTLSPaddingScheme returns the padding scheme of the AnyTLS node, the one
+// of the local config taking precedence over the one of the panel
+func anyTLSPaddingScheme(config *Config, nodeInfo *api.NodeInfo) (*anytls.PaddingScheme, error) {
+	scheme := nodeInfo.PaddingScheme
+	if a := config.AnyTLSConfig; a != nil && a.PaddingScheme != "" {
+		scheme = a.PaddingScheme
+	}
+	return anytls.ParsePaddingScheme(scheme)
+}
+
+// buildAnyTLSConfig builds the config of the AnyTLS inbound of the node
+func buildAnyTLSConfig(config *Config, nodeInfo *api.NodeInfo, tag string) (*anytls.Config, error) {
+	padding, err := anyTLSPaddingScheme(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := buildServedTLSConfig(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	sniffing, err := sniffingRequest(config)
+	if err != nil {
+		return nil, err
+	}
+	return &anytls.Config{
+		Tag:           tag,
+		Listen:        config.ListenIP,
+		Port:          nodeInfo.Port,
+		TLSConfig:     tlsConfig,
+		PaddingScheme: padding,
+		Sniffing:      sniffing,
+	}, nil
+}
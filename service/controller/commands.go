@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// SetRestart sets how the node asks the panel to restart it, for the restart
+// command. f must not block. Set it before Start.
+func (c *Controller) SetRestart(f func()) {
+	c.restart = f
+}
+
+// commandMonitor runs the commands the panel queued for the node and reports
+// their results. A restart runs last, once the results are reported.
+func (c *Controller) commandMonitor() error {
+	commander := c.apiClient.(api.Commander)
+	commands, err := commander.GetCommands()
+	if err != nil {
+		c.logger.Print(err)
+		return nil
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	restart := false
+	results := make([]api.CommandResult, len(commands))
+	for i, command := range commands {
+		message, err := c.runCommand(command)
+		if err != nil {
+			message = err.Error()
+		}
+		if err == nil && command.Type == api.CommandRestart {
+			restart = true
+		}
+		results[i] = api.CommandResult{ID: command.ID, OK: err == nil, Message: message}
+		c.logger.Printf("Command %s %s of the panel: %s", command.ID, command.Type, message)
+	}
+	if err := commander.ReportCommandResults(results); err != nil {
+		// The panel sends them again
+		c.logger.Print(err)
+		return nil
+	}
+	if restart {
+		c.restart()
+	}
+	return nil
+}
+
+// runCommand runs a command but for the restart, returning what it did
+func (c *Controller) runCommand(command api.Command) (string, error) {
+	switch command.Type {
+	case api.CommandRestart:
+		if c.restart == nil {
+			return "", fmt.Errorf("restart is not supported")
+		}
+		return "restarting", nil
+	case api.CommandKickUser:
+		if !c.KickUser(command.UID) {
+			return "", fmt.Errorf("user %d has no connections", command.UID)
+		}
+		return fmt.Sprintf("user %d kicked", command.UID), nil
+	case api.CommandRenewCert:
+		// Replaced by nodeInfoMonitor on a rebuild
+		c.access.Lock()
+		enableTLS := c.nodeInfo.EnableTLS
+		c.access.Unlock()
+		if !enableTLS || c.config.EnableREALITY || c.config.CertConfig == nil {
+			return "", fmt.Errorf("node has no certificate")
+		}
+		renewed, err := c.renewCert()
+		if err != nil {
+			return "", err
+		}
+		if !renewed {
+			return "certificate not due for renewal", nil
+		}
+		return "certificate renewed", nil
+	case api.CommandSyncUsers:
+		c.userSyncMonitor()
+		return "user sync run", nil
+	default:
+		return "", fmt.Errorf("unknown command %s", command.Type)
+	}
+}
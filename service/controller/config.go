@@ -1,29 +1,83 @@
 package controller
 
 import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/cluster"
+	"github.com/qtai2901/new_xrayr/common/connlimit"
+	"github.com/qtai2901/new_xrayr/common/eventbus"
 	"github.com/qtai2901/new_xrayr/common/limiter"
 	"github.com/qtai2901/new_xrayr/common/mylego"
+	"github.com/qtai2901/new_xrayr/common/portscan"
+	"github.com/qtai2901/new_xrayr/common/speedtest"
+	"github.com/qtai2901/new_xrayr/common/trafficsink"
 )
 
 type Config struct {
 	ListenIP                  string                           `mapstructure:"ListenIP"`
 	SendIP                    string                           `mapstructure:"SendIP"`
+	SendInterface             string                           `mapstructure:"SendInterface"`
 	UpdatePeriodic            int                              `mapstructure:"UpdatePeriodic"`
+	NodeInfoPeriodic          int                              `mapstructure:"NodeInfoPeriodic"`
+	UserSyncPeriodic          int                              `mapstructure:"UserSyncPeriodic"`
+	OnlineReportPeriodic      int                              `mapstructure:"OnlineReportPeriodic"`
+	TrafficReportPeriodic     int                              `mapstructure:"TrafficReportPeriodic"`
+	CommandPeriodic           int                              `mapstructure:"CommandPeriodic"` // Second, 0 for not polling the commands of the panel
+	DisableJitter             bool                             `mapstructure:"DisableJitter"`
+	DataDir                   string                           `mapstructure:"DataDir"`
+	TrafficBatchSize          int                              `mapstructure:"TrafficBatchSize"`
+	TrafficMaxBodySize        int                              `mapstructure:"TrafficMaxBodySize"` // KB
+	TrafficRate               float64                          `mapstructure:"TrafficRate"`        // Multiplier of the traffic reported to the panel
 	CertConfig                *mylego.CertConfig               `mapstructure:"CertConfig"`
 	EnableDNS                 bool                             `mapstructure:"EnableDNS"`
 	DNSType                   string                           `mapstructure:"DNSType"`
 	DisableUploadTraffic      bool                             `mapstructure:"DisableUploadTraffic"`
+	DisableUserUDP            bool                             `mapstructure:"DisableUserUDP"` // Default of the users the panel sets no UDP flag for
 	DisableGetRule            bool                             `mapstructure:"DisableGetRule"`
 	EnableProxyProtocol       bool                             `mapstructure:"EnableProxyProtocol"`
 	EnableFallback            bool                             `mapstructure:"EnableFallback"`
+	EnableSplice              bool                             `mapstructure:"EnableSplice"` // Let the unlimited TCP connections be spliced by Xray
 	DisableIVCheck            bool                             `mapstructure:"DisableIVCheck"`
 	DisableSniffing           bool                             `mapstructure:"DisableSniffing"`
+	SniffingConfig            *SniffingConfig                  `mapstructure:"SniffingConfig"` // Takes precedence over DisableSniffing
 	AutoSpeedLimitConfig      *AutoSpeedLimitConfig            `mapstructure:"AutoSpeedLimitConfig"`
 	GlobalDeviceLimitConfig   *limiter.GlobalDeviceLimitConfig `mapstructure:"GlobalDeviceLimitConfig"`
+	OnlineStoreConfig         *limiter.OnlineStoreConfig       `mapstructure:"OnlineStoreConfig"`
+	ShaperConfig              *limiter.ShaperConfig            `mapstructure:"ShaperConfig"`
+	ClusterConfig             *cluster.Config                  `mapstructure:"ClusterConfig"`
+	TrafficSinkConfig         *trafficsink.Config              `mapstructure:"TrafficSinkConfig"`
+	EventBusConfig            *eventbus.Config                 `mapstructure:"EventBusConfig"`
+	HeartbeatConfig           *HeartbeatConfig                 `mapstructure:"HeartbeatConfig"`
+	AliveConfig               *AliveConfig                     `mapstructure:"AliveConfig"`
 	FallBackConfigs           []*FallBackConfig                `mapstructure:"FallBackConfigs"`
 	DisableLocalREALITYConfig bool                             `mapstructure:"DisableLocalREALITYConfig"`
 	EnableREALITY             bool                             `mapstructure:"EnableREALITY"`
 	REALITYConfigs            *REALITYConfig                   `mapstructure:"REALITYConfigs"`
+	TLSFingerprint            string                           `mapstructure:"TLSFingerprint"` // chrome, firefox, safari, ios, android, edge, 360, qq, random or randomized
+	WireGuardConfig           *WireGuardConfig                 `mapstructure:"WireGuardConfig"`
+	UpstreamProxyConfig       *UpstreamProxyConfig             `mapstructure:"UpstreamProxyConfig"`
+	BalancerConfig            *BalancerConfig                  `mapstructure:"BalancerConfig"`
+	UserRouteConfigs          []*UserRouteConfig               `mapstructure:"UserRouteConfigs"`
+	RelayConfig               *RelayConfig                     `mapstructure:"RelayConfig"`
+	DomesticRouteConfig       *DomesticRouteConfig             `mapstructure:"DomesticRouteConfig"`
+	ASNRouteConfigs           []*ASNRouteConfig                `mapstructure:"ASNRouteConfigs"`
+	CountryRouteConfigs       []*CountryRouteConfig            `mapstructure:"CountryRouteConfigs"`
+	IPv6PoolConfig            *IPv6PoolConfig                  `mapstructure:"IPv6PoolConfig"`
+	BlocklistConfig           *BlocklistConfig                 `mapstructure:"BlocklistConfig"`
+	SpeedtestConfig           *speedtest.Config                `mapstructure:"SpeedtestConfig"`
+	PlaintextPortConfig       *PlaintextPortConfig             `mapstructure:"PlaintextPortConfig"`
+	ConnectionConfig          *ConnectionConfig                `mapstructure:"ConnectionConfig"`
+	ConnectionLimitConfig     *connlimit.Config                `mapstructure:"ConnectionLimitConfig"`
+	PortScanConfig            *portscan.Config                 `mapstructure:"PortScanConfig"`
+	ExtraInboundConfigs       []*ExtraInboundConfig            `mapstructure:"ExtraInboundConfigs"`
+	ShadowsocksPluginConfig   *ShadowsocksPluginConfig         `mapstructure:"ShadowsocksPluginConfig"`
+	MixedVMessConfig          *MixedVMessConfig                `mapstructure:"MixedVMessConfig"`
+	AnyTLSConfig              *AnyTLSConfig                    `mapstructure:"AnyTLSConfig"`
+	NaiveConfig               *NaiveConfig                     `mapstructure:"NaiveConfig"`
+	JuicityConfig             *JuicityConfig                   `mapstructure:"JuicityConfig"`
+	WireGuardNodeConfig       *WireGuardNodeConfig             `mapstructure:"WireGuardNodeConfig"`
+	SSHConfig                 *SSHConfig                       `mapstructure:"SSHConfig"`
+	ForwardConfig             *ForwardConfig                   `mapstructure:"ForwardConfig"`
+	MuxConfig                 *MuxConfig                       `mapstructure:"MuxConfig"`
 }
 
 type AutoSpeedLimitConfig struct {
@@ -33,6 +87,23 @@ type AutoSpeedLimitConfig struct {
 	LimitDuration int `mapstructure:"LimitDuration"` // minute
 }
 
+// HeartbeatConfig pushes a heartbeat to an external uptime monitor on every
+// successful user sync, like a push monitor of Uptime Kuma, so the sync
+// failures are noticed and not only the process dying
+type HeartbeatConfig struct {
+	URL     string `mapstructure:"URL"`     // Requested with GET, empty for disable. A ping= query parameter is set to the sync time, ms
+	Timeout int    `mapstructure:"Timeout"` // Second
+}
+
+// AliveConfig posts an alive report to the panel on its own interval, apart
+// from the traffic reports, for the panels marking silent nodes offline
+type AliveConfig struct {
+	Path     string            `mapstructure:"Path"`     // Path of the panel posted to, empty for disable
+	Interval int               `mapstructure:"Interval"` // Second, 60 if 0
+	Fields   []string          `mapstructure:"Fields"`   // Of AliveFields, all if empty
+	Extra    map[string]string `mapstructure:"Extra"`    // Added to the report as they are
+}
+
 type FallBackConfig struct {
 	SNI              string `mapstructure:"SNI"`
 	Alpn             string `mapstructure:"Alpn"`
@@ -52,3 +123,257 @@ type REALITYConfig struct {
 	MaxTimeDiff      uint64   `mapstructure:"MaxTimeDiff"`
 	ShortIds         []string `mapstructure:"ShortIds"`
 }
+
+type WireGuardConfig struct {
+	Enable         bool             `mapstructure:"Enable"`
+	SecretKey      string           `mapstructure:"SecretKey"`
+	Address        []string         `mapstructure:"Address"`
+	Peers          []*WireGuardPeer `mapstructure:"Peers"`
+	MTU            int32            `mapstructure:"MTU"`
+	Reserved       []byte           `mapstructure:"Reserved"`
+	DomainStrategy string           `mapstructure:"DomainStrategy"`
+	SendThrough    string           `mapstructure:"SendThrough"`   // Defaults to SendIP of the node
+	SendInterface  string           `mapstructure:"SendInterface"` // Defaults to SendInterface of the node
+	Domains        []string         `mapstructure:"Domains"`       // Destinations routed through WireGuard, all if both empty
+	IPs            []string         `mapstructure:"IPs"`
+}
+
+type WireGuardPeer struct {
+	PublicKey    string `mapstructure:"PublicKey"`
+	PreSharedKey string `mapstructure:"PreSharedKey"`
+	Endpoint     string `mapstructure:"Endpoint"`
+	KeepAlive    uint32 `mapstructure:"KeepAlive"`
+}
+
+type UpstreamProxyConfig struct {
+	Enable        bool     `mapstructure:"Enable"`
+	Protocol      string   `mapstructure:"Protocol"` // socks or http
+	Address       string   `mapstructure:"Address"`
+	Port          uint16   `mapstructure:"Port"`
+	Username      string   `mapstructure:"Username"`
+	Password      string   `mapstructure:"Password"`
+	SendThrough   string   `mapstructure:"SendThrough"`   // Defaults to SendIP of the node
+	SendInterface string   `mapstructure:"SendInterface"` // Defaults to SendInterface of the node
+	Domains       []string `mapstructure:"Domains"`       // Destinations forwarded to the upstream, all if both empty
+	IPs           []string `mapstructure:"IPs"`
+}
+
+type BalancerConfig struct {
+	Enable   bool              `mapstructure:"Enable"`
+	Strategy string            `mapstructure:"Strategy"` // random, roundRobin or leastPing
+	Members  []*BalancerMember `mapstructure:"Members"`
+	Domains  []string          `mapstructure:"Domains"` // Destinations balanced over the members, all if both empty
+	IPs      []string          `mapstructure:"IPs"`
+}
+
+type BalancerMember struct {
+	Protocol      string `mapstructure:"Protocol"`      // freedom, socks or http
+	SendThrough   string `mapstructure:"SendThrough"`   // Defaults to SendIP of the node
+	SendInterface string `mapstructure:"SendInterface"` // Defaults to SendInterface of the node
+	Address       string `mapstructure:"Address"`
+	Port          uint16 `mapstructure:"Port"`
+	Username      string `mapstructure:"Username"`
+	Password      string `mapstructure:"Password"`
+}
+
+type UserRouteConfig struct {
+	UIDs     []int    `mapstructure:"UIDs"`
+	Tags     []string `mapstructure:"Tags"`     // User tags given by the panel
+	Outbound string   `mapstructure:"Outbound"` // direct, block, wireguard, upstream, relay, balancer or the tag of a custom outbound
+}
+
+func (r *UserRouteConfig) match(user *api.UserInfo) bool {
+	for _, uid := range r.UIDs {
+		if uid == user.UID {
+			return true
+		}
+	}
+	for _, tag := range r.Tags {
+		if tag != "" && tag == user.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtraInboundConfig serves some users of the node on another port and
+// transport, so one node can offer tiered transports to the user groups of
+// the panel. The rest of the inbound settings are the ones of the node.
+type ExtraInboundConfig struct {
+	Port        uint32   `mapstructure:"Port"`      // 0 for disable
+	Transport   string   `mapstructure:"Transport"` // tcp, ws, http or grpc, defaults to the transport of the node
+	Path        string   `mapstructure:"Path"`
+	Host        string   `mapstructure:"Host"`
+	ServiceName string   `mapstructure:"ServiceName"`
+	UserTags    []string `mapstructure:"UserTags"`  // User tags given by the panel, all the users if empty
+	Exclusive   bool     `mapstructure:"Exclusive"` // Remove the matched users from the inbound of the node
+}
+
+func (e *ExtraInboundConfig) match(user *api.UserInfo) bool {
+	if len(e.UserTags) == 0 {
+		return true
+	}
+	for _, tag := range e.UserTags {
+		if tag != "" && tag == user.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+type RelayConfig struct {
+	Enable        bool     `mapstructure:"Enable"`
+	Protocol      string   `mapstructure:"Protocol"` // vmess, vless, trojan or shadowsocks
+	Address       string   `mapstructure:"Address"`
+	Port          uint16   `mapstructure:"Port"`
+	UUID          string   `mapstructure:"UUID"`     // vmess and vless
+	Flow          string   `mapstructure:"Flow"`     // vless
+	Password      string   `mapstructure:"Password"` // trojan and shadowsocks
+	Method        string   `mapstructure:"Method"`   // shadowsocks
+	Network       string   `mapstructure:"Network"`  // tcp, ws or grpc
+	Path          string   `mapstructure:"Path"`
+	Host          string   `mapstructure:"Host"`
+	ServiceName   string   `mapstructure:"ServiceName"`
+	Security      string   `mapstructure:"Security"` // none, tls or reality
+	SNI           string   `mapstructure:"SNI"`
+	Fingerprint   string   `mapstructure:"Fingerprint"`
+	PublicKey     string   `mapstructure:"PublicKey"`     // reality
+	ShortID       string   `mapstructure:"ShortID"`       // reality
+	SendThrough   string   `mapstructure:"SendThrough"`   // Defaults to SendIP of the node
+	SendInterface string   `mapstructure:"SendInterface"` // Defaults to SendInterface of the node
+	Domains       []string `mapstructure:"Domains"`       // Destinations relayed to the exit node, all if both empty
+	IPs           []string `mapstructure:"IPs"`
+}
+
+// MuxConfig replaces the mux.cool setting of the node given by the panel
+type MuxConfig struct {
+	Enable          bool   `mapstructure:"Enable"`
+	RejectInbound   bool   `mapstructure:"RejectInbound"`   // Refuse the clients multiplexing their connections, XUDP included
+	Outbound        bool   `mapstructure:"Outbound"`        // Multiplex the connections of the relay outbound
+	Concurrency     int16  `mapstructure:"Concurrency"`     // 8 if 0
+	XudpConcurrency int16  `mapstructure:"XudpConcurrency"` // UDP through the connections if 0
+	XudpProxyUDP443 string `mapstructure:"XudpProxyUDP443"` // reject, allow or skip
+}
+
+// SniffingConfig replaces the default sniffing of the node, which overrides
+// the destination of the http and tls connections with the domain they ask for
+type SniffingConfig struct {
+	Enable          bool     `mapstructure:"Enable"`
+	DestOverride    []string `mapstructure:"DestOverride"` // http, tls, quic, fakedns or fakedns+others, http and tls if empty
+	MetadataOnly    bool     `mapstructure:"MetadataOnly"` // Sniff from the metadata only, not reading the content
+	RouteOnly       bool     `mapstructure:"RouteOnly"`    // Route by the sniffed domain, but connect to the original destination
+	DomainsExcluded []string `mapstructure:"DomainsExcluded"`
+}
+
+type DomesticRouteConfig struct {
+	Private string `mapstructure:"Private"` // direct or block, empty for leaving it to the other rules
+	CN      string `mapstructure:"CN"`      // direct or block, empty for leaving it to the other rules
+}
+
+type ASNRouteConfig struct {
+	ASNs     []uint32 `mapstructure:"ASNs"`
+	Outbound string   `mapstructure:"Outbound"` // direct, block, wireguard, upstream, relay, balancer or the tag of a custom outbound
+}
+
+type CountryRouteConfig struct {
+	Countries []string `mapstructure:"Countries"` // ISO 3166 codes, like US
+	Except    bool     `mapstructure:"Except"`    // Match the destinations outside Countries instead
+	Outbound  string   `mapstructure:"Outbound"`  // direct, block, wireguard, upstream, relay, balancer or the tag of a custom outbound
+}
+
+type IPv6PoolConfig struct {
+	Enable  bool     `mapstructure:"Enable"`
+	Prefix  string   `mapstructure:"Prefix"`  // Routed to this server, like 2001:db8:1:2::/64
+	Size    int      `mapstructure:"Size"`    // Addresses picked from Prefix on start
+	Rotate  string   `mapstructure:"Rotate"`  // connection or user
+	Domains []string `mapstructure:"Domains"` // Destinations sent from the pool, all if both empty
+	IPs     []string `mapstructure:"IPs"`
+}
+
+type BlocklistConfig struct {
+	Enable        bool `mapstructure:"Enable"`
+	ResolveDomain bool `mapstructure:"ResolveDomain"` // Check the addresses of domain destinations too
+}
+
+// ConnectionConfig overrides the global connection timeouts for the users and
+// outbounds of the node, and the relay buffers of its connections. A zero
+// timeout or size keeps the global one.
+type ConnectionConfig struct {
+	ConnIdle        uint32 `mapstructure:"ConnIdle"`        // Second
+	UplinkOnly      uint32 `mapstructure:"UplinkOnly"`      // Second
+	DownlinkOnly    uint32 `mapstructure:"DownlinkOnly"`    // Second
+	ReadBufferSize  int32  `mapstructure:"ReadBufferSize"`  // kB, -1 for no limit
+	WriteBufferSize int32  `mapstructure:"WriteBufferSize"` // kB, -1 for no limit
+	Level           uint32 `mapstructure:"-"`               // Policy level of the timeouts, assigned by the panel
+}
+
+// userLevel returns the policy level of the users and outbounds of the node
+func (c *Config) userLevel() uint32 {
+	if c.ConnectionConfig != nil {
+		return c.ConnectionConfig.Level
+	}
+	return 0
+}
+
+func (c *Config) wireGuardNetwork() string {
+	if c.WireGuardNodeConfig != nil {
+		return c.WireGuardNodeConfig.Network
+	}
+	return ""
+}
+
+// ShadowsocksPluginConfig replaces the plugin of a Shadowsocks node given by
+// the panel
+type ShadowsocksPluginConfig struct {
+	Plugin     string `mapstructure:"Plugin"`     // obfs-server or v2ray-plugin
+	PluginOpts string `mapstructure:"PluginOpts"` // SIP003 options of the plugin
+}
+
+// MixedVMessConfig accepts the VMess clients of the users on the port of a
+// VLESS node too, easing the move of a user base to VLESS. The VLESS inbound
+// falls back to a local VMess inbound for the connections it can't
+// authenticate, taking the default fallback of FallBackConfigs over.
+type MixedVMessConfig struct {
+	Enable bool   `mapstructure:"Enable"`
+	Port   uint32 `mapstructure:"Port"` // Local port of the VMess inbound, on 127.0.0.1
+}
+
+// AnyTLSConfig replaces the padding scheme of an AnyTLS node given by the panel
+type AnyTLSConfig struct {
+	PaddingScheme string `mapstructure:"PaddingScheme"` // Lines like stop=8 and 0=30-30, the default scheme of AnyTLS if empty
+}
+
+// NaiveConfig sets the website of a NaiveProxy node, shown to everything but
+// its users
+type NaiveConfig struct {
+	FallbackURL string `mapstructure:"FallbackURL"` // Like http://127.0.0.1:8080, the requests other than the proxy ones are proxied to it. 404 for them if empty
+}
+
+// JuicityConfig replaces the options of a Juicity node given by the panel
+type JuicityConfig struct {
+	CongestionControl string `mapstructure:"CongestionControl"` // Only cubic for now
+}
+
+// WireGuardNodeConfig sets the interface of a WireGuard node
+type WireGuardNodeConfig struct {
+	PrivateKey string `mapstructure:"PrivateKey"` // Of the node in base64, replacing the server key of the panel
+	Network    string `mapstructure:"Network"`    // Of the tunnel addresses, 10.0.0.0/8 if empty
+	MTU        int    `mapstructure:"MTU"`        // 1420 if 0
+}
+
+// SSHConfig sets the host key of an SSH node
+type SSHConfig struct {
+	HostKeyFile string `mapstructure:"HostKeyFile"` // OpenSSH private key file, created with a new Ed25519 key if missing. Replaces the server key of the panel
+}
+
+// ForwardConfig replaces the destination of a Forward node given by the panel
+type ForwardConfig struct {
+	Address string `mapstructure:"Address"` // Like 1.2.3.4:27015
+	Network string `mapstructure:"Network"` // tcp, udp or tcp,udp
+}
+
+type PlaintextPortConfig struct {
+	Enable bool     `mapstructure:"Enable"`
+	Ports  []uint16 `mapstructure:"Ports"`  // Like 21 and 23
+	RuleID int      `mapstructure:"RuleID"` // Audit rule the attempts are reported as
+}
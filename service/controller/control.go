@@ -8,7 +8,6 @@ import (
 	"github.com/xtls/xray-core/core"
 	"github.com/xtls/xray-core/features/inbound"
 	"github.com/xtls/xray-core/features/outbound"
-	"github.com/xtls/xray-core/features/stats"
 	"github.com/xtls/xray-core/proxy"
 
 	"github.com/qtai2901/new_xrayr/api"
@@ -105,35 +104,14 @@ func (c *Controller) removeUsers(users []string, tag string) error {
 	return nil
 }
 
-func (c *Controller) getTraffic(email string) (up int64, down int64, upCounter stats.Counter, downCounter stats.Counter) {
-	upName := "user>>>" + email + ">>>traffic>>>uplink"
-	downName := "user>>>" + email + ">>>traffic>>>downlink"
-	upCounter = c.stm.GetCounter(upName)
-	downCounter = c.stm.GetCounter(downName)
-	if upCounter != nil && upCounter.Value() != 0 {
-		up = upCounter.Value()
-	} else {
-		upCounter = nil
-	}
-	if downCounter != nil && downCounter.Value() != 0 {
-		down = downCounter.Value()
-	} else {
-		downCounter = nil
-	}
-	return up, down, upCounter, downCounter
+// snapshotTraffic returns the traffic of the users of the inbound with tag
+// since the last snapshot, keyed by UID
+func (c *Controller) snapshotTraffic(tag string) map[int]limiter.TrafficSnapshot {
+	return c.dispatcher.Limiter.SnapshotTraffic(tag)
 }
 
-func (c *Controller) resetTraffic(upCounterList *[]stats.Counter, downCounterList *[]stats.Counter) {
-	for _, upCounter := range *upCounterList {
-		upCounter.Set(0)
-	}
-	for _, downCounter := range *downCounterList {
-		downCounter.Set(0)
-	}
-}
-
-func (c *Controller) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalDeviceLimitConfig *limiter.GlobalDeviceLimitConfig) error {
-	err := c.dispatcher.Limiter.AddInboundLimiter(tag, nodeSpeedLimit, userList, globalDeviceLimitConfig)
+func (c *Controller) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalDeviceLimitConfig *limiter.GlobalDeviceLimitConfig, onlineStoreConfig *limiter.OnlineStoreConfig, shaperConfig *limiter.ShaperConfig) error {
+	err := c.dispatcher.Limiter.AddInboundLimiter(tag, nodeSpeedLimit, userList, globalDeviceLimitConfig, onlineStoreConfig, shaperConfig)
 	return err
 }
 
@@ -142,6 +120,11 @@ func (c *Controller) UpdateInboundLimiter(tag string, updatedUserList *[]api.Use
 	return err
 }
 
+func (c *Controller) UpdateNodeSpeedLimit(tag string, nodeSpeedLimit uint64) error {
+	err := c.dispatcher.Limiter.UpdateNodeSpeedLimit(tag, nodeSpeedLimit)
+	return err
+}
+
 func (c *Controller) DeleteInboundLimiter(tag string) error {
 	err := c.dispatcher.Limiter.DeleteInboundLimiter(tag)
 	return err
@@ -3,22 +3,35 @@ package controller
 import (
 	"errors"
 	"fmt"
+	"math/rand"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/task"
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/extension"
 	"github.com/xtls/xray-core/features/inbound"
 	"github.com/xtls/xray-core/features/outbound"
 	"github.com/xtls/xray-core/features/routing"
-	"github.com/xtls/xray-core/features/stats"
 
 	"github.com/qtai2901/new_xrayr/api"
 	"github.com/qtai2901/new_xrayr/app/mydispatcher"
+	"github.com/qtai2901/new_xrayr/common/cluster"
+	"github.com/qtai2901/new_xrayr/common/eventbus"
+	"github.com/qtai2901/new_xrayr/common/geodata"
+	"github.com/qtai2901/new_xrayr/common/limiter"
 	"github.com/qtai2901/new_xrayr/common/mylego"
+	"github.com/qtai2901/new_xrayr/common/nodecache"
 	"github.com/qtai2901/new_xrayr/common/serverstatus"
+	"github.com/qtai2901/new_xrayr/common/trafficqueue"
+	"github.com/qtai2901/new_xrayr/common/trafficsink"
+	"github.com/qtai2901/new_xrayr/common/webhook"
 )
 
 type LimitInfo struct {
@@ -41,12 +54,39 @@ type Controller struct {
 	panelType    string
 	ibm          inbound.Manager
 	obm          outbound.Manager
-	stm          stats.Manager
 	dispatcher   *mydispatcher.DefaultDispatcher
 	startAt      time.Time
 	logger       *log.Entry
+	access       sync.Mutex
+	trafficQueue *trafficqueue.Queue
+	routeTags    []string              // Extra outbounds added by addNodeRoute
+	routeGeoData uint64                // Generation of the geo files the route was compiled from
+	expiredUsers map[api.UserInfo]bool // Removed from the inbound on expiry, still listed by the panel
+	nextExpiry   int64                 // Unix time the next user expires at, 0 for none
+	quotas       map[int]int64         // Traffic left to the users with a quota by UID, as last handed to the limiter
+	nodeCache    *nodecache.Cache
+	cluster      cluster.Cluster   // nil unless the cluster mode is on
+	trafficSink  *trafficsink.Sink // nil unless the traffic sink is on
+	eventBus     *eventbus.Bus     // nil unless the event bus is on
+	userTraffic  []api.UserTraffic // Reused by every traffic report, the queue copies it
+	recent       recentActivity
+	notify       func(event, text string, data any) // nil unless the panel alerts, see SetNotify
+	events       func(event, text string, data any) // nil unless the panel posts the events, see SetEvents
+	restart      func()                             // nil unless the panel can restart the node, see SetRestart
+	started      atomic.Bool                        // Between a successful Start and Close
+	syncsFailing atomic.Int32                       // Syncs failed enough in a row to alert, see syncFetched
+	maintenance  atomic.Bool                        // Set by Maintain
+	userSyncAt   atomic.Int64                       // Unix nano the user sync last ran at, see Stalled
+	heartbeating atomic.Bool                        // A heartbeat push is running
+
+	nodeInfoFailures int       // Failed node info fetches in a row
+	userListFailures int       // Failed user list fetches in a row
+	certAlertedAt    time.Time // Expiry of the certificate last alerted
 }
 
+// periodicJitter is the fraction of an interval periodic tasks are randomly spread by
+const periodicJitter = 0.1
+
 type periodicTask struct {
 	tag string
 	*task.Periodic
@@ -66,7 +106,6 @@ func New(server *core.Instance, api api.API, config *Config, panelType string) *
 		panelType:  panelType,
 		ibm:        server.GetFeature(inbound.ManagerType()).(inbound.Manager),
 		obm:        server.GetFeature(outbound.ManagerType()).(outbound.Manager),
-		stm:        server.GetFeature(stats.ManagerType()).(stats.Manager),
 		dispatcher: server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher),
 		startAt:    time.Now(),
 		logger:     logger,
@@ -76,11 +115,26 @@ func New(server *core.Instance, api api.API, config *Config, panelType string) *
 }
 
 // Start implement the Start() function of the service interface
-func (c *Controller) Start() error {
+func (c *Controller) Start() (err error) {
 	c.clientInfo = c.apiClient.Describe()
-	// First fetch Node Info
+	if c.nodeCache == nil && c.config.DataDir != "" {
+		// Without it the node only starts with the panel up
+		cache, err := nodecache.Open(filepath.Join(c.config.DataDir, "nodecache.db"), c.nodeKey())
+		if err != nil {
+			c.logger.Print(err)
+		}
+		c.nodeCache = cache
+	}
+	// First fetch Node Info, fall back to the last synced one if the panel is down
+	var snapshot *nodecache.Snapshot
 	newNodeInfo, err := c.apiClient.GetNodeInfo()
 	if err != nil {
+		if snapshot = c.restoreSnapshot(err); snapshot == nil {
+			return err
+		}
+		newNodeInfo = snapshot.NodeInfo
+	}
+	if newNodeInfo, err = ShadowsocksPluginBuilder(c.config, newNodeInfo); err != nil {
 		return err
 	}
 	if newNodeInfo.Port == 0 {
@@ -89,29 +143,88 @@ func (c *Controller) Start() error {
 	c.nodeInfo = newNodeInfo
 	c.Tag = c.buildNodeTag()
 
+	// Restore the traffic that wasn't reported before the last shutdown
+	if c.trafficQueue, err = trafficqueue.New(c.dataPath("traffic")); err != nil {
+		return err
+	}
+	c.trafficQueue.SetBatchLimit(c.config.TrafficBatchSize, c.config.TrafficMaxBodySize*1024)
+
+	if clusterConfig := c.config.ClusterConfig; clusterConfig != nil && clusterConfig.Enable && c.cluster == nil {
+		name := fmt.Sprintf("%s:%s:%d", c.clientInfo.APIHost, c.clientInfo.NodeType, c.clientInfo.NodeID)
+		if c.cluster, err = cluster.New(clusterConfig, name); err != nil {
+			return err
+		}
+	}
+
+	if sinkConfig := c.config.TrafficSinkConfig; sinkConfig != nil && sinkConfig.Enable && c.trafficSink == nil {
+		config := *sinkConfig
+		if config.Path == "" {
+			config.Path = c.config.DataDir
+		}
+		if c.trafficSink, err = trafficsink.New(&config, c.nodeInfo.NodeType, c.nodeInfo.NodeID); err != nil {
+			return err
+		}
+	}
+
+	if busConfig := c.config.EventBusConfig; busConfig != nil && busConfig.Enable && c.eventBus == nil {
+		if c.eventBus, err = eventbus.New(busConfig, c.nodeInfo.NodeType, c.nodeInfo.NodeID); err != nil {
+			return err
+		}
+	}
+
+	// Roll back the handlers on failure so that a later retry can start from
+	// scratch. A panic is a failure too, the supervisor recovers it after the
+	// rollback.
+	defer func() {
+		r := recover()
+		if err != nil || r != nil {
+			c.removeInbound(c.Tag)
+			c.removeExtraInbounds(c.Tag)
+			c.removeOutbound(c.Tag)
+			c.removeNodeRoute(c.Tag)
+		}
+		if r != nil {
+			panic(r)
+		}
+	}()
 	// Add new tag
 	err = c.addNewTag(newNodeInfo)
 	if err != nil {
-		c.logger.Panic(err)
 		return err
 	}
 	// Update user
 	userInfo, err := c.apiClient.GetUserList()
 	if err != nil {
-		return err
+		if snapshot == nil {
+			snapshot = c.restoreSnapshot(err)
+		}
+		if snapshot == nil {
+			return err
+		}
+		userInfo = &snapshot.UserList
 	}
 
 	// sync controller userList
+	c.takeDisabled(userInfo)
+	quotas := c.takeQuotas(userInfo)
+	c.defaultUDP(userInfo)
 	c.userList = userInfo
+	c.expiredUsers = make(map[api.UserInfo]bool)
 
-	err = c.addNewUser(userInfo, newNodeInfo)
+	err = c.addNewUser(c.activeUsers(userInfo), newNodeInfo)
 	if err != nil {
 		return err
 	}
+	c.scheduleExpiry()
+	if err = c.updateNodeRoute(); err != nil {
+		return err
+	}
 
 	// Add Limiter
-	if err := c.AddInboundLimiter(c.Tag, newNodeInfo.SpeedLimit, userInfo, c.config.GlobalDeviceLimitConfig); err != nil {
+	if err := c.AddInboundLimiter(c.Tag, newNodeInfo.SpeedLimit, userInfo, c.config.GlobalDeviceLimitConfig, c.onlineStoreConfig(), c.config.ShaperConfig); err != nil {
 		c.logger.Print(err)
+	} else {
+		c.updateQuotas(quotas)
 	}
 
 	// Add Rule Manager
@@ -134,60 +247,143 @@ func (c *Controller) Start() error {
 		c.warnedUsers = make(map[api.UserInfo]int)
 	}
 
+	if snapshot == nil {
+		c.saveSnapshot()
+	}
+
 	// Add periodic tasks
 	c.tasks = append(c.tasks,
-		periodicTask{
-			tag: "node monitor",
-			Periodic: &task.Periodic{
-				Interval: time.Duration(c.config.UpdatePeriodic) * time.Second,
-				Execute:  c.nodeInfoMonitor,
-			}},
-		periodicTask{
-			tag: "user monitor",
-			Periodic: &task.Periodic{
-				Interval: time.Duration(c.config.UpdatePeriodic) * time.Second,
-				Execute:  c.userInfoMonitor,
-			}},
+		c.newPeriodicTask("node monitor", c.interval(c.config.NodeInfoPeriodic), c.nodeInfoMonitor),
+		c.newPeriodicTask("user monitor", c.interval(c.config.UserSyncPeriodic), c.userSyncMonitor),
+		c.newPeriodicTask("traffic monitor", c.interval(c.config.TrafficReportPeriodic), c.trafficMonitor),
+		c.newPeriodicTask("online monitor", c.interval(c.config.OnlineReportPeriodic), c.onlineMonitor),
+		c.newPeriodicTask("expiry monitor", time.Second, c.expiryMonitor),
 	)
 
+	if _, ok := c.apiClient.(api.Commander); ok && c.config.CommandPeriodic > 0 {
+		c.tasks = append(c.tasks,
+			c.newPeriodicTask("command monitor", time.Duration(c.config.CommandPeriodic)*time.Second, c.commandMonitor))
+	}
+
+	if config := c.config.AliveConfig; config != nil && config.Path != "" {
+		if _, ok := c.apiClient.(api.AliveReporter); !ok {
+			c.logger.Warnf("Panel type %s does not take alive reports, AliveConfig ignored", c.panelType)
+		} else if _, err := c.aliveReport(config); err != nil {
+			c.logger.Errorf("AliveConfig ignored: %s", err)
+		} else {
+			c.tasks = append(c.tasks, c.newPeriodicTask("alive monitor", aliveInterval(config), c.aliveMonitor))
+		}
+	}
+
 	// Check cert service in need
 	if c.nodeInfo.EnableTLS && c.config.EnableREALITY == false {
-		c.tasks = append(c.tasks, periodicTask{
-			tag: "cert monitor",
-			Periodic: &task.Periodic{
-				Interval: time.Duration(c.config.UpdatePeriodic) * time.Second * 60,
-				Execute:  c.certMonitor,
-			}})
+		c.tasks = append(c.tasks,
+			c.newPeriodicTask("cert monitor", time.Duration(c.config.UpdatePeriodic)*time.Second*60, c.certMonitor))
 	}
 
+	c.userSyncAt.Store(time.Now().UnixNano())
 	// Start periodic tasks
 	for i := range c.tasks {
 		c.logger.Printf("Start %s periodic task", c.tasks[i].tag)
 		go c.tasks[i].Start()
 	}
+	c.started.Store(true)
+	c.event(webhook.NodeStarted, map[string]string{"tag": c.Tag}, "Started %s", c.Tag)
 
 	return nil
 }
 
 // Close implement the Close() function of the service interface
 func (c *Controller) Close() error {
+	c.closeTasks()
+	c.flushReports()
+	if c.cluster != nil {
+		if err := c.cluster.Close(); err != nil {
+			c.logger.Printf("Leave the cluster failed: %s", err)
+		}
+		c.cluster = nil
+	}
+	if c.trafficSink != nil {
+		if err := c.trafficSink.Close(); err != nil {
+			c.logger.Print(err)
+		}
+	}
+	if c.eventBus != nil {
+		c.eventBus.Close()
+	}
+	if err := c.nodeCache.Close(); err != nil {
+		c.logger.Print(err)
+	}
+	c.nodeCache = nil
+	if c.started.Swap(false) {
+		c.event(webhook.NodeStopped, map[string]string{"tag": c.Tag}, "Stopped %s", c.Tag)
+	}
+
+	return nil
+}
+
+// Drain implement the Drain() function of the service interface. It stops the
+// periodic tasks and the listener of the node, connections already established
+// keep running until Close is called.
+func (c *Controller) Drain() error {
+	c.closeTasks()
+
+	c.access.Lock()
+	defer c.access.Unlock()
+	if err := c.removeInbound(c.Tag); err != nil {
+		return fmt.Errorf("stop listening failed: %s", err)
+	}
+	c.removeExtraInbounds(c.Tag)
+	c.logger.Print("Stop accepting new connections")
+	return nil
+}
+
+func (c *Controller) closeTasks() {
 	for i := range c.tasks {
 		if c.tasks[i].Periodic != nil {
 			if err := c.tasks[i].Periodic.Close(); err != nil {
-				c.logger.Panicf("%s periodic task close failed: %s", c.tasks[i].tag, err)
+				c.logger.Errorf("%s periodic task close failed: %s", c.tasks[i].tag, err)
 			}
 		}
 	}
+	c.tasks = nil
+}
 
-	return nil
+// flushReports hands the traffic left in the counters and the online users
+// to the panel one last time, so a restart doesn't lose usage data.
+func (c *Controller) flushReports() {
+	c.access.Lock()
+	tag, userList := c.Tag, c.userList
+	c.access.Unlock()
+	if c.trafficQueue == nil || userList == nil {
+		return
+	}
+
+	c.submitTraffic(AppendUserTraffic(nil, *userList, c.snapshotTraffic(tag)))
+
+	if c.cluster != nil && !c.isLeader() {
+		c.pushOnline(tag)
+		return
+	}
+	if onlineDevice, err := c.getOnlineDevice(tag); err != nil {
+		c.logger.Print(err)
+	} else if len(*onlineDevice) > 0 {
+		c.publishOnline(onlineDevice)
+		if err := c.apiClient.ReportNodeOnlineUsers(onlineDevice); err != nil {
+			c.logger.Print(err)
+		}
+	}
 }
 
 func (c *Controller) nodeInfoMonitor() (err error) {
 	// delay to start
-	if time.Since(c.startAt) < time.Duration(c.config.UpdatePeriodic)*time.Second {
+	if time.Since(c.startAt) < c.interval(c.config.NodeInfoPeriodic) {
 		return nil
 	}
 
+	c.access.Lock()
+	defer c.access.Unlock()
+
 	// First fetch Node Info
 	var nodeInfoChanged = true
 	newNodeInfo, err := c.apiClient.GetNodeInfo()
@@ -197,29 +393,22 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 			newNodeInfo = c.nodeInfo
 		} else {
 			c.logger.Print(err)
+			c.syncFetched("node_info", &c.nodeInfoFailures, err)
 			return nil
 		}
 	}
+	c.syncFetched("node_info", &c.nodeInfoFailures, nil)
+	if newNodeInfo, err = ShadowsocksPluginBuilder(c.config, newNodeInfo); err != nil {
+		c.logger.Print(err)
+		return nil
+	}
 	if newNodeInfo.Port == 0 {
 		return errors.New("server port must > 0")
 	}
 
-	// Update User
-	var usersChanged = true
-	newUserInfo, err := c.apiClient.GetUserList()
-	if err != nil {
-		if err.Error() == api.UserNotModified {
-			usersChanged = false
-			newUserInfo = c.userList
-		} else {
-			c.logger.Print(err)
-			return nil
-		}
-	}
-
 	// If nodeInfo changed
 	if nodeInfoChanged {
-		if !reflect.DeepEqual(c.nodeInfo, newNodeInfo) {
+		if needRebuild(c.nodeInfo, newNodeInfo) {
 			// Remove old tag
 			oldTag := c.Tag
 			err := c.removeOldTag(oldTag)
@@ -227,6 +416,7 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 				c.logger.Print(err)
 				return nil
 			}
+			c.removeExtraInbounds(oldTag)
 			if c.nodeInfo.NodeType == "Shadowsocks-Plugin" {
 				err = c.removeOldTag(fmt.Sprintf("dokodemo-door_%s+1", c.Tag))
 			}
@@ -242,15 +432,31 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 				c.logger.Print(err)
 				return nil
 			}
-			nodeInfoChanged = true
+			// The quotas carry over with the traffic the users have left
+			if quotas := c.dispatcher.Limiter.UserQuotas(oldTag); quotas != nil {
+				c.quotas = quotas
+			}
 			// Remove Old limiter
 			if err = c.DeleteInboundLimiter(oldTag); err != nil {
 				c.logger.Print(err)
 				return nil
 			}
-		} else {
-			nodeInfoChanged = false
+			// Add the current users to the new inbound
+			err = c.addNewUser(c.activeUsers(c.userList), newNodeInfo)
+			if err != nil {
+				c.logger.Print(err)
+				return nil
+			}
+			// Add Limiter
+			if err := c.AddInboundLimiter(c.Tag, newNodeInfo.SpeedLimit, c.userList, c.config.GlobalDeviceLimitConfig, c.onlineStoreConfig(), c.config.ShaperConfig); err != nil {
+				c.logger.Print(err)
+				return nil
+			}
+			c.applyQuotas()
+		} else if !reflect.DeepEqual(c.nodeInfo, newNodeInfo) {
+			c.liveUpdateNodeInfo(newNodeInfo)
 		}
+		c.saveSnapshot()
 	}
 
 	// Check Rule
@@ -266,50 +472,369 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 		}
 	}
 
-	if nodeInfoChanged {
-		err = c.addNewUser(newUserInfo, newNodeInfo)
+	return nil
+}
+
+func (c *Controller) userSyncMonitor() (err error) {
+	defer func() { c.userSyncAt.Store(time.Now().UnixNano()) }()
+	// delay to start
+	if time.Since(c.startAt) < c.interval(c.config.UserSyncPeriodic) {
+		return nil
+	}
+
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	fetchStart := time.Now()
+	newUserInfo, err := c.apiClient.GetUserList()
+	notModified := err != nil && err.Error() == api.UserNotModified
+	if err != nil && !notModified {
+		c.logger.Print(err)
+		c.syncFetched("user_list", &c.userListFailures, err)
+		return nil
+	}
+	c.syncFetched("user_list", &c.userListFailures, nil)
+	c.pushHeartbeat(time.Since(fetchStart))
+	if notModified {
+		return nil
+	}
+	disabled := c.takeDisabled(newUserInfo)
+	quotas := c.takeQuotas(newUserInfo)
+	c.defaultUDP(newUserInfo)
+
+	deleted, added := compareUserList(c.userList, newUserInfo)
+	if len(deleted) > 0 {
+		removed := make([]api.UserInfo, 0, len(deleted))
+		for _, u := range deleted {
+			// Already removed on expiry
+			if c.expiredUsers[u] {
+				delete(c.expiredUsers, u)
+				continue
+			}
+			removed = append(removed, u)
+		}
+		err := c.removeNodeUsers(removed)
 		if err != nil {
 			c.logger.Print(err)
-			return nil
 		}
-
-		// Add Limiter
-		if err := c.AddInboundLimiter(c.Tag, newNodeInfo.SpeedLimit, newUserInfo, c.config.GlobalDeviceLimitConfig); err != nil {
+	}
+	// Removed from the inbounds above, so they can't connect again
+	c.kickUsers(disabled)
+	added = *c.activeUsers(&added)
+	if len(added) > 0 {
+		err = c.addNewUser(&added, c.nodeInfo)
+		if err != nil {
 			c.logger.Print(err)
-			return nil
 		}
+		// Update Limiter
+		if err := c.UpdateInboundLimiter(c.Tag, &added); err != nil {
+			c.logger.Print(err)
+		}
+	}
+	c.logger.Printf("%d user deleted, %d user added", len(deleted), len(added))
+	c.userList = newUserInfo
+	c.scheduleExpiry()
+	c.updateQuotas(quotas)
+	if err := c.updateNodeRoute(); err != nil {
+		c.logger.Print(err)
+	}
+	c.saveSnapshot()
+	return nil
+}
 
-	} else {
-		var deleted, added []api.UserInfo
-		if usersChanged {
-			deleted, added = compareUserList(c.userList, newUserInfo)
-			if len(deleted) > 0 {
-				deletedEmail := make([]string, len(deleted))
-				for i, u := range deleted {
-					deletedEmail[i] = fmt.Sprintf("%s|%s|%d", c.Tag, u.Email, u.UID)
-				}
-				err := c.removeUsers(deletedEmail, c.Tag)
-				if err != nil {
-					c.logger.Print(err)
-				}
-			}
-			if len(added) > 0 {
-				err = c.addNewUser(&added, c.nodeInfo)
-				if err != nil {
-					c.logger.Print(err)
-				}
-				// Update Limiter
-				if err := c.UpdateInboundLimiter(c.Tag, &added); err != nil {
-					c.logger.Print(err)
-				}
+// takeDisabled drops the users banned or disabled by the panel from the
+// list, and returns them
+func (c *Controller) takeDisabled(userInfo *[]api.UserInfo) []api.UserInfo {
+	var disabled []api.UserInfo
+	users := (*userInfo)[:0]
+	for _, u := range *userInfo {
+		if u.Disabled {
+			disabled = append(disabled, u)
+			continue
+		}
+		users = append(users, u)
+	}
+	*userInfo = users
+	return disabled
+}
+
+// kickUsers closes the connections the users still have open on the node
+func (c *Controller) kickUsers(users []api.UserInfo) {
+	kicked := 0
+	for _, u := range users {
+		if c.dispatcher.Limiter.Kick(c.Tag, c.buildUserTag(&u)) {
+			kicked++
+		}
+	}
+	if kicked > 0 {
+		c.logger.Printf("%d disabled user kicked", kicked)
+	}
+}
+
+// takeQuotas moves the traffic quotas out of the user list, keyed by UID, so
+// a quota changing on every sync does not make the user look changed
+func (c *Controller) takeQuotas(userInfo *[]api.UserInfo) map[int]int64 {
+	quotas := make(map[int]int64)
+	for i := range *userInfo {
+		u := &(*userInfo)[i]
+		if u.Quota != 0 {
+			quotas[u.UID] = u.Quota
+			u.Quota = 0
+		}
+	}
+	return quotas
+}
+
+// updateQuotas hands the quotas listed by the panel to the limiter, as the
+// traffic the users may still move through the node
+func (c *Controller) updateQuotas(quotas map[int]int64) {
+	unreported := c.dispatcher.Limiter.PendingTraffic(c.Tag)
+	if unreported == nil {
+		unreported = make(map[int]int64)
+	}
+	if c.trafficQueue != nil {
+		for uid, used := range c.trafficQueue.Traffic() {
+			unreported[uid] += used
+		}
+	}
+	c.quotas = QuotasLeft(quotas, unreported, c.config.TrafficRate)
+	c.applyQuotas()
+}
+
+// QuotasLeft turns the quotas listed by the panel into the traffic the users
+// may still move through the node, by UID. The panel counts the traffic
+// multiplied by rate, and not the unreported traffic yet, which is taken off.
+// The quotas not above 0 are kept as they are.
+func QuotasLeft(quotas map[int]int64, unreported map[int]int64, rate float64) map[int]int64 {
+	left := make(map[int]int64, len(quotas))
+	for uid, quota := range quotas {
+		if quota > 0 {
+			if rate > 0 && rate != 1 {
+				quota = int64(float64(quota) / rate)
 			}
+			quota -= unreported[uid]
 		}
-		c.logger.Printf("%d user deleted, %d user added", len(deleted), len(added))
+		left[uid] = quota
 	}
-	c.userList = newUserInfo
+	return left
+}
+
+// applyQuotas sets the quotas kept by the controller to the users of the
+// inbound, keyed by their tag on it
+func (c *Controller) applyQuotas() {
+	quotas := make(map[string]int64, len(c.quotas))
+	for i := range *c.userList {
+		u := &(*c.userList)[i]
+		if left, ok := c.quotas[u.UID]; ok {
+			quotas[c.buildUserTag(u)] = left
+		}
+	}
+	if err := c.dispatcher.Limiter.UpdateUserQuota(c.Tag, quotas); err != nil {
+		c.logger.Print(err)
+	}
+}
+
+// defaultUDP applies the UDP default of the node to the users the panel sets
+// no UDP flag for
+func (c *Controller) defaultUDP(userInfo *[]api.UserInfo) {
+	udp := int8(1)
+	if c.config.DisableUserUDP {
+		udp = -1
+	}
+	for i := range *userInfo {
+		if u := &(*userInfo)[i]; u.UDP == 0 {
+			u.UDP = udp
+		}
+	}
+}
+
+// activeUsers returns the users not expired yet. The expired ones are marked,
+// so they are not removed from the inbound again once the panel drops them.
+func (c *Controller) activeUsers(users *[]api.UserInfo) *[]api.UserInfo {
+	now := time.Now().Unix()
+	active := make([]api.UserInfo, 0, len(*users))
+	for _, u := range *users {
+		if u.ExpiredAt > 0 && u.ExpiredAt <= now {
+			c.expiredUsers[u] = true
+			continue
+		}
+		active = append(active, u)
+	}
+	return &active
+}
+
+// scheduleExpiry finds the time the next user of the list expires at
+func (c *Controller) scheduleExpiry() {
+	c.nextExpiry = 0
+	for _, u := range *c.userList {
+		if u.ExpiredAt > 0 && !c.expiredUsers[u] && (c.nextExpiry == 0 || u.ExpiredAt < c.nextExpiry) {
+			c.nextExpiry = u.ExpiredAt
+		}
+	}
+}
+
+// expiryMonitor removes the users from the inbound once they expire, instead
+// of letting them connect until the panel drops them on a later user sync
+func (c *Controller) expiryMonitor() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	now := time.Now().Unix()
+	if c.nextExpiry == 0 || now < c.nextExpiry {
+		return nil
+	}
+	var expired []api.UserInfo
+	for _, u := range *c.userList {
+		if u.ExpiredAt > 0 && u.ExpiredAt <= now && !c.expiredUsers[u] {
+			c.expiredUsers[u] = true
+			expired = append(expired, u)
+		}
+	}
+	c.scheduleExpiry()
+	if err := c.removeNodeUsers(expired); err != nil {
+		c.logger.Print(err)
+	}
+	c.logger.Printf("%d user expired", len(expired))
 	return nil
 }
 
+// isLeader reports whether this instance reports for the cluster, always
+// false when the cluster mode is off
+func (c *Controller) isLeader() bool {
+	if c.cluster == nil {
+		return false
+	}
+	leader, err := c.cluster.IsLeader()
+	if err != nil {
+		c.logger.Printf("Check the cluster leader failed: %s", err)
+	}
+	return leader
+}
+
+// onlineStoreConfig is the store of the online users. A redis cluster
+// shares them through its redis unless a redis store is set.
+func (c *Controller) onlineStoreConfig() *limiter.OnlineStoreConfig {
+	storeConfig := c.config.OnlineStoreConfig
+	clusterConfig := c.config.ClusterConfig
+	if clusterConfig == nil || !clusterConfig.Enable || (storeConfig != nil && storeConfig.Type == "redis") ||
+		(clusterConfig.Type != "" && !strings.EqualFold(clusterConfig.Type, "redis")) {
+		return storeConfig
+	}
+	config := &limiter.OnlineStoreConfig{
+		Type:          "redis",
+		RedisNetwork:  clusterConfig.RedisNetwork,
+		RedisAddr:     clusterConfig.RedisAddr,
+		RedisUsername: clusterConfig.RedisUsername,
+		RedisPassword: clusterConfig.RedisPassword,
+		RedisDB:       clusterConfig.RedisDB,
+		Timeout:       clusterConfig.Timeout,
+	}
+	if storeConfig != nil {
+		config.DeviceWindow = storeConfig.DeviceWindow
+	}
+	return config
+}
+
+// sharesOnlineStore reports whether all the instances of the cluster keep
+// the online users in the same store
+func (c *Controller) sharesOnlineStore() bool {
+	storeConfig := c.onlineStoreConfig()
+	return storeConfig != nil && storeConfig.Type == "redis"
+}
+
+// getOnlineDevice takes the online users of the node. When the instances of
+// the cluster don't share the online store, the leader adds the ones pushed
+// by the others.
+func (c *Controller) getOnlineDevice(tag string) (*[]api.OnlineUser, error) {
+	onlineDevice, err := c.GetOnlineDevice(tag)
+	if err != nil || c.cluster == nil || c.sharesOnlineStore() {
+		return onlineDevice, err
+	}
+	shared, err := c.cluster.Online()
+	if err != nil {
+		c.logger.Printf("Get the online users of the cluster failed: %s", err)
+		return onlineDevice, nil
+	}
+	merged := append(*onlineDevice, shared...)
+	return &merged, nil
+}
+
+// pushOnline hands the online users of a follower to the leader, unless
+// the online store is shared already
+func (c *Controller) pushOnline(tag string) {
+	if c.sharesOnlineStore() {
+		return
+	}
+	onlineDevice, err := c.GetOnlineDevice(tag)
+	if err != nil {
+		c.logger.Print(err)
+		return
+	}
+	c.recent.setOnline(*onlineDevice)
+	if err := c.cluster.PushOnline(*onlineDevice); err != nil {
+		c.logger.Printf("Push online users to the cluster failed: %s", err)
+	}
+}
+
+// dataPath is the file keeping the state of the given kind for this node
+// in DataDir, empty if there is no DataDir
+func (c *Controller) dataPath(kind string) string {
+	if c.config.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(c.config.DataDir, fmt.Sprintf("%s_%s.json", kind, c.nodeKey()))
+}
+
+// nodeKey tells this node from the other ones sharing the DataDir
+func (c *Controller) nodeKey() string {
+	return fmt.Sprintf("%s_%s_%d", c.panelType, c.clientInfo.NodeType, c.clientInfo.NodeID)
+}
+
+// restoreSnapshot returns the node info and users saved by the last sync, so
+// the node can serve the previous users while the panel is unreachable
+func (c *Controller) restoreSnapshot(cause error) *nodecache.Snapshot {
+	snapshot, err := c.nodeCache.Load()
+	if err != nil {
+		c.logger.Print(err)
+		return nil
+	}
+	if snapshot == nil {
+		return nil
+	}
+	c.logger.Printf("Panel unreachable (%s), start with the node and users saved at %s", cause, snapshot.SavedAt.Format(time.RFC3339))
+	return snapshot
+}
+
+func (c *Controller) saveSnapshot() {
+	if err := c.nodeCache.Save(c.nodeInfo, c.userList); err != nil {
+		c.logger.Printf("Save node cache failed: %s", err)
+	}
+}
+
+// needRebuild reports whether the change from old to new has to tear down
+// and rebuild the inbound. Port, transport, TLS/REALITY mode and the other
+// listener settings do; the fields cleared below are applied to the running
+// inbound by liveUpdateNodeInfo instead.
+func needRebuild(old, new *api.NodeInfo) bool {
+	o, n := *old, *new
+	o.SpeedLimit, n.SpeedLimit = 0, 0
+	o.AlterID, n.AlterID = 0, 0
+	o.NameServerConfig, n.NameServerConfig = nil, nil
+	return !reflect.DeepEqual(o, n)
+}
+
+// liveUpdateNodeInfo applies node changes that don't need a new inbound.
+func (c *Controller) liveUpdateNodeInfo(newNodeInfo *api.NodeInfo) {
+	if c.nodeInfo.SpeedLimit != newNodeInfo.SpeedLimit {
+		if err := c.UpdateNodeSpeedLimit(c.Tag, newNodeInfo.SpeedLimit); err != nil {
+			c.logger.Print(err)
+			return
+		}
+	}
+	c.nodeInfo = newNodeInfo
+	c.logger.Print("Node info updated without restarting the inbound")
+}
+
 func (c *Controller) removeOldTag(oldTag string) (err error) {
 	err = c.removeInbound(oldTag)
 	if err != nil {
@@ -319,20 +844,39 @@ func (c *Controller) removeOldTag(oldTag string) (err error) {
 	if err != nil {
 		return err
 	}
+	c.removeNodeRoute(oldTag)
 	return nil
 }
 
 func (c *Controller) addNewTag(newNodeInfo *api.NodeInfo) (err error) {
-	if newNodeInfo.NodeType != "Shadowsocks-Plugin" {
+	if servedNodeType(newNodeInfo.NodeType) {
+		if err := c.addServedInbound(newNodeInfo); err != nil {
+			return err
+		}
+		outBoundConfig, err := OutboundBuilder(c.config, newNodeInfo, c.Tag)
+		if err != nil {
+			return err
+		}
+		if err := c.addOutbound(outBoundConfig); err != nil {
+			return err
+		}
+	} else if newNodeInfo.NodeType != "Shadowsocks-Plugin" {
 		inboundConfig, err := InboundBuilder(c.config, newNodeInfo, c.Tag)
 		if err != nil {
 			return err
 		}
-		err = c.addInbound(inboundConfig)
+		err = c.addNodeInbound(inboundConfig, newNodeInfo)
 		if err != nil {
 
 			return err
 		}
+		if dest, serverNames, ok := realityDest(c.config, newNodeInfo); ok {
+			go func() {
+				if err := verifyREALITYDest(dest, serverNames, c.config.TLSFingerprint); err != nil {
+					c.logger.Printf("REALITY dest check failed: %s", err)
+				}
+			}()
+		}
 		outBoundConfig, err := OutboundBuilder(c.config, newNodeInfo, c.Tag)
 		if err != nil {
 
@@ -345,9 +889,117 @@ func (c *Controller) addNewTag(newNodeInfo *api.NodeInfo) (err error) {
 		}
 
 	} else {
-		return c.addInboundForSSPlugin(*newNodeInfo)
+		if err := c.addInboundForSSPlugin(*newNodeInfo); err != nil {
+			return err
+		}
 	}
-	return nil
+	if err := c.addExtraInbounds(newNodeInfo); err != nil {
+		return err
+	}
+	return c.addNodeRoute(c.Tag)
+}
+
+// addNodeRoute adds the extra outbounds of the node and routes the matched
+// traffic of the inbound with tag to them. The blocklist, the speed test and
+// port scan detections, the plaintext port rule and the connection limit of
+// the node are turned on here too, as they filter the same connections, and
+// so are its relay buffer sizes and splicing.
+func (c *Controller) addNodeRoute(tag string) error {
+	if c.config.EnableSplice {
+		c.dispatcher.SpliceInbounds.Store(tag, true)
+	}
+	if b := c.config.ConnectionConfig; b != nil && (b.ReadBufferSize != 0 || b.WriteBufferSize != 0) {
+		c.dispatcher.LinkBuffers.Store(tag, mydispatcher.LinkBuffer{
+			Read:  bufferSize(b.ReadBufferSize),
+			Write: bufferSize(b.WriteBufferSize),
+		})
+	}
+	if b := c.config.BlocklistConfig; b != nil && b.Enable {
+		c.dispatcher.Blocklist.AddNode(tag, b.ResolveDomain)
+	}
+	if s := c.config.SpeedtestConfig; s != nil && s.Enable {
+		if err := c.dispatcher.Speedtest.AddNode(tag, s); err != nil {
+			return err
+		}
+	}
+	if p := c.config.PlaintextPortConfig; p != nil && p.Enable && len(p.Ports) > 0 {
+		c.dispatcher.RuleManager.UpdatePortRule(tag, p.Ports, p.RuleID)
+	}
+	if l := c.config.ConnectionLimitConfig; l != nil && l.Enable {
+		if err := c.dispatcher.ConnLimit.AddNode(tag, l); err != nil {
+			return err
+		}
+	}
+	if p := c.config.PortScanConfig; p != nil && p.Enable {
+		if err := c.dispatcher.PortScan.AddNode(tag, p); err != nil {
+			return err
+		}
+	}
+	c.routeGeoData = geodata.Generation()
+	outbounds, routeConfig, err := RouteBuilder(c.config, c.nodeInfo, tag, c.userList)
+	if err != nil || routeConfig == nil {
+		return err
+	}
+	if b := c.config.BalancerConfig; b != nil && b.Enable && strings.EqualFold(b.Strategy, "leastPing") {
+		if c.server.GetFeature(extension.ObservatoryType()) == nil {
+			return errors.New("leastPing balancer needs the observatory, restart XrayR to enable it")
+		}
+	}
+	for _, outbound := range outbounds {
+		if err := c.addOutbound(outbound); err != nil {
+			return err
+		}
+		c.routeTags = append(c.routeTags, outbound.Tag)
+	}
+	return c.dispatcher.NodeRoute.UpdateRoute(tag, routeConfig)
+}
+
+// updateNodeRoute regenerates the routing rules of the node, so the user
+// routes follow the user list, the ASN and country routes follow their
+// databases, and the geoip: and geosite: rules follow the geo files
+func (c *Controller) updateNodeRoute() error {
+	pool := c.config.IPv6PoolConfig
+	perUserPool := pool != nil && pool.Enable && pool.Rotate == "user"
+	geoData := geodata.Generation()
+	if len(c.config.UserRouteConfigs) == 0 && len(c.config.ASNRouteConfigs) == 0 && len(c.config.CountryRouteConfigs) == 0 && !perUserPool && geoData == c.routeGeoData {
+		return nil
+	}
+	c.routeGeoData = geoData
+	_, routeConfig, err := RouteBuilder(c.config, c.nodeInfo, c.Tag, c.userList)
+	if err != nil {
+		return err
+	}
+	if routeConfig == nil {
+		c.dispatcher.NodeRoute.RemoveRoute(c.Tag)
+		return nil
+	}
+	return c.dispatcher.NodeRoute.UpdateRoute(c.Tag, routeConfig)
+}
+
+// bufferSize returns the relay buffer size of the node in Byte, -1 being no
+// limit and 0 the global size
+func bufferSize(kB int32) int32 {
+	if kB <= 0 {
+		return kB
+	}
+	return kB * 1024
+}
+
+func (c *Controller) removeNodeRoute(tag string) {
+	c.dispatcher.NodeRoute.RemoveRoute(tag)
+	c.dispatcher.Blocklist.RemoveNode(tag)
+	c.dispatcher.Speedtest.RemoveNode(tag)
+	c.dispatcher.RuleManager.RemovePortRule(tag)
+	c.dispatcher.ConnLimit.RemoveNode(tag)
+	c.dispatcher.PortScan.RemoveNode(tag)
+	c.dispatcher.LinkBuffers.Delete(tag)
+	c.dispatcher.SpliceInbounds.Delete(tag)
+	for _, outboundTag := range c.routeTags {
+		if err := c.removeOutbound(outboundTag); err != nil {
+			c.logger.Print(err)
+		}
+	}
+	c.routeTags = nil
 }
 
 func (c *Controller) addInboundForSSPlugin(newNodeInfo api.NodeInfo) (err error) {
@@ -360,7 +1012,7 @@ func (c *Controller) addInboundForSSPlugin(newNodeInfo api.NodeInfo) (err error)
 	if err != nil {
 		return err
 	}
-	err = c.addInbound(inboundConfig)
+	err = c.addNodeInbound(inboundConfig, &fakeNodeInfo)
 	if err != nil {
 
 		return err
@@ -403,27 +1055,38 @@ func (c *Controller) addInboundForSSPlugin(newNodeInfo api.NodeInfo) (err error)
 }
 
 func (c *Controller) addNewUser(userInfo *[]api.UserInfo, nodeInfo *api.NodeInfo) (err error) {
-	users := make([]*protocol.User, 0)
-	switch nodeInfo.NodeType {
-	case "V2ray":
-		if nodeInfo.EnableVless {
-			users = c.buildVlessUser(userInfo)
-		} else {
-			users = c.buildVmessUser(userInfo)
+	for tag, list := range c.inboundUsers(*userInfo) {
+		users := make([]*protocol.User, 0)
+		switch nodeInfo.NodeType {
+		case "V2ray":
+			if nodeInfo.EnableVless && tag != mixedVMessTag(c.Tag) {
+				users = c.buildVlessUser(&list)
+			} else {
+				users = c.buildVmessUser(&list)
+			}
+		case "Trojan", "AnyTLS", "Naive":
+			users = c.buildTrojanUser(&list)
+		case "Juicity", "Mixed", "SSH":
+			users = c.buildPasswordUser(&list)
+		case "Forward":
+			// No credentials, the users only own the traffic of the forward
+			users = c.buildTrojanUser(&list)
+		case "Shadowsocks":
+			users = c.buildSSUser(&list, nodeInfo.CypherMethod)
+		case "Shadowsocks-Plugin":
+			users = c.buildSSPluginUser(&list)
+		default:
+			served, ok := servedProtocols[nodeInfo.NodeType]
+			if !ok || served.buildUsers == nil {
+				return fmt.Errorf("unsupported node type: %s", nodeInfo.NodeType)
+			}
+			users = served.buildUsers(c, &list)
 		}
-	case "Trojan":
-		users = c.buildTrojanUser(userInfo)
-	case "Shadowsocks":
-		users = c.buildSSUser(userInfo, nodeInfo.CypherMethod)
-	case "Shadowsocks-Plugin":
-		users = c.buildSSPluginUser(userInfo)
-	default:
-		return fmt.Errorf("unsupported node type: %s", nodeInfo.NodeType)
-	}
 
-	err = c.addUsers(users, c.Tag)
-	if err != nil {
-		return err
+		err = c.addUsers(users, tag)
+		if err != nil {
+			return err
+		}
 	}
 	c.logger.Printf("Added %d new users", len(*userInfo))
 	return nil
@@ -478,27 +1141,16 @@ func limitUser(c *Controller, user api.UserInfo, silentUsers *[]api.UserInfo) {
 	*silentUsers = append(*silentUsers, user)
 }
 
-func (c *Controller) userInfoMonitor() (err error) {
+func (c *Controller) trafficMonitor() (err error) {
 	// delay to start
-	if time.Since(c.startAt) < time.Duration(c.config.UpdatePeriodic)*time.Second {
+	if time.Since(c.startAt) < c.interval(c.config.TrafficReportPeriodic) {
 		return nil
 	}
 
-	// Get server status
-	CPU, Mem, Disk, Uptime, err := serverstatus.GetSystemInfo()
-	if err != nil {
-		c.logger.Print(err)
-	}
-	err = c.apiClient.ReportNodeStatus(
-		&api.NodeStatus{
-			CPU:    CPU,
-			Mem:    Mem,
-			Disk:   Disk,
-			Uptime: Uptime,
-		})
-	if err != nil {
-		c.logger.Print(err)
-	}
+	c.access.Lock()
+	tag, userList := c.Tag, c.userList
+	c.access.Unlock()
+
 	// Unlock users
 	if c.config.AutoSpeedLimitConfig.Limit > 0 && len(c.limitedUsers) > 0 {
 		c.logger.Printf("Limited users:")
@@ -514,25 +1166,23 @@ func (c *Controller) userInfoMonitor() (err error) {
 			}
 		}
 		if len(toReleaseUsers) > 0 {
-			if err := c.UpdateInboundLimiter(c.Tag, &toReleaseUsers); err != nil {
+			if err := c.UpdateInboundLimiter(tag, &toReleaseUsers); err != nil {
 				c.logger.Print(err)
 			}
 		}
 	}
 
 	// Get User traffic
-	var userTraffic []api.UserTraffic
-	var upCounterList []stats.Counter
-	var downCounterList []stats.Counter
+	traffic := c.snapshotTraffic(tag)
 	AutoSpeedLimit := int64(c.config.AutoSpeedLimitConfig.Limit)
-	UpdatePeriodic := int64(c.config.UpdatePeriodic)
+	TrafficPeriodic := int64(c.interval(c.config.TrafficReportPeriodic) / time.Second)
 	limitedUsers := make([]api.UserInfo, 0)
-	for _, user := range *c.userList {
-		up, down, upCounter, downCounter := c.getTraffic(c.buildUserTag(&user))
-		if up > 0 || down > 0 {
+	for _, user := range *userList {
+		if t, ok := traffic[user.UID]; ok {
+			up, down := t.Up, t.Down
 			// Over speed users
 			if AutoSpeedLimit > 0 {
-				if down > AutoSpeedLimit*1000000*UpdatePeriodic/8 || up > AutoSpeedLimit*1000000*UpdatePeriodic/8 {
+				if down > AutoSpeedLimit*1000000*TrafficPeriodic/8 || up > AutoSpeedLimit*1000000*TrafficPeriodic/8 {
 					if _, ok := c.limitedUsers[user]; !ok {
 						if c.config.AutoSpeedLimitConfig.WarnTimes == 0 {
 							limitUser(c, user, &limitedUsers)
@@ -548,63 +1198,217 @@ func (c *Controller) userInfoMonitor() (err error) {
 					delete(c.warnedUsers, user)
 				}
 			}
-			userTraffic = append(userTraffic, api.UserTraffic{
-				UID:      user.UID,
-				Email:    user.Email,
-				Upload:   up,
-				Download: down})
-
-			if upCounter != nil {
-				upCounterList = append(upCounterList, upCounter)
-			}
-			if downCounter != nil {
-				downCounterList = append(downCounterList, downCounter)
-			}
 		} else {
 			delete(c.warnedUsers, user)
 		}
 	}
 	if len(limitedUsers) > 0 {
-		if err := c.UpdateInboundLimiter(c.Tag, &limitedUsers); err != nil {
+		if err := c.UpdateInboundLimiter(tag, &limitedUsers); err != nil {
 			c.logger.Print(err)
 		}
 	}
-	if len(userTraffic) > 0 {
-		var err error // Define an empty error
-		if !c.config.DisableUploadTraffic {
-			err = c.apiClient.ReportUserTraffic(&userTraffic)
+	userTraffic := AppendUserTraffic(c.userTraffic[:0], *userList, traffic)
+	c.submitTraffic(userTraffic)
+	clear(userTraffic)
+	c.userTraffic = userTraffic[:0]
+
+	// Report Illegal user
+	if detectResult, err := c.GetDetectResult(tag); err != nil {
+		c.logger.Print(err)
+	} else if len(*detectResult) > 0 {
+		c.recent.addAudits(*detectResult)
+		if c.eventBus != nil {
+			if err := c.eventBus.PublishAudit(time.Now(), *detectResult); err != nil {
+				c.logger.Print(err)
+			}
 		}
-		// If report traffic error, not clear the traffic
-		if err != nil {
+		if err = c.apiClient.ReportIllegal(detectResult); err != nil {
 			c.logger.Print(err)
 		} else {
-			c.resetTraffic(&upCounterList, &downCounterList)
+			c.logger.Printf("Report %d illegal behaviors", len(*detectResult))
+		}
+
+	}
+	return nil
+}
+
+// AppendUserTraffic appends the traffic of the users of userList found in the
+// snapshot to userTraffic, in the order of userList
+func AppendUserTraffic(userTraffic []api.UserTraffic, userList []api.UserInfo, traffic map[int]limiter.TrafficSnapshot) []api.UserTraffic {
+	for _, user := range userList {
+		if t, ok := traffic[user.UID]; ok {
+			userTraffic = append(userTraffic, api.UserTraffic{
+				UID:      user.UID,
+				Email:    user.Email,
+				Upload:   t.Up,
+				Download: t.Down})
+		}
+	}
+	return userTraffic
+}
+
+// submitTraffic moves the collected traffic into the queue and reports
+// everything pending to the panel.
+func (c *Controller) submitTraffic(userTraffic []api.UserTraffic) {
+	if len(userTraffic) > 0 {
+		// The local files get the usage of this instance whether or not it goes to the panel
+		if c.trafficSink != nil {
+			if err := c.trafficSink.Write(time.Now(), userTraffic); err != nil {
+				c.logger.Print(err)
+			}
+		}
+		if c.eventBus != nil {
+			if err := c.eventBus.PublishTraffic(time.Now(), userTraffic); err != nil {
+				c.logger.Print(err)
+			}
+		}
+		if !c.config.DisableUploadTraffic {
+			// In cluster mode the traffic joins the pool reported by the leader,
+			// it is reported by this instance only when redis is unreachable
+			if c.cluster != nil {
+				if err := c.cluster.PushTraffic(userTraffic); err != nil {
+					c.logger.Printf("Push traffic to the cluster failed: %s", err)
+				} else {
+					userTraffic = nil
+				}
+			}
+			// Hand the traffic over to the queue, it is kept there until the panel accepts it
+			if len(userTraffic) > 0 {
+				if err := c.trafficQueue.Push(&userTraffic); err != nil {
+					c.logger.Print(err)
+				}
+			}
 		}
 	}
+	if !c.config.DisableUploadTraffic {
+		if c.isLeader() {
+			if pooled, err := c.cluster.PopTraffic(); err != nil {
+				c.logger.Printf("Pop traffic from the cluster failed: %s", err)
+			} else if len(pooled) > 0 {
+				if err := c.trafficQueue.Push(&pooled); err != nil {
+					c.logger.Print(err)
+				}
+			}
+		}
+		if _, err := c.trafficQueue.FlushWithKey(c.reportTraffic); err != nil {
+			c.logger.Printf("Report traffic failed, keep %d users for retry: %s", c.trafficQueue.Len(), err)
+		}
+	}
+}
+
+// reportTraffic sends a batch of the traffic queue, tagged with its key when
+// the panel client supports it, so a retried batch is not billed twice. The
+// traffic is multiplied by TrafficRate on the way, the queue keeps the usage.
+func (c *Controller) reportTraffic(key string, userTraffic *[]api.UserTraffic) error {
+	if rate := c.config.TrafficRate; rate > 0 && rate != 1 {
+		billed := make([]api.UserTraffic, len(*userTraffic))
+		for i, t := range *userTraffic {
+			t.Upload = int64(float64(t.Upload) * rate)
+			t.Download = int64(float64(t.Download) * rate)
+			billed[i] = t
+		}
+		userTraffic = &billed
+	}
+	if reporter, ok := c.apiClient.(api.IdempotentReporter); ok {
+		return reporter.ReportUserTrafficWithKey(key, userTraffic)
+	}
+	return c.apiClient.ReportUserTraffic(userTraffic)
+}
+
+func (c *Controller) onlineMonitor() (err error) {
+	// delay to start
+	if time.Since(c.startAt) < c.interval(c.config.OnlineReportPeriodic) {
+		return nil
+	}
+
+	c.access.Lock()
+	tag := c.Tag
+	c.access.Unlock()
+	c.reportDeviceRejects(tag)
+
+	// The online users are shared by the cluster, only the leader reports them
+	// along with the node status
+	if c.cluster != nil && !c.isLeader() {
+		c.pushOnline(tag)
+		return nil
+	}
+
+	// Get server status
+	CPU, Mem, Disk, Uptime, err := serverstatus.GetSystemInfo()
+	if err != nil {
+		c.logger.Print(err)
+	}
+	err = c.apiClient.ReportNodeStatus(
+		&api.NodeStatus{
+			CPU:    CPU,
+			Mem:    Mem,
+			Disk:   Disk,
+			Uptime: Uptime,
+		})
+	if err != nil {
+		c.logger.Print(err)
+	}
 
 	// Report Online info
-	if onlineDevice, err := c.GetOnlineDevice(c.Tag); err != nil {
+	onlineDevice, err := c.getOnlineDevice(tag)
+	if err != nil {
 		c.logger.Print(err)
-	} else if len(*onlineDevice) > 0 {
+		return nil
+	}
+	c.recent.setOnline(*onlineDevice)
+	if len(*onlineDevice) > 0 {
+		c.publishOnline(onlineDevice)
 		if err = c.apiClient.ReportNodeOnlineUsers(onlineDevice); err != nil {
 			c.logger.Print(err)
 		} else {
 			c.logger.Printf("Report %d online users", len(*onlineDevice))
 		}
 	}
+	return nil
+}
 
-	// Report Illegal user
-	if detectResult, err := c.GetDetectResult(c.Tag); err != nil {
+// publishOnline hands the online users to the event bus, if there is one
+func (c *Controller) publishOnline(onlineDevice *[]api.OnlineUser) {
+	if c.eventBus == nil {
+		return
+	}
+	if err := c.eventBus.PublishOnline(time.Now(), *onlineDevice); err != nil {
 		c.logger.Print(err)
-	} else if len(*detectResult) > 0 {
-		if err = c.apiClient.ReportIllegal(detectResult); err != nil {
-			c.logger.Print(err)
-		} else {
-			c.logger.Printf("Report %d illegal behaviors", len(*detectResult))
+	}
+}
+
+// newPeriodicTask wraps execute into a periodic task. Unless jitter is
+// disabled, the first run is pushed back by a random offset of up to one
+// interval and every later interval varies by ±periodicJitter, so that nodes
+// provisioned from the same image don't hit the panel in lockstep.
+func (c *Controller) newPeriodicTask(tag string, interval time.Duration, execute func() error) periodicTask {
+	t := &task.Periodic{
+		Interval: interval,
+		Execute:  execute,
+	}
+	if !c.config.DisableJitter && interval > 0 {
+		first := true
+		t.Execute = func() error {
+			// Periodic reads Interval right after Execute returns to schedule the next run
+			if first {
+				first = false
+				t.Interval = interval + time.Duration(rand.Int63n(int64(interval)))
+			} else {
+				spread := int64(float64(interval) * periodicJitter)
+				t.Interval = interval + time.Duration(rand.Int63n(2*spread+1)-spread)
+			}
+			return execute()
 		}
+	}
+	return periodicTask{tag: tag, Periodic: t}
+}
 
+// interval returns the given periodic in seconds, falling back to UpdatePeriodic.
+func (c *Controller) interval(periodic int) time.Duration {
+	if periodic > 0 {
+		return time.Duration(periodic) * time.Second
 	}
-	return nil
+	return time.Duration(c.config.UpdatePeriodic) * time.Second
 }
 
 func (c *Controller) buildNodeTag() string {
@@ -618,18 +1422,38 @@ func (c *Controller) buildNodeTag() string {
 // Check Cert
 func (c *Controller) certMonitor() error {
 	if c.nodeInfo.EnableTLS && c.config.EnableREALITY == false {
-		switch c.config.CertConfig.CertMode {
-		case "dns", "http", "tls":
-			lego, err := mylego.New(c.config.CertConfig)
-			if err != nil {
-				c.logger.Print(err)
-			}
-			// Xray-core supports the OcspStapling certification hot renew
-			_, _, _, err = lego.RenewCert()
-			if err != nil {
-				c.logger.Print(err)
-			}
+		if _, err := c.renewCert(); err != nil {
+			c.logger.Print(err)
 		}
 	}
 	return nil
 }
+
+// renewCert renews the certificate obtained from a CA if it is due,
+// reporting whether it was, and alerts if the one in use expires soon
+func (c *Controller) renewCert() (bool, error) {
+	switch c.config.CertConfig.CertMode {
+	case "dns", "http", "tls":
+		lego, err := mylego.New(c.config.CertConfig)
+		if err != nil {
+			return false, err
+		}
+		// Xray-core supports the OcspStapling certification hot renew
+		certPath, _, renewed, err := lego.RenewCert()
+		if err != nil {
+			c.alert(webhook.CertRenewFailed, certificate{Domain: c.config.CertConfig.CertDomain, Error: err.Error()},
+				"Renew certificate of %s failed: %s", c.config.CertConfig.CertDomain, err)
+			return false, err
+		}
+		if renewed {
+			notAfter, _ := certNotAfter(certPath)
+			c.event(webhook.CertRenewed, certificate{Domain: c.config.CertConfig.CertDomain, NotAfter: &notAfter},
+				"Certificate of %s renewed, expires at %s", c.config.CertConfig.CertDomain, notAfter.Format(time.DateTime))
+		}
+		c.checkCertExpiry(certPath)
+		return renewed, nil
+	case "file":
+		c.checkCertExpiry(c.config.CertConfig.CertFile)
+	}
+	return false, nil
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/qtai2901/new_xrayr/api"
 	"github.com/qtai2901/new_xrayr/api/sspanel"
 	_ "github.com/qtai2901/new_xrayr/cmd/distro/all"
+	"github.com/qtai2901/new_xrayr/common/limiter"
 	"github.com/qtai2901/new_xrayr/common/mylego"
 	. "github.com/qtai2901/new_xrayr/service/controller"
 )
@@ -79,3 +80,37 @@ func TestController(t *testing.T) {
 		<-osSignals
 	}
 }
+
+func TestQuotasLeft(t *testing.T) {
+	// 1 GB billed left at a rate of 2 is 500 MB through the node, less the
+	// 100 MB the panel hasn't counted yet
+	quotas := map[int]int64{1: 1000000000, 2: -1}
+	unreported := map[int]int64{1: 100000000, 2: 5}
+	left := QuotasLeft(quotas, unreported, 2)
+	if left[1] != 400000000 {
+		t.Errorf("got %d left at a rate of 2, want 400000000", left[1])
+	}
+	if left[2] != -1 {
+		t.Errorf("got %d left of a used up quota, want it kept", left[2])
+	}
+	if left := QuotasLeft(quotas, unreported, 0); left[1] != 900000000 {
+		t.Errorf("got %d left without a rate, want 900000000", left[1])
+	}
+}
+
+func TestAppendUserTrafficReused(t *testing.T) {
+	userList := []api.UserInfo{{UID: 1, Email: "a"}, {UID: 2, Email: "b"}, {UID: 3, Email: "c"}}
+	traffic := map[int]limiter.TrafficSnapshot{1: {Up: 10, Down: 20}, 3: {Up: 5}}
+	userTraffic := AppendUserTraffic(nil, userList, traffic)
+	if len(userTraffic) != 2 || userTraffic[0].Download != 20 || userTraffic[1].Email != "c" {
+		t.Fatalf("unexpected traffic: %v", userTraffic)
+	}
+	// The next reports go into the slice of the first one, like trafficMonitor
+	allocs := testing.AllocsPerRun(10, func() {
+		clear(userTraffic)
+		userTraffic = AppendUserTraffic(userTraffic[:0], userList, traffic)
+	})
+	if allocs != 0 {
+		t.Errorf("got %.0f allocations on a report after the first, want 0", allocs)
+	}
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// extraInboundTag returns the tag of the i-th extra inbound of the node with tag
+func extraInboundTag(tag string, i int) string {
+	return fmt.Sprintf("%s_extra_%d", tag, i)
+}
+
+// extraNodeInfo returns the node info the extra inbound is built from, the
+// one of the node with the port and transport replaced
+func extraNodeInfo(nodeInfo *api.NodeInfo, e *ExtraInboundConfig) *api.NodeInfo {
+	info := *nodeInfo
+	info.Port = e.Port
+	if e.Transport != "" && e.Transport != nodeInfo.TransportProtocol {
+		info.TransportProtocol = e.Transport
+		info.Header = nil
+	}
+	if e.Path != "" {
+		info.Path = e.Path
+	}
+	if e.Host != "" {
+		info.Host = e.Host
+	}
+	if e.ServiceName != "" {
+		info.ServiceName = e.ServiceName
+	}
+	return &info
+}
+
+// addExtraInbounds adds the extra inbounds of the node. They have no outbound
+// of their own: the dispatcher handles their connections as the ones of the
+// node, so the traffic, limits and routes of the users are shared.
+func (c *Controller) addExtraInbounds(nodeInfo *api.NodeInfo) error {
+	if err := c.addMixedVMessInbound(nodeInfo); err != nil {
+		return err
+	}
+	if len(c.config.ExtraInboundConfigs) == 0 {
+		return nil
+	}
+	if nodeInfo.NodeType == "Shadowsocks-Plugin" || servedNodeType(nodeInfo.NodeType) {
+		return fmt.Errorf("extra inbounds are not supported by %s nodes", nodeInfo.NodeType)
+	}
+	for i, e := range c.config.ExtraInboundConfigs {
+		if e.Port == 0 {
+			continue
+		}
+		tag := extraInboundTag(c.Tag, i)
+		inboundConfig, err := InboundBuilder(c.config, extraNodeInfo(nodeInfo, e), tag)
+		if err != nil {
+			return err
+		}
+		if err := c.addNodeInbound(inboundConfig, nodeInfo); err != nil {
+			return err
+		}
+		c.dispatcher.InboundAliases.Store(tag, c.Tag)
+	}
+	return nil
+}
+
+// removeExtraInbounds removes the extra inbounds of the node with tag
+func (c *Controller) removeExtraInbounds(tag string) {
+	c.removeMixedVMessInbound(tag)
+	for i, e := range c.config.ExtraInboundConfigs {
+		if e.Port == 0 {
+			continue
+		}
+		extraTag := extraInboundTag(tag, i)
+		c.dispatcher.InboundAliases.Delete(extraTag)
+		if err := c.removeInbound(extraTag); err != nil {
+			c.logger.Print(err)
+		}
+	}
+}
+
+// inboundUsers splits the users over the inbounds of the node by their tags.
+// A user goes to every extra inbound matching its tag, and to the inbound of
+// the node unless one of them is exclusive, along with the VMess inbound
+// behind it if any.
+func (c *Controller) inboundUsers(users []api.UserInfo) map[string][]api.UserInfo {
+	split := make(map[string][]api.UserInfo)
+	for _, u := range users {
+		exclusive := false
+		for i, e := range c.config.ExtraInboundConfigs {
+			if e.Port == 0 || !e.match(&u) {
+				continue
+			}
+			tag := extraInboundTag(c.Tag, i)
+			split[tag] = append(split[tag], u)
+			exclusive = exclusive || e.Exclusive
+		}
+		if !exclusive {
+			split[c.Tag] = append(split[c.Tag], u)
+			if mixedVMess(c.config, c.nodeInfo) {
+				tag := mixedVMessTag(c.Tag)
+				split[tag] = append(split[tag], u)
+			}
+		}
+	}
+	return split
+}
+
+// removeNodeUsers removes the users from the inbounds of the node they were
+// added to
+func (c *Controller) removeNodeUsers(users []api.UserInfo) error {
+	for tag, list := range c.inboundUsers(users) {
+		emails := make([]string, len(list))
+		for i := range list {
+			emails[i] = c.buildUserTag(&list[i])
+		}
+		if err := c.removeUsers(emails, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
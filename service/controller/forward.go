@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/proxy"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/app/mydispatcher"
+)
+
+// forwardSetting is the setting of the dokodemo-door inbound of a Forward node
+type forwardSetting struct {
+	Host        string   `json:"address"`
+	Port        uint16   `json:"port"`
+	NetworkList []string `json:"network"`
+}
+
+// buildForwardSetting returns the destination of a Forward node, the one of
+// the local config taking precedence over the one of the panel
+func buildForwardSetting(config *Config, nodeInfo *api.NodeInfo) (*forwardSetting, error) {
+	address, network := nodeInfo.ForwardAddress, nodeInfo.ForwardNetwork
+	if f := config.ForwardConfig; f != nil {
+		if f.Address != "" {
+			address = f.Address
+		}
+		if f.Network != "" {
+			network = f.Network
+		}
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid forward address %q, like 1.2.3.4:27015", address)
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid forward port: %s", portString)
+	}
+	setting := &forwardSetting{Host: host, Port: uint16(port)}
+	if network == "" {
+		network = "tcp,udp"
+	}
+	for _, n := range strings.Split(network, ",") {
+		n = strings.ToLower(strings.TrimSpace(n))
+		if n != "tcp" && n != "udp" {
+			return nil, fmt.Errorf("invalid forward network: %s", network)
+		}
+		setting.NetworkList = append(setting.NetworkList, n)
+	}
+	return setting, nil
+}
+
+// forwardHandler is the dokodemo-door inbound of a Forward node. Its
+// connections carry no user, so the users of the node are taken here for the
+// dispatcher to count all the traffic to the first one still there, and to
+// refuse the connections while there is none. The panel is expected to give
+// the node the user the forward belongs to.
+type forwardHandler struct {
+	inbound.Handler
+	owners *forwardOwners
+}
+
+func newForwardHandler(handler inbound.Handler, dispatcher *mydispatcher.DefaultDispatcher) (*forwardHandler, error) {
+	getInbound, ok := handler.(proxy.GetInbound)
+	if !ok {
+		return nil, fmt.Errorf("handler %s has not implemented proxy.GetInbound", handler.Tag())
+	}
+	owners := &forwardOwners{Inbound: getInbound.GetInbound(), tag: handler.Tag(), dispatcher: dispatcher}
+	owners.update()
+	return &forwardHandler{Handler: handler, owners: owners}, nil
+}
+
+// GetInbound implements proxy.GetInbound.
+func (h *forwardHandler) GetInbound() proxy.Inbound {
+	return h.owners
+}
+
+// Close implements common.Closable.
+func (h *forwardHandler) Close() error {
+	h.owners.dispatcher.InboundOwners.Delete(h.owners.tag)
+	return h.Handler.Close()
+}
+
+// forwardOwners is the dokodemo-door proxy with the users of the node
+type forwardOwners struct {
+	proxy.Inbound
+	tag        string
+	dispatcher *mydispatcher.DefaultDispatcher
+
+	access sync.Mutex
+	users  []*protocol.MemoryUser // In the order they were added
+}
+
+// AddUser implements proxy.UserManager.AddUser().
+func (o *forwardOwners) AddUser(ctx context.Context, u *protocol.MemoryUser) error {
+	o.access.Lock()
+	defer o.access.Unlock()
+	for _, user := range o.users {
+		if strings.EqualFold(user.Email, u.Email) {
+			return fmt.Errorf("user %s already exists", u.Email)
+		}
+	}
+	o.users = append(o.users, u)
+	o.update()
+	return nil
+}
+
+// RemoveUser implements proxy.UserManager.RemoveUser().
+func (o *forwardOwners) RemoveUser(ctx context.Context, email string) error {
+	o.access.Lock()
+	defer o.access.Unlock()
+	for i, user := range o.users {
+		if strings.EqualFold(user.Email, email) {
+			o.users = append(o.users[:i], o.users[i+1:]...)
+			o.update()
+			return nil
+		}
+	}
+	return fmt.Errorf("user %s not found", email)
+}
+
+// update hands the owner of the inbound to the dispatcher
+func (o *forwardOwners) update() {
+	var owner *protocol.MemoryUser
+	if len(o.users) > 0 {
+		owner = o.users[0]
+	}
+	o.dispatcher.InboundOwners.Store(o.tag, owner)
+}
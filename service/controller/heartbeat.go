@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// pushHeartbeat requests the URL of HeartbeatConfig in the background, elapsed
+// being how long the sync took. A push is skipped while the last one runs,
+// the monitor only needs one every so often.
+func (c *Controller) pushHeartbeat(elapsed time.Duration) {
+	config := c.config.HeartbeatConfig
+	if config == nil || config.URL == "" || !c.heartbeating.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.heartbeating.Store(false)
+		if err := pushHeartbeat(config, elapsed); err != nil {
+			c.logger.Printf("Push heartbeat failed: %s", err)
+		}
+	}()
+}
+
+func pushHeartbeat(config *HeartbeatConfig, elapsed time.Duration) error {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return err
+	}
+	// Uptime Kuma shows it as the response time of the monitor
+	if query := u.Query(); query.Has("ping") {
+		query.Set("ping", strconv.FormatInt(elapsed.Milliseconds(), 10))
+		u.RawQuery = query.Encode()
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Get(u.String())
+	if err != nil {
+		// The error holds the URL, with the token of the monitor
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
@@ -39,13 +39,7 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 	// Build Tag
 	inboundDetourConfig.Tag = tag
 	// SniffingConfig
-	sniffingConfig := &conf.SniffingConfig{
-		Enabled:      true,
-		DestOverride: &conf.StringList{"http", "tls"},
-	}
-	if config.DisableSniffing {
-		sniffingConfig.Enabled = false
-	}
+	sniffingConfig := buildSniffingConfig(config)
 	inboundDetourConfig.SniffingConfig = sniffingConfig
 
 	var (
@@ -76,6 +70,15 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 					Decryption: "none",
 				}
 			}
+			// Send the VMess clients to the VMess inbound behind
+			if mixedVMess(config, nodeInfo) {
+				fallback, err := mixedVMessFallback(config)
+				if err != nil {
+					return nil, err
+				}
+				vlessSetting := proxySetting.(*conf.VLessInboundConfig)
+				vlessSetting.Fallbacks = append(vlessSetting.Fallbacks, fallback)
+			}
 		} else {
 			protocol = "vmess"
 			proxySetting = &conf.VMessInboundConfig{}
@@ -124,6 +127,15 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 			proxySetting.IVCheck = false
 		}
 
+	case "Forward":
+		protocol = "dokodemo-door"
+		forward, err := buildForwardSetting(config, nodeInfo)
+		if err != nil {
+			return nil, err
+		}
+		proxySetting = forward
+		// The destination is fixed, not the sniffed one
+		sniffingConfig.Enabled = false
 	case "dokodemo-door":
 		protocol = "dokodemo-door"
 		proxySetting = struct {
@@ -96,3 +96,88 @@ func TestBuildSS(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestBuildSSWithPlugin(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "Shadowsocks",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		CypherMethod:      "aes-128-gcm",
+		Plugin:            "v2ray-plugin",
+		PluginOpts:        "server;path=/ss;host=test.test.tk",
+	}
+	pluginInfo, err := ShadowsocksPluginBuilder(&Config{}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pluginInfo.NodeType != "Shadowsocks-Plugin" || pluginInfo.Port != 1144 ||
+		pluginInfo.TransportProtocol != "ws" || pluginInfo.Path != "/ss" || pluginInfo.EnableTLS {
+		t.Fatalf("unexpected node info: %+v", pluginInfo)
+	}
+	// Applied once only
+	if again, err := ShadowsocksPluginBuilder(&Config{}, pluginInfo); err != nil || again.Port != 1144 {
+		t.Fatalf("plugin applied twice: %+v %v", again, err)
+	}
+
+	// The local plugin replaces the one of the panel
+	config := &Config{ShadowsocksPluginConfig: &ShadowsocksPluginConfig{Plugin: "obfs-server", PluginOpts: "obfs=http"}}
+	obfsInfo, err := ShadowsocksPluginBuilder(config, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obfsInfo.NodeType != "Shadowsocks" || obfsInfo.Port != 1145 || len(obfsInfo.Header) == 0 {
+		t.Fatalf("unexpected node info: %+v", obfsInfo)
+	}
+	if _, err := InboundBuilder(config, obfsInfo, "test_tag"); err != nil {
+		t.Error(err)
+	}
+	config.ShadowsocksPluginConfig.PluginOpts = "obfs=tls"
+	if _, err := ShadowsocksPluginBuilder(config, nodeInfo); err == nil {
+		t.Error("obfs tls should be rejected")
+	}
+}
+
+func TestBuildMixedVMess(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		EnableVless:       true,
+	}
+	config := &Config{
+		EnableFallback:   true,
+		FallBackConfigs:  []*FallBackConfig{{Alpn: "h2", Dest: "80"}},
+		MixedVMessConfig: &MixedVMessConfig{Enable: true, Port: 11450},
+	}
+	if _, err := InboundBuilder(config, nodeInfo, "test_tag"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuildForward(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "Forward",
+		NodeID:            1,
+		Port:              27015,
+		TransportProtocol: "tcp",
+		ForwardAddress:    "1.2.3.4:27015",
+		ForwardNetwork:    "udp",
+	}
+	if _, err := InboundBuilder(&Config{}, nodeInfo, "test_tag"); err != nil {
+		t.Error(err)
+	}
+	config := &Config{ForwardConfig: &ForwardConfig{Address: "[2001:db8::1]:25565", Network: "tcp,udp"}}
+	if _, err := InboundBuilder(config, nodeInfo, "test_tag"); err != nil {
+		t.Error(err)
+	}
+	config.ForwardConfig.Network = "quic"
+	if _, err := InboundBuilder(config, nodeInfo, "test_tag"); err == nil {
+		t.Error("network quic should be rejected")
+	}
+	nodeInfo.ForwardAddress = "1.2.3.4"
+	if _, err := InboundBuilder(&Config{}, nodeInfo, "test_tag"); err == nil {
+		t.Error("an address without port should be rejected")
+	}
+}
@@ -0,0 +1,49 @@
+//go:build !no_juicity
+
+package controller
+
+import (
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/policy"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/juicity"
+)
+
+func init() {
+	servedProtocols["Juicity"] = servedProtocol{
+		newHandler: func(c *Controller, nodeInfo *api.NodeInfo, pm policy.Manager) (inbound.Handler, error) {
+			juicityConfig, err := buildJuicityConfig(c.config, nodeInfo, c.Tag)
+			if err != nil {
+				return nil, err
+			}
+			return juicity.NewHandler(juicityConfig, c.dispatcher, pm)
+		},
+	}
+}
+
+// buildJuicityConfig builds the config of the Juicity inbound of the node,
+// the congestion control of the local config taking precedence over the one
+// of the panel
+func buildJuicityConfig(config *Config, nodeInfo *api.NodeInfo, tag string) (*juicity.Config, error) {
+	tlsConfig, err := buildServedTLSConfig(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	sniffing, err := sniffingRequest(config)
+	if err != nil {
+		return nil, err
+	}
+	congestionControl := nodeInfo.CongestionControl
+	if j := config.JuicityConfig; j != nil && j.CongestionControl != "" {
+		congestionControl = j.CongestionControl
+	}
+	return &juicity.Config{
+		Tag:               tag,
+		Listen:            config.ListenIP,
+		Port:              nodeInfo.Port,
+		TLSConfig:         tlsConfig,
+		CongestionControl: congestionControl,
+		Sniffing:          sniffing,
+	}, nil
+}
@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/webhook"
+)
+
+// Maintain puts the node, drained before, in maintenance: it reports
+// unhealthy, and tells the panel with an alive report if AliveConfig is set.
+// The node is left to be closed once its connections are.
+func (c *Controller) Maintain() error {
+	if c.maintenance.Swap(true) {
+		return nil
+	}
+	c.event(webhook.NodeMaintenance, map[string]string{"tag": c.Tag}, "%s in maintenance, waiting for its connections", c.Tag)
+
+	config := c.config.AliveConfig
+	reporter, ok := c.apiClient.(api.AliveReporter)
+	if config == nil || config.Path == "" || !ok {
+		return nil
+	}
+	alive, err := c.aliveReport(config)
+	if err != nil {
+		return err
+	}
+	alive["maintenance"] = true
+	if err := reporter.ReportAlive(config.Path, alive); err != nil {
+		c.logger.Printf("Report maintenance failed: %s", err)
+	}
+	return nil
+}
+
+// Connections returns the connections of the node still open
+func (c *Controller) Connections() int64 {
+	return c.dispatcher.OpenConnections(c.Tag)
+}
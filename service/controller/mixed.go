@@ -0,0 +1,37 @@
+//go:build !no_mixed
+
+package controller
+
+import (
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/policy"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/mixed"
+)
+
+func init() {
+	servedProtocols["Mixed"] = servedProtocol{
+		newHandler: func(c *Controller, nodeInfo *api.NodeInfo, pm policy.Manager) (inbound.Handler, error) {
+			mixedConfig, err := buildMixedConfig(c.config, nodeInfo, c.Tag)
+			if err != nil {
+				return nil, err
+			}
+			return mixed.NewHandler(mixedConfig, c.dispatcher, pm), nil
+		},
+	}
+}
+
+// buildMixedConfig builds the config of the SOCKS5 and HTTP inbound of the node
+func buildMixedConfig(config *Config, nodeInfo *api.NodeInfo, tag string) (*mixed.Config, error) {
+	sniffing, err := sniffingRequest(config)
+	if err != nil {
+		return nil, err
+	}
+	return &mixed.Config{
+		Tag:      tag,
+		Listen:   config.ListenIP,
+		Port:     nodeInfo.Port,
+		Sniffing: sniffing,
+	}, nil
+}
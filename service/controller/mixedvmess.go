@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// mixedVMess reports whether the VLESS node accepts VMess clients too
+func mixedVMess(config *Config, nodeInfo *api.NodeInfo) bool {
+	m := config.MixedVMessConfig
+	return m != nil && m.Enable && nodeInfo.NodeType == "V2ray" && nodeInfo.EnableVless
+}
+
+// mixedVMessTag returns the tag of the VMess inbound behind the node with tag
+func mixedVMessTag(tag string) string {
+	return tag + "_vmess"
+}
+
+// mixedVMessFallback sends the connections the VLESS inbound can't
+// authenticate to the local VMess inbound, with the client address in a
+// PROXY protocol header
+func mixedVMessFallback(config *Config) (*conf.VLessInboundFallback, error) {
+	dest, err := json.Marshal(fmt.Sprintf("127.0.0.1:%d", config.MixedVMessConfig.Port))
+	if err != nil {
+		return nil, err
+	}
+	return &conf.VLessInboundFallback{Dest: dest, Xver: 1}, nil
+}
+
+// buildMixedVMessInbound builds the VMess inbound the VMess clients of a VLESS
+// node fall back to. It listens in plain TCP on 127.0.0.1, the transport and
+// the security of the node being handled by the VLESS inbound already.
+func buildMixedVMessInbound(config *Config, tag string) (*core.InboundHandlerConfig, error) {
+	port := config.MixedVMessConfig.Port
+	if port == 0 {
+		return nil, fmt.Errorf("mixed VMess needs a local port")
+	}
+	setting, err := json.Marshal(&conf.VMessInboundConfig{})
+	if err != nil {
+		return nil, err
+	}
+	settings := json.RawMessage(setting)
+	network := conf.TransportProtocol("tcp")
+	inboundDetourConfig := &conf.InboundDetourConfig{
+		Protocol:       "vmess",
+		ListenOn:       &conf.Address{Address: net.ParseAddress("127.0.0.1")},
+		PortList:       &conf.PortList{Range: []conf.PortRange{{From: port, To: port}}},
+		Tag:            tag,
+		SniffingConfig: buildSniffingConfig(config),
+		Settings:       &settings,
+		StreamSetting: &conf.StreamConfig{
+			Network:     &network,
+			TCPSettings: &conf.TCPConfig{AcceptProxyProtocol: true},
+		},
+	}
+	return inboundDetourConfig.Build()
+}
+
+// addMixedVMessInbound adds the VMess inbound behind a VLESS node accepting
+// VMess clients, handled by the dispatcher as the node like the extra inbounds
+func (c *Controller) addMixedVMessInbound(nodeInfo *api.NodeInfo) error {
+	if !mixedVMess(c.config, nodeInfo) {
+		return nil
+	}
+	tag := mixedVMessTag(c.Tag)
+	inboundConfig, err := buildMixedVMessInbound(c.config, tag)
+	if err != nil {
+		return err
+	}
+	if err := c.addNodeInbound(inboundConfig, nodeInfo); err != nil {
+		return err
+	}
+	c.dispatcher.InboundAliases.Store(tag, c.Tag)
+	return nil
+}
+
+func (c *Controller) removeMixedVMessInbound(tag string) {
+	if !mixedVMess(c.config, c.nodeInfo) {
+		return
+	}
+	c.dispatcher.InboundAliases.Delete(mixedVMessTag(tag))
+	if err := c.removeInbound(mixedVMessTag(tag)); err != nil {
+		c.logger.Print(err)
+	}
+}
@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/xtls/xray-core/app/proxyman"
+	proxymanInbound "github.com/xtls/xray-core/app/proxyman/inbound"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/internet/stat"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/ban"
+)
+
+// nodeMux returns the mux.cool setting of the node, the one of the local
+// config taking precedence over the one of the panel. Nil for the defaults of
+// Xray: the clients may multiplex, the relay outbound doesn't.
+func nodeMux(config *Config, nodeInfo *api.NodeInfo) *api.MuxInfo {
+	if m := config.MuxConfig; m != nil && m.Enable {
+		return &api.MuxInfo{
+			RejectInbound:   m.RejectInbound,
+			Outbound:        m.Outbound,
+			Concurrency:     m.Concurrency,
+			XudpConcurrency: m.XudpConcurrency,
+			XudpProxyUDP443: m.XudpProxyUDP443,
+		}
+	}
+	if nodeInfo == nil {
+		return nil
+	}
+	return nodeInfo.Mux
+}
+
+// buildMuxConfig returns the mux settings of the relay outbound, nil if it
+// doesn't multiplex
+func buildMuxConfig(m *api.MuxInfo) (*conf.MuxConfig, error) {
+	if m == nil || !m.Outbound {
+		return nil, nil
+	}
+	switch m.XudpProxyUDP443 {
+	case "", "reject", "allow", "skip":
+	default:
+		return nil, fmt.Errorf("unsupported mux XudpProxyUDP443: %s", m.XudpProxyUDP443)
+	}
+	return &conf.MuxConfig{
+		Enabled:         true,
+		Concurrency:     m.Concurrency,
+		XudpConcurrency: m.XudpConcurrency,
+		XudpProxyUDP443: m.XudpProxyUDP443,
+	}, nil
+}
+
+// addNodeInbound adds an inbound of the node, like addInbound, with its proxy
+// refusing the banned clients, and mux.cool if the node says so
+func (c *Controller) addNodeInbound(config *core.InboundHandlerConfig, nodeInfo *api.NodeInfo) error {
+	m := nodeMux(c.config, nodeInfo)
+	rawHandler, err := core.CreateObject(c.server, &guardedHandlerConfig{
+		InboundHandlerConfig: config,
+		refuseMux:            m != nil && m.RejectInbound,
+		ban:                  c.dispatcher.Ban,
+	})
+	if err != nil {
+		return err
+	}
+	handler, ok := rawHandler.(inbound.Handler)
+	if !ok {
+		return fmt.Errorf("not an InboundHandler: %s", config.Tag)
+	}
+	return c.ibm.AddHandler(context.Background(), handler)
+}
+
+// guardedHandlerConfig is an inbound handler config, the handler being
+// created with its proxy behind a ban.Inbound, and a muxRefusingInbound if
+// refuseMux. The banned clients have to be refused before the proxy reads
+// their handshake. Xray always serves mux.cool, the proxy handing the mux
+// connections to the mux server of the handler, so they have to be refused
+// before reaching it too.
+type guardedHandlerConfig struct {
+	*core.InboundHandlerConfig
+	refuseMux bool
+	ban       *ban.Manager
+}
+
+// guardedProxyConfig is the config of a proxy created behind a ban.Inbound
+type guardedProxyConfig struct {
+	proxy     interface{}
+	refuseMux bool
+	ban       *ban.Manager
+}
+
+func init() {
+	common.Must(common.RegisterConfig((*guardedHandlerConfig)(nil), func(ctx context.Context, config interface{}) (interface{}, error) {
+		c := config.(*guardedHandlerConfig)
+		rawReceiverSettings, err := c.ReceiverSettings.GetInstance()
+		if err != nil {
+			return nil, err
+		}
+		receiverSettings, ok := rawReceiverSettings.(*proxyman.ReceiverConfig)
+		if !ok {
+			return nil, fmt.Errorf("not a ReceiverConfig: %s", c.Tag)
+		}
+		proxySettings, err := c.ProxySettings.GetInstance()
+		if err != nil {
+			return nil, err
+		}
+		// Like the handlers created by Xray
+		if streamSettings := receiverSettings.StreamSettings; streamSettings != nil && streamSettings.SocketSettings != nil {
+			ctx = session.ContextWithSockopt(ctx, &session.Sockopt{Mark: streamSettings.SocketSettings.Mark})
+		}
+		return proxymanInbound.NewAlwaysOnInboundHandler(ctx, c.Tag, receiverSettings, &guardedProxyConfig{
+			proxy:     proxySettings,
+			refuseMux: c.refuseMux,
+			ban:       c.ban,
+		})
+	}))
+	common.Must(common.RegisterConfig((*guardedProxyConfig)(nil), func(ctx context.Context, config interface{}) (interface{}, error) {
+		c := config.(*guardedProxyConfig)
+		rawProxy, err := common.CreateObject(ctx, c.proxy)
+		if err != nil {
+			return nil, err
+		}
+		p, ok := rawProxy.(proxy.Inbound)
+		if !ok {
+			return nil, fmt.Errorf("not an inbound proxy")
+		}
+		p = &ban.Inbound{Inbound: p, Manager: c.ban}
+		if c.refuseMux {
+			p = &muxRefusingInbound{Inbound: p}
+		}
+		return p, nil
+	}))
+}
+
+// muxRefusingInbound is an inbound proxy whose connections may not go to
+// mux.cool
+type muxRefusingInbound struct {
+	proxy.Inbound
+}
+
+// Process implements proxy.Inbound.Process().
+func (p *muxRefusingInbound) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	return p.Inbound.Process(ctx, network, conn, muxRefusingDispatcher{dispatcher})
+}
+
+// AddUser implements proxy.UserManager.AddUser().
+func (p *muxRefusingInbound) AddUser(ctx context.Context, u *protocol.MemoryUser) error {
+	userManager, ok := p.Inbound.(proxy.UserManager)
+	if !ok {
+		return fmt.Errorf("proxy has no users")
+	}
+	return userManager.AddUser(ctx, u)
+}
+
+// RemoveUser implements proxy.UserManager.RemoveUser().
+func (p *muxRefusingInbound) RemoveUser(ctx context.Context, email string) error {
+	userManager, ok := p.Inbound.(proxy.UserManager)
+	if !ok {
+		return fmt.Errorf("proxy has no users")
+	}
+	return userManager.RemoveUser(ctx, email)
+}
+
+// muxRefusingDispatcher is the mux server of an inbound handler, failing the
+// connections to mux.cool
+type muxRefusingDispatcher struct {
+	routing.Dispatcher
+}
+
+func isMuxCool(destination net.Destination) bool {
+	return destination.Address.Family().IsDomain() && destination.Address.Domain() == "v1.mux.cool"
+}
+
+// Dispatch implements routing.Dispatcher.
+func (d muxRefusingDispatcher) Dispatch(ctx context.Context, destination net.Destination) (*transport.Link, error) {
+	if isMuxCool(destination) {
+		return nil, fmt.Errorf("mux is not accepted by the node")
+	}
+	return d.Dispatcher.Dispatch(ctx, destination)
+}
+
+// DispatchLink implements routing.Dispatcher.
+func (d muxRefusingDispatcher) DispatchLink(ctx context.Context, destination net.Destination, link *transport.Link) error {
+	if isMuxCool(destination) {
+		return fmt.Errorf("mux is not accepted by the node")
+	}
+	return d.Dispatcher.DispatchLink(ctx, destination, link)
+}
@@ -0,0 +1,46 @@
+//go:build !no_naive
+
+package controller
+
+import (
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/policy"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/naive"
+)
+
+func init() {
+	servedProtocols["Naive"] = servedProtocol{
+		newHandler: func(c *Controller, nodeInfo *api.NodeInfo, pm policy.Manager) (inbound.Handler, error) {
+			naiveConfig, err := buildNaiveConfig(c.config, nodeInfo, c.Tag)
+			if err != nil {
+				return nil, err
+			}
+			return naive.NewHandler(naiveConfig, c.dispatcher, pm)
+		},
+	}
+}
+
+// buildNaiveConfig builds the config of the NaiveProxy inbound of the node
+func buildNaiveConfig(config *Config, nodeInfo *api.NodeInfo, tag string) (*naive.Config, error) {
+	tlsConfig, err := buildServedTLSConfig(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	sniffing, err := sniffingRequest(config)
+	if err != nil {
+		return nil, err
+	}
+	naiveConfig := &naive.Config{
+		Tag:       tag,
+		Listen:    config.ListenIP,
+		Port:      nodeInfo.Port,
+		TLSConfig: tlsConfig,
+		Sniffing:  sniffing,
+	}
+	if n := config.NaiveConfig; n != nil {
+		naiveConfig.FallbackURL = n.FallbackURL
+	}
+	return naiveConfig, nil
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/qtai2901/new_xrayr/common/webhook"
+)
+
+const (
+	// Failed fetches in a row before the panel is alerted as unreachable
+	unreachableAlertFailures = 3
+	// Time left before a certificate expires it is alerted at
+	certExpiryAlert = 7 * 24 * time.Hour
+)
+
+// SetNotify sets where the alerts of the node go, like a Telegram bot, with
+// the event they are, see package webhook, and its data to be encoded in JSON.
+// f must not block. Set it before Start.
+func (c *Controller) SetNotify(f func(event, text string, data any)) {
+	c.notify = f
+}
+
+// SetEvents sets where the lifecycle events of the node go, like a webhook,
+// with a text for humans and their data to be encoded in JSON. f must not
+// block. Set it before Start.
+func (c *Controller) SetEvents(f func(event, text string, data any)) {
+	c.events = f
+}
+
+// event sends the event to the events hook, if there is one
+func (c *Controller) event(name string, data any, format string, a ...any) {
+	if c.events != nil {
+		c.events(name, fmt.Sprintf(format, a...), data)
+	}
+}
+
+// alert sends the event to the notifier, if there is one
+func (c *Controller) alert(name string, data any, format string, a ...any) {
+	if c.notify != nil {
+		c.notify(name, fmt.Sprintf(format, a...), data)
+	}
+}
+
+type syncFailure struct {
+	Sync     string `json:"sync"` // node_info or user_list
+	Failures int    `json:"failures"`
+	Error    string `json:"error"`
+}
+
+type deviceLimitReject struct {
+	UID         int      `json:"uid"`
+	DeviceLimit int      `json:"device_limit"`
+	IPs         []string `json:"ips"`
+}
+
+type certificate struct {
+	Domain   string     `json:"domain"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// syncFetched counts the failed fetches of sync in a row, alerting once the
+// panel looks unreachable and once it is back
+func (c *Controller) syncFetched(sync string, failures *int, err error) {
+	if err != nil {
+		*failures++
+		if *failures == unreachableAlertFailures {
+			c.syncsFailing.Add(1)
+			c.alert(webhook.SyncFailed, syncFailure{Sync: sync, Failures: *failures, Error: err.Error()},
+				"Panel %s unreachable, %s failed %d times: %s", c.apiClient.Describe().APIHost, sync, *failures, err)
+		}
+		return
+	}
+	if *failures >= unreachableAlertFailures {
+		c.syncsFailing.Add(-1)
+		c.alert(webhook.SyncRecovered, nil, "Panel %s reachable again, %s succeeded", c.apiClient.Describe().APIHost, sync)
+	}
+	*failures = 0
+}
+
+// reportDeviceRejects sends an event for each user rejected by its device
+// limit since the last report
+func (c *Controller) reportDeviceRejects(tag string) {
+	rejects := c.dispatcher.Limiter.SnapshotDeviceRejects(tag)
+	if len(rejects) == 0 || c.events == nil {
+		return
+	}
+	deviceLimits := make(map[int]int, len(rejects))
+	c.access.Lock()
+	if c.userList != nil {
+		for _, u := range *c.userList {
+			if _, ok := rejects[u.UID]; ok {
+				deviceLimits[u.UID] = u.DeviceLimit
+			}
+		}
+	}
+	c.access.Unlock()
+	for uid, ips := range rejects {
+		c.event(webhook.DeviceLimit, deviceLimitReject{UID: uid, DeviceLimit: deviceLimits[uid], IPs: ips},
+			"User %d rejected by its device limit of %d from %s", uid, deviceLimits[uid], strings.Join(ips, ", "))
+	}
+}
+
+// checkCertExpiry alerts once per certificate when the one in file expires soon
+func (c *Controller) checkCertExpiry(file string) {
+	notAfter, err := certNotAfter(file)
+	if err != nil {
+		c.logger.Print(err)
+		return
+	}
+	if left := time.Until(notAfter); left < certExpiryAlert && !notAfter.Equal(c.certAlertedAt) {
+		c.certAlertedAt = notAfter
+		c.alert(webhook.CertExpiring, certificate{Domain: c.config.CertConfig.CertDomain, NotAfter: &notAfter},
+			"Certificate %s expires in %s, at %s", file, left.Round(time.Hour), notAfter.Format(time.DateTime))
+	}
+}
+
+// certNotAfter returns the expiry of the first certificate in the PEM file
+func certNotAfter(file string) (time.Time, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return time.Time{}, errors.New("no certificate in " + file)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
@@ -17,11 +17,8 @@ func OutboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.
 	outboundDetourConfig.Protocol = "freedom"
 	outboundDetourConfig.Tag = tag
 
-	// Build Send IP address
-	if config.SendIP != "" {
-		ipAddress := net.ParseAddress(config.SendIP)
-		outboundDetourConfig.SendThrough = &conf.Address{Address: ipAddress}
-	}
+	// Build Send IP address and interface
+	nodeEgress(config).apply(outboundDetourConfig)
 
 	// Freedom Protocol setting
 	var domainStrategy = "Asis"
@@ -34,6 +31,7 @@ func OutboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.
 	}
 	proxySetting := &conf.FreedomConfig{
 		DomainStrategy: domainStrategy,
+		UserLevel:      config.userLevel(),
 	}
 	// Used for Shadowsocks-Plugin
 	if nodeInfo.NodeType == "dokodemo-door" {
@@ -47,3 +45,40 @@ func OutboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.
 	outboundDetourConfig.Settings = &setting
 	return outboundDetourConfig.Build()
 }
+
+// egress is the local address and network interface an outbound sends from
+type egress struct {
+	sendThrough string
+	iface       string
+}
+
+func nodeEgress(config *Config) egress {
+	return egress{sendThrough: config.SendIP, iface: config.SendInterface}
+}
+
+// override returns e with the address and interface replaced by the given
+// ones that are set
+func (e egress) override(sendThrough, iface string) egress {
+	if sendThrough != "" {
+		e.sendThrough = sendThrough
+	}
+	if iface != "" {
+		e.iface = iface
+	}
+	return e
+}
+
+func (e egress) apply(outboundDetourConfig *conf.OutboundDetourConfig) {
+	if e.sendThrough != "" {
+		outboundDetourConfig.SendThrough = &conf.Address{Address: net.ParseAddress(e.sendThrough)}
+	}
+	if e.iface != "" {
+		if outboundDetourConfig.StreamSetting == nil {
+			outboundDetourConfig.StreamSetting = &conf.StreamConfig{}
+		}
+		if outboundDetourConfig.StreamSetting.SocketSettings == nil {
+			outboundDetourConfig.StreamSetting.SocketSettings = &conf.SocketConfig{}
+		}
+		outboundDetourConfig.StreamSetting.SocketSettings.Interface = e.iface
+	}
+}
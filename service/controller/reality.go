@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// defaultTLSFingerprint is the fingerprint the REALITY dest is checked with
+// when the node sets none
+const defaultTLSFingerprint = "chrome"
+
+// realityDest returns the dest and the server names of the REALITY inbound
+// built for the node, picked the same way as in InboundBuilder
+func realityDest(config *Config, nodeInfo *api.NodeInfo) (string, []string, bool) {
+	if config.DisableLocalREALITYConfig {
+		if nodeInfo.REALITYConfig != nil && nodeInfo.EnableREALITY {
+			return nodeInfo.REALITYConfig.Dest, nodeInfo.REALITYConfig.ServerNames, true
+		}
+		return "", nil, false
+	}
+	if config.EnableREALITY && config.REALITYConfigs != nil {
+		return config.REALITYConfigs.Dest, config.REALITYConfigs.ServerNames, true
+	}
+	return "", nil, false
+}
+
+// verifyREALITYDest handshakes with the REALITY dest for each server name,
+// sending the ClientHello of the fingerprint the clients use. The dest
+// has to complete a TLS 1.3 handshake with a valid certificate, otherwise
+// the clients are told apart from the real visitors of the site.
+func verifyREALITYDest(dest string, serverNames []string, fingerprint string) error {
+	if fingerprint == "" {
+		fingerprint = defaultTLSFingerprint
+	}
+	hello := xtls.GetFingerprint(fingerprint)
+	if hello == nil {
+		return fmt.Errorf("unsupported TLS fingerprint: %s", fingerprint)
+	}
+	network, address := "tcp", dest
+	if _, err := strconv.Atoi(dest); err == nil {
+		address = net.JoinHostPort("127.0.0.1", dest)
+	} else if strings.HasPrefix(dest, "/") || strings.HasPrefix(dest, "@") {
+		network = "unix"
+	}
+	for _, serverName := range serverNames {
+		// Wildcard and empty names cannot be dialed as they are
+		if serverName == "" || strings.Contains(serverName, "*") {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := func() error {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return err
+			}
+			uConn := xtls.UClient(conn, &tls.Config{ServerName: serverName}, hello).(*xtls.UConn)
+			defer uConn.Close()
+			if err := uConn.HandshakeContext(ctx); err != nil {
+				return err
+			}
+			if uConn.ConnectionState().Version != tls.VersionTLS13 {
+				return fmt.Errorf("TLS 1.3 is not negotiated")
+			}
+			return nil
+		}()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("REALITY dest %s rejects %s with the %s fingerprint: %s", dest, serverName, fingerprint, err)
+		}
+	}
+	return nil
+}
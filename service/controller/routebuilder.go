@@ -0,0 +1,576 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/asn"
+	"github.com/qtai2901/new_xrayr/common/geoip"
+)
+
+// routeRule is a field rule of the xray routing config
+type routeRule struct {
+	Type        string   `json:"type"`
+	OutboundTag string   `json:"outboundTag,omitempty"`
+	BalancerTag string   `json:"balancerTag,omitempty"`
+	Domain      []string `json:"domain,omitempty"`
+	IP          []string `json:"ip,omitempty"`
+	Network     string   `json:"network,omitempty"`
+	User        []string `json:"user,omitempty"`
+}
+
+// newRouteRules routes the given destinations to outboundTag, or all the
+// traffic if there is no destination. The conditions of a single rule must
+// all match, so domains and IPs go to separate rules.
+func newRouteRules(outboundTag string, domains, ips []string) []routeRule {
+	if len(domains) == 0 && len(ips) == 0 {
+		return []routeRule{{Type: "field", OutboundTag: outboundTag, Network: "tcp,udp"}}
+	}
+	var rules []routeRule
+	if len(domains) > 0 {
+		rules = append(rules, routeRule{Type: "field", OutboundTag: outboundTag, Domain: domains})
+	}
+	if len(ips) > 0 {
+		rules = append(rules, routeRule{Type: "field", OutboundTag: outboundTag, IP: ips})
+	}
+	return rules
+}
+
+// setRouteTarget sends the traffic matching rule to outbound, which is one of
+// direct, block, wireguard, upstream, relay, balancer or the tag of a custom outbound
+func setRouteTarget(rule *routeRule, tag, outbound string) {
+	switch outbound {
+	case "direct":
+		rule.OutboundTag = tag
+	case "block", "wireguard", "upstream", "relay":
+		rule.OutboundTag = tag + "_" + outbound
+	case "balancer":
+		rule.BalancerTag = tag + "_balancer"
+	default:
+		rule.OutboundTag = outbound
+	}
+}
+
+// newUserRouteRule routes the users with the given emails to outbound
+func newUserRouteRule(tag, outbound string, emails []string) routeRule {
+	rule := routeRule{
+		Type: "field",
+		User: emails,
+	}
+	setRouteTarget(&rule, tag, outbound)
+	return rule
+}
+
+// userEmail is the email a user is registered with in the inbound with tag
+func userEmail(tag string, user *api.UserInfo) string {
+	return user.CoreEmail(tag)
+}
+
+// RouteBuilder builds the extra outbounds of a node and the routing config
+// sending the matched traffic to them. Both are nil if the node has none.
+// The user rules come first and are built from userList, which may be nil.
+// The mux setting of the panel is taken from nodeInfo, which may be nil too.
+func RouteBuilder(config *Config, nodeInfo *api.NodeInfo, tag string, userList *[]api.UserInfo) ([]*core.OutboundHandlerConfig, *router.Config, error) {
+	var (
+		outbounds []*core.OutboundHandlerConfig
+		rules     []routeRule
+		balancers []*conf.BalancingRule
+	)
+
+	var domesticRules []routeRule
+	if domestic := config.DomesticRouteConfig; domestic != nil {
+		for _, target := range []struct {
+			action string
+			name   string
+		}{{domestic.Private, "private"}, {domestic.CN, "cn"}} {
+			switch target.action {
+			case "":
+				continue
+			case "direct", "block":
+				for _, rule := range newRouteRules("", []string{"geosite:" + target.name}, []string{"geoip:" + target.name}) {
+					setRouteTarget(&rule, tag, target.action)
+					domesticRules = append(domesticRules, rule)
+				}
+			default:
+				return nil, nil, fmt.Errorf("unsupported route action for %s: %s", target.name, target.action)
+			}
+		}
+	}
+
+	var asnRules []routeRule
+	if len(config.ASNRouteConfigs) > 0 {
+		db := asn.Current()
+		if db == nil {
+			return nil, nil, fmt.Errorf("ASN database is not loaded, check ASNConfig")
+		}
+		for _, asnRoute := range config.ASNRouteConfigs {
+			var ips []string
+			for _, number := range asnRoute.ASNs {
+				for _, prefix := range db.Prefixes(number) {
+					ips = append(ips, prefix.String())
+				}
+			}
+			if len(ips) == 0 {
+				continue
+			}
+			rule := routeRule{Type: "field", IP: ips}
+			setRouteTarget(&rule, tag, asnRoute.Outbound)
+			asnRules = append(asnRules, rule)
+		}
+	}
+
+	var countryRules []routeRule
+	if len(config.CountryRouteConfigs) > 0 {
+		db := geoip.Current()
+		if db == nil {
+			return nil, nil, fmt.Errorf("GeoIP database is not loaded, check GeoIPConfig")
+		}
+		for _, countryRoute := range config.CountryRouteConfigs {
+			if len(countryRoute.Countries) == 0 {
+				continue
+			}
+			prefixes := db.Prefixes(countryRoute.Countries...)
+			if countryRoute.Except {
+				prefixes = db.PrefixesExcept(countryRoute.Countries...)
+			}
+			if len(prefixes) == 0 {
+				continue
+			}
+			ips := make([]string, len(prefixes))
+			for i, prefix := range prefixes {
+				ips[i] = prefix.String()
+			}
+			rule := routeRule{Type: "field", IP: ips}
+			setRouteTarget(&rule, tag, countryRoute.Outbound)
+			countryRules = append(countryRules, rule)
+		}
+	}
+
+	if wg := config.WireGuardConfig; wg != nil && wg.Enable {
+		outboundTag := tag + "_wireguard"
+		outbound, err := buildWireGuardOutbound(wg, outboundTag, nodeEgress(config).override(wg.SendThrough, wg.SendInterface))
+		if err != nil {
+			return nil, nil, err
+		}
+		outbounds = append(outbounds, outbound)
+		rules = append(rules, newRouteRules(outboundTag, wg.Domains, wg.IPs)...)
+	}
+
+	if upstream := config.UpstreamProxyConfig; upstream != nil && upstream.Enable {
+		outboundTag := tag + "_upstream"
+		outbound, err := buildUpstreamOutbound(upstream, outboundTag, nodeEgress(config).override(upstream.SendThrough, upstream.SendInterface))
+		if err != nil {
+			return nil, nil, err
+		}
+		outbounds = append(outbounds, outbound)
+		rules = append(rules, newRouteRules(outboundTag, upstream.Domains, upstream.IPs)...)
+	}
+
+	if relay := config.RelayConfig; relay != nil && relay.Enable {
+		outboundTag := tag + "_relay"
+		// The relay dials with the fingerprint of the node unless it has its own
+		if relay.Fingerprint == "" {
+			withFingerprint := *relay
+			withFingerprint.Fingerprint = config.TLSFingerprint
+			relay = &withFingerprint
+		}
+		mux, err := buildMuxConfig(nodeMux(config, nodeInfo))
+		if err != nil {
+			return nil, nil, err
+		}
+		outbound, err := buildRelayOutbound(relay, outboundTag, config.userLevel(), mux, nodeEgress(config).override(relay.SendThrough, relay.SendInterface))
+		if err != nil {
+			return nil, nil, err
+		}
+		outbounds = append(outbounds, outbound)
+		rules = append(rules, newRouteRules(outboundTag, relay.Domains, relay.IPs)...)
+	}
+
+	if balancer := config.BalancerConfig; balancer != nil && balancer.Enable {
+		balancerTag := tag + "_balancer"
+		// Members share the balancer_ prefix, so the observatory can find them all
+		memberPrefix := "balancer_" + tag + "_"
+		if len(balancer.Members) == 0 {
+			return nil, nil, fmt.Errorf("balancer of %s has no member", tag)
+		}
+		switch strings.ToLower(balancer.Strategy) {
+		case "", "random", "roundrobin", "leastping":
+		default:
+			return nil, nil, fmt.Errorf("unsupported balancer strategy: %s", balancer.Strategy)
+		}
+		for i, member := range balancer.Members {
+			outbound, err := buildBalancerMember(member, fmt.Sprintf("%s%d", memberPrefix, i), nodeEgress(config).override(member.SendThrough, member.SendInterface))
+			if err != nil {
+				return nil, nil, err
+			}
+			outbounds = append(outbounds, outbound)
+		}
+		balancers = append(balancers, &conf.BalancingRule{
+			Tag:         balancerTag,
+			Selectors:   conf.StringList{memberPrefix},
+			Strategy:    conf.StrategyConfig{Type: balancer.Strategy},
+			FallbackTag: tag,
+		})
+		for _, rule := range newRouteRules("", balancer.Domains, balancer.IPs) {
+			rule.BalancerTag = balancerTag
+			rules = append(rules, rule)
+		}
+	}
+
+	if pool := config.IPv6PoolConfig; pool != nil && pool.Enable {
+		poolRules, poolOutbounds, poolBalancer, err := buildIPv6Pool(config, pool, tag, userList)
+		if err != nil {
+			return nil, nil, err
+		}
+		outbounds = append(outbounds, poolOutbounds...)
+		balancers = append(balancers, poolBalancer)
+		rules = append(rules, poolRules...)
+	}
+
+	if len(config.UserRouteConfigs) > 0 && userList != nil {
+		var userRules []routeRule
+		for _, userRoute := range config.UserRouteConfigs {
+			var emails []string
+			for i := range *userList {
+				user := &(*userList)[i]
+				if userRoute.match(user) {
+					emails = append(emails, userEmail(tag, user))
+				}
+			}
+			if len(emails) > 0 {
+				userRules = append(userRules, newUserRouteRule(tag, userRoute.Outbound, emails))
+			}
+		}
+		rules = append(userRules, rules...)
+	}
+	// Domestic, ASN and country destinations never leave through the other rules
+	rules = append(append(append(domesticRules, asnRules...), countryRules...), rules...)
+
+	if needBlock(config, rules, tag) {
+		setting := json.RawMessage("{}")
+		outbound, err := (&conf.OutboundDetourConfig{Protocol: "blackhole", Tag: tag + "_block", Settings: &setting}).Build()
+		if err != nil {
+			return nil, nil, err
+		}
+		outbounds = append(outbounds, outbound)
+	}
+	if len(rules) == 0 && len(outbounds) == 0 {
+		return nil, nil, nil
+	}
+	routerConfig := &conf.RouterConfig{Balancers: balancers}
+	// Resolve the domains only when some rule has to match by IP
+	domainStrategy := "AsIs"
+	for _, rule := range rules {
+		if len(rule.IP) > 0 {
+			domainStrategy = "IPIfNonMatch"
+		}
+		raw, err := json.Marshal(rule)
+		if err != nil {
+			return nil, nil, err
+		}
+		routerConfig.RuleList = append(routerConfig.RuleList, raw)
+	}
+	routerConfig.DomainStrategy = &domainStrategy
+	routeConfig, err := routerConfig.Build()
+	if err != nil {
+		return nil, nil, fmt.Errorf("build route config failed: %s", err)
+	}
+	return outbounds, routeConfig, nil
+}
+
+// buildIPv6Pool builds a freedom outbound for each of the random addresses
+// picked from the prefix of the pool, and the rules spreading the traffic
+// over them, either by connection or by user. Users are pinned by UID, the
+// ones missing from userList fall back to a random address.
+func buildIPv6Pool(config *Config, pool *IPv6PoolConfig, tag string, userList *[]api.UserInfo) ([]routeRule, []*core.OutboundHandlerConfig, *conf.BalancingRule, error) {
+	prefix, err := netip.ParsePrefix(pool.Prefix)
+	if err != nil || !prefix.Addr().Is6() {
+		return nil, nil, nil, fmt.Errorf("invalid IPv6 pool prefix: %s", pool.Prefix)
+	}
+	size := pool.Size
+	if size <= 0 {
+		size = 16
+	}
+	if pool.Rotate != "connection" && pool.Rotate != "user" {
+		return nil, nil, nil, fmt.Errorf("unsupported IPv6 pool rotation: %s", pool.Rotate)
+	}
+
+	memberPrefix := "ipv6pool_" + tag + "_"
+	var outbounds []*core.OutboundHandlerConfig
+	for i := 0; i < size; i++ {
+		address, err := randomAddr(prefix.Masked())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		setting, err := json.Marshal(&conf.FreedomConfig{DomainStrategy: "UseIPv6"})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		raw := json.RawMessage(setting)
+		outboundDetourConfig := &conf.OutboundDetourConfig{
+			Protocol: "freedom",
+			Tag:      fmt.Sprintf("%s%d", memberPrefix, i),
+			Settings: &raw,
+		}
+		nodeEgress(config).override(address.String(), "").apply(outboundDetourConfig)
+		outbound, err := outboundDetourConfig.Build()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		outbounds = append(outbounds, outbound)
+	}
+
+	var rules []routeRule
+	if pool.Rotate == "user" && userList != nil {
+		emails := make([][]string, size)
+		for i := range *userList {
+			user := &(*userList)[i]
+			emails[user.UID%size] = append(emails[user.UID%size], userEmail(tag, user))
+		}
+		for i := range emails {
+			if len(emails[i]) == 0 {
+				continue
+			}
+			for _, rule := range newRouteRules(fmt.Sprintf("%s%d", memberPrefix, i), pool.Domains, pool.IPs) {
+				rule.User = emails[i]
+				rules = append(rules, rule)
+			}
+		}
+	}
+	balancerTag := tag + "_ipv6pool"
+	for _, rule := range newRouteRules("", pool.Domains, pool.IPs) {
+		rule.BalancerTag = balancerTag
+		rules = append(rules, rule)
+	}
+	balancer := &conf.BalancingRule{
+		Tag:         balancerTag,
+		Selectors:   conf.StringList{memberPrefix},
+		Strategy:    conf.StrategyConfig{Type: "random"},
+		FallbackTag: tag,
+	}
+	return rules, outbounds, balancer, nil
+}
+
+// randomAddr picks a random address in prefix
+func randomAddr(prefix netip.Prefix) (netip.Addr, error) {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return netip.Addr{}, err
+	}
+	addr := prefix.Addr().As16()
+	for i := prefix.Bits(); i < 128; i++ {
+		bit := byte(1 << (7 - i%8))
+		addr[i/8] = addr[i/8]&^bit | random[i/8]&bit
+	}
+	return netip.AddrFrom16(addr), nil
+}
+
+// needBlock reports whether the node needs the blackhole outbound. The user,
+// ASN and country routes count even when they match nothing yet, as they are
+// regenerated later without adding outbounds.
+func needBlock(config *Config, rules []routeRule, tag string) bool {
+	for _, rule := range rules {
+		if rule.OutboundTag == tag+"_block" {
+			return true
+		}
+	}
+	for _, userRoute := range config.UserRouteConfigs {
+		if userRoute.Outbound == "block" {
+			return true
+		}
+	}
+	for _, asnRoute := range config.ASNRouteConfigs {
+		if asnRoute.Outbound == "block" {
+			return true
+		}
+	}
+	for _, countryRoute := range config.CountryRouteConfigs {
+		if countryRoute.Outbound == "block" {
+			return true
+		}
+	}
+	return false
+}
+
+func buildWireGuardOutbound(wg *WireGuardConfig, tag string, egress egress) (*core.OutboundHandlerConfig, error) {
+	proxySetting := &conf.WireGuardConfig{
+		IsClient:       true,
+		SecretKey:      wg.SecretKey,
+		Address:        wg.Address,
+		MTU:            wg.MTU,
+		Reserved:       wg.Reserved,
+		DomainStrategy: wg.DomainStrategy,
+	}
+	for _, peer := range wg.Peers {
+		proxySetting.Peers = append(proxySetting.Peers, &conf.WireGuardPeerConfig{
+			PublicKey:    peer.PublicKey,
+			PreSharedKey: peer.PreSharedKey,
+			Endpoint:     peer.Endpoint,
+			KeepAlive:    peer.KeepAlive,
+		})
+	}
+	setting, err := json.Marshal(proxySetting)
+	if err != nil {
+		return nil, fmt.Errorf("marshal wireguard config failed: %s", err)
+	}
+	raw := json.RawMessage(setting)
+	outboundDetourConfig := &conf.OutboundDetourConfig{
+		Protocol: "wireguard",
+		Tag:      tag,
+		Settings: &raw,
+	}
+	egress.apply(outboundDetourConfig)
+	return outboundDetourConfig.Build()
+}
+
+func buildUpstreamOutbound(upstream *UpstreamProxyConfig, tag string, egress egress) (*core.OutboundHandlerConfig, error) {
+	var users []json.RawMessage
+	if upstream.Username != "" {
+		user, err := json.Marshal(&conf.SocksAccount{Username: upstream.Username, Password: upstream.Password})
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	address := &conf.Address{Address: net.ParseAddress(upstream.Address)}
+
+	var proxySetting any
+	switch upstream.Protocol {
+	case "socks":
+		proxySetting = &conf.SocksClientConfig{
+			Servers: []*conf.SocksRemoteConfig{{Address: address, Port: upstream.Port, Users: users}},
+		}
+	case "http":
+		proxySetting = &conf.HTTPClientConfig{
+			Servers: []*conf.HTTPRemoteConfig{{Address: address, Port: upstream.Port, Users: users}},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy protocol: %s", upstream.Protocol)
+	}
+	setting, err := json.Marshal(proxySetting)
+	if err != nil {
+		return nil, fmt.Errorf("marshal upstream proxy config failed: %s", err)
+	}
+	raw := json.RawMessage(setting)
+	outboundDetourConfig := &conf.OutboundDetourConfig{
+		Protocol: upstream.Protocol,
+		Tag:      tag,
+		Settings: &raw,
+	}
+	egress.apply(outboundDetourConfig)
+	return outboundDetourConfig.Build()
+}
+
+func buildBalancerMember(member *BalancerMember, tag string, egress egress) (*core.OutboundHandlerConfig, error) {
+	switch member.Protocol {
+	case "", "freedom":
+		setting := json.RawMessage("{}")
+		outboundDetourConfig := &conf.OutboundDetourConfig{
+			Protocol: "freedom",
+			Tag:      tag,
+			Settings: &setting,
+		}
+		egress.apply(outboundDetourConfig)
+		return outboundDetourConfig.Build()
+	default:
+		return buildUpstreamOutbound(&UpstreamProxyConfig{
+			Protocol: member.Protocol,
+			Address:  member.Address,
+			Port:     member.Port,
+			Username: member.Username,
+			Password: member.Password,
+		}, tag, egress)
+	}
+}
+
+// buildRelayOutbound builds the outbound forwarding the decrypted traffic to
+// the exit node, with the timeouts of the policy level, multiplexed if mux is
+// not nil
+func buildRelayOutbound(relay *RelayConfig, tag string, level uint32, mux *conf.MuxConfig, egress egress) (*core.OutboundHandlerConfig, error) {
+	var settings map[string]any
+	switch relay.Protocol {
+	case "vmess":
+		settings = map[string]any{"vnext": []any{map[string]any{
+			"address": relay.Address,
+			"port":    relay.Port,
+			"users":   []any{map[string]any{"id": relay.UUID, "security": "auto", "level": level}},
+		}}}
+	case "vless":
+		settings = map[string]any{"vnext": []any{map[string]any{
+			"address": relay.Address,
+			"port":    relay.Port,
+			"users":   []any{map[string]any{"id": relay.UUID, "encryption": "none", "flow": relay.Flow, "level": level}},
+		}}}
+	case "trojan":
+		settings = map[string]any{"servers": []any{map[string]any{
+			"address":  relay.Address,
+			"port":     relay.Port,
+			"password": relay.Password,
+			"level":    level,
+		}}}
+	case "shadowsocks":
+		settings = map[string]any{"servers": []any{map[string]any{
+			"address":  relay.Address,
+			"port":     relay.Port,
+			"method":   relay.Method,
+			"password": relay.Password,
+			"level":    level,
+		}}}
+	default:
+		return nil, fmt.Errorf("unsupported relay protocol: %s", relay.Protocol)
+	}
+
+	network := relay.Network
+	if network == "" {
+		network = "tcp"
+	}
+	streamSettings := map[string]any{"network": network}
+	switch network {
+	case "ws":
+		streamSettings["wsSettings"] = map[string]any{"path": relay.Path, "headers": map[string]string{"Host": relay.Host}}
+	case "grpc":
+		streamSettings["grpcSettings"] = map[string]any{"serviceName": relay.ServiceName}
+	}
+	switch relay.Security {
+	case "", "none":
+	case "tls":
+		streamSettings["security"] = "tls"
+		streamSettings["tlsSettings"] = map[string]any{"serverName": relay.SNI, "fingerprint": relay.Fingerprint}
+	case "reality":
+		streamSettings["security"] = "reality"
+		streamSettings["realitySettings"] = map[string]any{
+			"serverName":  relay.SNI,
+			"fingerprint": relay.Fingerprint,
+			"publicKey":   relay.PublicKey,
+			"shortId":     relay.ShortID,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported relay security: %s", relay.Security)
+	}
+
+	raw, err := json.Marshal(map[string]any{
+		"protocol":       relay.Protocol,
+		"tag":            tag,
+		"settings":       settings,
+		"streamSettings": streamSettings,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal relay config failed: %s", err)
+	}
+	outboundDetourConfig := &conf.OutboundDetourConfig{}
+	if err := json.Unmarshal(raw, outboundDetourConfig); err != nil {
+		return nil, fmt.Errorf("parse relay config failed: %s", err)
+	}
+	outboundDetourConfig.MuxSettings = mux
+	egress.apply(outboundDetourConfig)
+	return outboundDetourConfig.Build()
+}
@@ -0,0 +1,276 @@
+package controller_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xtls/xray-core/app/proxyman"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/asn"
+	"github.com/qtai2901/new_xrayr/common/geoip"
+	. "github.com/qtai2901/new_xrayr/service/controller"
+)
+
+func TestBuildWireGuardRoute(t *testing.T) {
+	config := &Config{
+		WireGuardConfig: &WireGuardConfig{
+			Enable:    true,
+			SecretKey: "cBl9XfNtlDcAxVGXxf4KwUlEMuhTkoNBqQW7sq3Lb2M=",
+			Address:   []string{"172.16.0.2/32"},
+			Peers: []*WireGuardPeer{{
+				PublicKey: "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+				Endpoint:  "engage.cloudflareclient.com:2408",
+			}},
+			Reserved: []byte{1, 2, 3},
+			Domains:  []string{"domain:openai.com"},
+		},
+	}
+	outbounds, routeConfig, err := RouteBuilder(config, nil, "test_tag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbounds) != 1 || outbounds[0].Tag != "test_tag_wireguard" {
+		t.Fatalf("unexpected outbounds: %v", outbounds)
+	}
+	if len(routeConfig.Rule) != 1 || routeConfig.Rule[0].GetTag() != "test_tag_wireguard" {
+		t.Fatalf("unexpected route: %v", routeConfig)
+	}
+}
+
+func TestBuildUpstreamRoute(t *testing.T) {
+	config := &Config{
+		UpstreamProxyConfig: &UpstreamProxyConfig{
+			Enable:   true,
+			Protocol: "socks",
+			Address:  "127.0.0.1",
+			Port:     1080,
+			Username: "user",
+			Password: "pass",
+		},
+	}
+	outbounds, routeConfig, err := RouteBuilder(config, nil, "test_tag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbounds) != 1 || outbounds[0].Tag != "test_tag_upstream" {
+		t.Fatalf("unexpected outbounds: %v", outbounds)
+	}
+	if len(routeConfig.Rule) != 1 || routeConfig.Rule[0].GetTag() != "test_tag_upstream" {
+		t.Fatalf("unexpected route: %v", routeConfig)
+	}
+}
+
+func TestBuildRelayRoute(t *testing.T) {
+	config := &Config{
+		RelayConfig: &RelayConfig{
+			Enable:   true,
+			Protocol: "vless",
+			Address:  "exit.example.com",
+			Port:     443,
+			UUID:     "b831381d-6324-4d53-ad4f-8cda48b30811",
+			Network:  "ws",
+			Path:     "/relay",
+			Security: "tls",
+			SNI:      "exit.example.com",
+		},
+	}
+	outbounds, routeConfig, err := RouteBuilder(config, nil, "test_tag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbounds) != 1 || outbounds[0].Tag != "test_tag_relay" {
+		t.Fatalf("unexpected outbounds: %v", outbounds)
+	}
+	if len(routeConfig.Rule) != 1 || routeConfig.Rule[0].GetTag() != "test_tag_relay" {
+		t.Fatalf("unexpected route: %v", routeConfig)
+	}
+}
+
+func TestBuildRelayMux(t *testing.T) {
+	config := &Config{
+		RelayConfig: &RelayConfig{
+			Enable:   true,
+			Protocol: "trojan",
+			Address:  "exit.example.com",
+			Port:     443,
+			Password: "password",
+		},
+	}
+	nodeInfo := &api.NodeInfo{Mux: &api.MuxInfo{Outbound: true, Concurrency: 4}}
+	for _, local := range []*MuxConfig{nil, {Enable: true, Outbound: true, Concurrency: 16}, {Enable: true}} {
+		config.MuxConfig = local
+		outbounds, _, err := RouteBuilder(config, nodeInfo, "test_tag", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings, err := outbounds[0].SenderSettings.GetInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := settings.(*proxyman.SenderConfig).MultiplexSettings
+		switch {
+		case local == nil && (mux == nil || !mux.Enabled || mux.Concurrency != 4):
+			t.Errorf("mux %v, want the one of the panel", mux)
+		case local != nil && local.Outbound && (mux == nil || mux.Concurrency != 16):
+			t.Errorf("mux %v, want the local one", mux)
+		case local != nil && !local.Outbound && mux != nil && mux.Enabled:
+			t.Errorf("mux %v, want none", mux)
+		}
+	}
+}
+
+func TestBuildDomesticRoute(t *testing.T) {
+	t.Setenv("XRAY_LOCATION_ASSET", "../../release/config")
+	config := &Config{
+		DomesticRouteConfig: &DomesticRouteConfig{Private: "block", CN: "direct"},
+		RelayConfig: &RelayConfig{
+			Enable:   true,
+			Protocol: "trojan",
+			Address:  "exit.example.com",
+			Port:     443,
+			Password: "password",
+		},
+	}
+	outbounds, routeConfig, err := RouteBuilder(config, nil, "test_tag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbounds) != 2 || outbounds[1].Tag != "test_tag_block" {
+		t.Fatalf("unexpected outbounds: %v", outbounds)
+	}
+	// The domestic rules come before the relay catching all the rest
+	if len(routeConfig.Rule) != 5 || routeConfig.Rule[1].GetTag() != "test_tag_block" ||
+		routeConfig.Rule[2].GetTag() != "test_tag" || routeConfig.Rule[4].GetTag() != "test_tag_relay" {
+		t.Fatalf("unexpected route: %v", routeConfig)
+	}
+}
+
+func TestBuildASNRoute(t *testing.T) {
+	db, err := asn.Parse(strings.NewReader("1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asn.SetCurrent(db)
+	defer asn.SetCurrent(nil)
+	config := &Config{
+		ASNRouteConfigs: []*ASNRouteConfig{
+			{ASNs: []uint32{13335}, Outbound: "block"},
+			{ASNs: []uint32{404}, Outbound: "direct"},
+		},
+	}
+	outbounds, routeConfig, err := RouteBuilder(config, nil, "test_tag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbounds) != 1 || outbounds[0].Tag != "test_tag_block" {
+		t.Fatalf("unexpected outbounds: %v", outbounds)
+	}
+	// The AS announcing nothing is left out
+	if len(routeConfig.Rule) != 1 || routeConfig.Rule[0].GetTag() != "test_tag_block" {
+		t.Fatalf("unexpected route: %v", routeConfig)
+	}
+}
+
+func TestBuildCountryRoute(t *testing.T) {
+	db, err := geoip.Parse(strings.NewReader("1.0.0.0\t1.0.0.255\tAU\n8.8.8.0\t8.8.8.255\tUS\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoip.SetCurrent(db)
+	defer geoip.SetCurrent(nil)
+	config := &Config{
+		CountryRouteConfigs: []*CountryRouteConfig{
+			{Countries: []string{"au"}, Outbound: "direct"},
+			{Countries: []string{"AU", "US"}, Except: true, Outbound: "block"},
+		},
+	}
+	outbounds, routeConfig, err := RouteBuilder(config, nil, "test_tag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbounds) != 1 || outbounds[0].Tag != "test_tag_block" {
+		t.Fatalf("unexpected outbounds: %v", outbounds)
+	}
+	if len(routeConfig.Rule) != 2 || routeConfig.Rule[0].GetTag() != "test_tag" || routeConfig.Rule[1].GetTag() != "test_tag_block" {
+		t.Fatalf("unexpected route: %v", routeConfig)
+	}
+	// Everything outside AU and US is blocked
+	if len(routeConfig.Rule[1].Geoip) == 0 {
+		t.Fatalf("the block rule should match by IP: %v", routeConfig.Rule[1])
+	}
+}
+
+func TestBuildBalancerRoute(t *testing.T) {
+	config := &Config{
+		BalancerConfig: &BalancerConfig{
+			Enable:   true,
+			Strategy: "roundRobin",
+			Members: []*BalancerMember{
+				{Protocol: "freedom", SendThrough: "192.0.2.10"},
+				{Protocol: "http", Address: "127.0.0.1", Port: 8080},
+			},
+		},
+	}
+	outbounds, routeConfig, err := RouteBuilder(config, nil, "test_tag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbounds) != 2 || outbounds[1].Tag != "balancer_test_tag_1" {
+		t.Fatalf("unexpected outbounds: %v", outbounds)
+	}
+	if len(routeConfig.BalancingRule) != 1 || routeConfig.Rule[0].GetBalancingTag() != "test_tag_balancer" {
+		t.Fatalf("unexpected route: %v", routeConfig)
+	}
+}
+
+func TestBuildIPv6PoolRoute(t *testing.T) {
+	config := &Config{
+		IPv6PoolConfig: &IPv6PoolConfig{
+			Enable: true,
+			Prefix: "2001:db8:1:2::/64",
+			Size:   4,
+			Rotate: "user",
+		},
+	}
+	userList := &[]api.UserInfo{
+		{UID: 1, Email: "a@test"},
+		{UID: 5, Email: "b@test"},
+		{UID: 2, Email: "c@test"},
+	}
+	outbounds, routeConfig, err := RouteBuilder(config, nil, "test_tag", userList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbounds) != 4 || outbounds[3].Tag != "ipv6pool_test_tag_3" {
+		t.Fatalf("unexpected outbounds: %v", outbounds)
+	}
+	// UID 1 and 5 share an address, the balancer catches the rest
+	if len(routeConfig.Rule) != 3 || routeConfig.Rule[0].GetTag() != "ipv6pool_test_tag_1" ||
+		routeConfig.Rule[1].GetTag() != "ipv6pool_test_tag_2" || routeConfig.Rule[2].GetBalancingTag() != "test_tag_ipv6pool" {
+		t.Fatalf("unexpected route: %v", routeConfig)
+	}
+}
+
+func TestBuildUserRoute(t *testing.T) {
+	config := &Config{
+		UserRouteConfigs: []*UserRouteConfig{
+			{UIDs: []int{1}, Outbound: "residential"},
+			{Tags: []string{"premium"}, Outbound: "residential"},
+			{UIDs: []int{404}, Outbound: "residential"},
+		},
+	}
+	userList := &[]api.UserInfo{
+		{UID: 1, Email: "a@test"},
+		{UID: 2, Email: "b@test", Tag: "premium"},
+		{UID: 3, Email: "c@test"},
+	}
+	_, routeConfig, err := RouteBuilder(config, nil, "test_tag", userList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The route of UID 404 matches nobody and is left out
+	if len(routeConfig.Rule) != 2 || routeConfig.Rule[1].GetTag() != "residential" {
+		t.Fatalf("unexpected route: %v", routeConfig)
+	}
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/infra/conf"
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// servedProtocol is a node type served by XrayR itself
+type servedProtocol struct {
+	newHandler func(c *Controller, nodeInfo *api.NodeInfo, pm policy.Manager) (inbound.Handler, error)
+	// Builds the users when they are not the ones of a Trojan or HTTP
+	// account, nil otherwise
+	buildUsers func(c *Controller, userInfo *[]api.UserInfo) []*protocol.User
+}
+
+// servedProtocols are the served node types built in. Their files register
+// them, unless excluded by the build tag no_<node type in lower case>, like
+// no_wireguard, for a smaller binary.
+var servedProtocols = map[string]servedProtocol{}
+
+// servedNodeType reports whether Xray has no inbound for the node type, the
+// inbound being served by XrayR itself, or wrapped by it like the one of the
+// Forward nodes
+func servedNodeType(nodeType string) bool {
+	switch nodeType {
+	case "AnyTLS", "Naive", "Juicity", "WireGuard", "Mixed", "SSH", "Forward":
+		return true
+	}
+	return false
+}
+
+// buildServedTLSConfig returns the TLS config of a served inbound, with the
+// certificate of the node
+func buildServedTLSConfig(config *Config, nodeInfo *api.NodeInfo) (*tls.Config, error) {
+	if config.CertConfig == nil || config.CertConfig.CertMode == "none" {
+		return nil, fmt.Errorf("%s needs a certificate, CertMode none is not supported", nodeInfo.NodeType)
+	}
+	certFile, keyFile, err := getCertFile(config.CertConfig)
+	if err != nil {
+		return nil, err
+	}
+	tlsSettings := &conf.TLSConfig{
+		RejectUnknownSNI: config.CertConfig.RejectUnknownSni,
+		Certs:            []*conf.TLSCertConfig{{CertFile: certFile, KeyFile: keyFile, OcspStapling: 3600}},
+	}
+	tlsConfig, err := tlsSettings.Build()
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig.(*xtls.Config).GetTLSConfig(), nil
+}
+
+// addServedInbound adds the inbound of a served node type. Its connections go
+// through the dispatcher like the ones of the Xray inbounds, so the traffic of
+// the users is counted and reported the same way.
+func (c *Controller) addServedInbound(nodeInfo *api.NodeInfo) error {
+	pm := c.server.GetFeature(policy.ManagerType()).(policy.Manager)
+	var handler inbound.Handler
+	switch nodeInfo.NodeType {
+	case "Forward":
+		inboundConfig, err := InboundBuilder(c.config, nodeInfo, c.Tag)
+		if err != nil {
+			return err
+		}
+		rawHandler, err := core.CreateObject(c.server, inboundConfig)
+		if err != nil {
+			return err
+		}
+		dokodemo, ok := rawHandler.(inbound.Handler)
+		if !ok {
+			return fmt.Errorf("not an InboundHandler: %s", c.Tag)
+		}
+		if handler, err = newForwardHandler(dokodemo, c.dispatcher); err != nil {
+			return err
+		}
+	default:
+		served, ok := servedProtocols[nodeInfo.NodeType]
+		if !ok {
+			return fmt.Errorf("node type %s is not built in", nodeInfo.NodeType)
+		}
+		var err error
+		if handler, err = served.newHandler(c, nodeInfo, pm); err != nil {
+			return err
+		}
+	}
+	return c.ibm.AddHandler(context.Background(), handler)
+}
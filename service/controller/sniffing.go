@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+// defaultDestOverride are the protocols sniffed when the node sets none
+var defaultDestOverride = []string{"http", "tls"}
+
+// buildSniffingConfig builds the sniffing of the inbounds of the node, from
+// SniffingConfig if it is set and DisableSniffing otherwise
+func buildSniffingConfig(config *Config) *conf.SniffingConfig {
+	s := config.SniffingConfig
+	if s == nil {
+		destOverride := conf.StringList(defaultDestOverride)
+		return &conf.SniffingConfig{
+			Enabled:      !config.DisableSniffing,
+			DestOverride: &destOverride,
+		}
+	}
+	destOverride := conf.StringList(s.DestOverride)
+	if len(destOverride) == 0 {
+		destOverride = defaultDestOverride
+	}
+	sniffingConfig := &conf.SniffingConfig{
+		Enabled:      s.Enable,
+		DestOverride: &destOverride,
+		MetadataOnly: s.MetadataOnly,
+		RouteOnly:    s.RouteOnly,
+	}
+	if len(s.DomainsExcluded) > 0 {
+		domainsExcluded := conf.StringList(s.DomainsExcluded)
+		sniffingConfig.DomainsExcluded = &domainsExcluded
+	}
+	return sniffingConfig
+}
+
+// sniffingRequest is the sniffing of the node for the protocols served by
+// XrayR, checked the way Xray checks the one of its inbounds
+func sniffingRequest(config *Config) (session.SniffingRequest, error) {
+	sniffing, err := buildSniffingConfig(config).Build()
+	if err != nil {
+		return session.SniffingRequest{}, err
+	}
+	return session.SniffingRequest{
+		Enabled:                        sniffing.Enabled,
+		OverrideDestinationForProtocol: sniffing.DestinationOverride,
+		ExcludeForDomain:               sniffing.DomainsExcluded,
+		MetadataOnly:                   sniffing.MetadataOnly,
+		RouteOnly:                      sniffing.RouteOnly,
+	}, nil
+}
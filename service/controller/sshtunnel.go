@@ -0,0 +1,57 @@
+//go:build !no_ssh
+
+package controller
+
+import (
+	"fmt"
+
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/policy"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/sshtunnel"
+)
+
+func init() {
+	servedProtocols["SSH"] = servedProtocol{
+		newHandler: func(c *Controller, nodeInfo *api.NodeInfo, pm policy.Manager) (inbound.Handler, error) {
+			sshConfig, err := buildSSHConfig(c.config, nodeInfo, c.Tag)
+			if err != nil {
+				return nil, err
+			}
+			return sshtunnel.NewHandler(sshConfig, c.dispatcher, pm), nil
+		},
+	}
+}
+
+// buildSSHConfig builds the config of the SSH server of the node, the host key
+// file of the local config taking precedence over the host key of the panel
+func buildSSHConfig(config *Config, nodeInfo *api.NodeInfo, tag string) (*sshtunnel.Config, error) {
+	var (
+		hostKey ssh.Signer
+		err     error
+	)
+	switch {
+	case config.SSHConfig != nil && config.SSHConfig.HostKeyFile != "":
+		hostKey, err = sshtunnel.LoadHostKey(config.SSHConfig.HostKeyFile)
+	case nodeInfo.ServerKey != "":
+		hostKey, err = sshtunnel.ParseHostKey(nodeInfo.ServerKey)
+	default:
+		return nil, fmt.Errorf("SSH needs the host key of the node, given by neither the panel nor SSHConfig")
+	}
+	if err != nil {
+		return nil, err
+	}
+	sniffing, err := sniffingRequest(config)
+	if err != nil {
+		return nil, err
+	}
+	return &sshtunnel.Config{
+		Tag:      tag,
+		Listen:   config.ListenIP,
+		Port:     nodeInfo.Port,
+		HostKey:  hostKey,
+		Sniffing: sniffing,
+	}, nil
+}
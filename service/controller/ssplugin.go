@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/qtai2901/new_xrayr/api"
+)
+
+// parsePluginOpts splits SIP003 plugin options like "obfs=http;obfs-host=a.com",
+// the options without a value map to ""
+func parsePluginOpts(opts string) map[string]string {
+	options := make(map[string]string)
+	for _, opt := range strings.Split(opts, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		if key != "" {
+			options[key] = value
+		}
+	}
+	return options
+}
+
+// ShadowsocksPluginBuilder returns the node info of a Shadowsocks node with
+// its SIP003 plugin applied, the plugin of the local config taking precedence
+// over the one of the panel:
+//   - obfs-server (simple-obfs) with obfs=http becomes the HTTP header of TCP
+//   - v2ray-plugin (xray-plugin) becomes a Shadowsocks-Plugin node, with the
+//     Shadowsocks inbound one port down and the plugin transport on the port
+//
+// The node info is returned as is if there is no plugin, or it is applied
+// already.
+func ShadowsocksPluginBuilder(config *Config, nodeInfo *api.NodeInfo) (*api.NodeInfo, error) {
+	plugin, opts := nodeInfo.Plugin, nodeInfo.PluginOpts
+	if p := config.ShadowsocksPluginConfig; p != nil && p.Plugin != "" {
+		plugin, opts = p.Plugin, p.PluginOpts
+	}
+	if nodeInfo.NodeType != "Shadowsocks" || plugin == "" {
+		return nodeInfo, nil
+	}
+	options := parsePluginOpts(opts)
+	info := *nodeInfo
+	switch strings.ToLower(plugin) {
+	case "obfs-server", "simple-obfs", "obfs":
+		switch options["obfs"] {
+		case "", "http":
+		default:
+			return nil, fmt.Errorf("unsupported obfs mode: %s, only http is supported", options["obfs"])
+		}
+		path := "/"
+		if uri := options["obfs-uri"]; uri != "" {
+			path = "/" + strings.TrimPrefix(uri, "/")
+		}
+		header, err := json.Marshal(map[string]any{
+			"type":    "http",
+			"request": map[string]any{"path": []string{path}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		info.TransportProtocol = "tcp"
+		info.Header = header
+	case "v2ray-plugin", "xray-plugin":
+		if info.Port < 2 {
+			return nil, fmt.Errorf("%s needs a port bigger than 1", plugin)
+		}
+		info.NodeType = "Shadowsocks-Plugin"
+		info.Port-- // Of the Shadowsocks inbound, the plugin transport listens on the port of the node
+		info.Header = nil
+		switch mode := options["mode"]; mode {
+		case "", "websocket":
+			info.TransportProtocol = "ws"
+		case "grpc":
+			info.TransportProtocol = "grpc"
+			info.ServiceName = options["serviceName"]
+		default:
+			return nil, fmt.Errorf("unsupported %s mode: %s", plugin, mode)
+		}
+		if path, ok := options["path"]; ok {
+			info.Path = path
+		}
+		if host, ok := options["host"]; ok {
+			info.Host = host
+		}
+		_, info.EnableTLS = options["tls"]
+	default:
+		return nil, fmt.Errorf("unsupported shadowsocks plugin: %s", plugin)
+	}
+	return &info, nil
+}
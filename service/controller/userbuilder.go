@@ -10,6 +10,7 @@ import (
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
 	"github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/proxy/http"
 	"github.com/xtls/xray-core/proxy/shadowsocks"
 	"github.com/xtls/xray-core/proxy/shadowsocks_2022"
 	"github.com/xtls/xray-core/proxy/trojan"
@@ -33,8 +34,8 @@ func (c *Controller) buildVmessUser(userInfo *[]api.UserInfo) (users []*protocol
 			Security: "auto",
 		}
 		users[i] = &protocol.User{
-			Level:   0,
-			Email:   c.buildUserTag(&user), // Email: InboundTag|email|uid
+			Level:   c.config.userLevel(),
+			Email:   c.buildUserTag(&user), // Email: InboundTag|uid@node|uid
 			Account: serial.ToTypedMessage(vmessAccount.Build()),
 		}
 	}
@@ -49,7 +50,7 @@ func (c *Controller) buildVlessUser(userInfo *[]api.UserInfo) (users []*protocol
 			Flow: c.nodeInfo.VlessFlow,
 		}
 		users[i] = &protocol.User{
-			Level:   0,
+			Level:   c.config.userLevel(),
 			Email:   c.buildUserTag(&user),
 			Account: serial.ToTypedMessage(vlessAccount),
 		}
@@ -64,7 +65,7 @@ func (c *Controller) buildTrojanUser(userInfo *[]api.UserInfo) (users []*protoco
 			Password: user.UUID,
 		}
 		users[i] = &protocol.User{
-			Level:   0,
+			Level:   c.config.userLevel(),
 			Email:   c.buildUserTag(&user),
 			Account: serial.ToTypedMessage(trojanAccount),
 		}
@@ -72,6 +73,24 @@ func (c *Controller) buildTrojanUser(userInfo *[]api.UserInfo) (users []*protoco
 	return users
 }
 
+// buildPasswordUser builds the users of the Juicity, Mixed and SSH nodes, logging
+// in with their UUID and password, the UUID too if the panel gives none
+func (c *Controller) buildPasswordUser(userInfo *[]api.UserInfo) (users []*protocol.User) {
+	users = make([]*protocol.User, len(*userInfo))
+	for i, user := range *userInfo {
+		password := user.Passwd
+		if password == "" {
+			password = user.UUID
+		}
+		users[i] = &protocol.User{
+			Level:   c.config.userLevel(),
+			Email:   c.buildUserTag(&user),
+			Account: serial.ToTypedMessage(&http.Account{Username: user.UUID, Password: password}),
+		}
+	}
+	return users
+}
+
 func (c *Controller) buildSSUser(userInfo *[]api.UserInfo, method string) (users []*protocol.User) {
 	users = make([]*protocol.User, len(*userInfo))
 
@@ -85,17 +104,17 @@ func (c *Controller) buildSSUser(userInfo *[]api.UserInfo, method string) (users
 				continue
 			}
 			users[i] = &protocol.User{
-				Level: 0,
+				Level: c.config.userLevel(),
 				Email: e,
 				Account: serial.ToTypedMessage(&shadowsocks_2022.User{
 					Key:   userKey,
 					Email: e,
-					Level: 0,
+					Level: c.config.userLevel(),
 				}),
 			}
 		} else {
 			users[i] = &protocol.User{
-				Level: 0,
+				Level: c.config.userLevel(),
 				Email: c.buildUserTag(&user),
 				Account: serial.ToTypedMessage(&shadowsocks.Account{
 					Password:   user.Passwd,
@@ -111,6 +130,11 @@ func (c *Controller) buildSSPluginUser(userInfo *[]api.UserInfo) (users []*proto
 	users = make([]*protocol.User, len(*userInfo))
 
 	for i, user := range *userInfo {
+		// The method is set per user by SSpanel, and per node by the panels
+		// whose Shadowsocks nodes turn to plugin ones with a v2ray-plugin
+		if user.Method == "" {
+			user.Method = c.nodeInfo.CypherMethod
+		}
 		// shadowsocks2022 Key = openssl rand -base64 32 and multi users needn't cipher method
 		if C.Contains(shadowaead_2022.List, strings.ToLower(user.Method)) {
 			e := c.buildUserTag(&user)
@@ -120,12 +144,12 @@ func (c *Controller) buildSSPluginUser(userInfo *[]api.UserInfo) (users []*proto
 				continue
 			}
 			users[i] = &protocol.User{
-				Level: 0,
+				Level: c.config.userLevel(),
 				Email: e,
 				Account: serial.ToTypedMessage(&shadowsocks_2022.User{
 					Key:   userKey,
 					Email: e,
-					Level: 0,
+					Level: c.config.userLevel(),
 				}),
 			}
 		} else {
@@ -133,7 +157,7 @@ func (c *Controller) buildSSPluginUser(userInfo *[]api.UserInfo) (users []*proto
 			cypherMethod := cipherFromString(user.Method)
 			if _, ok := AEADMethod[cypherMethod]; ok {
 				users[i] = &protocol.User{
-					Level: 0,
+					Level: c.config.userLevel(),
 					Email: c.buildUserTag(&user),
 					Account: serial.ToTypedMessage(&shadowsocks.Account{
 						Password:   user.Passwd,
@@ -162,7 +186,7 @@ func cipherFromString(c string) shadowsocks.CipherType {
 }
 
 func (c *Controller) buildUserTag(user *api.UserInfo) string {
-	return fmt.Sprintf("%s|%s|%d", c.Tag, user.Email, user.UID)
+	return userEmail(c.Tag, user)
 }
 
 func (c *Controller) checkShadowsocksPassword(password string, method string) (string, error) {
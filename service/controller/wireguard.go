@@ -0,0 +1,85 @@
+//go:build !no_wireguard
+
+package controller
+
+import (
+	"fmt"
+
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/proxy/http"
+
+	"github.com/qtai2901/new_xrayr/api"
+	"github.com/qtai2901/new_xrayr/common/wireguard"
+)
+
+func init() {
+	servedProtocols["WireGuard"] = servedProtocol{
+		newHandler: func(c *Controller, nodeInfo *api.NodeInfo, pm policy.Manager) (inbound.Handler, error) {
+			wireGuardConfig, err := buildWireGuardConfig(c.config, nodeInfo, c.Tag)
+			if err != nil {
+				return nil, err
+			}
+			return wireguard.NewHandler(wireGuardConfig, c.dispatcher, pm)
+		},
+		buildUsers: (*Controller).buildWireGuardUser,
+	}
+}
+
+// buildWireGuardConfig builds the config of the WireGuard interface of the
+// node, the private key of the local config taking precedence over the server
+// key of the panel
+func buildWireGuardConfig(config *Config, nodeInfo *api.NodeInfo, tag string) (*wireguard.Config, error) {
+	sniffing, err := sniffingRequest(config)
+	if err != nil {
+		return nil, err
+	}
+	wireGuardConfig := &wireguard.Config{
+		Tag:        tag,
+		Port:       nodeInfo.Port,
+		PrivateKey: nodeInfo.ServerKey,
+		Sniffing:   sniffing,
+	}
+	if w := config.WireGuardNodeConfig; w != nil {
+		if w.PrivateKey != "" {
+			wireGuardConfig.PrivateKey = w.PrivateKey
+		}
+		wireGuardConfig.Network = w.Network
+		wireGuardConfig.MTU = w.MTU
+	}
+	if wireGuardConfig.PrivateKey == "" {
+		return nil, fmt.Errorf("WireGuard needs the private key of the node, given by neither the panel nor WireGuardNodeConfig")
+	}
+	return wireGuardConfig, nil
+}
+
+// buildWireGuardUser builds the peers of a WireGuard node, with the public
+// key of their user, derived from its UUID if the panel gives none, and the
+// tunnel address of its UID
+func (c *Controller) buildWireGuardUser(userInfo *[]api.UserInfo) (users []*protocol.User) {
+	network, err := wireguard.ParseNetwork(c.config.wireGuardNetwork())
+	if err != nil {
+		newError(err).AtError().WriteToLog()
+		return nil
+	}
+	users = make([]*protocol.User, 0, len(*userInfo))
+	for _, user := range *userInfo {
+		publicKey := wireguard.DerivePrivateKey(user.UUID).PublicKey().String()
+		if user.PublicKey != "" {
+			publicKey = user.PublicKey
+		}
+		address, err := wireguard.PeerAddress(network, user.UID)
+		if err != nil {
+			newError(fmt.Errorf("[UID: %d] %s", user.UID, err)).AtError().WriteToLog()
+			continue
+		}
+		users = append(users, &protocol.User{
+			Level:   c.config.userLevel(),
+			Email:   c.buildUserTag(&user),
+			Account: serial.ToTypedMessage(&http.Account{Username: publicKey, Password: address.String()}),
+		})
+	}
+	return users
+}
@@ -14,3 +14,9 @@ type Restart interface {
 	Start() error
 	Close() error
 }
+
+// Drain is implemented by the services that can stop taking new work
+// while letting the work in flight finish
+type Drain interface {
+	Drain() error
+}